@@ -0,0 +1,412 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Fake Avahi D-Bus service
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/holoplot/go-avahi"
+)
+
+// FakeAvahiService represents the service, served by FakeAvahi
+type FakeAvahiService struct {
+	Interface int32    // Interface index
+	Name      string   // Service instance name
+	Type      string   // Service type, i.e., _uscan._tcp
+	Domain    string   // Domain, "local" if empty
+	Host      string   // Host name
+	Address   string   // IP address
+	Port      uint16   // IP port
+	Txt       [][]byte // TXT records
+	Fail      bool     // ResolveService fails
+}
+
+// FakeAvahi is the fake Avahi daemon. It implements the subset of
+// the org.freedesktop.Avahi D-Bus API, used by DNS-SD discovery and
+// registration, and serves services from its own table
+type FakeAvahi struct {
+	conn     *dbus.Conn
+	services []*FakeAvahiService
+	browsers map[dbus.ObjectPath]*fakeAvahiBrowser
+	nextID   int
+	lock     sync.Mutex
+}
+
+// fakeAvahiServer is the org.freedesktop.Avahi.Server object
+type fakeAvahiServer struct {
+	fa *FakeAvahi
+}
+
+// fakeAvahiBrowser is the org.freedesktop.Avahi.ServiceBrowser object
+type fakeAvahiBrowser struct {
+	fa      *FakeAvahi
+	path    dbus.ObjectPath
+	client  string
+	iface   int32
+	proto   int32
+	svcType string
+	domain  string
+}
+
+// fakeAvahiEntryGroup is the org.freedesktop.Avahi.EntryGroup object
+type fakeAvahiEntryGroup struct {
+	fa        *FakeAvahi
+	path      dbus.ObjectPath
+	services  []*FakeAvahiService
+	committed bool
+}
+
+// fakeAvahiErrNotFound is returned, when service cannot be resolved
+var fakeAvahiErrNotFound = dbus.NewError("org.freedesktop.Avahi.TimeoutError",
+	[]interface{}{"Timeout reached"})
+
+// FakeAvahiStart starts the fake Avahi daemon on the D-Bus connection.
+// It takes the org.freedesktop.Avahi name, so the connection is
+// expected to be the private bus, not the real system bus
+func FakeAvahiStart(conn *dbus.Conn) (*FakeAvahi, error) {
+	fa := &FakeAvahi{
+		conn:     conn,
+		browsers: make(map[dbus.ObjectPath]*fakeAvahiBrowser),
+	}
+
+	err := conn.Export(&fakeAvahiServer{fa}, "/", "org.freedesktop.Avahi.Server")
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := conn.RequestName("org.freedesktop.Avahi",
+		dbus.NameFlagDoNotQueue)
+	if err != nil {
+		return nil, err
+	}
+
+	if reply != dbus.RequestNameReplyPrimaryOwner {
+		return nil, fmt.Errorf("org.freedesktop.Avahi: name already taken")
+	}
+
+	return fa, nil
+}
+
+// Add adds the service and announces it to browsers
+func (fa *FakeAvahi) Add(service *FakeAvahiService) {
+	if service.Domain == "" {
+		service.Domain = "local"
+	}
+
+	fa.lock.Lock()
+	fa.services = append(fa.services, service)
+	browsers := fa.matchBrowsers(service)
+	fa.lock.Unlock()
+
+	for _, browser := range browsers {
+		browser.emit("ItemNew", service)
+	}
+}
+
+// Remove removes the service and announces removal to browsers
+func (fa *FakeAvahi) Remove(service *FakeAvahiService) {
+	fa.lock.Lock()
+	for i, s := range fa.services {
+		if s == service {
+			fa.services = append(fa.services[:i], fa.services[i+1:]...)
+			break
+		}
+	}
+	browsers := fa.matchBrowsers(service)
+	fa.lock.Unlock()
+
+	for _, browser := range browsers {
+		browser.emit("ItemRemove", service)
+	}
+}
+
+// matchBrowsers returns browsers the service is visible to.
+// Must be called under the lock
+func (fa *FakeAvahi) matchBrowsers(service *FakeAvahiService) []*fakeAvahiBrowser {
+	var browsers []*fakeAvahiBrowser
+	for _, browser := range fa.browsers {
+		if browser.match(service) {
+			browsers = append(browsers, browser)
+		}
+	}
+	return browsers
+}
+
+// newPath returns the new object path
+func (fa *FakeAvahi) newPath(kind string) dbus.ObjectPath {
+	fa.lock.Lock()
+	fa.nextID++
+	id := fa.nextID
+	fa.lock.Unlock()
+
+	return dbus.ObjectPath(fmt.Sprintf("/Client1/%s%d", kind, id))
+}
+
+// fakeAvahiProto returns Avahi protocol of the address
+func fakeAvahiProto(address string) int32 {
+	if ip := net.ParseIP(address); ip != nil && ip.To4() == nil {
+		return avahi.ProtoInet6
+	}
+	return avahi.ProtoInet
+}
+
+// GetVersionString returns the daemon version
+func (srv *fakeAvahiServer) GetVersionString() (string, *dbus.Error) {
+	return "avahi 0.8 (fake)", nil
+}
+
+// ServiceBrowserNew creates the service browser. Known services
+// are announced after the browser is returned to the client,
+// followed by the AllForNow signal
+func (srv *fakeAvahiServer) ServiceBrowserNew(client dbus.Sender,
+	iface, proto int32, svcType, domain string, flags uint32) (
+	dbus.ObjectPath, *dbus.Error) {
+
+	fa := srv.fa
+	if domain == "" {
+		domain = "local"
+	}
+
+	browser := &fakeAvahiBrowser{
+		fa:      fa,
+		path:    fa.newPath("ServiceBrowser"),
+		client:  string(client),
+		iface:   iface,
+		proto:   proto,
+		svcType: svcType,
+		domain:  domain,
+	}
+
+	err := fa.conn.Export(browser, browser.path,
+		"org.freedesktop.Avahi.ServiceBrowser")
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+
+	fa.lock.Lock()
+	fa.browsers[browser.path] = browser
+	var services []*FakeAvahiService
+	for _, service := range fa.services {
+		if browser.match(service) {
+			services = append(services, service)
+		}
+	}
+	fa.lock.Unlock()
+
+	// Signals, sent before the method reply, are lost by clients,
+	// that don't know the browser yet. godbus sends the reply after
+	// the method returns, so wait for return, then make a round-trip
+	// to the client, which is answered after the reply is received
+	returned := make(chan struct{})
+	defer close(returned)
+
+	go func() {
+		<-returned
+		browser.ping()
+
+		for _, service := range services {
+			browser.emit("ItemNew", service)
+		}
+		browser.signal("AllForNow")
+	}()
+
+	return browser.path, nil
+}
+
+// ResolveService resolves the service
+func (srv *fakeAvahiServer) ResolveService(iface, proto int32,
+	name, svcType, domain string, aproto int32, flags uint32) (
+	int32, int32, string, string, string, string, int32, string,
+	uint16, [][]byte, uint32, *dbus.Error) {
+
+	fa := srv.fa
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+
+	for _, s := range fa.services {
+		p := fakeAvahiProto(s.Address)
+		switch {
+		case s.Name != name || s.Type != svcType || s.Domain != domain:
+		case iface != avahi.InterfaceUnspec && iface != s.Interface:
+		case proto != avahi.ProtoUnspec && proto != p:
+		case aproto != avahi.ProtoUnspec && aproto != p:
+		case s.Fail:
+		default:
+			return s.Interface, p, s.Name, s.Type, s.Domain, s.Host,
+				p, s.Address, s.Port, s.Txt, 0, nil
+		}
+	}
+
+	return 0, 0, "", "", "", "", 0, "", 0, nil, 0, fakeAvahiErrNotFound
+}
+
+// EntryGroupNew creates the entry group
+func (srv *fakeAvahiServer) EntryGroupNew() (dbus.ObjectPath, *dbus.Error) {
+	fa := srv.fa
+	group := &fakeAvahiEntryGroup{fa: fa, path: fa.newPath("EntryGroup")}
+
+	err := fa.conn.Export(group, group.path, "org.freedesktop.Avahi.EntryGroup")
+	if err != nil {
+		return "", dbus.MakeFailedError(err)
+	}
+
+	return group.path, nil
+}
+
+// match reports whether the service is visible to the browser
+func (browser *fakeAvahiBrowser) match(service *FakeAvahiService) bool {
+	switch {
+	case browser.svcType != service.Type:
+	case browser.domain != service.Domain:
+	case browser.iface != avahi.InterfaceUnspec &&
+		browser.iface != service.Interface:
+	case browser.proto != avahi.ProtoUnspec &&
+		browser.proto != fakeAvahiProto(service.Address):
+	default:
+		return true
+	}
+	return false
+}
+
+// emit emits the ItemNew or ItemRemove signal
+func (browser *fakeAvahiBrowser) emit(signal string, service *FakeAvahiService) {
+	browser.signal(signal, service.Interface,
+		fakeAvahiProto(service.Address), service.Name, service.Type,
+		service.Domain, uint32(0))
+}
+
+// signal sends the signal to the browser's client. Like avahi-daemon,
+// signals are unicast, so clients receive them without match rules
+func (browser *fakeAvahiBrowser) signal(member string, args ...interface{}) {
+	msg := &dbus.Message{
+		Type: dbus.TypeSignal,
+		Headers: map[dbus.HeaderField]dbus.Variant{
+			dbus.FieldPath:        dbus.MakeVariant(browser.path),
+			dbus.FieldInterface:   dbus.MakeVariant("org.freedesktop.Avahi.ServiceBrowser"),
+			dbus.FieldMember:      dbus.MakeVariant(member),
+			dbus.FieldDestination: dbus.MakeVariant(browser.client),
+		},
+		Body: args,
+	}
+
+	if len(args) != 0 {
+		msg.Headers[dbus.FieldSignature] = dbus.MakeVariant(dbus.SignatureOf(args...))
+	}
+
+	browser.fa.conn.Send(msg, nil)
+}
+
+// ping pings the browser's client
+func (browser *fakeAvahiBrowser) ping() {
+	obj := browser.fa.conn.Object(browser.client, "/")
+	call := obj.Call("org.freedesktop.DBus.Peer.Ping", 0)
+	if call.Err != nil {
+		LogDebug("%s: ping: %s", browser.client, call.Err)
+	}
+}
+
+// Free destroys the service browser
+func (browser *fakeAvahiBrowser) Free() *dbus.Error {
+	fa := browser.fa
+	fa.lock.Lock()
+	delete(fa.browsers, browser.path)
+	fa.lock.Unlock()
+
+	fa.conn.Export(nil, browser.path, "org.freedesktop.Avahi.ServiceBrowser")
+	return nil
+}
+
+// AddService adds service to the entry group. The service becomes
+// visible after Commit, with the loopback address, so it can be
+// reached by local clients
+func (group *fakeAvahiEntryGroup) AddService(iface, proto int32,
+	flags uint32, name, svcType, domain, host string, port uint16,
+	txt [][]byte) *dbus.Error {
+
+	if iface == avahi.InterfaceUnspec {
+		iface = int32(fakeAvahiLoopback())
+	}
+
+	if domain == "" {
+		domain = "local"
+	}
+
+	if host == "" {
+		host = "localhost.local"
+	}
+
+	group.services = append(group.services, &FakeAvahiService{
+		Interface: iface,
+		Name:      name,
+		Type:      svcType,
+		Domain:    domain,
+		Host:      host,
+		Address:   "127.0.0.1",
+		Port:      port,
+		Txt:       txt,
+	})
+
+	return nil
+}
+
+// Commit publishes services of the entry group
+func (group *fakeAvahiEntryGroup) Commit() *dbus.Error {
+	if !group.committed {
+		group.committed = true
+		for _, service := range group.services {
+			group.fa.Add(service)
+		}
+	}
+	return nil
+}
+
+// Reset removes all services of the entry group
+func (group *fakeAvahiEntryGroup) Reset() *dbus.Error {
+	if group.committed {
+		group.committed = false
+		for _, service := range group.services {
+			group.fa.Remove(service)
+		}
+	}
+	group.services = nil
+	return nil
+}
+
+// GetState returns the entry group state
+func (group *fakeAvahiEntryGroup) GetState() (int32, *dbus.Error) {
+	if group.committed {
+		return avahi.EntryGroupEstablished, nil
+	}
+	return avahi.EntryGroupUncommited, nil
+}
+
+// IsEmpty reports whether the entry group is empty
+func (group *fakeAvahiEntryGroup) IsEmpty() (bool, *dbus.Error) {
+	return len(group.services) == 0, nil
+}
+
+// Free destroys the entry group, with all its services
+func (group *fakeAvahiEntryGroup) Free() *dbus.Error {
+	group.Reset()
+	group.fa.conn.Export(nil, group.path, "org.freedesktop.Avahi.EntryGroup")
+	return nil
+}
+
+// fakeAvahiLoopback returns index of the loopback interface
+func fakeAvahiLoopback() int {
+	interfaces, _ := network.Interfaces()
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			return iface.Index
+		}
+	}
+	return 1
+}
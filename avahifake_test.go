@@ -0,0 +1,252 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// DNS-SD discovery tests, using the fake Avahi daemon
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// testAvahi is the fake Avahi daemon on the private bus, shared
+// by tests, as avahiBrowser uses the cached system bus connection
+var (
+	testAvahi      *FakeAvahi
+	testAvahiErr   error
+	testAvahiBus   *exec.Cmd
+	testAvahiSetup sync.Once
+	testAvahiRuns  int
+)
+
+// TestMain runs tests and stops the private bus
+func TestMain(m *testing.M) {
+	status := m.Run()
+	if testAvahiBus != nil {
+		testAvahiBus.Process.Kill()
+		testAvahiBus.Wait()
+	}
+	os.Exit(status)
+}
+
+// testFakeAvahi starts the private D-Bus daemon and the fake Avahi
+// daemon on it, once. The test is skipped, if dbus-daemon is not
+// available
+func testFakeAvahi(t *testing.T) *FakeAvahi {
+	path, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not available")
+	}
+
+	testAvahiSetup.Do(func() {
+		testAvahi, testAvahiErr = testFakeAvahiStart(path)
+	})
+
+	if testAvahiErr != nil {
+		t.Fatal(testAvahiErr)
+	}
+
+	return testAvahi
+}
+
+// testFakeAvahiStart starts the private D-Bus daemon and the fake
+// Avahi daemon on it
+func testFakeAvahiStart(path string) (*FakeAvahi, error) {
+	cmd := exec.Command(path, "--session", "--nofork", "--print-address")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	testAvahiBus = cmd
+
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("dbus-daemon: %s", err)
+	}
+
+	addr = strings.TrimSpace(addr)
+
+	conn, err := dbus.Dial(addr)
+	if err == nil {
+		err = conn.Auth(nil)
+	}
+	if err == nil {
+		err = conn.Hello()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("D-Bus: %s", err)
+	}
+
+	// avahiBrowser connects to the system bus
+	os.Setenv("DBUS_SYSTEM_BUS_ADDRESS", addr)
+
+	return FakeAvahiStart(conn)
+}
+
+// TestDNSSdDiscover runs DNS-SD discovery against the fake Avahi daemon
+func TestDNSSdDiscover(t *testing.T) {
+	fa := testFakeAvahi(t)
+
+	// Services of previous runs are still served, so names
+	// and addresses are unique per run
+	testAvahiRuns++
+	run := testAvahiRuns
+	known := fmt.Sprintf("Known Scanner %d", run)
+	broken := fmt.Sprintf("Broken Scanner %d", run)
+	late := fmt.Sprintf("Late Scanner %d", run)
+	dual := fmt.Sprintf("Dual Scanner %d", run)
+
+	// Services, known before browsing, are announced right
+	// after ServiceBrowserNew, the last one after the browser
+	// is created
+	fa.Add(&FakeAvahiService{
+		Interface: 2,
+		Name:      known,
+		Type:      "_uscan._tcp",
+		Address:   fmt.Sprintf("10.0.0.%d", 50+run),
+		Port:      8080,
+		Txt:       [][]byte{[]byte("rs=/eSCL"), []byte("ty=Known")},
+	})
+	fa.Add(&FakeAvahiService{
+		Interface: 3,
+		Name:      broken,
+		Type:      "_uscan._tcp",
+		Address:   fmt.Sprintf("10.1.0.%d", 50+run),
+		Port:      8080,
+		Fail:      true,
+	})
+
+	// The dual-stack service is resolved only via IPv4
+	fa.Add(&FakeAvahiService{
+		Interface: 2,
+		Name:      dual,
+		Type:      "_uscan._tcp",
+		Address:   fmt.Sprintf("fe80::%d", run),
+		Port:      8080,
+		Fail:      true,
+	})
+	fa.Add(&FakeAvahiService{
+		Interface: 2,
+		Name:      dual,
+		Type:      "_uscan._tcp",
+		Address:   fmt.Sprintf("10.0.0.%d", 150+run),
+		Port:      8080,
+		Txt:       [][]byte{[]byte("rs=eSCL"), []byte("ty=Dual")},
+	})
+
+	testInstall()
+	testTransports.set(&MemNetwork{Ifaces: testInterfaces}, nil,
+		avahiBrowser{})
+
+	discoveryReport.Reset()
+
+	out := make(chan Endpoint)
+	go DNSSdDiscover(out)
+
+	fa.Add(&FakeAvahiService{
+		Interface: 3,
+		Name:      late,
+		Type:      "_uscan._tcp",
+		Address:   fmt.Sprintf("10.1.0.%d", 100+run),
+		Port:      9095,
+		Txt:       [][]byte{[]byte("rs=eSCL"), []byte("ty=Late")},
+	})
+
+	expected := map[string]Endpoint{
+		known: {
+			URL:       fmt.Sprintf("http://10.0.0.%d:8080/eSCL", 50+run),
+			Interface: "eth0",
+			Model:     "Known",
+		},
+		late: {
+			URL:       fmt.Sprintf("http://10.1.0.%d:9095/eSCL", 100+run),
+			Interface: "eth1",
+			Model:     "Late",
+		},
+		dual: {
+			URL:       fmt.Sprintf("http://10.0.0.%d:8080/eSCL", 150+run),
+			Interface: "eth0",
+			Model:     "Dual",
+		},
+	}
+
+	timeout := time.After(5 * time.Second)
+	for len(expected) != 0 {
+		select {
+		case endpoint := <-out:
+			exp, ok := expected[endpoint.Name]
+			if !ok {
+				if !strings.HasSuffix(endpoint.Name,
+					fmt.Sprintf(" %d", run)) {
+					continue // Service of the previous run
+				}
+				t.Errorf("unexpected endpoint %q", endpoint.Name)
+				continue
+			}
+
+			delete(expected, endpoint.Name)
+			if endpoint.Proto != "escl" || endpoint.URL != exp.URL ||
+				endpoint.Interface != exp.Interface ||
+				endpoint.Model != exp.Model {
+				t.Errorf("%q: got %s %s %s %q, expected escl %s %s %q",
+					endpoint.Name, endpoint.Proto, endpoint.URL,
+					endpoint.Interface, endpoint.Model,
+					exp.URL, exp.Interface, exp.Model)
+			}
+
+		case <-timeout:
+			for name := range expected {
+				t.Errorf("%q: not discovered", name)
+			}
+			return
+		}
+	}
+
+	// Failed services are resolved before the late one. The failure
+	// of the dual-stack service is merged with its accepted outcome
+	outcomes := map[string]string{
+		broken: OutcomeResolveFailed,
+		dual:   OutcomeAccepted,
+	}
+
+	for _, entry := range discoveryReport.Entries() {
+		outcome, found := outcomes[entry.Name]
+		switch {
+		case entry.Backend != ReportDNSSd || !found:
+		case outcome == "":
+			t.Errorf("%q: reported twice", entry.Name)
+		case entry.Outcome != outcome:
+			t.Errorf("%q: outcome %q, expected %q", entry.Name,
+				entry.Outcome, outcome)
+			outcomes[entry.Name] = ""
+		case entry.Interface == "":
+			t.Errorf("%q: interface not reported", entry.Name)
+			outcomes[entry.Name] = ""
+		default:
+			outcomes[entry.Name] = ""
+		}
+	}
+
+	for name, outcome := range outcomes {
+		if outcome != "" {
+			t.Errorf("%q: not reported", name)
+		}
+	}
+}
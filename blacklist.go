@@ -0,0 +1,417 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The "blacklist" command: sane-airscan blacklist rules generator
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// blacklistUsage is the usage template of the blacklist command
+const blacklistUsage = `Usage:
+    %s blacklist [options]
+
+Discover devices and generate [blacklist] rules for devices,
+selected by filters. Multiple filters are combined with AND.
+
+Filters are:
+    -p proto       protocol: escl or wsd
+    -N pattern     device name, glob-style pattern
+    -s subnet      device address or subnet (addr[/mask])
+    -D             device is a duplicate, i.e. the same device
+                   (by UUID or address) is also discovered with
+                   the preferred protocol
+    -P proto       preferred protocol for -D (default: escl)
+
+sane-airscan rules hide devices regardless of protocol. With -D,
+rules that would hide the preferred endpoint too are not generated.
+
+Options are:
+    -k key         generate rules by: name (default), model or ip
+    -u file        merge rules into the [blacklist] section of file
+    -n, --dry-run  with -u, print the diff, but don't write the file
+    -b suffix      with -u, backup file suffix (default: .bak)
+    -B             with -u, don't create a backup file
+` + usageCommonOptions
+
+// BlacklistRule represents a single rule of the [blacklist] section:
+//
+//	name = "pattern"   ; device name, glob-style pattern
+//	model = "pattern"  ; device model, glob-style pattern
+//	ip = addr[/mask]   ; device address or subnet
+type BlacklistRule struct {
+	Key   string // "name", "model" or "ip"
+	Value string // Rule value
+	glob  *regexp.Regexp
+	ipnet *net.IPNet
+}
+
+// BlacklistParse parses the [blacklist] rule
+func BlacklistParse(key, value string) (*BlacklistRule, error) {
+	rule := &BlacklistRule{Key: key, Value: value}
+
+	switch key {
+	case "name", "model":
+		rule.glob = globCompile(value)
+
+	case "ip":
+		_, ipnet, err := net.ParseCIDR(value)
+		if err != nil {
+			ip := net.ParseIP(value)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", value)
+			}
+
+			bits := 8 * len(ip)
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 32
+			}
+
+			ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		rule.ipnet = ipnet
+
+	default:
+		return nil, fmt.Errorf("unknown blacklist rule %q", key)
+	}
+
+	return rule, nil
+}
+
+// Match reports whether rule matches the endpoint
+func (rule *BlacklistRule) Match(endpoint Endpoint) bool {
+	switch rule.Key {
+	case "name":
+		return rule.glob.MatchString(endpoint.Name)
+	case "model":
+		model := endpoint.Model
+		if model == "" {
+			model = endpoint.Name
+		}
+		return rule.glob.MatchString(model)
+	case "ip":
+		ip := EndpointIP(endpoint)
+		return ip != nil && rule.ipnet.Contains(ip)
+	}
+
+	return false
+}
+
+// String returns the rule, formatted as airscan.conf line
+func (rule *BlacklistRule) String() string {
+	return IniFormat("blacklist", rule.Key, rule.Value)
+}
+
+// EndpointIP returns IP address of the endpoint, taken from
+// its URL or, if URL contains a host name, from the endpoint
+// source address
+func EndpointIP(endpoint Endpoint) net.IP {
+	if u, err := url.Parse(endpoint.URL); err == nil {
+		host := u.Hostname()
+		if i := strings.IndexByte(host, '%'); i >= 0 {
+			host = host[:i]
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			return ip
+		}
+	}
+
+	return net.ParseIP(endpoint.Source)
+}
+
+// globQuote replaces glob-style pattern metacharacters with '?',
+// so the pattern matches the string itself, not a whole family
+// of strings
+func globQuote(s string) string {
+	var buf strings.Builder
+	for _, c := range s {
+		if c == '*' || c == '?' {
+			buf.WriteString("?")
+		} else {
+			buf.WriteRune(c)
+		}
+	}
+	return buf.String()
+}
+
+// globCompile compiles glob-style pattern into regexp.
+// Unlike path.Match, '*' matches any characters, including '/'
+func globCompile(pattern string) *regexp.Regexp {
+	var buf strings.Builder
+
+	buf.WriteString("^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			buf.WriteString(".*")
+		case '?':
+			buf.WriteString(".")
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+
+	return regexp.MustCompile(buf.String())
+}
+
+// blacklistFilter selects endpoints to be blacklisted
+type blacklistFilter struct {
+	proto      string         // Protocol, "" if any
+	name       *regexp.Regexp // Name pattern, nil if any
+	subnet     *net.IPNet     // Subnet, nil if any
+	duplicates bool           // Select duplicates only
+	preferred  string         // Preferred protocol for duplicates
+}
+
+// match reports whether endpoint matches the filter
+func (filter *blacklistFilter) match(endpoint Endpoint,
+	endpoints []Endpoint) bool {
+
+	if filter.proto != "" && filter.proto != endpoint.Proto {
+		return false
+	}
+
+	if filter.name != nil && !filter.name.MatchString(endpoint.Name) {
+		return false
+	}
+
+	if filter.subnet != nil {
+		ip := EndpointIP(endpoint)
+		if ip == nil || !filter.subnet.Contains(ip) {
+			return false
+		}
+	}
+
+	if filter.duplicates {
+		return endpoint.Proto != filter.preferred &&
+			blacklistPreferred(endpoint, endpoints, filter.preferred) != nil
+	}
+
+	return true
+}
+
+// blacklistPreferred returns endpoint of the same device as
+// the specified endpoint, but with the preferred protocol
+func blacklistPreferred(endpoint Endpoint, endpoints []Endpoint,
+	preferred string) *Endpoint {
+
+	ip := EndpointIP(endpoint)
+	for i := range endpoints {
+		other := &endpoints[i]
+		if other.Proto != preferred {
+			continue
+		}
+
+		if endpoint.UUID != "" && strings.EqualFold(endpoint.UUID, other.UUID) {
+			return other
+		}
+
+		if ip != nil && ip.Equal(EndpointIP(*other)) {
+			return other
+		}
+	}
+
+	return nil
+}
+
+// blacklistProto validates the protocol argument of the option
+func blacklistProto(opts *Options) string {
+	proto := opts.Value()
+	switch proto {
+	case "escl", "wsd":
+	default:
+		opts.Fail("Option %s: invalid protocol %q", opts.Opt, proto)
+	}
+	return proto
+}
+
+// BlacklistRuleFor creates a rule of the specified kind
+// ("name", "model" or "ip") that matches the endpoint
+func BlacklistRuleFor(key string, endpoint Endpoint) (*BlacklistRule, error) {
+	value := ""
+
+	switch key {
+	case "name":
+		value = globQuote(endpoint.Name)
+	case "model":
+		value = endpoint.Model
+		if value == "" {
+			value = endpoint.Name
+		}
+		value = globQuote(value)
+	case "ip":
+		ip := EndpointIP(endpoint)
+		if ip == nil {
+			return nil, fmt.Errorf("%q: unknown address", endpoint.Name)
+		}
+		value = ip.String()
+	}
+
+	return BlacklistParse(key, value)
+}
+
+// ConfMergeBlacklist merges rules into the [blacklist] section
+// of the airscan.conf. Rules, already listed in the file, are
+// not added again
+func ConfMergeBlacklist(ini *IniFile, rules []*BlacklistRule) {
+	for _, rule := range rules {
+		found := false
+		for _, line := range ini.Variables("blacklist") {
+			if line.Key == rule.Key && line.Value == rule.Value {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			ini.Add("blacklist", rule.Key, rule.Value)
+		}
+	}
+}
+
+// ConfBlacklist returns all valid rules of the [blacklist] section
+func ConfBlacklist(ini *IniFile) []*BlacklistRule {
+	var rules []*BlacklistRule
+	for _, line := range ini.Variables("blacklist") {
+		if rule, err := BlacklistParse(line.Key, line.Value); err == nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// cmdBlacklist implements the "blacklist" command
+func cmdBlacklist(args []string) {
+	filter := blacklistFilter{preferred: "escl"}
+	key := "name"
+	file := ""
+	dryRun := false
+	suffix := ".bak"
+	filters := 0
+
+	// Parse options
+	opts := NewOptions(args, blacklistUsage)
+	for opts.Next() {
+		switch opts.Opt {
+		case "-p":
+			filter.proto = blacklistProto(opts)
+			filters++
+		case "-N":
+			filter.name = globCompile(opts.Value())
+			filters++
+		case "-s":
+			rule, err := BlacklistParse("ip", opts.Value())
+			if err != nil {
+				opts.Fail("Option %s: %s", opts.Opt, err)
+			}
+			filter.subnet = rule.ipnet
+			filters++
+		case "-D":
+			filter.duplicates = true
+			filters++
+		case "-P":
+			filter.preferred = blacklistProto(opts)
+		case "-k":
+			key = opts.Value()
+		case "-u":
+			file = opts.Value()
+		case "-n", "--dry-run":
+			dryRun = true
+		case "-b":
+			suffix = opts.Value()
+		case "-B":
+			suffix = ""
+		default:
+			opts.Common()
+		}
+	}
+
+	if len(opts.Args()) != 0 {
+		opts.Invalid(opts.Args()[0])
+	}
+
+	if filters == 0 {
+		opts.Fail("At least one filter must be specified")
+	}
+
+	switch key {
+	case "name", "model", "ip":
+	default:
+		opts.Fail("Invalid rule key %q", key)
+	}
+
+	var ini *IniFile
+	var old []string
+	if file != "" {
+		var err error
+		ini, err = confLoad(file)
+		LogCheck(err)
+		old = ini.Text()
+	}
+
+	// Discover and generate rules
+	endpoints := Discover(DiscoveryTime, nil)
+
+	var rules []*BlacklistRule
+	seen := make(map[string]struct{})
+
+	fmt.Printf("[blacklist]\n")
+	if filter.duplicates {
+		fmt.Printf("  ; Rules hide devices regardless of protocol\n")
+	}
+
+	for _, endpoint := range endpoints {
+		if !filter.match(endpoint, endpoints) {
+			continue
+		}
+
+		rule, err := BlacklistRuleFor(key, endpoint)
+		if err != nil {
+			fmt.Printf("  ; %s\n", err)
+			continue
+		}
+
+		// Rules match devices regardless of protocol, so make
+		// sure, the preferred endpoint is not hidden as well
+		if filter.duplicates {
+			preferred := blacklistPreferred(endpoint, endpoints,
+				filter.preferred)
+			if rule.Match(*preferred) {
+				fmt.Printf("  ; %s: %s rule would hide %s endpoint too\n",
+					IniQuote(endpoint.Name), key, filter.preferred)
+				continue
+			}
+		}
+
+		fmt.Printf("  ; %s (%s) %s\n", IniQuote(endpoint.Name),
+			endpoint.Proto, endpoint.URL)
+
+		if _, dup := seen[rule.String()]; !dup {
+			seen[rule.String()] = struct{}{}
+			rules = append(rules, rule)
+			fmt.Printf("  %s\n", rule)
+		}
+	}
+
+	// Update the file
+	if ini != nil {
+		fmt.Printf("\n")
+		ConfMergeBlacklist(ini, rules)
+
+		backup := ""
+		if suffix != "" {
+			backup = file + suffix
+		}
+
+		confUpdate(file, old, ini, dryRun, backup)
+	}
+}
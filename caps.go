@@ -0,0 +1,244 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Scanner capabilities
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Input sources
+const (
+	SourcePlaten    = "platen"
+	SourceADF       = "adf"
+	SourceADFDuplex = "adf-duplex"
+)
+
+// Capabilities represents scanner capabilities, normalized
+// across protocols
+type Capabilities struct {
+	Version      string   `json:"version,omitempty"`        // Protocol version
+	MakeAndModel string   `json:"make_and_model,omitempty"` // Make and model
+	SerialNumber string   `json:"serial_number,omitempty"`  // Serial number
+	UUID         string   `json:"uuid,omitempty"`           // Device UUID
+	AdminURI     string   `json:"admin_uri,omitempty"`      // Admin page URI
+	IconURI      string   `json:"icon_uri,omitempty"`       // Icon URI
+	Sources      []string `json:"sources"`                  // Input sources
+	Resolutions  []int    `json:"resolutions"`              // Resolutions, DPI
+	ColorModes   []string `json:"color_modes"`              // Color modes
+	Formats      []string `json:"formats"`                  // MIME types
+	MaxWidth     int      `json:"max_width_mm"`             // Max width, mm
+	MaxHeight    int      `json:"max_height_mm"`            // Max height, mm
+
+	// Max scan area of each input source. MaxWidth and MaxHeight
+	// are maximums across all sources
+	SourceSizes map[string]CapsSize `json:"source_sizes,omitempty"`
+}
+
+// CapsSize is the max scan area of the input source
+type CapsSize struct {
+	Width  int `json:"width_mm"`  // Max width, mm
+	Height int `json:"height_mm"` // Max height, mm
+}
+
+// capsStdResolutions are the standard resolutions, used to
+// represent resolution ranges as a list
+var capsStdResolutions = []int{75, 100, 150, 200, 300, 400, 600, 1200, 2400}
+
+// HasSource reports whether scanner has the input source
+func (caps *Capabilities) HasSource(source string) bool {
+	return capsContains(caps.Sources, source)
+}
+
+// HasResolution reports whether scanner supports the resolution
+func (caps *Capabilities) HasResolution(res int) bool {
+	for _, r := range caps.Resolutions {
+		if r == res {
+			return true
+		}
+	}
+	return false
+}
+
+// MaxSize returns max scan area of the input source, in millimeters.
+// Duplex ADF defaults to simplex ADF limits, and unknown sources
+// default to maximums across all sources
+func (caps *Capabilities) MaxSize(source string) (width, height int) {
+	size, found := caps.SourceSizes[source]
+	if !found && source == SourceADFDuplex {
+		size, found = caps.SourceSizes[SourceADF]
+	}
+
+	if !found {
+		return caps.MaxWidth, caps.MaxHeight
+	}
+
+	return size.Width, size.Height
+}
+
+// MaxResolution returns the maximum supported resolution
+func (caps *Capabilities) MaxResolution() int {
+	max := 0
+	for _, r := range caps.Resolutions {
+		if r > max {
+			max = r
+		}
+	}
+	return max
+}
+
+// String returns a short human-readable summary of capabilities
+func (caps *Capabilities) String() string {
+	var parts []string
+
+	parts = append(parts, strings.Join(caps.Sources, "+"))
+
+	var res []string
+	for _, r := range caps.Resolutions {
+		res = append(res, fmt.Sprintf("%d", r))
+	}
+	parts = append(parts, strings.Join(res, ",")+" dpi")
+
+	parts = append(parts, strings.Join(caps.ColorModes, ","))
+	parts = append(parts, strings.Join(caps.Formats, ","))
+
+	if caps.MaxWidth != 0 && caps.MaxHeight != 0 {
+		parts = append(parts,
+			fmt.Sprintf("%dx%d mm", caps.MaxWidth, caps.MaxHeight))
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// addSource adds input source
+func (caps *Capabilities) addSource(source string) {
+	if !capsContains(caps.Sources, source) {
+		caps.Sources = append(caps.Sources, source)
+	}
+}
+
+// addResolution adds supported resolution
+func (caps *Capabilities) addResolution(res int) {
+	if res > 0 && !caps.HasResolution(res) {
+		caps.Resolutions = append(caps.Resolutions, res)
+	}
+}
+
+// addResolutionRange adds standard resolutions within the range
+func (caps *Capabilities) addResolutionRange(min, max int) {
+	for _, res := range capsStdResolutions {
+		if res >= min && res <= max {
+			caps.addResolution(res)
+		}
+	}
+}
+
+// addColorMode adds supported color mode
+func (caps *Capabilities) addColorMode(mode string) {
+	if mode != "" && !capsContains(caps.ColorModes, mode) {
+		caps.ColorModes = append(caps.ColorModes, mode)
+	}
+}
+
+// addFormat adds supported document format
+func (caps *Capabilities) addFormat(format string) {
+	if format != "" && !capsContains(caps.Formats, format) {
+		caps.Formats = append(caps.Formats, format)
+	}
+}
+
+// addMaxSize updates max scan area of the input source, in millimeters
+func (caps *Capabilities) addMaxSize(source string, width, height int) {
+	if caps.SourceSizes == nil {
+		caps.SourceSizes = make(map[string]CapsSize)
+	}
+
+	size := caps.SourceSizes[source]
+	if width > size.Width {
+		size.Width = width
+	}
+	if height > size.Height {
+		size.Height = height
+	}
+	caps.SourceSizes[source] = size
+
+	if width > caps.MaxWidth {
+		caps.MaxWidth = width
+	}
+	if height > caps.MaxHeight {
+		caps.MaxHeight = height
+	}
+}
+
+// normalize sorts lists of capabilities and makes sure
+// they are not nil
+func (caps *Capabilities) normalize() {
+	order := map[string]int{SourcePlaten: 0, SourceADF: 1, SourceADFDuplex: 2}
+	sort.Slice(caps.Sources, func(i, j int) bool {
+		return order[caps.Sources[i]] < order[caps.Sources[j]]
+	})
+
+	sort.Ints(caps.Resolutions)
+
+	if caps.Sources == nil {
+		caps.Sources = []string{}
+	}
+	if caps.Resolutions == nil {
+		caps.Resolutions = []int{}
+	}
+	if caps.ColorModes == nil {
+		caps.ColorModes = []string{}
+	}
+	if caps.Formats == nil {
+		caps.Formats = []string{}
+	}
+}
+
+// capsContains reports whether list contains the string
+func capsContains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ProbeCapabilities queries capabilities of all endpoints
+// in parallel, and stores them into the endpoints
+func ProbeCapabilities(endpoints []Endpoint) {
+	var wait sync.WaitGroup
+
+	for i := range endpoints {
+		endpoint := &endpoints[i]
+
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+
+			var err error
+			switch endpoint.Proto {
+			case "escl":
+				endpoint.Caps, err = EsclCapabilities(endpoint.URL)
+			case "wsd":
+				endpoint.Caps, err = WsdCapabilities(endpoint.URL)
+			default:
+				err = fmt.Errorf("protocol %q not supported", endpoint.Proto)
+			}
+
+			if err != nil {
+				LogDebug("%s: capabilities: %s", endpoint.URL, err)
+				endpoint.CapsError = err.Error()
+			}
+		}()
+	}
+
+	wait.Wait()
+}
@@ -0,0 +1,640 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Conversion of packet captures for replay
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Capture is the packet capture, converted for replay. WS-Discovery
+// messages and HTTP exchanges become trace records, and DNS-SD
+// services are resolved from mDNS responses. Services, that can't
+// be resolved, are added to the discovery report
+type Capture struct {
+	Trace      *TraceArchive  // WS-Discovery and HTTP records
+	Services   []DNSSdService // Resolved _uscan._tcp services
+	Interfaces []NetInterface // Capture interfaces
+}
+
+// Well-known ports
+const (
+	captureWSDPort  = 3702
+	captureMDNSPort = 5353
+)
+
+// CaptureLoad loads the pcap or pcapng capture file
+func CaptureLoad(file string) (*Capture, error) {
+	pcap, err := PcapRead(file)
+	if err != nil {
+		return nil, err
+	}
+
+	capture := &Capture{
+		Trace: &TraceArchive{
+			Manifest: &TraceManifest{
+				Format:      traceFormat,
+				Version:     Version,
+				CommandLine: []string{file},
+			},
+		},
+	}
+
+	for _, iface := range pcap.Interfaces {
+		capture.Interfaces = append(capture.Interfaces, NetInterface{
+			Index: iface.Index,
+			Name:  captureIfaceName(iface),
+			Flags: net.FlagUp | net.FlagMulticast,
+		})
+		capture.Trace.Manifest.Interfaces = append(
+			capture.Trace.Manifest.Interfaces, TraceInterface{
+				Index: iface.Index,
+				Name:  captureIfaceName(iface),
+			})
+	}
+
+	if len(pcap.Packets) != 0 {
+		capture.Trace.Manifest.StartTime = pcap.Packets[0].Time
+	}
+
+	mdns := newCaptureMDNS()
+	streams := make(map[string]*captureStream)
+	var order []string
+
+	for _, ip := range pcap.IPPackets() {
+		zone := captureIfaceName(pcap.Interface(ip.Iface))
+
+		if udp := ip.UDP(); udp != nil {
+			switch {
+			case udp.SrcPort == captureWSDPort || udp.DstPort == captureWSDPort:
+				capture.addUDP(udp, zone)
+			case udp.SrcPort == captureMDNSPort:
+				mdns.add(udp, zone)
+			}
+		} else if tcp := ip.TCP(); tcp != nil {
+			key := captureTCPKey(tcp.Src, tcp.SrcPort, tcp.Dst, tcp.DstPort)
+			stream := streams[key]
+			if stream == nil {
+				stream = &captureStream{zone: zone}
+				streams[key] = stream
+				order = append(order, key)
+			}
+			stream.add(tcp)
+		}
+	}
+
+	// Convert TCP connections into HTTP exchanges
+	done := make(map[string]bool)
+	for _, key := range order {
+		stream := streams[key]
+		peer := streams[stream.peer]
+		if done[key] || peer == nil {
+			continue
+		}
+
+		done[key] = true
+		done[stream.peer] = true
+		capture.addHTTP(stream, peer)
+	}
+
+	sort.SliceStable(capture.Trace.Entries, func(i, j int) bool {
+		return capture.Trace.Entries[i].Time.Before(
+			capture.Trace.Entries[j].Time)
+	})
+
+	for i, entry := range capture.Trace.Entries {
+		entry.Index = i
+	}
+
+	capture.Services = mdns.services()
+
+	return capture, nil
+}
+
+// captureIfaceName returns name of the capture interface
+func captureIfaceName(iface PcapInterface) string {
+	if iface.Name != "" {
+		return iface.Name
+	}
+	return fmt.Sprintf("if%d", iface.Index)
+}
+
+// captureAddr returns the UDP address. Zone is added to
+// link-local IPv6 addresses
+func captureAddr(ip net.IP, port int, zone string) *net.UDPAddr {
+	addr := &net.UDPAddr{IP: ip, Port: port}
+	if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+		addr.Zone = zone
+	}
+	return addr
+}
+
+// addUDP adds WS-Discovery message to the trace. Messages from
+// the WS-Discovery port are received from devices, and messages
+// to this port are probes, sent to devices
+func (capture *Capture) addUDP(udp *PcapUDP, zone string) {
+	src := captureAddr(udp.Src, udp.SrcPort, zone)
+	dst := captureAddr(udp.Dst, udp.DstPort, zone)
+
+	entry := &TraceEntry{
+		TraceMeta: TraceMeta{
+			Time:      udp.Time,
+			Direction: "in",
+			Local:     dst.String(),
+			Remote:    src.String(),
+			Zone:      zone,
+			ID:        traceSOAPID(udp.Data),
+		},
+		Name: "udp-from-" + src.String(),
+		Data: udp.Data,
+	}
+
+	if udp.SrcPort != captureWSDPort {
+		entry.Direction = "out"
+		entry.Local, entry.Remote = entry.Remote, entry.Local
+		entry.Name = "udp-to-" + dst.String()
+	}
+
+	capture.Trace.Entries = append(capture.Trace.Entries, entry)
+}
+
+// captureStream is the one direction of TCP connection
+type captureStream struct {
+	zone     string         // Interface name
+	src, dst *net.TCPAddr   // Connection addresses
+	peer     string         // Key of the reverse direction
+	isn      uint32         // Initial sequence number
+	syn      bool           // SYN seen, isn is valid
+	segments []*PcapTCP     // Segments with data
+	data     []byte         // Reassembled data
+	times    []captureChunk // Time of data chunks
+}
+
+// captureChunk is the chunk of the reassembled stream
+type captureChunk struct {
+	off  int       // Chunk offset
+	time time.Time // Time of the chunk
+}
+
+// captureTCPKey returns the key of TCP connection direction
+func captureTCPKey(src net.IP, srcPort int, dst net.IP, dstPort int) string {
+	return fmt.Sprintf("%s %d %s %d", src, srcPort, dst, dstPort)
+}
+
+// add adds TCP segment to the stream
+func (stream *captureStream) add(tcp *PcapTCP) {
+	if stream.src == nil {
+		stream.src = &net.TCPAddr{IP: tcp.Src, Port: tcp.SrcPort}
+		stream.dst = &net.TCPAddr{IP: tcp.Dst, Port: tcp.DstPort}
+		stream.peer = captureTCPKey(tcp.Dst, tcp.DstPort,
+			tcp.Src, tcp.SrcPort)
+	}
+
+	if tcp.Flags&pcapTCPSyn != 0 {
+		stream.isn = tcp.Seq
+		stream.syn = true
+	}
+
+	if len(tcp.Data) != 0 {
+		stream.segments = append(stream.segments, tcp)
+	}
+}
+
+// reassemble reassembles the stream data. Retransmitted segments
+// are dropped, and the stream is truncated at the first gap
+func (stream *captureStream) reassemble() {
+	if len(stream.segments) == 0 {
+		return
+	}
+
+	base := stream.isn + 1
+	if !stream.syn {
+		// Capture started in the middle of connection
+		base = stream.segments[0].Seq
+		for _, seg := range stream.segments {
+			if int32(seg.Seq-base) < 0 {
+				base = seg.Seq
+			}
+		}
+	}
+
+	segments := make([]*PcapTCP, len(stream.segments))
+	copy(segments, stream.segments)
+	sort.SliceStable(segments, func(i, j int) bool {
+		return int32(segments[i].Seq-base) < int32(segments[j].Seq-base)
+	})
+
+	for _, seg := range segments {
+		off := int(int32(seg.Seq - base))
+		end := off + len(seg.Data)
+		switch {
+		case off < 0 || end <= len(stream.data):
+			continue
+		case off > len(stream.data):
+			return
+		}
+
+		stream.times = append(stream.times,
+			captureChunk{len(stream.data), seg.Time})
+		stream.data = append(stream.data, seg.Data[len(stream.data)-off:]...)
+	}
+}
+
+// timeAt returns time of the stream data at the offset
+func (stream *captureStream) timeAt(off int) time.Time {
+	i := sort.Search(len(stream.times), func(i int) bool {
+		return stream.times[i].off > off
+	})
+	if i > 0 {
+		i--
+	}
+	return stream.times[i].time
+}
+
+// countingReader counts bytes, read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+// Read reads from the underlying reader
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += n
+	return n, err
+}
+
+// addHTTP adds HTTP exchanges of TCP connection to the trace
+func (capture *Capture) addHTTP(stream, peer *captureStream) {
+	stream.reassemble()
+	peer.reassemble()
+
+	// The client is the side, that sends requests
+	client, server := stream, peer
+	if len(client.data) == 0 ||
+		bytes.HasPrefix(client.data, []byte("HTTP/")) {
+		client, server = server, client
+	}
+
+	if len(client.data) == 0 {
+		return
+	}
+
+	reqReader := &countingReader{r: bytes.NewReader(client.data)}
+	reqBuf := bufio.NewReader(reqReader)
+	rspReader := &countingReader{r: bytes.NewReader(server.data)}
+	rspBuf := bufio.NewReader(rspReader)
+
+	serverAddr := captureAddr(client.dst.IP, client.dst.Port, client.zone)
+	hostport := net.JoinHostPort(serverAddr.IP.String(),
+		strconv.Itoa(serverAddr.Port))
+	if serverAddr.Zone != "" {
+		hostport = net.JoinHostPort(serverAddr.IP.String()+"%"+
+			serverAddr.Zone, strconv.Itoa(serverAddr.Port))
+	}
+	clientAddr := captureAddr(client.src.IP, client.src.Port, client.zone)
+
+	for {
+		off := reqReader.n - reqBuf.Buffered()
+		if off >= len(client.data) {
+			return
+		}
+
+		req, err := http.ReadRequest(reqBuf)
+		if err != nil {
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
+
+		u := &url.URL{Scheme: "http", Host: hostport}
+		if ref, err := url.ParseRequestURI(req.RequestURI); err == nil {
+			u = u.ResolveReference(ref)
+		}
+
+		id := traceNewID("http")
+		request := &TraceEntry{
+			TraceMeta: TraceMeta{
+				Time:      client.timeAt(off),
+				Direction: "out",
+				Local:     clientAddr.String(),
+				Remote:    serverAddr.String(),
+				Zone:      client.zone,
+				Method:    req.Method,
+				URL:       u.String(),
+				Header:    req.Header,
+				ID:        id,
+			},
+			Name: "http-request",
+			Data: body,
+		}
+
+		capture.Trace.Entries = append(capture.Trace.Entries, request)
+
+		response := &TraceEntry{
+			TraceMeta: request.TraceMeta,
+			Name:      "http-error",
+		}
+		response.Direction = "in"
+		response.Method = ""
+		response.Header = nil
+
+		off = rspReader.n - rspBuf.Buffered()
+		rsp, err := http.ReadResponse(rspBuf, req)
+		if err == nil {
+			response.Data, err = ioutil.ReadAll(rsp.Body)
+		}
+
+		switch {
+		case off >= len(server.data):
+			response.Data = []byte("no response in capture")
+		case err != nil:
+			response.Data = []byte(fmt.Sprintf("invalid response: %s", err))
+		default:
+			response.Name = "http-response"
+			response.Status = rsp.StatusCode
+			response.Header = rsp.Header
+		}
+
+		if off < len(server.data) {
+			response.Time = server.timeAt(off)
+		}
+
+		capture.Trace.Entries = append(capture.Trace.Entries, response)
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// captureMDNS collects mDNS records of the capture
+type captureMDNS struct {
+	ptr     map[string][]captureRR     // PTR records by name
+	srv     map[string]captureRR       // SRV records by instance
+	txt     map[string]captureRR       // TXT records by instance
+	addrs   map[string][]captureRR     // A and AAAA records by host
+	sources map[string]map[string]bool // Advertised types by source
+	zones   map[string]string          // Interface names by source
+	order   []string                   // Source addresses, in order
+}
+
+// captureRR is the mDNS resource record
+type captureRR struct {
+	source string   // Source address
+	iface  int      // Interface index
+	zone   string   // Interface name
+	labels []string // PTR, SRV: target name labels
+	port   uint16   // SRV: port
+	txt    [][]byte // TXT: strings
+	ip     net.IP   // A, AAAA: address
+}
+
+// DNS record types
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeTXT  = 16
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+)
+
+// captureUScan is the DNS-SD service type of eSCL scanners
+const captureUScan = "_uscan._tcp.local"
+
+// newCaptureMDNS creates a new captureMDNS
+func newCaptureMDNS() *captureMDNS {
+	return &captureMDNS{
+		ptr:     make(map[string][]captureRR),
+		srv:     make(map[string]captureRR),
+		txt:     make(map[string]captureRR),
+		addrs:   make(map[string][]captureRR),
+		sources: make(map[string]map[string]bool),
+		zones:   make(map[string]string),
+	}
+}
+
+// add adds records of the mDNS response
+func (mdns *captureMDNS) add(udp *PcapUDP, zone string) {
+	msg := udp.Data
+	if len(msg) < 12 || msg[2]&0x80 == 0 {
+		return // Not a response
+	}
+
+	source := udp.Src.String()
+	if mdns.sources[source] == nil {
+		mdns.sources[source] = make(map[string]bool)
+		mdns.zones[source] = zone
+		mdns.order = append(mdns.order, source)
+	}
+
+	// Skip questions
+	off := 12
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	for i := 0; i < qdcount; i++ {
+		var err error
+		_, off, err = dnsName(msg, off)
+		if err != nil || off+4 > len(msg) {
+			return
+		}
+		off += 4
+	}
+
+	count := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+
+	for i := 0; i < count; i++ {
+		labels, next, err := dnsName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return
+		}
+
+		rtype := binary.BigEndian.Uint16(msg[next:])
+		ttl := binary.BigEndian.Uint32(msg[next+4:])
+		rdlen := int(binary.BigEndian.Uint16(msg[next+8:]))
+		rdata := next + 10
+		off = rdata + rdlen
+		if off > len(msg) {
+			return
+		}
+
+		// Goodbye records remove services
+		if ttl == 0 {
+			continue
+		}
+
+		name := dnsKey(labels)
+		rr := captureRR{source: source, iface: udp.Iface, zone: zone}
+
+		switch rtype {
+		case dnsTypePTR:
+			rr.labels, _, err = dnsName(msg, rdata)
+			if err == nil && len(rr.labels) > 2 {
+				mdns.ptr[name] = append(mdns.ptr[name], rr)
+				if name != "_services._dns-sd._udp.local" {
+					mdns.sources[source][name] = true
+				}
+			}
+
+		case dnsTypeSRV:
+			if rdlen >= 7 {
+				rr.port = binary.BigEndian.Uint16(msg[rdata+4:])
+				rr.labels, _, err = dnsName(msg, rdata+6)
+				if err == nil {
+					mdns.srv[name] = rr
+				}
+			}
+
+		case dnsTypeTXT:
+			for txt := msg[rdata:off]; len(txt) > 0; {
+				l := int(txt[0])
+				if l+1 > len(txt) {
+					break
+				}
+				if l > 0 {
+					rr.txt = append(rr.txt, txt[1:l+1])
+				}
+				txt = txt[l+1:]
+			}
+			mdns.txt[name] = rr
+
+		case dnsTypeA, dnsTypeAAAA:
+			if rdlen == 4 || rdlen == 16 {
+				rr.ip = net.IP(msg[rdata:off])
+				mdns.addrs[name] = append(mdns.addrs[name], rr)
+			}
+		}
+	}
+}
+
+// services returns resolved _uscan._tcp services. Services, that
+// can't be resolved, are added to the discovery report
+func (mdns *captureMDNS) services() []DNSSdService {
+	var services []DNSSdService
+	seen := make(map[string]bool)
+
+	for _, ptr := range mdns.ptr[captureUScan] {
+		instance := dnsKey(ptr.labels)
+		if seen[instance] {
+			continue
+		}
+		seen[instance] = true
+
+		name := ptr.labels[0]
+		srv, found := mdns.srv[instance]
+		if !found {
+			discoveryReport.Add(ReportDNSSd, ptr.zone, ptr.source, name,
+				OutcomeResolveFailed, "no SRV record")
+			continue
+		}
+
+		host := dnsKey(srv.labels)
+		addrs := mdns.addrs[host]
+		if len(addrs) == 0 {
+			discoveryReport.Add(ReportDNSSd, srv.zone, srv.source, name,
+				OutcomeResolveFailed, "no address of "+host)
+			continue
+		}
+
+		known := make(map[string]bool)
+		for _, addr := range addrs {
+			if known[addr.ip.String()] {
+				continue
+			}
+			known[addr.ip.String()] = true
+
+			services = append(services, DNSSdService{
+				Interface: addr.iface,
+				Name:      name,
+				Address:   addr.ip.String(),
+				Port:      srv.port,
+				Txt:       mdns.txt[instance].txt,
+			})
+		}
+	}
+
+	// Hosts, that advertise other services, i.e., printers
+	// without the scanner
+	for _, source := range mdns.order {
+		types := mdns.sources[source]
+		if len(types) == 0 || types[captureUScan] {
+			continue
+		}
+
+		var list []string
+		for svcType := range types {
+			list = append(list, strings.TrimSuffix(svcType, ".local"))
+		}
+		sort.Strings(list)
+
+		discoveryReport.Add(ReportDNSSd, mdns.zones[source], source, "",
+			OutcomeNotScanner, "advertises only "+strings.Join(list, ", "))
+	}
+
+	return services
+}
+
+// dnsName decodes the (possibly compressed) domain name at the
+// offset. It returns name labels and offset of the next field
+func dnsName(msg []byte, off int) ([]string, int, error) {
+	var labels []string
+	next := -1
+
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return nil, 0, errors.New("truncated name")
+		}
+
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return labels, next, nil
+
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 32 {
+				return nil, 0, errors.New("invalid name")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+
+		case l&0xc0 != 0 || off+1+l > len(msg):
+			return nil, 0, errors.New("invalid name")
+
+		default:
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// dnsKey returns the case-insensitive key of the domain name
+func dnsKey(labels []string) string {
+	return strings.ToLower(strings.Join(labels, "."))
+}
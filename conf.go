@@ -0,0 +1,422 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The "conf" command: airscan.conf updater
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+)
+
+// ConfDefault is the default location of airscan.conf
+const ConfDefault = "/etc/sane.d/airscan.conf"
+
+// confUsage is the usage template of the conf command
+const confUsage = `Usage:
+    %s conf [options] [file]
+
+Discover devices and merge them into the [devices] section of
+the airscan.conf file (default: ` + ConfDefault + `)
+
+The unified diff of changes is printed before file is written.
+The file is replaced atomically, and its previous version is
+saved as the backup file.
+
+Options are:
+    -n, --dry-run  print the diff, but don't write the file
+    -b suffix      backup file suffix (default: .bak)
+    -B             don't create a backup file
+` + usageCommonOptions
+
+// ConfDevice represents an entry of the [devices] section
+type ConfDevice struct {
+	Line     *IniLine // Line of the file
+	Name     string   // Device name
+	URL      string   // Device URL
+	Proto    string   // Protocol, "escl" or "wsd"
+	Disabled bool     // Device is disabled
+}
+
+// ConfDevices returns all entries of the [devices] section
+func ConfDevices(ini *IniFile) []ConfDevice {
+	var devices []ConfDevice
+
+	for _, line := range ini.Variables("devices") {
+		dev := ConfDevice{Line: line, Name: line.Key, Proto: "escl"}
+
+		fields := strings.Split(line.Value, ",")
+		dev.URL = strings.TrimSpace(fields[0])
+		if len(fields) > 1 {
+			dev.Proto = strings.ToLower(strings.TrimSpace(fields[1]))
+		}
+
+		if strings.EqualFold(dev.URL, "disable") {
+			dev.Disabled = true
+			dev.URL = ""
+		}
+
+		devices = append(devices, dev)
+	}
+
+	return devices
+}
+
+// ConfDeviceValue returns value of the [devices] section entry,
+// that corresponds to the endpoint
+func ConfDeviceValue(endpoint Endpoint) string {
+	if endpoint.Proto == "escl" {
+		return endpoint.URL
+	}
+	return endpoint.URL + ", " + endpoint.Proto
+}
+
+// ConfMergeDevices merges discovered endpoints into the [devices]
+// section of the airscan.conf
+//
+// Endpoints, already listed in the file, are left as is. If the
+// device is listed with a different URL, the entry is updated.
+// Otherwise, the new entry is added. Devices are recognized by the
+// address or UUID (see ConfSameDevice), and by name only if it is
+// unambiguous. Disabled devices, and devices that match rules of
+// the [blacklist] section, are never touched.
+func ConfMergeDevices(ini *IniFile, endpoints []Endpoint) {
+	devices := ConfDevices(ini)
+	blacklist := ConfBlacklist(ini)
+
+	listed := make(map[string]bool)
+	disabled := make(map[string]bool)
+	for _, dev := range devices {
+		if dev.Disabled {
+			disabled[dev.Name] = true
+		} else {
+			listed[dev.Proto+" "+dev.URL] = true
+		}
+	}
+
+	// Choose endpoints to merge
+	var merged, fresh []Endpoint
+	discovered := make(map[string]bool)
+
+	for _, endpoint := range endpoints {
+		key := endpoint.Proto + " " + endpoint.URL
+		switch {
+		case confBlacklisted(blacklist, endpoint):
+		case disabled[endpoint.Name]:
+		case discovered[key]:
+		default:
+			discovered[key] = true
+			merged = append(merged, endpoint)
+			if !listed[key] {
+				fresh = append(fresh, endpoint)
+			}
+		}
+	}
+
+	// Entries, not found at their URLs, may be updated
+	var stale []ConfDevice
+	for _, dev := range devices {
+		if !dev.Disabled && !discovered[dev.Proto+" "+dev.URL] {
+			stale = append(stale, dev)
+		}
+	}
+
+	// Update stale entries, then add the rest
+	for _, endpoint := range fresh {
+		i := confFindStale(stale, devices, endpoint, merged)
+		if i >= 0 {
+			ini.Set(stale[i].Line, ConfDeviceValue(endpoint))
+			stale = append(stale[:i], stale[i+1:]...)
+		} else {
+			ini.Add("devices", endpoint.Name, ConfDeviceValue(endpoint))
+		}
+	}
+}
+
+// confFindStale returns index of the stale entry, that the endpoint
+// replaces, or -1
+func confFindStale(stale, devices []ConfDevice, endpoint Endpoint,
+	endpoints []Endpoint) int {
+
+	for i, dev := range stale {
+		if same, _ := ConfSameDevice(dev, endpoint); same {
+			return i
+		}
+	}
+
+	for i, dev := range stale {
+		if confSameName(dev, devices, endpoint, endpoints) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// confUUIDRe matches UUID, i.e., in the URL of WSD device
+var confUUIDRe = regexp.MustCompile(
+	"[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}")
+
+// ConfSameDevice reports whether the [devices] entry refers to the
+// same device, as the discovered endpoint. Devices are compared by
+// UUID, if the entry URL contains it, or by address. If neither
+// tells, known is false
+func ConfSameDevice(dev ConfDevice, endpoint Endpoint) (same, known bool) {
+	if dev.Proto != endpoint.Proto {
+		return false, true
+	}
+
+	uuid := confUUIDRe.FindString(dev.URL)
+	if uuid != "" && endpoint.UUID != "" {
+		same = strings.EqualFold(uuid,
+			strings.TrimPrefix(endpoint.UUID, "urn:uuid:"))
+		return same, true
+	}
+
+	host := confURLHost(dev.URL)
+	if host != nil && (host.Equal(net.ParseIP(endpoint.Source)) ||
+		host.Equal(confURLHost(endpoint.URL))) {
+		return true, true
+	}
+
+	return false, false
+}
+
+// confSameName reports whether the entry and the endpoint are the
+// only enabled entry and the only endpoint with their name and
+// protocol, so the device can be recognized by name
+func confSameName(dev ConfDevice, devices []ConfDevice,
+	endpoint Endpoint, endpoints []Endpoint) bool {
+
+	if dev.Name != endpoint.Name || dev.Proto != endpoint.Proto {
+		return false
+	}
+
+	if _, known := ConfSameDevice(dev, endpoint); known {
+		return false
+	}
+
+	entries := 0
+	for _, d := range devices {
+		if !d.Disabled && d.Name == dev.Name && d.Proto == dev.Proto {
+			entries++
+		}
+	}
+
+	found := 0
+	for _, e := range endpoints {
+		if e.Name == endpoint.Name && e.Proto == endpoint.Proto {
+			found++
+		}
+	}
+
+	return entries == 1 && found == 1
+}
+
+// confURLHost returns IP address of the URL host, or nil
+func confURLHost(s string) net.IP {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil
+	}
+
+	host := u.Hostname()
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+
+	return net.ParseIP(host)
+}
+
+// confBlacklisted reports whether endpoint matches any of
+// the blacklist rules
+func confBlacklisted(rules []*BlacklistRule, endpoint Endpoint) bool {
+	for _, rule := range rules {
+		if rule.Match(endpoint) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfWrite atomically replaces the file with the new content
+//
+// The new content is written into the temporary file in the same
+// directory, which then renamed to the target file. File mode and
+// ownership are preserved. If backup is not empty, the previous
+// version of the file, if any, is saved under that name
+func ConfWrite(file string, data []byte, backup string) error {
+	var mode os.FileMode = 0644
+	uid, gid := -1, -1
+
+	fi, err := os.Stat(file)
+	switch {
+	case err == nil:
+		mode = fi.Mode().Perm()
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			uid, gid = int(st.Uid), int(st.Gid)
+		}
+
+		if backup != "" {
+			old, err := ioutil.ReadFile(file)
+			if err == nil {
+				err = confWriteAtomic(backup, old, mode, uid, gid)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	return confWriteAtomic(file, data, mode, uid, gid)
+}
+
+// confWriteAtomic writes file via temporary file and rename
+func confWriteAtomic(file string, data []byte, mode os.FileMode,
+	uid, gid int) error {
+
+	dir, base := filepath.Split(file)
+	if dir == "" {
+		dir = "."
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+base+".")
+	if err != nil {
+		return err
+	}
+
+	tmpName := tmp.Name()
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	err2 := tmp.Close()
+	if err == nil {
+		err = err2
+	}
+
+	if err == nil {
+		err = os.Chmod(tmpName, mode)
+	}
+
+	if err == nil && uid >= 0 {
+		// Only root may change ownership; failure is not fatal
+		os.Chown(tmpName, uid, gid)
+	}
+
+	if err == nil {
+		err = os.Rename(tmpName, file)
+	}
+
+	if err != nil {
+		os.Remove(tmpName)
+	}
+
+	return err
+}
+
+// confLoad loads airscan.conf. Missing file is treated as empty
+func confLoad(file string) (*IniFile, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return IniRead(bytes.NewReader(data))
+}
+
+// confUpdate shows the diff between the old and new version of
+// airscan.conf and, unless dryRun is set, writes the new version
+func confUpdate(file string, old []string, ini *IniFile,
+	dryRun bool, backup string) {
+
+	diff := UnifiedDiff(file, file, old, ini.Text())
+	if diff == "" {
+		fmt.Printf("%s: no changes\n", file)
+		return
+	}
+
+	fmt.Print(diff)
+
+	if dryRun {
+		return
+	}
+
+	if _, err := os.Stat(file); err != nil {
+		backup = ""
+	}
+
+	err := ConfWrite(file, ini.Bytes(), backup)
+	if err != nil {
+		LogFatal("%s", err)
+	}
+
+	if backup != "" {
+		fmt.Printf("%s: updated, previous version saved as %s\n",
+			file, backup)
+	} else {
+		fmt.Printf("%s: updated\n", file)
+	}
+}
+
+// cmdConf implements the "conf" command
+func cmdConf(args []string) {
+	dryRun := false
+	suffix := ".bak"
+
+	// Parse options
+	opts := NewOptions(args, confUsage)
+	for opts.Next() {
+		switch opts.Opt {
+		case "-n", "--dry-run":
+			dryRun = true
+		case "-b":
+			suffix = opts.Value()
+		case "-B":
+			suffix = ""
+		default:
+			opts.Common()
+		}
+	}
+
+	file := ConfDefault
+	switch args := opts.Args(); len(args) {
+	case 0:
+	case 1:
+		file = args[0]
+	default:
+		opts.Invalid(args[1])
+	}
+
+	// Load the file before discovery, so errors are reported early
+	ini, err := confLoad(file)
+	LogCheck(err)
+
+	old := ini.Text()
+
+	// Discover and merge
+	endpoints := Discover(DiscoveryTime, nil)
+	ConfMergeDevices(ini, endpoints)
+
+	backup := ""
+	if suffix != "" {
+		backup = file + suffix
+	}
+
+	confUpdate(file, old, ini, dryRun, backup)
+}
@@ -0,0 +1,194 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The "conf" command tests
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestConfMergeDevices merges endpoints into the [devices] section
+func TestConfMergeDevices(t *testing.T) {
+	const uuid = "4509a320-00a0-008f-00b6-00a0f1e0c0de"
+
+	tests := []struct {
+		name      string
+		in        string
+		endpoints []Endpoint
+		out       string
+	}{
+		{
+			name: "listed",
+			in: "[devices]\n" +
+				"  \"A\" = http://10.0.0.1:80/eSCL # comment\n",
+			endpoints: []Endpoint{
+				{Proto: "escl", Name: "A", URL: "http://10.0.0.1:80/eSCL"},
+			},
+			out: "[devices]\n" +
+				"  \"A\" = http://10.0.0.1:80/eSCL # comment\n",
+		},
+		{
+			name: "new",
+			in: "# Devices\n" +
+				"[devices]\n" +
+				"  \"A\" = http://10.0.0.1:80/eSCL\n" +
+				"\n" +
+				"[options]\n",
+			endpoints: []Endpoint{
+				{Proto: "escl", Name: "A", URL: "http://10.0.0.1:80/eSCL"},
+				{Proto: "wsd", Name: "B \"1\"", URL: "http://10.0.0.2:80/WDP/SCAN"},
+			},
+			out: "# Devices\n" +
+				"[devices]\n" +
+				"  \"A\" = http://10.0.0.1:80/eSCL\n" +
+				"  \"B \\\"1\\\"\" = http://10.0.0.2:80/WDP/SCAN, wsd\n" +
+				"\n" +
+				"[options]\n",
+		},
+		{
+			name: "by UUID",
+			in: "[devices]\n" +
+				"  \"Renamed\" = http://10.0.0.1:5357/" + uuid + ", wsd\n",
+			endpoints: []Endpoint{
+				{Proto: "wsd", Name: "WSD", UUID: "urn:uuid:" + uuid,
+					URL: "http://10.0.0.9:5357/" + uuid},
+			},
+			out: "[devices]\n" +
+				"  \"Renamed\" = http://10.0.0.9:5357/" + uuid + ", wsd\n",
+		},
+		{
+			name: "name conflicts with UUID",
+			in: "[devices]\n" +
+				"  \"WSD\" = http://10.0.0.1:5357/" + uuid + ", wsd\n",
+			endpoints: []Endpoint{
+				{Proto: "wsd", Name: "WSD",
+					UUID: "urn:uuid:00000000-0000-0000-0000-000000000001",
+					URL:  "http://10.0.0.1:5358/WDP"},
+			},
+			out: "[devices]\n" +
+				"  \"WSD\" = http://10.0.0.1:5357/" + uuid + ", wsd\n" +
+				"  \"WSD\" = http://10.0.0.1:5358/WDP, wsd\n",
+		},
+		{
+			name: "by address",
+			in: "[devices]\n" +
+				"  \"Old Name\" = http://10.0.0.1:80/eSCL\n",
+			endpoints: []Endpoint{
+				{Proto: "escl", Name: "New Name", Source: "10.0.0.1",
+					URL: "http://10.0.0.1:8080/eSCL"},
+			},
+			out: "[devices]\n" +
+				"  \"Old Name\" = http://10.0.0.1:8080/eSCL\n",
+		},
+		{
+			name: "by name",
+			in: "[devices]\n" +
+				"  \"A\" = http://scanner.local/eSCL\n",
+			endpoints: []Endpoint{
+				{Proto: "escl", Name: "A", URL: "http://10.0.0.5/eSCL"},
+			},
+			out: "[devices]\n" +
+				"  \"A\" = http://10.0.0.5/eSCL\n",
+		},
+		{
+			name: "ambiguous name",
+			in: "[devices]\n" +
+				"  \"A\" = http://scanner.local/eSCL\n",
+			endpoints: []Endpoint{
+				{Proto: "escl", Name: "A", URL: "http://10.0.0.5/eSCL"},
+				{Proto: "escl", Name: "A", URL: "http://10.0.0.6/eSCL"},
+			},
+			out: "[devices]\n" +
+				"  \"A\" = http://scanner.local/eSCL\n" +
+				"  \"A\" = http://10.0.0.5/eSCL\n" +
+				"  \"A\" = http://10.0.0.6/eSCL\n",
+		},
+		{
+			name: "moved to other address",
+			in: "[devices]\n" +
+				"  \"A\" = http://10.0.0.1/eSCL\n",
+			endpoints: []Endpoint{
+				{Proto: "escl", Name: "A", Source: "10.0.0.2",
+					URL: "http://10.0.0.2/eSCL"},
+			},
+			out: "[devices]\n" +
+				"  \"A\" = http://10.0.0.2/eSCL\n",
+		},
+		{
+			name: "other protocol",
+			in: "[devices]\n" +
+				"  \"A\" = http://10.0.0.1/eSCL\n",
+			endpoints: []Endpoint{
+				{Proto: "wsd", Name: "A", Source: "10.0.0.1",
+					URL: "http://10.0.0.1:5357/WDP"},
+			},
+			out: "[devices]\n" +
+				"  \"A\" = http://10.0.0.1/eSCL\n" +
+				"  \"A\" = http://10.0.0.1:5357/WDP, wsd\n",
+		},
+		{
+			name: "duplicates",
+			in:   "[devices]\n",
+			endpoints: []Endpoint{
+				{Proto: "escl", Name: "A", URL: "http://10.0.0.1/eSCL"},
+				{Proto: "escl", Name: "A", URL: "http://10.0.0.1/eSCL"},
+			},
+			out: "[devices]\n" +
+				"  \"A\" = http://10.0.0.1/eSCL\n",
+		},
+		{
+			name: "two entries, one device",
+			in: "[devices]\n" +
+				"  \"A\" = http://10.0.0.1:80/eSCL\n" +
+				"  \"B\" = http://10.0.0.1:81/eSCL\n",
+			endpoints: []Endpoint{
+				{Proto: "escl", Name: "A", Source: "10.0.0.1",
+					URL: "http://10.0.0.1:8080/eSCL"},
+			},
+			out: "[devices]\n" +
+				"  \"A\" = http://10.0.0.1:8080/eSCL\n" +
+				"  \"B\" = http://10.0.0.1:81/eSCL\n",
+		},
+		{
+			name: "disabled",
+			in: "[devices]\n" +
+				"  \"A\" = disable\n",
+			endpoints: []Endpoint{
+				{Proto: "escl", Name: "A", URL: "http://10.0.0.1/eSCL"},
+			},
+			out: "[devices]\n" +
+				"  \"A\" = disable\n",
+		},
+		{
+			name: "blacklisted",
+			in: "[devices]\n" +
+				"[blacklist]\n" +
+				"  ip = 10.0.0.0/24\n",
+			endpoints: []Endpoint{
+				{Proto: "escl", Name: "A", Source: "10.0.0.1",
+					URL: "http://10.0.0.1/eSCL"},
+			},
+			out: "[devices]\n" +
+				"[blacklist]\n" +
+				"  ip = 10.0.0.0/24\n",
+		},
+	}
+
+	for _, test := range tests {
+		ini := testIni(t, test.in)
+		ConfMergeDevices(ini, test.endpoints)
+
+		out := string(ini.Bytes())
+		if out != test.out {
+			t.Errorf("%s:\n%s", test.name,
+				UnifiedDiff("expected", "got",
+					strings.Split(test.out, "\n"),
+					strings.Split(out, "\n")))
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Unified diff
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of context lines around each change
+const diffContext = 3
+
+// diffOp is the single line of the diff
+type diffOp struct {
+	op   byte // ' ', '-' or '+'
+	a, b int  // Line indices in old and new text
+}
+
+// UnifiedDiff returns unified diff between old and new versions of
+// text, represented as slices of lines. If texts are equal, it
+// returns an empty string
+func UnifiedDiff(oldName, newName string, a, b []string) string {
+	ops := diffLines(a, b)
+
+	// Find changed lines
+	changed := false
+	for _, op := range ops {
+		if op.op != ' ' {
+			changed = true
+			break
+		}
+	}
+
+	if !changed {
+		return ""
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+
+	// Generate hunks
+	for i := 0; i < len(ops); {
+		// Skip unchanged lines
+		if ops[i].op == ' ' {
+			i++
+			continue
+		}
+
+		// Find hunk boundaries
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+
+		end := i
+		for j := i; j < len(ops) && j <= end+2*diffContext+1; j++ {
+			if ops[j].op != ' ' {
+				end = j
+			}
+		}
+
+		end += diffContext + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		// Count lines
+		aStart, bStart := ops[start].a, ops[start].b
+		aCount, bCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.op != '+' {
+				aCount++
+			}
+			if op.op != '-' {
+				bCount++
+			}
+		}
+
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n",
+			diffRange(aStart, aCount), diffRange(bStart, bCount))
+
+		for _, op := range ops[start:end] {
+			line := ""
+			if op.op == '+' {
+				line = b[op.b]
+			} else {
+				line = a[op.a]
+			}
+			fmt.Fprintf(&buf, "%c%s\n", op.op, line)
+		}
+
+		i = end
+	}
+
+	return buf.String()
+}
+
+// diffRange formats line range of the hunk header
+func diffRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// diffLines computes line-by-line difference between a and b,
+// using the longest common subsequence
+//
+// Each returned op contains indices of the line in both texts;
+// for inserted and deleted lines, index in the other text is the
+// position where the line would be
+func diffLines(a, b []string) []diffOp {
+	// lcs[i][j] is the LCS length of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// Walk the table
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', i, j})
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] > lcs[i+1][j]):
+			ops = append(ops, diffOp{'+', i, j})
+			j++
+		default:
+			ops = append(ops, diffOp{'-', i, j})
+			i++
+		}
+	}
+
+	return ops
+}
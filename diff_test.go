@@ -0,0 +1,143 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Unified diff tests
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testLines returns n lines, named by numbers
+func testLines(n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%d", i+1)
+	}
+	return lines
+}
+
+// testReplace returns copy of lines with the lines at given
+// indices replaced
+func testReplace(lines []string, indices ...int) []string {
+	lines = append([]string(nil), lines...)
+	for _, i := range indices {
+		lines[i] = "x" + lines[i]
+	}
+	return lines
+}
+
+// TestUnifiedDiff checks hunk boundaries of the unified diff
+func TestUnifiedDiff(t *testing.T) {
+	lines := testLines(20)
+
+	tests := []struct {
+		name string
+		a, b []string
+		diff string
+	}{
+		{
+			name: "equal",
+			a:    lines,
+			b:    lines,
+			diff: "",
+		},
+		{
+			name: "first line",
+			a:    lines,
+			b:    testReplace(lines, 0),
+			diff: "@@ -1,4 +1,4 @@\n-1\n+x1\n 2\n 3\n 4\n",
+		},
+		{
+			name: "last line",
+			a:    lines,
+			b:    testReplace(lines, 19),
+			diff: "@@ -17,4 +17,4 @@\n 17\n 18\n 19\n-20\n+x20\n",
+		},
+		{
+			name: "merged hunks",
+			a:    lines,
+			b:    testReplace(lines, 4, 10),
+			diff: "@@ -2,13 +2,13 @@\n 2\n 3\n 4\n-5\n+x5\n" +
+				" 6\n 7\n 8\n 9\n 10\n-11\n+x11\n 12\n 13\n 14\n",
+		},
+		{
+			name: "separate hunks",
+			a:    lines,
+			b:    testReplace(lines, 4, 12),
+			diff: "@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+x5\n 6\n 7\n 8\n" +
+				"@@ -10,7 +10,7 @@\n 10\n 11\n 12\n-13\n+x13\n 14\n 15\n 16\n",
+		},
+		{
+			name: "insert into empty",
+			a:    nil,
+			b:    []string{"a", "b"},
+			diff: "@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name: "delete all",
+			a:    []string{"a"},
+			b:    nil,
+			diff: "@@ -1 +0,0 @@\n-a\n",
+		},
+		{
+			name: "append",
+			a:    testLines(5),
+			b:    append(testLines(5), "6"),
+			diff: "@@ -3,3 +3,4 @@\n 3\n 4\n 5\n+6\n",
+		},
+	}
+
+	for _, test := range tests {
+		diff := UnifiedDiff("old", "new", test.a, test.b)
+		if test.diff != "" {
+			test.diff = "--- old\n+++ new\n" + test.diff
+		}
+
+		if diff != test.diff {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.name, diff,
+				test.diff)
+		}
+	}
+}
+
+// TestUnifiedDiffApply checks that hunks reproduce the new text
+func TestUnifiedDiffApply(t *testing.T) {
+	a := testLines(30)
+	b := append([]string{"new"}, testReplace(a, 3, 9, 25)...)
+	b = append(b[:15], b[17:]...)
+
+	diff := UnifiedDiff("old", "new", a, b)
+
+	var got []string
+	pos := 0
+	for _, line := range strings.Split(diff, "\n")[2:] {
+		switch {
+		case strings.HasPrefix(line, "@@"):
+			var start int
+			fmt.Sscanf(line, "@@ -%d", &start)
+			if start > 0 {
+				start--
+			}
+			got = append(got, a[pos:start]...)
+			pos = start
+		case strings.HasPrefix(line, "+"):
+			got = append(got, line[1:])
+		case strings.HasPrefix(line, "-"):
+			pos++
+		case strings.HasPrefix(line, " "):
+			got = append(got, line[1:])
+			pos++
+		}
+	}
+	got = append(got, a[pos:]...)
+
+	if strings.Join(got, "\n") != strings.Join(b, "\n") {
+		t.Errorf("diff doesn't apply:\n%s", diff)
+	}
+}
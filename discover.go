@@ -0,0 +1,69 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Discovery driver
+
+package main
+
+import (
+	"time"
+)
+
+// DiscoveryTime is the default discovery duration
+const DiscoveryTime = 2500 * time.Millisecond
+
+// Discover performs a discovery for the specified time and returns
+// sorted slice of discovered endpoints, with SANE device names
+// assigned
+//
+// If found is not nil, it is called for each new endpoint as soon
+// as it is discovered
+func Discover(timeout time.Duration, found func(Endpoint)) []Endpoint {
+	c := make(chan Endpoint)
+	t := time.NewTimer(timeout)
+
+	endpoints := make(map[string]Endpoint)
+
+	// When replaying the trace, discovery ends when all
+	// recorded messages are handled
+	done := make(chan struct{})
+	if traceReplay != nil {
+		go func() {
+			traceReplay.Discover(c)
+			close(done)
+		}()
+	} else {
+		go DNSSdDiscover(c)
+		go WSSDDiscover(c)
+	}
+
+loop:
+	for {
+		select {
+		case endpoint := <-c:
+			key := endpoint.Key()
+			if _, dup := endpoints[key]; !dup {
+				endpoints[key] = endpoint
+				if found != nil {
+					found(endpoint)
+				}
+			}
+		case <-t.C:
+			break loop
+		case <-done:
+			break loop
+		}
+	}
+
+	list := make([]Endpoint, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		list = append(list, endpoint)
+	}
+
+	SortEndpoints(list)
+	SaneAssignNames(list)
+
+	return list
+}
@@ -0,0 +1,347 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Discovery tests, using in-memory transports
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDiscoveryTime is the discovery time of tests
+const testDiscoveryTime = 1500 * time.Millisecond
+
+// testInterfaces are interfaces of the test network
+var testInterfaces = []NetInterface{
+	{
+		Index: 2,
+		Name:  "eth0",
+		Flags: net.FlagUp | net.FlagMulticast,
+		Addrs: []net.Addr{&net.IPNet{
+			IP:   net.ParseIP("10.0.0.1").To4(),
+			Mask: net.CIDRMask(24, 32),
+		}},
+	},
+	{
+		Index: 3,
+		Name:  "eth1",
+		Flags: net.FlagUp | net.FlagMulticast,
+		Addrs: []net.Addr{&net.IPNet{
+			IP:   net.ParseIP("10.1.0.1").To4(),
+			Mask: net.CIDRMask(24, 32),
+		}},
+	},
+}
+
+// testWSDDevice is the WSD device on the test network. It responds
+// to Probe with ProbeMatches, and serves metadata by the emulator
+type testWSDDevice struct {
+	zone       string        // Interface name
+	ip         string        // Device address
+	uuid       string        // Device UUID
+	probeDelay time.Duration // ProbeMatches delay
+	httpDelay  time.Duration // GetResponse delay
+}
+
+// start starts the device and returns its HTTP handler
+func (dev testWSDDevice) start(t *testing.T, mn *MemNetwork) http.Handler {
+	emu := &wsdEmulator{
+		device: &EmuDevice{
+			Name:         "Test " + dev.uuid[:4],
+			Manufacturer: "ACME",
+			Model:        "Scan " + dev.uuid[:4],
+			UUID:         dev.uuid,
+		},
+		profile: &WsdEmuProfile{
+			XAddrs:     fmt.Sprintf("http://%s:5357/%s", dev.ip, dev.uuid),
+			ProbeDelay: dev.probeDelay,
+			Delay:      dev.httpDelay,
+		},
+		address:  "urn:uuid:" + dev.uuid,
+		instance: 1,
+	}
+
+	group, err := mn.ListenUDP("udp4",
+		&net.UDPAddr{IP: WSDiscoveryAddrIp4, Port: 3702, Zone: dev.zone})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := mn.ListenUDP("udp4",
+		&net.UDPAddr{IP: net.ParseIP(dev.ip), Port: 3702, Zone: dev.zone})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		buf := make([]byte, 32768)
+		for {
+			n, from, err := group.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			elements, err := XMLDecode(wsddNsMap, bytes.NewBuffer(buf[:n]))
+			if err != nil {
+				continue
+			}
+
+			var action, msgID string
+			for _, elem := range elements {
+				switch elem.Path {
+				case "/s:Envelope/s:Header/a:Action":
+					action = elem.Text
+				case "/s:Envelope/s:Header/a:MessageID":
+					msgID = elem.Text
+				}
+			}
+
+			if !strings.HasSuffix(action, "/discovery/Probe") {
+				continue
+			}
+
+			go func() {
+				time.Sleep(dev.probeDelay)
+				msg := emu.discoveryMessage("ProbeMatches",
+					"http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous",
+					fmt.Sprintf("\t\t<a:RelatesTo>%s</a:RelatesTo>\n", msgID),
+					"\t\t<d:ProbeMatches>\n"+
+						emu.discoveryBody("ProbeMatch", nil)+
+						"\t\t</d:ProbeMatches>\n")
+				conn.WriteTo(msg, from)
+			}()
+		}
+	}()
+
+	return emu
+}
+
+// testTransport is the Network, HTTPClient and DNSSdBrowser of tests.
+// Goroutines of the previous discovery may still use the global
+// transports, so tests switch the underlying transports instead
+// of globals
+type testTransport struct {
+	net     *MemNetwork
+	client  HTTPClient
+	browser DNSSdBrowser
+	lock    sync.Mutex
+}
+
+// testTransports are transports of tests, installed once
+var (
+	testTransports testTransport
+	testSetup      sync.Once
+)
+
+// testInstall installs test transports
+func testInstall() {
+	testSetup.Do(func() {
+		Trace = false
+		network = &testTransports
+		httpClient = &testTransports
+		dnssdBrowser = &testTransports
+	})
+}
+
+// set switches the underlying transports
+func (tt *testTransport) set(mn *MemNetwork, client HTTPClient,
+	browser DNSSdBrowser) {
+	tt.lock.Lock()
+	tt.net, tt.client, tt.browser = mn, client, browser
+	tt.lock.Unlock()
+}
+
+// Interfaces returns network interfaces
+func (tt *testTransport) Interfaces() ([]NetInterface, error) {
+	tt.lock.Lock()
+	mn := tt.net
+	tt.lock.Unlock()
+	return mn.Interfaces()
+}
+
+// ListenUDP creates UDP socket, bound to the local address
+func (tt *testTransport) ListenUDP(network string, laddr *net.UDPAddr) (
+	PacketConn, error) {
+	tt.lock.Lock()
+	mn := tt.net
+	tt.lock.Unlock()
+	return mn.ListenUDP(network, laddr)
+}
+
+// Do performs HTTP request
+func (tt *testTransport) Do(req *http.Request) (*http.Response, error) {
+	tt.lock.Lock()
+	client := tt.client
+	tt.lock.Unlock()
+	return client.Do(req)
+}
+
+// Browse starts browsing of services of the specified type
+func (tt *testTransport) Browse(svcType string) (<-chan DNSSdService, error) {
+	tt.lock.Lock()
+	browser := tt.browser
+	tt.lock.Unlock()
+	return browser.Browse(svcType)
+}
+
+// testDropProbeMatches returns the MemNetwork.Loss function, that
+// drops the first n ProbeMatches messages
+func testDropProbeMatches(n int) func(from, to *net.UDPAddr, msg []byte) bool {
+	var lock sync.Mutex
+	return func(from, to *net.UDPAddr, msg []byte) bool {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if n > 0 && bytes.Contains(msg, []byte("/discovery/ProbeMatches")) {
+			n--
+			return true
+		}
+		return false
+	}
+}
+
+// TestDiscover runs discovery scenarios on the in-memory network
+func TestDiscover(t *testing.T) {
+	tests := []struct {
+		name      string
+		devices   []testWSDDevice
+		drop      int               // ProbeMatches to drop
+		endpoints []string          // Expected "uuid%zone" endpoints
+		outcomes  map[string]string // Expected outcomes by source
+	}{
+		{
+			name: "two interfaces",
+			devices: []testWSDDevice{
+				{zone: "eth0", ip: "10.0.0.10",
+					uuid: "11111111-0000-0000-0000-000000000001"},
+				{zone: "eth1", ip: "10.1.0.10",
+					uuid: "11111111-0000-0000-0000-000000000002"},
+			},
+			endpoints: []string{
+				"11111111-0000-0000-0000-000000000001%eth0",
+				"11111111-0000-0000-0000-000000000002%eth1",
+			},
+			outcomes: map[string]string{
+				"10.0.0.10": OutcomeAccepted,
+				"10.1.0.10": OutcomeAccepted,
+			},
+		},
+		{
+			name: "dropped ProbeMatch",
+			devices: []testWSDDevice{
+				{zone: "eth0", ip: "10.0.0.20",
+					uuid: "22222222-0000-0000-0000-000000000001"},
+			},
+			drop: 2,
+			endpoints: []string{
+				"22222222-0000-0000-0000-000000000001%eth0",
+			},
+			outcomes: map[string]string{
+				"10.0.0.20": OutcomeAccepted,
+			},
+		},
+		{
+			name: "delayed GetResponse",
+			devices: []testWSDDevice{
+				{zone: "eth1", ip: "10.1.0.30",
+					uuid:      "33333333-0000-0000-0000-000000000001",
+					httpDelay: 500 * time.Millisecond},
+			},
+			endpoints: []string{
+				"33333333-0000-0000-0000-000000000001%eth1",
+			},
+			outcomes: map[string]string{
+				"10.1.0.30": OutcomeAccepted,
+			},
+		},
+		{
+			name: "duplicate responder",
+			devices: []testWSDDevice{
+				{zone: "eth0", ip: "10.0.0.40",
+					uuid: "44444444-0000-0000-0000-000000000001"},
+				{zone: "eth0", ip: "10.0.0.41",
+					uuid:       "44444444-0000-0000-0000-000000000001",
+					probeDelay: 100 * time.Millisecond},
+			},
+			endpoints: []string{
+				"44444444-0000-0000-0000-000000000001%eth0",
+			},
+			outcomes: map[string]string{
+				"10.0.0.40": OutcomeAccepted,
+				"10.0.0.41": OutcomeDuplicate,
+			},
+		},
+	}
+
+	testInstall()
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mn := &MemNetwork{Ifaces: testInterfaces}
+			defer mn.Close()
+
+			if test.drop != 0 {
+				mn.Loss = testDropProbeMatches(test.drop)
+			}
+
+			handlers := make(map[string]http.Handler)
+			for _, dev := range test.devices {
+				handlers[dev.ip+":5357"] = dev.start(t, mn)
+			}
+
+			testTransports.set(mn, &MemHTTPClient{
+				Handler: http.HandlerFunc(func(w http.ResponseWriter,
+					r *http.Request) {
+					if h := handlers[r.Host]; h != nil {
+						h.ServeHTTP(w, r)
+					} else {
+						http.NotFound(w, r)
+					}
+				}),
+			}, &MemDNSSdBrowser{})
+
+			wsddFoundMutex.Lock()
+			wsddFound = map[string]struct{}{}
+			wsddFoundMutex.Unlock()
+			discoveryReport.Reset()
+
+			var endpoints []string
+			for _, endpoint := range Discover(testDiscoveryTime, nil) {
+				endpoints = append(endpoints,
+					endpoint.UUID+"%"+endpoint.Interface)
+			}
+			sort.Strings(endpoints)
+
+			if strings.Join(endpoints, " ") !=
+				strings.Join(test.endpoints, " ") {
+				t.Errorf("endpoints: expected %q, present %q",
+					test.endpoints, endpoints)
+			}
+
+			outcomes := make(map[string]string)
+			for _, entry := range discoveryReport.Entries() {
+				if entry.Backend == ReportWSD {
+					outcomes[entry.Source] = entry.Outcome
+				}
+			}
+
+			for source, outcome := range test.outcomes {
+				if outcomes[source] != outcome {
+					t.Errorf("%s: expected %q, present %q",
+						source, outcome, outcomes[source])
+				}
+			}
+		})
+	}
+}
@@ -18,70 +18,102 @@ import (
 
 // DNSSdDiscover performs DNS-SD discovery for scanner devices
 func DNSSdDiscover(out chan Endpoint) {
-	conn, err := dbus.SystemBus()
+	services, err := dnssdBrowser.Browse("_uscan._tcp")
 	if err != nil {
-		LogFatal("Cannot get system bus")
+		LogFatal("%s", err)
 	}
 
-	server, err := avahi.ServerNew(conn)
-	if err != nil {
-		LogFatal("Avahi new failed")
-	}
+	for service := range services {
+		LogTraceDNSSd(service)
 
-	sb, err := server.ServiceBrowserNew(avahi.InterfaceUnspec,
-		avahi.ProtoUnspec, "_uscan._tcp", "local", 0)
-	if err != nil {
-		LogFatal("ServiceBrowserNew() failed: %s", err.Error())
-	}
+		iface := netInterfaceName(service.Interface)
+		if service.Err != nil {
+			discoveryReport.Add(ReportDNSSd, iface, "", service.Name,
+				OutcomeResolveFailed, service.Err.Error())
+			continue
+		}
 
-	for {
-		select {
-		case service := <-sb.AddChannel:
-			service, err = server.ResolveService(service.Interface,
-				service.Protocol, service.Name, service.Type,
-				service.Domain, avahi.ProtoUnspec, 0)
-			if err != nil {
-				continue
-			}
+		addr := net.ParseIP(service.Address)
+		if addr == nil {
+			discoveryReport.Add(ReportDNSSd, iface, service.Address,
+				service.Name, OutcomeIgnored, "invalid address")
+			continue
+		}
 
-			addr := net.ParseIP(service.Address)
-			if addr == nil {
-				continue
-			}
+		endpoint := Endpoint{
+			Proto:     "escl",
+			Name:      service.Name,
+			Source:    addr.String(),
+			Interface: iface,
+			Meta:      make(map[string]string),
+		}
 
-			endpoint := Endpoint{
-				Name: service.Name,
-			}
+		rs := ""
 
-			rs := ""
-
-			for _, txt := range service.Txt {
-				name := ""
-				if i := bytes.IndexByte(txt, '='); i >= 0 {
-					name = string(bytes.ToLower(txt[:i]))
-					txt = txt[i+1:]
-				} else {
-					name = string(bytes.ToLower(txt))
-					txt = txt[len(txt):]
-				}
-
-				switch name {
-				case "rs":
-					rs = string(bytes.Trim(txt, "/"))
-				}
+		for _, txt := range service.Txt {
+			name := ""
+			if i := bytes.IndexByte(txt, '='); i >= 0 {
+				name = string(bytes.ToLower(txt[:i]))
+				txt = txt[i+1:]
+			} else {
+				name = string(bytes.ToLower(txt))
+				txt = txt[len(txt):]
 			}
 
-			port := service.Port
-			if addr.To4() != nil {
-				endpoint.URL = fmt.Sprintf("http://%s:%d/%s", addr, port, rs)
-			} else if addr.IsLinkLocalUnicast() {
-				endpoint.URL = fmt.Sprintf("http://[%s%%25%d]:%d/%s", addr,
-					service.Interface, port, rs)
-			} else {
-				endpoint.URL = fmt.Sprintf("http://[%s]:%d/%s", addr, port, rs)
+			endpoint.Meta[name] = string(txt)
+
+			switch name {
+			case "rs":
+				rs = string(bytes.Trim(txt, "/"))
+			case "uuid":
+				endpoint.UUID = string(txt)
+			case "ty":
+				endpoint.Model = string(txt)
+			case "usb_mfg":
+				endpoint.Manufacturer = string(txt)
 			}
+		}
 
-			out <- endpoint
+		port := service.Port
+		if addr.To4() != nil {
+			endpoint.URL = fmt.Sprintf("http://%s:%d/%s", addr, port, rs)
+		} else if addr.IsLinkLocalUnicast() {
+			endpoint.URL = fmt.Sprintf("http://[%s%%25%d]:%d/%s", addr,
+				service.Interface, port, rs)
+		} else {
+			endpoint.URL = fmt.Sprintf("http://[%s]:%d/%s", addr, port, rs)
 		}
+
+		discoveryReport.Add(ReportDNSSd, iface, endpoint.Source,
+			endpoint.Name, OutcomeAccepted, endpoint.Model)
+
+		out <- endpoint
 	}
 }
+
+// DNSSdRegister registers DNS-SD service with Avahi. The service
+// remains registered until program exits
+func DNSSdRegister(name, svcType string, port int, txt [][]byte) error {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return err
+	}
+
+	server, err := avahi.ServerNew(conn)
+	if err != nil {
+		return err
+	}
+
+	group, err := server.EntryGroupNew()
+	if err != nil {
+		return err
+	}
+
+	err = group.AddService(avahi.InterfaceUnspec, avahi.ProtoUnspec, 0,
+		name, svcType, "local", "", uint16(port), txt)
+	if err != nil {
+		return err
+	}
+
+	return group.Commit()
+}
@@ -0,0 +1,445 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The "emulate" command: virtual devices for testing
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// emulateUsage is the usage template of the emulate command
+const emulateUsage = `Usage:
+    %s emulate [options] [profile]
+
+Run a virtual device for testing. The device is described by
+the profile file. If profile is not specified, the built-in
+profile is used.
+
+Options are:
+    -P             print the built-in profile and exit
+` + usageCommonOptions + `
+Use the built-in profile as a starting point for own profiles:
+    %s emulate -P > vendor.conf
+`
+
+// emuDefaultProfile is the built-in device profile. It also
+// provides defaults for missed parameters of other profiles
+const emuDefaultProfile = `; airscan-discover emulator profile
+;
+; Each protocol section ([escl], [wsd]) enables emulation of the
+; corresponding protocol. Missed parameters are taken from
+; the built-in profile
+
+[device]
+  name         = airscan-discover virtual scanner
+  manufacturer = airscan-discover
+  model        = Virtual Scanner
+  serial       = 0000000001
+  firmware     = 1.0
+; uuid         = 00000000-0000-0000-0000-000000000000, random if missed
+
+[escl]
+  port         = 8080                  ; 0 to choose any free port
+  root         = eSCL                  ; eSCL root path (TXT rs)
+  version      = 2.63
+  sources      = platen, adf, adf-duplex
+  resolutions  = 75, 150, 300, 600
+  color_modes  = RGB24, Grayscale8, BlackAndWhite1
+  formats      = image/jpeg, image/png, application/pdf
+  max_width    = 216                   ; mm
+  max_height   = 356                   ; mm
+  adf_pages    = 3                     ; pages in ADF
+  state        = Idle                  ; reported scanner state
+  adf_state    = ScannerAdfLoaded      ; reported ADF state
+  delay        = 0s                    ; delay of each response
+  busy         = 0                     ; NextDocument answers 503 that many times
+  job_status   = 0                     ; if not 0, ScanJobs fails with this HTTP status
+  register     = no                    ; register _uscan._tcp with Avahi
+; txt.note     = Office                ; add, override or (if empty) remove TXT record
+
+[wsd]
+  port         = 5358                  ; 0 to choose any free port
+  hello        = yes                   ; send Hello on start and Bye on exit
+  xaddrs       = all                   ; all, ipv4, ll6, none or list of URLs
+  probe        = ok                    ; ok, ignore or malformed
+  probe_delay  = 0s                    ; delay of ProbeMatches
+  metadata     = ok                    ; ok, fault, malformed or no-hosted
+  delay        = 0s                    ; delay of each HTTP response
+`
+
+// EmuDevice represents the [device] section of the profile
+type EmuDevice struct {
+	Name         string // Device name
+	Manufacturer string // Manufacturer
+	Model        string // Model
+	Serial       string // Serial number
+	Firmware     string // Firmware version
+	UUID         string // Device UUID
+}
+
+// EsclEmuProfile represents the [escl] section of the profile
+type EsclEmuProfile struct {
+	Port        int               // TCP port
+	Root        string            // eSCL root path
+	Version     string            // eSCL version
+	Sources     []string          // Input sources
+	Resolutions []int             // Resolutions, DPI
+	ColorModes  []string          // eSCL color modes
+	Formats     []string          // MIME types
+	MaxWidth    int               // Max width, mm
+	MaxHeight   int               // Max height, mm
+	AdfPages    int               // Pages in ADF
+	State       string            // Scanner state
+	AdfState    string            // ADF state
+	Delay       time.Duration     // Response delay
+	Busy        int               // NextDocument 503 responses
+	JobStatus   int               // ScanJobs HTTP status, if not 0
+	Register    bool              // Register with Avahi
+	Txt         map[string]string // TXT records overrides
+}
+
+// WsdEmuProfile represents the [wsd] section of the profile
+type WsdEmuProfile struct {
+	Port       int           // TCP port
+	Hello      bool          // Send Hello and Bye
+	XAddrs     string        // XAddrs mode or list of URLs
+	Probe      string        // Probe handling mode
+	ProbeDelay time.Duration // ProbeMatches delay
+	Metadata   string        // Metadata handling mode
+	Delay      time.Duration // HTTP response delay
+}
+
+// EmuProfile represents the emulated device profile. Protocol
+// sections are nil, if protocol is not emulated
+type EmuProfile struct {
+	Device EmuDevice
+	Escl   *EsclEmuProfile
+	Wsd    *WsdEmuProfile
+}
+
+// EmuLoadProfile loads the profile file. If file is "", the
+// built-in profile is returned
+func EmuLoadProfile(file string) (*EmuProfile, error) {
+	defaults, err := emuParseProfile("", []byte(emuDefaultProfile), nil)
+	LogCheck(err)
+
+	if file == "" {
+		return defaults, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return emuParseProfile(file, data, defaults)
+}
+
+// emuParseProfile parses the profile. Missed parameters are
+// taken from defaults, if not nil
+func emuParseProfile(file string, data []byte,
+	defaults *EmuProfile) (*EmuProfile, error) {
+
+	ini, err := IniRead(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	profile := &EmuProfile{}
+	if defaults != nil {
+		profile.Device = defaults.Device
+	}
+
+	for _, line := range ini.Lines {
+		switch line.Kind {
+		case IniSection:
+			switch line.Section {
+			case "device":
+			case "escl":
+				if profile.Escl == nil {
+					profile.Escl = &EsclEmuProfile{Txt: make(map[string]string)}
+					if defaults != nil && defaults.Escl != nil {
+						*profile.Escl = *defaults.Escl
+						profile.Escl.Txt = make(map[string]string)
+					}
+				}
+			case "wsd":
+				if profile.Wsd == nil {
+					profile.Wsd = &WsdEmuProfile{}
+					if defaults != nil && defaults.Wsd != nil {
+						*profile.Wsd = *defaults.Wsd
+					}
+				}
+			default:
+				err = fmt.Errorf("unknown section [%s]", line.Section)
+			}
+
+		case IniVariable:
+			switch line.Section {
+			case "device":
+				err = profile.Device.set(line.Key, line.Value)
+			case "escl":
+				err = profile.Escl.set(line.Key, line.Value)
+			case "wsd":
+				err = profile.Wsd.set(line.Key, line.Value)
+			case "":
+				err = fmt.Errorf("%s: parameter outside of section", line.Key)
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, line.LineNo, err)
+		}
+	}
+
+	if profile.Escl == nil && profile.Wsd == nil {
+		return nil, fmt.Errorf("%s: no protocols to emulate", file)
+	}
+
+	if profile.Device.UUID == "" {
+		u, err := uuid.NewRandom()
+		LogCheck(err)
+		profile.Device.UUID = u.String()
+	}
+
+	return profile, nil
+}
+
+// set sets the [device] parameter
+func (device *EmuDevice) set(key, value string) error {
+	switch key {
+	case "name":
+		device.Name = value
+	case "manufacturer":
+		device.Manufacturer = value
+	case "model":
+		device.Model = value
+	case "serial":
+		device.Serial = value
+	case "firmware":
+		device.Firmware = value
+	case "uuid":
+		device.UUID = value
+	default:
+		return fmt.Errorf("%s: unknown parameter", key)
+	}
+	return nil
+}
+
+// set sets the [escl] parameter
+func (escl *EsclEmuProfile) set(key, value string) error {
+	var err error
+
+	switch key {
+	case "port":
+		escl.Port, err = emuInt(value)
+	case "root":
+		escl.Root = strings.Trim(value, "/")
+	case "version":
+		escl.Version = value
+	case "sources":
+		escl.Sources = emuList(value)
+		for _, source := range escl.Sources {
+			switch source {
+			case SourcePlaten, SourceADF, SourceADFDuplex:
+			default:
+				err = fmt.Errorf("%q: unknown input source", source)
+			}
+		}
+	case "resolutions":
+		escl.Resolutions = nil
+		for _, s := range emuList(value) {
+			var res int
+			res, err = emuPositive(s)
+			if err != nil {
+				break
+			}
+			escl.Resolutions = append(escl.Resolutions, res)
+		}
+	case "color_modes":
+		escl.ColorModes = emuList(value)
+	case "formats":
+		escl.Formats = emuList(value)
+	case "max_width":
+		escl.MaxWidth, err = emuPositive(value)
+	case "max_height":
+		escl.MaxHeight, err = emuPositive(value)
+	case "adf_pages":
+		escl.AdfPages, err = emuInt(value)
+	case "state":
+		escl.State = value
+	case "adf_state":
+		escl.AdfState = value
+	case "delay":
+		escl.Delay, err = time.ParseDuration(value)
+	case "busy":
+		escl.Busy, err = emuInt(value)
+	case "job_status":
+		escl.JobStatus, err = emuInt(value)
+	case "register":
+		escl.Register, err = emuBool(value)
+	default:
+		if !strings.HasPrefix(key, "txt.") || len(key) == 4 {
+			return fmt.Errorf("%s: unknown parameter", key)
+		}
+		escl.Txt[key[4:]] = value
+	}
+
+	switch key {
+	case "sources", "resolutions", "color_modes", "formats":
+		if err == nil && len(emuList(value)) == 0 {
+			err = fmt.Errorf("empty list")
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %s", key, err)
+	}
+
+	return nil
+}
+
+// set sets the [wsd] parameter
+func (wsd *WsdEmuProfile) set(key, value string) error {
+	var err error
+
+	switch key {
+	case "port":
+		wsd.Port, err = emuInt(value)
+	case "hello":
+		wsd.Hello, err = emuBool(value)
+	case "xaddrs":
+		wsd.XAddrs = value
+		switch value {
+		case "all", "ipv4", "ll6", "none":
+		default:
+			for _, url := range strings.Fields(value) {
+				if !strings.HasPrefix(url, "http://") &&
+					!strings.HasPrefix(url, "https://") {
+					err = fmt.Errorf("%q: invalid URL", url)
+				}
+			}
+		}
+	case "probe":
+		wsd.Probe, err = emuChoice(value, "ok", "ignore", "malformed")
+	case "probe_delay":
+		wsd.ProbeDelay, err = time.ParseDuration(value)
+	case "metadata":
+		wsd.Metadata, err = emuChoice(value,
+			"ok", "fault", "malformed", "no-hosted")
+	case "delay":
+		wsd.Delay, err = time.ParseDuration(value)
+	default:
+		return fmt.Errorf("%s: unknown parameter", key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %s", key, err)
+	}
+
+	return nil
+}
+
+// emuList parses comma-separated list
+func emuList(value string) []string {
+	var list []string
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+// emuInt parses non-negative integer
+func emuInt(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q: invalid number", value)
+	}
+	return n, nil
+}
+
+// emuPositive parses positive integer
+func emuPositive(value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q: invalid positive number", value)
+	}
+	return n, nil
+}
+
+// emuChoice checks that value is one of choices
+func emuChoice(value string, choices ...string) (string, error) {
+	for _, choice := range choices {
+		if value == choice {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("%q: must be one of %s", value,
+		strings.Join(choices, ", "))
+}
+
+// emuBool parses boolean value
+func emuBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "true", "on", "1":
+		return true, nil
+	case "no", "false", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q: invalid boolean", value)
+}
+
+// cmdEmulate implements the "emulate" command
+func cmdEmulate(args []string) {
+	// Parse options
+	opts := NewOptions(args, emulateUsage)
+	for opts.Next() {
+		switch opts.Opt {
+		case "-P":
+			fmt.Print(emuDefaultProfile)
+			os.Exit(0)
+		default:
+			opts.Common()
+		}
+	}
+
+	args = opts.Args()
+	if len(args) > 1 {
+		opts.Invalid(args[1])
+	}
+
+	file := ""
+	if len(args) != 0 {
+		file = args[0]
+	}
+
+	profile, err := EmuLoadProfile(file)
+	LogCheck(err)
+
+	// Start emulators
+	if profile.Escl != nil {
+		err = EsclEmulate(&profile.Device, profile.Escl)
+		LogCheck(err)
+	}
+
+	if profile.Wsd != nil {
+		err = WsdEmulate(&profile.Device, profile.Wsd)
+		LogCheck(err)
+	}
+
+	select {}
+}
@@ -0,0 +1,143 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Synthetic pages for emulated devices
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+)
+
+// EmuPage generates the synthetic page image: diagonal gradient
+// with page number, shown as count of bars at the left margin
+//
+// The mode is ScanColor, ScanGray or ScanBW, format is MIME type,
+// page size is in mm
+func EmuPage(format, mode string, res, width, height, page int) (
+	[]byte, error) {
+
+	w := emuPixels(width, res)
+	h := emuPixels(height, res)
+
+	var img image.Image
+	switch mode {
+	case ScanColor:
+		rgba := image.NewRGBA(image.Rect(0, 0, w, h))
+		emuDraw(w, h, page, func(x, y int, v uint8) {
+			rgba.Set(x, y, color.RGBA{v, 255 - v, uint8(x * 255 / w), 255})
+		})
+		img = rgba
+
+	case ScanGray:
+		gray := image.NewGray(image.Rect(0, 0, w, h))
+		emuDraw(w, h, page, func(x, y int, v uint8) {
+			gray.SetGray(x, y, color.Gray{v})
+		})
+		img = gray
+
+	default:
+		bw := image.NewGray(image.Rect(0, 0, w, h))
+		emuDraw(w, h, page, func(x, y int, v uint8) {
+			if v >= 128 {
+				bw.SetGray(x, y, color.Gray{255})
+			}
+		})
+		img = bw
+	}
+
+	var buf bytes.Buffer
+	var err error
+
+	switch format {
+	case "image/png":
+		err = png.Encode(&buf, img)
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "application/pdf":
+		err = jpeg.Encode(&buf, img, nil)
+		if err == nil {
+			data := emuPDF(buf.Bytes(), w, h, res, mode == ScanColor)
+			return data, nil
+		}
+	default:
+		err = fmt.Errorf("%s: format not supported", format)
+	}
+
+	return buf.Bytes(), err
+}
+
+// emuPixels converts size in mm into pixels
+func emuPixels(mm, res int) int {
+	px := mm * res * 10 / 254
+	if px < 1 {
+		px = 1
+	}
+	return px
+}
+
+// emuDraw calls set for each pixel of the page with its brightness
+func emuDraw(w, h, page int, set func(x, y int, v uint8)) {
+	bar := h / (2*page + 2)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8((x + y) * 255 / (w + h))
+			if x < w/10 && bar > 0 && (y/bar)%2 == 1 && y/bar < 2*page+1 {
+				v = 0
+			}
+			set(x, y, v)
+		}
+	}
+}
+
+// emuPDF wraps JPEG image into the single-page PDF document
+func emuPDF(img []byte, w, h, res int, color bool) []byte {
+	colorSpace := "/DeviceGray"
+	if color {
+		colorSpace = "/DeviceRGB"
+	}
+
+	pw, ph := float64(w)*72/float64(res), float64(h)*72/float64(res)
+	contents := fmt.Sprintf("q %.2f 0 0 %.2f 0 0 cm /Im0 Do Q\n", pw, ph)
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /XObject << /Im0 4 0 R >> >> /Contents 5 0 R >>",
+			pw, ph),
+		fmt.Sprintf("<< /Type /XObject /Subtype /Image /Width %d /Height %d "+
+			"/ColorSpace %s /BitsPerComponent 8 /Filter /DCTDecode "+
+			"/Length %d >>\nstream\n%s\nendstream", w, h, colorSpace,
+			len(img), img),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream",
+			len(contents), contents),
+	}
+
+	var buf bytes.Buffer
+	var offsets []int
+
+	buf.WriteString("%PDF-1.4\n")
+	for i, obj := range objects {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, off := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", off)
+	}
+
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R >>\n"+
+		"startxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return buf.Bytes()
+}
@@ -7,9 +7,53 @@
 
 package main
 
+import (
+	"sort"
+)
+
 // Endpoint represents scanner endpoint
 type Endpoint struct {
-	Proto string // Protocol name
-	Name  string // Device name
-	URL   string // Endpoint URL
+	Proto        string            `json:"proto"`              // Protocol name
+	Name         string            `json:"name"`               // Device name
+	URL          string            `json:"url"`                // Endpoint URL
+	Interface    string            `json:"interface"`          // Network interface
+	Source       string            `json:"source"`             // Responder address
+	UUID         string            `json:"uuid"`               // Device UUID
+	Manufacturer string            `json:"manufacturer"`       // Manufacturer
+	Model        string            `json:"model"`              // Model name
+	Meta         map[string]string `json:"metadata,omitempty"` // Other metadata
+
+	// SANE device names and scanimage command line,
+	// see SaneAssignNames for details
+	SaneName     string `json:"sane_name,omitempty"`
+	SaneConfName string `json:"sane_conf_name,omitempty"`
+	Scanimage    string `json:"scanimage,omitempty"`
+
+	// Scanner capabilities, if requested, or the error
+	// that prevented to obtain them
+	Caps      *Capabilities `json:"capabilities,omitempty"`
+	CapsError string        `json:"capabilities_error,omitempty"`
+}
+
+// Key returns a key that identifies endpoint in a set of endpoints
+//
+// Endpoints with the same key produce the same line of
+// airscan.conf, so only one of them needs to be kept
+func (endpoint *Endpoint) Key() string {
+	return endpoint.Proto + "\x00" + endpoint.Name + "\x00" + endpoint.URL
+}
+
+// SortEndpoints sorts slice of endpoints by name, then by
+// protocol, then by URL
+func SortEndpoints(endpoints []Endpoint) {
+	sort.Slice(endpoints, func(i, j int) bool {
+		e1, e2 := &endpoints[i], &endpoints[j]
+		switch {
+		case e1.Name != e2.Name:
+			return e1.Name < e2.Name
+		case e1.Proto != e2.Proto:
+			return e1.Proto < e2.Proto
+		}
+		return e1.URL < e2.URL
+	})
 }
@@ -0,0 +1,188 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// eSCL protocol
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// esclNsMap maps eSCL XML namespaces into short prefixes
+var esclNsMap = map[string]string{
+	"http://schemas.hp.com/imaging/escl/2011/05/03": "scan",
+	"http://www.pwg.org/schemas/2010/12/sm":         "pwg",
+}
+
+// esclURL appends path to the eSCL base URL
+func esclURL(base, path string) string {
+	return strings.TrimSuffix(base, "/") + "/" + path
+}
+
+// esclGet performs HTTP GET request of the eSCL resource and
+// returns parsed response
+func esclGet(base, path string) ([]*XMLElement, error) {
+	resp, err := httpGet(httpClient, esclURL(base, path))
+	if err != nil {
+		return nil, fmt.Errorf("HTTP: %s", err)
+	}
+
+	// Load response body
+	response, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("HTTP: %s", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP: %s", resp.Status)
+	}
+
+	// Parse response XML
+	elements, err := XMLDecode(esclNsMap, bytes.NewBuffer(response))
+	if err != nil {
+		return nil, fmt.Errorf("XML: %s", err)
+	}
+
+	return elements, nil
+}
+
+// EsclCapabilities queries and parses eSCL ScannerCapabilities
+func EsclCapabilities(base string) (*Capabilities, error) {
+	elements, err := esclGet(base, "ScannerCapabilities")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(elements) == 0 ||
+		elements[0].Path != "/scan:ScannerCapabilities" {
+		return nil, fmt.Errorf("not an eSCL ScannerCapabilities response")
+	}
+
+	return esclParseCapabilities(elements), nil
+}
+
+// esclParseCapabilities parses eSCL ScannerCapabilities:
+//
+//	<scan:ScannerCapabilities>
+//	  <pwg:Version>2.63</pwg:Version>
+//	  <pwg:MakeAndModel>HP LaserJet MFP M426fdn</pwg:MakeAndModel>
+//	  <scan:UUID>...</scan:UUID>
+//	  <scan:Platen>
+//	    <scan:PlatenInputCaps>
+//	      <scan:MaxWidth>2550</scan:MaxWidth>
+//	      <scan:MaxHeight>3508</scan:MaxHeight>
+//	      <scan:SettingProfiles>
+//	        <scan:SettingProfile>
+//	          <scan:ColorModes>
+//	            <scan:ColorMode>RGB24</scan:ColorMode>
+//	          </scan:ColorModes>
+//	          <scan:DocumentFormats>
+//	            <pwg:DocumentFormat>image/jpeg</pwg:DocumentFormat>
+//	          </scan:DocumentFormats>
+//	          <scan:SupportedResolutions>
+//	            <scan:DiscreteResolutions>
+//	              <scan:DiscreteResolution>
+//	                <scan:XResolution>300</scan:XResolution>
+//	                <scan:YResolution>300</scan:YResolution>
+//	              </scan:DiscreteResolution>
+//	            </scan:DiscreteResolutions>
+//	          </scan:SupportedResolutions>
+//	        </scan:SettingProfile>
+//	      </scan:SettingProfiles>
+//	    </scan:PlatenInputCaps>
+//	  </scan:Platen>
+//	  <scan:Adf>
+//	    <scan:AdfSimplexInputCaps>...</scan:AdfSimplexInputCaps>
+//	    <scan:AdfDuplexInputCaps>...</scan:AdfDuplexInputCaps>
+//	  </scan:Adf>
+//	</scan:ScannerCapabilities>
+//
+// Sizes are in 1/300 of inch
+func esclParseCapabilities(elements []*XMLElement) *Capabilities {
+	caps := &Capabilities{}
+
+	for _, elem := range elements {
+		path := elem.Path
+
+		switch path {
+		case "/scan:ScannerCapabilities/pwg:Version":
+			caps.Version = elem.Text
+		case "/scan:ScannerCapabilities/pwg:MakeAndModel":
+			caps.MakeAndModel = elem.Text
+		case "/scan:ScannerCapabilities/pwg:SerialNumber":
+			caps.SerialNumber = elem.Text
+		case "/scan:ScannerCapabilities/scan:UUID":
+			caps.UUID = elem.Text
+		case "/scan:ScannerCapabilities/scan:AdminURI":
+			caps.AdminURI = elem.Text
+		case "/scan:ScannerCapabilities/scan:IconURI":
+			caps.IconURI = elem.Text
+		case "/scan:ScannerCapabilities/scan:Platen/scan:PlatenInputCaps":
+			caps.addSource(SourcePlaten)
+		case "/scan:ScannerCapabilities/scan:Adf/scan:AdfSimplexInputCaps":
+			caps.addSource(SourceADF)
+		case "/scan:ScannerCapabilities/scan:Adf/scan:AdfDuplexInputCaps":
+			caps.addSource(SourceADFDuplex)
+		case "/scan:ScannerCapabilities/scan:Adf/scan:AdfOptions/scan:AdfOption":
+			if elem.Text == "Duplex" {
+				caps.addSource(SourceADFDuplex)
+			}
+		}
+
+		switch {
+		case strings.HasSuffix(path, "InputCaps"):
+			var width, height int
+			for _, child := range elem.Children {
+				switch child.Path {
+				case path + "/scan:MaxWidth":
+					width, _ = strconv.Atoi(child.Text)
+				case path + "/scan:MaxHeight":
+					height, _ = strconv.Atoi(child.Text)
+				}
+			}
+			source := SourcePlaten
+			switch {
+			case strings.HasSuffix(path, "/scan:AdfSimplexInputCaps"):
+				source = SourceADF
+			case strings.HasSuffix(path, "/scan:AdfDuplexInputCaps"):
+				source = SourceADFDuplex
+			}
+			caps.addMaxSize(source, width*254/3000, height*254/3000)
+
+		case strings.HasSuffix(path, "/scan:ColorModes/scan:ColorMode"):
+			caps.addColorMode(elem.Text)
+
+		case strings.HasSuffix(path, "/scan:DocumentFormats/pwg:DocumentFormat"),
+			strings.HasSuffix(path, "/scan:DocumentFormats/scan:DocumentFormatExt"):
+			caps.addFormat(elem.Text)
+
+		case strings.HasSuffix(path, "/scan:DiscreteResolution/scan:XResolution"):
+			res, _ := strconv.Atoi(elem.Text)
+			caps.addResolution(res)
+
+		case strings.HasSuffix(path, "/scan:ResolutionRange/scan:XResolutionRange"):
+			var min, max int
+			for _, child := range elem.Children {
+				switch child.Path {
+				case path + "/scan:Min":
+					min, _ = strconv.Atoi(child.Text)
+				case path + "/scan:Max":
+					max, _ = strconv.Atoi(child.Text)
+				}
+			}
+			caps.addResolutionRange(min, max)
+		}
+	}
+
+	caps.normalize()
+	return caps
+}
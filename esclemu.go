@@ -0,0 +1,523 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Virtual eSCL scanner
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// esclEmuColorModes maps eSCL color modes into ScanColor,
+// ScanGray or ScanBW
+var esclEmuColorModes = map[string]string{
+	"RGB24":          ScanColor,
+	"RGB48":          ScanColor,
+	"Grayscale8":     ScanGray,
+	"Grayscale16":    ScanGray,
+	"BlackAndWhite1": ScanBW,
+}
+
+// esclEmulator is the virtual eSCL scanner
+type esclEmulator struct {
+	device  *EmuDevice
+	profile *EsclEmuProfile
+	jobs    map[string]*esclEmuJob // Jobs by ID
+	order   []*esclEmuJob          // Jobs in order of creation
+	lock    sync.Mutex
+}
+
+// esclEmuJob is the scan job of the virtual eSCL scanner
+type esclEmuJob struct {
+	id      string    // Job UUID
+	created time.Time // Creation time
+	state   string    // Processing, Completed or Canceled
+	pages   int       // Total pages
+	sent    int       // Pages sent
+	busy    int       // Remaining 503 responses
+	format  string    // MIME type
+	mode    string    // ScanColor, ScanGray or ScanBW
+	res     int       // Resolution
+	width   int       // Page width, mm
+	height  int       // Page height, mm
+}
+
+// EsclEmulate starts the virtual eSCL scanner. It returns after
+// the scanner is started; requests are served in background
+func EsclEmulate(device *EmuDevice, profile *EsclEmuProfile) error {
+	emu := &esclEmulator{
+		device:  device,
+		profile: profile,
+		jobs:    make(map[string]*esclEmuJob),
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", profile.Port))
+	if err != nil {
+		return err
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	LogInfo("eSCL: http://localhost:%d/%s/", port, profile.Root)
+
+	go func() {
+		LogCheck(http.Serve(listener, TraceHandler(emu)))
+	}()
+
+	if profile.Register {
+		err = DNSSdRegister(device.Name, "_uscan._tcp", port, emu.txt())
+		if err != nil {
+			return fmt.Errorf("DNS-SD: %s", err)
+		}
+		LogInfo("eSCL: registered as %q", device.Name)
+	}
+
+	return nil
+}
+
+// txt returns TXT records of the _uscan._tcp service
+func (emu *esclEmulator) txt() [][]byte {
+	var cs, is []string
+	duplex := "F"
+
+	for _, mode := range emu.profile.ColorModes {
+		switch esclEmuColorModes[mode] {
+		case ScanColor:
+			cs = append(cs, "color")
+		case ScanGray:
+			cs = append(cs, "grayscale")
+		case ScanBW:
+			cs = append(cs, "binary")
+		}
+	}
+
+	for _, source := range emu.profile.Sources {
+		switch source {
+		case SourcePlaten:
+			is = append(is, "platen")
+		case SourceADF:
+			is = append(is, "adf")
+		case SourceADFDuplex:
+			duplex = "T"
+		}
+	}
+
+	records := [][2]string{
+		{"txtvers", "1"},
+		{"ty", emu.device.Model},
+		{"usb_MFG", emu.device.Manufacturer},
+		{"usb_MDL", emu.device.Model},
+		{"rs", emu.profile.Root},
+		{"UUID", emu.device.UUID},
+		{"cs", strings.Join(cs, ",")},
+		{"is", strings.Join(is, ",")},
+		{"duplex", duplex},
+		{"pdl", strings.Join(emu.profile.Formats, ",")},
+		{"vers", emu.profile.Version},
+	}
+
+	// Apply overrides. Empty value removes the record
+	var txt [][]byte
+	used := make(map[string]bool)
+	for _, rec := range records {
+		overridden := false
+		for k, v := range emu.profile.Txt {
+			if strings.EqualFold(k, rec[0]) {
+				rec[1] = v
+				used[k] = true
+				overridden = true
+			}
+		}
+
+		if !overridden || rec[1] != "" {
+			txt = append(txt, []byte(rec[0]+"="+rec[1]))
+		}
+	}
+
+	for k, v := range emu.profile.Txt {
+		if !used[k] && v != "" {
+			txt = append(txt, []byte(k+"="+v))
+		}
+	}
+
+	return txt
+}
+
+// ServeHTTP serves the eSCL requests
+func (emu *esclEmulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(emu.profile.Delay)
+
+	path := strings.Trim(r.URL.Path, "/")
+	root := emu.profile.Root
+	if root != "" {
+		if !strings.HasPrefix(path, root+"/") {
+			http.NotFound(w, r)
+			return
+		}
+		path = path[len(root)+1:]
+	}
+
+	LogDebug("eSCL: %s %s", r.Method, r.URL.Path)
+
+	parts := strings.Split(path, "/")
+	switch {
+	case r.Method == "GET" && path == "ScannerCapabilities":
+		emu.reply(w, emu.capabilities())
+
+	case r.Method == "GET" && path == "ScannerStatus":
+		emu.reply(w, emu.status())
+
+	case r.Method == "POST" && path == "ScanJobs":
+		emu.createJob(w, r)
+
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "ScanJobs" &&
+		parts[2] == "NextDocument":
+		emu.nextDocument(w, parts[1])
+
+	case r.Method == "DELETE" && len(parts) == 2 && parts[0] == "ScanJobs":
+		emu.deleteJob(w, parts[1])
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// reply sends XML response
+func (emu *esclEmulator) reply(w http.ResponseWriter, xml string) {
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write([]byte(xml))
+}
+
+// capabilities returns ScannerCapabilities response
+func (emu *esclEmulator) capabilities() string {
+	var buf bytes.Buffer
+
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	buf.WriteString(`<scan:ScannerCapabilities xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03" xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm">` + "\n")
+	fmt.Fprintf(&buf, "  <pwg:Version>%s</pwg:Version>\n", emu.profile.Version)
+	fmt.Fprintf(&buf, "  <pwg:MakeAndModel>%s</pwg:MakeAndModel>\n",
+		wsdEscape(strings.TrimSpace(emu.device.Manufacturer+" "+emu.device.Model)))
+	fmt.Fprintf(&buf, "  <pwg:SerialNumber>%s</pwg:SerialNumber>\n",
+		wsdEscape(emu.device.Serial))
+	fmt.Fprintf(&buf, "  <scan:UUID>%s</scan:UUID>\n", emu.device.UUID)
+
+	caps := emu.inputCaps()
+	adf := false
+
+	for _, source := range emu.profile.Sources {
+		switch source {
+		case SourcePlaten:
+			buf.WriteString("  <scan:Platen>\n")
+			buf.WriteString("    <scan:PlatenInputCaps>\n" + caps +
+				"    </scan:PlatenInputCaps>\n")
+			buf.WriteString("  </scan:Platen>\n")
+		case SourceADF, SourceADFDuplex:
+			adf = true
+		}
+	}
+
+	if adf {
+		buf.WriteString("  <scan:Adf>\n")
+		for _, source := range emu.profile.Sources {
+			switch source {
+			case SourceADF:
+				buf.WriteString("    <scan:AdfSimplexInputCaps>\n" + caps +
+					"    </scan:AdfSimplexInputCaps>\n")
+			case SourceADFDuplex:
+				buf.WriteString("    <scan:AdfDuplexInputCaps>\n" + caps +
+					"    </scan:AdfDuplexInputCaps>\n")
+				buf.WriteString("    <scan:AdfOptions>\n" +
+					"      <scan:AdfOption>Duplex</scan:AdfOption>\n" +
+					"    </scan:AdfOptions>\n")
+			}
+		}
+		buf.WriteString("  </scan:Adf>\n")
+	}
+
+	buf.WriteString("</scan:ScannerCapabilities>\n")
+	return buf.String()
+}
+
+// inputCaps returns content of the InputCaps element
+func (emu *esclEmulator) inputCaps() string {
+	var buf bytes.Buffer
+
+	buf.WriteString("      <scan:MinWidth>16</scan:MinWidth>\n")
+	fmt.Fprintf(&buf, "      <scan:MaxWidth>%d</scan:MaxWidth>\n",
+		esclUnits(emu.profile.MaxWidth))
+	buf.WriteString("      <scan:MinHeight>16</scan:MinHeight>\n")
+	fmt.Fprintf(&buf, "      <scan:MaxHeight>%d</scan:MaxHeight>\n",
+		esclUnits(emu.profile.MaxHeight))
+
+	buf.WriteString("      <scan:SettingProfiles>\n")
+	buf.WriteString("        <scan:SettingProfile>\n")
+
+	buf.WriteString("          <scan:ColorModes>\n")
+	for _, mode := range emu.profile.ColorModes {
+		fmt.Fprintf(&buf, "            <scan:ColorMode>%s</scan:ColorMode>\n", mode)
+	}
+	buf.WriteString("          </scan:ColorModes>\n")
+
+	buf.WriteString("          <scan:DocumentFormats>\n")
+	for _, format := range emu.profile.Formats {
+		fmt.Fprintf(&buf, "            <pwg:DocumentFormat>%s</pwg:DocumentFormat>\n", format)
+		fmt.Fprintf(&buf, "            <scan:DocumentFormatExt>%s</scan:DocumentFormatExt>\n", format)
+	}
+	buf.WriteString("          </scan:DocumentFormats>\n")
+
+	buf.WriteString("          <scan:SupportedResolutions>\n")
+	buf.WriteString("            <scan:DiscreteResolutions>\n")
+	for _, res := range emu.profile.Resolutions {
+		fmt.Fprintf(&buf, "              <scan:DiscreteResolution>\n"+
+			"                <scan:XResolution>%d</scan:XResolution>\n"+
+			"                <scan:YResolution>%d</scan:YResolution>\n"+
+			"              </scan:DiscreteResolution>\n", res, res)
+	}
+	buf.WriteString("            </scan:DiscreteResolutions>\n")
+	buf.WriteString("          </scan:SupportedResolutions>\n")
+
+	buf.WriteString("        </scan:SettingProfile>\n")
+	buf.WriteString("      </scan:SettingProfiles>\n")
+
+	return buf.String()
+}
+
+// status returns ScannerStatus response
+func (emu *esclEmulator) status() string {
+	emu.lock.Lock()
+	defer emu.lock.Unlock()
+
+	var buf bytes.Buffer
+	state := emu.profile.State
+
+	var jobs bytes.Buffer
+	for _, job := range emu.order {
+		if job.state == "Processing" {
+			state = "Processing"
+		}
+
+		fmt.Fprintf(&jobs, "    <scan:JobInfo>\n"+
+			"      <pwg:JobUri>/%s/ScanJobs/%s</pwg:JobUri>\n"+
+			"      <pwg:JobUuid>%s</pwg:JobUuid>\n"+
+			"      <scan:Age>%d</scan:Age>\n"+
+			"      <pwg:ImagesCompleted>%d</pwg:ImagesCompleted>\n"+
+			"      <pwg:ImagesToTransfer>%d</pwg:ImagesToTransfer>\n"+
+			"      <pwg:JobState>%s</pwg:JobState>\n"+
+			"    </scan:JobInfo>\n",
+			emu.profile.Root, job.id, job.id,
+			int(time.Since(job.created)/time.Second),
+			job.sent, job.pages-job.sent, job.state)
+	}
+
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	buf.WriteString(`<scan:ScannerStatus xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03" xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm">` + "\n")
+	fmt.Fprintf(&buf, "  <pwg:Version>%s</pwg:Version>\n", emu.profile.Version)
+	fmt.Fprintf(&buf, "  <pwg:State>%s</pwg:State>\n", state)
+	if emu.profile.AdfState != "" {
+		fmt.Fprintf(&buf, "  <scan:AdfState>%s</scan:AdfState>\n",
+			emu.profile.AdfState)
+	}
+	if jobs.Len() != 0 {
+		buf.WriteString("  <scan:Jobs>\n")
+		buf.Write(jobs.Bytes())
+		buf.WriteString("  </scan:Jobs>\n")
+	}
+	buf.WriteString("</scan:ScannerStatus>\n")
+
+	return buf.String()
+}
+
+// createJob handles POST ScanJobs request
+func (emu *esclEmulator) createJob(w http.ResponseWriter, r *http.Request) {
+	if emu.profile.JobStatus != 0 {
+		w.WriteHeader(emu.profile.JobStatus)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+
+	job, err := emu.parseSettings(body)
+	if err != nil {
+		LogDebug("eSCL: ScanJobs: %s", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	u, err := uuid.NewRandom()
+	LogCheck(err)
+
+	job.id = u.String()
+	job.created = time.Now()
+	job.state = "Processing"
+	job.busy = emu.profile.Busy
+
+	emu.lock.Lock()
+	emu.jobs[job.id] = job
+	emu.order = append(emu.order, job)
+	emu.lock.Unlock()
+
+	LogDebug("eSCL: job %s: %d page(s), %s, %s, %d dpi, %dx%d mm",
+		job.id, job.pages, job.format, job.mode, job.res,
+		job.width, job.height)
+
+	w.Header().Set("Location", fmt.Sprintf("http://%s/%s/ScanJobs/%s",
+		r.Host, emu.profile.Root, job.id))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// parseSettings parses and validates ScanSettings request
+func (emu *esclEmulator) parseSettings(body []byte) (*esclEmuJob, error) {
+	elements, err := XMLDecode(esclNsMap, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, fmt.Errorf("XML: %s", err)
+	}
+
+	if len(elements) == 0 || elements[0].Path != "/scan:ScanSettings" {
+		return nil, fmt.Errorf("not a ScanSettings request")
+	}
+
+	profile := emu.profile
+	job := &esclEmuJob{
+		format: profile.Formats[0],
+		width:  profile.MaxWidth,
+		height: profile.MaxHeight,
+	}
+
+	source, mode, duplex := "Platen", "", false
+	for _, elem := range elements {
+		switch elem.Path {
+		case "/scan:ScanSettings/pwg:InputSource",
+			"/scan:ScanSettings/scan:InputSource":
+			source = elem.Text
+		case "/scan:ScanSettings/scan:Duplex":
+			duplex = elem.Text == "true" || elem.Text == "1"
+		case "/scan:ScanSettings/scan:ColorMode":
+			mode = elem.Text
+		case "/scan:ScanSettings/pwg:DocumentFormat",
+			"/scan:ScanSettings/scan:DocumentFormatExt":
+			job.format = elem.Text
+		case "/scan:ScanSettings/scan:XResolution":
+			job.res, _ = strconv.Atoi(elem.Text)
+		case "/scan:ScanSettings/pwg:ScanRegions/pwg:ScanRegion/pwg:Width":
+			n, _ := strconv.Atoi(elem.Text)
+			job.width = n * 254 / 3000
+		case "/scan:ScanSettings/pwg:ScanRegions/pwg:ScanRegion/pwg:Height":
+			n, _ := strconv.Atoi(elem.Text)
+			job.height = n * 254 / 3000
+		}
+	}
+
+	switch {
+	case source == "Platen" && capsContains(profile.Sources, SourcePlaten):
+		job.pages = 1
+	case source == "Feeder" && duplex &&
+		capsContains(profile.Sources, SourceADFDuplex):
+		job.pages = profile.AdfPages * 2
+	case source == "Feeder" && !duplex &&
+		capsContains(profile.Sources, SourceADF):
+		job.pages = profile.AdfPages
+	default:
+		return nil, fmt.Errorf("%s: input source not supported", source)
+	}
+
+	if source == "Feeder" && profile.AdfState == "ScannerAdfEmpty" {
+		return nil, fmt.Errorf("ADF is empty")
+	}
+
+	if mode == "" {
+		mode = profile.ColorModes[0]
+	}
+	if !capsContains(profile.ColorModes, mode) {
+		return nil, fmt.Errorf("%s: color mode not supported", mode)
+	}
+	job.mode = esclEmuColorModes[mode]
+
+	if !capsContains(profile.Formats, job.format) {
+		return nil, fmt.Errorf("%s: format not supported", job.format)
+	}
+
+	res := false
+	for _, r := range profile.Resolutions {
+		res = res || r == job.res
+	}
+	if !res {
+		return nil, fmt.Errorf("%d: resolution not supported", job.res)
+	}
+
+	if job.width <= 0 || job.height <= 0 ||
+		job.width > profile.MaxWidth || job.height > profile.MaxHeight {
+		return nil, fmt.Errorf("%dx%d mm: invalid region",
+			job.width, job.height)
+	}
+
+	return job, nil
+}
+
+// nextDocument handles GET ScanJobs/{id}/NextDocument request
+func (emu *esclEmulator) nextDocument(w http.ResponseWriter, id string) {
+	emu.lock.Lock()
+	job := emu.jobs[id]
+	page := 0
+
+	switch {
+	case job == nil || job.state != "Processing":
+	case job.busy > 0:
+		job.busy--
+		page = -1
+	case job.sent == job.pages:
+		job.state = "Completed"
+	default:
+		job.sent++
+		page = job.sent
+	}
+
+	emu.lock.Unlock()
+
+	switch {
+	case page == 0:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case page < 0:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	data, err := EmuPage(job.format, job.mode, job.res,
+		job.width, job.height, page)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", job.format)
+	w.Write(data)
+}
+
+// deleteJob handles DELETE ScanJobs/{id} request
+func (emu *esclEmulator) deleteJob(w http.ResponseWriter, id string) {
+	emu.lock.Lock()
+	job := emu.jobs[id]
+	if job != nil && job.state == "Processing" {
+		job.state = "Canceled"
+	}
+	emu.lock.Unlock()
+
+	if job == nil {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
@@ -0,0 +1,182 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// eSCL scan client
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// esclScanSettingsTemplate represents the eSCL ScanSettings request.
+// Parameters are version, region (x, y, width, height, in 1/300 of
+// inch), input source, duplex, color mode, format (twice) and
+// resolution (twice)
+const esclScanSettingsTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<scan:ScanSettings xmlns:scan="http://schemas.hp.com/imaging/escl/2011/05/03" xmlns:pwg="http://www.pwg.org/schemas/2010/12/sm">
+  <pwg:Version>%s</pwg:Version>
+  <pwg:ScanRegions>
+    <pwg:ScanRegion>
+      <pwg:ContentRegionUnits>escl:ThreeHundredthsOfInches</pwg:ContentRegionUnits>
+      <pwg:XOffset>%d</pwg:XOffset>
+      <pwg:YOffset>%d</pwg:YOffset>
+      <pwg:Width>%d</pwg:Width>
+      <pwg:Height>%d</pwg:Height>
+    </pwg:ScanRegion>
+  </pwg:ScanRegions>
+  <pwg:InputSource>%s</pwg:InputSource>
+  <scan:Duplex>%t</scan:Duplex>
+  <scan:ColorMode>%s</scan:ColorMode>
+  <pwg:DocumentFormat>%s</pwg:DocumentFormat>
+  <scan:DocumentFormatExt>%s</scan:DocumentFormatExt>
+  <scan:XResolution>%d</scan:XResolution>
+  <scan:YResolution>%d</scan:YResolution>
+</scan:ScanSettings>
+`
+
+// esclColorModes maps color modes into eSCL ColorMode values
+var esclColorModes = map[string]string{
+	ScanColor: "RGB24",
+	ScanGray:  "Grayscale8",
+	ScanBW:    "BlackAndWhite1",
+}
+
+// esclBusyRetries is how many times NextDocument request is retried,
+// while scanner is busy (i.e., responds with 503 Service Unavailable)
+const esclBusyRetries = 30
+
+// EsclScan performs a scan. Each received document (page)
+// is passed to the page callback
+func EsclScan(base string, params ScanParams,
+	page func(data []byte) error) error {
+
+	// Fill missed parameters from capabilities
+	version := "2.0"
+	caps, err := EsclCapabilities(base)
+	if err != nil {
+		LogDebug("%s: capabilities: %s", base, err)
+	} else {
+		if caps.Version != "" {
+			version = caps.Version
+		}
+		params.SetDefaults(caps)
+	}
+	params.SetDefaults(nil)
+
+	// Create scan job
+	source := "Platen"
+	if params.Source != SourcePlaten {
+		source = "Feeder"
+	}
+
+	settings := fmt.Sprintf(esclScanSettingsTemplate, version,
+		esclUnits(params.X), esclUnits(params.Y),
+		esclUnits(params.Width), esclUnits(params.Height),
+		source, params.Source == SourceADFDuplex,
+		esclColorModes[params.ColorMode],
+		params.Format, params.Format,
+		params.Resolution, params.Resolution)
+
+	resp, err := httpPost(httpClient, esclURL(base, "ScanJobs"), "text/xml",
+		bytes.NewBufferString(settings))
+	if err != nil {
+		return fmt.Errorf("HTTP: %s", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("ScanJobs: HTTP: %s", resp.Status)
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return fmt.Errorf("ScanJobs: %s", err)
+	}
+
+	job := location.String()
+	LogDebug("%s: job created", job)
+
+	ScanOnInterrupt(func() { esclDeleteJob(job) })
+	defer ScanOnInterrupt(nil)
+
+	// Cancel the job on errors. Job is gone, when NextDocument
+	// returns 404
+	completed := false
+	defer func() {
+		if !completed {
+			esclDeleteJob(job)
+		}
+	}()
+
+	// Pull documents
+	for pages, retries := 0, 0; ; {
+		resp, err := httpGet(httpScanClient, esclURL(job, "NextDocument"))
+		if err != nil {
+			return fmt.Errorf("HTTP: %s", err)
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("HTTP: %s", err)
+		}
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			LogDebug("%s: page %d: %d bytes", job, pages+1, len(data))
+			err = page(data)
+			if err != nil {
+				return err
+			}
+			pages++
+			retries = 0
+
+		case http.StatusNotFound:
+			completed = true
+			if pages == 0 {
+				return fmt.Errorf("NextDocument: no pages scanned")
+			}
+			return nil
+
+		case http.StatusServiceUnavailable:
+			retries++
+			if retries > esclBusyRetries {
+				return fmt.Errorf("NextDocument: scanner busy")
+			}
+			time.Sleep(time.Second)
+
+		default:
+			return fmt.Errorf("NextDocument: HTTP: %s", resp.Status)
+		}
+	}
+}
+
+// esclDeleteJob cancels the scan job. Errors are only logged,
+// as there is nothing else to do with them
+func esclDeleteJob(job string) {
+	u, err := url.Parse(job)
+	LogCheck(err)
+
+	rq := &http.Request{Method: "DELETE", URL: u, Header: make(http.Header)}
+	resp, err := httpClient.Do(rq)
+	if err != nil {
+		LogDebug("%s: cancel: %s", job, err)
+		return
+	}
+
+	resp.Body.Close()
+	LogDebug("%s: cancel: %s", job, resp.Status)
+}
+
+// esclUnits converts millimeters into 1/300 of inch
+func esclUnits(mm int) int {
+	return mm * 3000 / 254
+}
@@ -0,0 +1,563 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The "events" command: scan-button events via WS-Eventing
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// eventsUsage is the usage template of the events command
+const eventsUsage = `Usage:
+    %s events [options]
+
+Subscribe to scan-button events of discovered WSD scanners. When
+user chooses this computer on the scanner panel, an event is printed
+or the command is executed.
+
+Options are:
+    -c command     command to run on event, via /bin/sh -c
+    -n name        name, displayed on scanner panel (default: hostname)
+    -l port        port of the local event sink (default: any)
+    -e interval    requested subscription time (default: 1h)
+    -o format      output format: text (default) or ndjson
+` + usageCommonOptions + `
+The command gets event parameters via environment variables:
+    AIRSCAN_DEVICE_NAME        device name
+    AIRSCAN_DEVICE_URL         device (scanner service) URL
+    AIRSCAN_CLIENT_CONTEXT     client context
+    AIRSCAN_SCAN_IDENTIFIER    scan identifier
+    AIRSCAN_DESTINATION_TOKEN  destination token
+`
+
+// eventsSubscribeTemplate represents the WS-Eventing Subscribe request.
+// Parameters are message ID, destination, sink address, sink
+// identifier, expiration time and display name
+const eventsSubscribeTemplate = `<?xml version="1.0" ?>
+<s:Envelope xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:wse="http://schemas.xmlsoap.org/ws/2004/08/eventing" xmlns:wscn="http://schemas.microsoft.com/windows/2006/08/wdp/scan">
+	<s:Header>
+		<a:Action>http://schemas.xmlsoap.org/ws/2004/08/eventing/Subscribe</a:Action>
+		<a:MessageID>urn:uuid:%s</a:MessageID>
+		<a:To>%s</a:To>
+		<a:ReplyTo>
+			<a:Address>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address>
+		</a:ReplyTo>
+	</s:Header>
+	<s:Body>
+		<wse:Subscribe>
+			<wse:Delivery Mode="http://schemas.xmlsoap.org/ws/2004/08/eventing/DeliveryModes/Push">
+				<wse:NotifyTo>
+					<a:Address>%s</a:Address>
+					<a:ReferenceParameters>
+						<wse:Identifier>urn:uuid:%s</wse:Identifier>
+					</a:ReferenceParameters>
+				</wse:NotifyTo>
+			</wse:Delivery>
+			<wse:Expires>%s</wse:Expires>
+			<wse:Filter Dialect="http://schemas.xmlsoap.org/ws/2006/02/devprof/Action">http://schemas.microsoft.com/windows/2006/08/wdp/scan/ScanAvailableEvent</wse:Filter>
+			<wscn:ScanDestinations>
+				<wscn:ScanDestination>
+					<wscn:ClientDisplayName>%s</wscn:ClientDisplayName>
+					<wscn:ClientContext>Scan</wscn:ClientContext>
+				</wscn:ScanDestination>
+			</wscn:ScanDestinations>
+		</wse:Subscribe>
+	</s:Body>
+</s:Envelope>
+`
+
+// eventsManagerTemplate represents the WS-Eventing request to the
+// subscription manager (Renew or Unsubscribe). Parameters are
+// action, message ID, destination, subscription identifier and body
+const eventsManagerTemplate = `<?xml version="1.0" ?>
+<s:Envelope xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:wse="http://schemas.xmlsoap.org/ws/2004/08/eventing">
+	<s:Header>
+		<a:Action>http://schemas.xmlsoap.org/ws/2004/08/eventing/%s</a:Action>
+		<a:MessageID>urn:uuid:%s</a:MessageID>
+		<a:To>%s</a:To>
+		<a:ReplyTo>
+			<a:Address>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address>
+		</a:ReplyTo>
+		<wse:Identifier>%s</wse:Identifier>
+	</s:Header>
+	<s:Body>
+%s	</s:Body>
+</s:Envelope>
+`
+
+// eventsRetryMin and eventsRetryMax limit the retry interval of
+// the failed subscription
+const (
+	eventsRetryMin = 5 * time.Second
+	eventsRetryMax = 5 * time.Minute
+)
+
+// eventsRenewMin is the minimum delay before subscription renewal
+const eventsRenewMin = time.Second
+
+// eventsSubscription represents subscription to the single device
+type eventsSubscription struct {
+	endpoint   Endpoint          // Device endpoint
+	path       string            // Path of the event sink
+	identifier string            // Our identifier (uuid)
+	manager    string            // Subscription manager address
+	managerID  string            // Subscription identifier
+	expires    time.Duration     // Subscription time
+	tokens     map[string]string // Client context -> destination token
+	lock       sync.Mutex        // Access lock
+	ended      chan struct{}     // Signaled on SubscriptionEnd
+}
+
+// scanEvent is the scan-button event
+type scanEvent struct {
+	Event            string    `json:"event"`
+	Time             time.Time `json:"time"`
+	Name             string    `json:"name"`
+	URL              string    `json:"url"`
+	ClientContext    string    `json:"client_context"`
+	ScanIdentifier   string    `json:"scan_identifier"`
+	DestinationToken string    `json:"destination_token"`
+}
+
+// eventsConfig contains the events command parameters
+type eventsConfig struct {
+	command string        // Command to run
+	name    string        // Display name
+	port    int           // Sink port
+	expires time.Duration // Requested subscription time
+	format  string        // Output format
+	sink    int           // Actual sink port
+}
+
+// eventsDuration matches the xs:duration value, as used by WS-Eventing
+var eventsDuration = regexp.MustCompile(
+	`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// eventsParseExpires parses WS-Eventing expiration time, which
+// is either xs:duration or xs:dateTime
+func eventsParseExpires(s string) (time.Duration, error) {
+	if m := eventsDuration.FindStringSubmatch(s); m != nil {
+		var d time.Duration
+		units := []time.Duration{24 * time.Hour, time.Hour, time.Minute}
+		for i, unit := range units {
+			n, _ := strconv.Atoi(m[i+1])
+			d += time.Duration(n) * unit
+		}
+		sec, _ := strconv.ParseFloat(m[4], 64)
+		d += time.Duration(sec * float64(time.Second))
+		if d <= 0 {
+			return 0, fmt.Errorf("invalid expiration time %q", s)
+		}
+		return d, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid expiration time %q", s)
+	}
+
+	d := time.Until(t)
+	if d <= 0 {
+		return 0, fmt.Errorf("expiration time %q already passed", s)
+	}
+
+	return d, nil
+}
+
+// eventsFormatDuration formats duration as xs:duration
+func eventsFormatDuration(d time.Duration) string {
+	return fmt.Sprintf("PT%dS", int(d/time.Second))
+}
+
+// eventsLocalURL returns URL of the local event sink, as seen by
+// the device. The local address is chosen by the routing table
+func eventsLocalURL(device string, port int, path string) (string, error) {
+	u, err := url.Parse(device)
+	if err != nil {
+		return "", err
+	}
+
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), "80"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	ip := conn.LocalAddr().(*net.UDPAddr).IP
+	host := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+
+	return "http://" + host + path, nil
+}
+
+// eventsPost sends the WS-Eventing request and checks response
+func eventsPost(to, action, msg string) ([]*XMLElement, error) {
+	elements, err := wsddRequest(to, []byte(msg))
+	if err == nil {
+		err = wsdCheckResponse(elements, action)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", action, err)
+	}
+
+	return elements, nil
+}
+
+// subscribe subscribes to the device events
+func (sub *eventsSubscription) subscribe(config *eventsConfig) error {
+	sink, err := eventsLocalURL(sub.endpoint.URL, config.sink, sub.path)
+	if err != nil {
+		return err
+	}
+
+	u, err := uuid.NewRandom()
+	LogCheck(err)
+
+	msg := fmt.Sprintf(eventsSubscribeTemplate, u, sub.endpoint.URL,
+		sink, sub.identifier, eventsFormatDuration(config.expires),
+		wsdEscape(config.name))
+
+	elements, err := eventsPost(sub.endpoint.URL, "Subscribe", msg)
+	if err != nil {
+		return err
+	}
+
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	sub.manager, sub.managerID = "", ""
+	sub.expires = config.expires
+	sub.tokens = make(map[string]string)
+
+	context := ""
+	for _, elem := range elements {
+		path := elem.Path
+		switch {
+		case strings.HasSuffix(path, "/wse:SubscriptionManager/a:Address"):
+			sub.manager = elem.Text
+		case strings.HasSuffix(path, "/wse:SubscriptionManager/a:ReferenceParameters/wse:Identifier"):
+			sub.managerID = elem.Text
+		case strings.HasSuffix(path, "/wse:SubscribeResponse/wse:Expires"):
+			sub.expires, err = eventsParseExpires(elem.Text)
+			if err != nil {
+				return err
+			}
+		case strings.HasSuffix(path, "/wscn:DestinationResponse/wscn:ClientContext"):
+			context = elem.Text
+		case strings.HasSuffix(path, "/wscn:DestinationResponse/wscn:DestinationToken"):
+			sub.tokens[context] = elem.Text
+		}
+	}
+
+	if sub.manager == "" {
+		sub.manager = sub.endpoint.URL
+	}
+
+	LogDebug("%s: subscribed for %s, sink %s", sub.endpoint.URL,
+		sub.expires, sink)
+
+	return nil
+}
+
+// renew renews the subscription
+func (sub *eventsSubscription) renew(config *eventsConfig) error {
+	body := fmt.Sprintf("\t\t<wse:Renew>\n"+
+		"\t\t\t<wse:Expires>%s</wse:Expires>\n"+
+		"\t\t</wse:Renew>\n", eventsFormatDuration(config.expires))
+
+	elements, err := sub.request("Renew", body)
+	if err != nil {
+		return err
+	}
+
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+
+	sub.expires = config.expires
+	for _, elem := range elements {
+		if strings.HasSuffix(elem.Path, "/wse:RenewResponse/wse:Expires") {
+			sub.expires, err = eventsParseExpires(elem.Text)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	LogDebug("%s: renewed for %s", sub.endpoint.URL, sub.expires)
+	return nil
+}
+
+// unsubscribe cancels the subscription
+func (sub *eventsSubscription) unsubscribe() {
+	_, err := sub.request("Unsubscribe", "\t\t<wse:Unsubscribe/>\n")
+	if err != nil {
+		LogDebug("%s: %s", sub.endpoint.URL, err)
+	}
+}
+
+// request sends request to the subscription manager
+func (sub *eventsSubscription) request(action, body string) (
+	[]*XMLElement, error) {
+
+	sub.lock.Lock()
+	manager, managerID := sub.manager, sub.managerID
+	sub.lock.Unlock()
+
+	if manager == "" {
+		return nil, fmt.Errorf("%s: not subscribed", action)
+	}
+
+	u, err := uuid.NewRandom()
+	LogCheck(err)
+
+	msg := fmt.Sprintf(eventsManagerTemplate, action, u, manager,
+		wsdEscape(managerID), body)
+
+	return eventsPost(manager, action, msg)
+}
+
+// run maintains the subscription: subscribes, renews subscription
+// before it expires and resubscribes on errors. It never returns
+func (sub *eventsSubscription) run(config *eventsConfig) {
+	retry := eventsRetryMin
+
+	for {
+		err := sub.subscribe(config)
+		if err != nil {
+			LogError("%s: %s", sub.endpoint.URL, err)
+			time.Sleep(retry)
+			retry *= 2
+			if retry > eventsRetryMax {
+				retry = eventsRetryMax
+			}
+			continue
+		}
+
+		retry = eventsRetryMin
+
+		// Renew at the half of subscription time
+		for err == nil {
+			sub.lock.Lock()
+			delay := sub.expires / 2
+			sub.lock.Unlock()
+
+			if delay < eventsRenewMin {
+				delay = eventsRenewMin
+			}
+
+			select {
+			case <-time.After(delay):
+				err = sub.renew(config)
+			case <-sub.ended:
+				err = fmt.Errorf("subscription ended by device")
+			}
+		}
+
+		LogError("%s: %s", sub.endpoint.URL, err)
+	}
+}
+
+// eventsSink returns HTTP handler of the local event sink
+func eventsSink(subs map[string]*eventsSubscription,
+	config *eventsConfig) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub := subs[r.URL.Path]
+		if sub == nil || r.Method != "POST" {
+			http.NotFound(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return
+		}
+
+		elements, err := XMLDecode(wsddNsMap, bytes.NewBuffer(body))
+		if err != nil {
+			LogDebug("%s: event: XML: %s", sub.endpoint.URL, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+
+		action := ""
+		event := scanEvent{
+			Event: "scan",
+			Time:  time.Now(),
+			Name:  sub.endpoint.Name,
+			URL:   sub.endpoint.URL,
+		}
+
+		for _, elem := range elements {
+			switch {
+			case elem.Path == "/s:Envelope/s:Header/a:Action":
+				action = elem.Text
+			case strings.HasSuffix(elem.Path, "/wscn:ScanAvailableEvent/wscn:ClientContext"):
+				event.ClientContext = elem.Text
+			case strings.HasSuffix(elem.Path, "/wscn:ScanAvailableEvent/wscn:ScanIdentifier"):
+				event.ScanIdentifier = elem.Text
+			}
+		}
+
+		switch {
+		case strings.HasSuffix(action, "/ScanAvailableEvent"):
+			sub.lock.Lock()
+			event.DestinationToken = sub.tokens[event.ClientContext]
+			sub.lock.Unlock()
+
+			eventsDispatch(event, config)
+
+		case strings.HasSuffix(action, "/SubscriptionEnd"):
+			select {
+			case sub.ended <- struct{}{}:
+			default:
+			}
+
+		default:
+			LogDebug("%s: event %q ignored", sub.endpoint.URL, action)
+		}
+	})
+}
+
+// eventsDispatch prints the event or runs the command
+func eventsDispatch(event scanEvent, config *eventsConfig) {
+	switch {
+	case config.command != "":
+		cmd := exec.Command("/bin/sh", "-c", config.command)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(),
+			"AIRSCAN_DEVICE_NAME="+event.Name,
+			"AIRSCAN_DEVICE_URL="+event.URL,
+			"AIRSCAN_CLIENT_CONTEXT="+event.ClientContext,
+			"AIRSCAN_SCAN_IDENTIFIER="+event.ScanIdentifier,
+			"AIRSCAN_DESTINATION_TOKEN="+event.DestinationToken,
+		)
+
+		go func() {
+			err := cmd.Run()
+			if err != nil {
+				LogError("%s: %s", config.command, err)
+			}
+		}()
+
+	case config.format == FormatNDJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.Encode(event)
+
+	default:
+		fmt.Printf("%s %s %s: scan (context %s, id %s, token %s)\n",
+			event.Time.Format("15:04:05"), IniQuote(event.Name),
+			event.URL, event.ClientContext, event.ScanIdentifier,
+			event.DestinationToken)
+	}
+}
+
+// cmdEvents implements the "events" command
+func cmdEvents(args []string) {
+	config := &eventsConfig{
+		expires: time.Hour,
+		format:  "text",
+	}
+
+	// Parse options
+	opts := NewOptions(args, eventsUsage)
+	for opts.Next() {
+		switch opts.Opt {
+		case "-c":
+			config.command = opts.Value()
+		case "-n":
+			config.name = opts.Value()
+		case "-l":
+			config.port = opts.IntValue()
+		case "-e":
+			config.expires = statusDuration(opts)
+		case "-o":
+			config.format = opts.Value()
+			if config.format != "text" && config.format != FormatNDJSON {
+				opts.Fail("Invalid output format %q", config.format)
+			}
+		default:
+			opts.Common()
+		}
+	}
+
+	if len(opts.Args()) != 0 {
+		opts.Invalid(opts.Args()[0])
+	}
+
+	if config.name == "" {
+		var err error
+		config.name, err = os.Hostname()
+		LogCheck(err)
+	}
+
+	// Start event sink
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.port))
+	LogCheck(err)
+	config.sink = listener.Addr().(*net.TCPAddr).Port
+
+	subs := make(map[string]*eventsSubscription)
+
+	// Discover devices and subscribe
+	for _, endpoint := range Discover(DiscoveryTime, nil) {
+		if endpoint.Proto != "wsd" {
+			continue
+		}
+
+		u, err := uuid.NewRandom()
+		LogCheck(err)
+
+		sub := &eventsSubscription{
+			endpoint:   endpoint,
+			path:       fmt.Sprintf("/events/%d", len(subs)+1),
+			identifier: u.String(),
+			ended:      make(chan struct{}, 1),
+		}
+		subs[sub.path] = sub
+	}
+
+	if len(subs) == 0 {
+		LogFatal("No WSD devices found")
+	}
+
+	go func() {
+		LogCheck(http.Serve(listener, TraceHandler(eventsSink(subs, config))))
+	}()
+
+	OnInterrupt(func() {
+		for _, sub := range subs {
+			sub.unsubscribe()
+		}
+	})
+
+	for _, sub := range subs {
+		LogDebug("Subscribing to %s (%s)", IniQuote(sub.endpoint.Name),
+			sub.endpoint.URL)
+		go sub.run(config)
+	}
+
+	select {}
+}
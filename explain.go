@@ -0,0 +1,63 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The "explain" command: why devices were or weren't discovered
+
+package main
+
+import (
+	"os"
+)
+
+// explainUsage is the usage template of the explain command
+const explainUsage = `Usage:
+    %s explain [options]
+
+Perform a discovery and explain its outcome: every responder, seen
+on each interface, is listed with the reason, why it was accepted
+or not. Outcomes are:
+    accepted               device discovered
+    not a scanner          device types don't include a scanner
+    no XAddrs              device didn't report its transport address
+    metadata fetch failed  HTTP or SOAP error of the metadata request
+    no model               metadata doesn't include the model name
+    duplicate              device already seen from another responder
+    resolve failed         DNS-SD service can't be resolved
+    ignored                message is malformed or unexpected
+
+The report ends with counters of outcomes per backend (WS-Discovery
+and DNS-SD).
+
+Options are:
+    -r trace       explain the protocol trace or pcap/pcapng capture
+                   instead of network discovery
+` + usageCommonOptions
+
+// cmdExplain handles the explain command
+func cmdExplain(args []string) {
+	replay := ""
+
+	// Parse options
+	opts := NewOptions(args, explainUsage)
+	for opts.Next() {
+		switch opts.Opt {
+		case "-r":
+			replay = opts.Value()
+		default:
+			opts.Common()
+		}
+	}
+
+	if len(opts.Args()) != 0 {
+		opts.Invalid(opts.Args()[0])
+	}
+
+	if replay != "" {
+		replayStart(replay)
+	}
+
+	Discover(DiscoveryTime, nil)
+	discoveryReport.Write(os.Stdout)
+}
@@ -0,0 +1,195 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The "fake-avahi" command: fake Avahi daemon for testing
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// fakeAvahiUsage is the usage template of the fake-avahi command
+const fakeAvahiUsage = `Usage:
+    %s fake-avahi [options] [services]
+
+Run the fake Avahi daemon for testing of DNS-SD discovery without
+the real avahi-daemon. The daemon connects to the system bus, taken
+from the DBUS_SYSTEM_BUS_ADDRESS environment variable, so it must
+be run on a private bus:
+
+    $ dbus-daemon --session --fork --print-address
+    unix:path=/tmp/dbus-XXXXXXXXXX,guid=...
+    $ export DBUS_SYSTEM_BUS_ADDRESS=unix:path=/tmp/dbus-XXXXXXXXXX
+    $ %s fake-avahi services.conf &
+    $ %s -d
+
+Services are loaded from the file, one section per service,
+named by the service instance name:
+
+    [Kyocera ECOSYS M2040dn]
+      type      = _uscan._tcp         ; default is _uscan._tcp
+      interface = 2                   ; interface index
+      address   = fe80::217:c8ff:fe7b:6a91
+      port      = 9095
+      txt       = rs=eSCL             ; TXT record, may be repeated
+      txt       = ty=Kyocera ECOSYS M2040dn
+      resolve   = yes                 ; "no" makes resolving to fail
+      remove    = 5s                  ; remove the service after delay
+
+Services, registered by clients (i.e., by the emulate command with
+register = yes) are announced too, with the loopback address.
+
+Options are:
+` + usageCommonOptions
+
+// fakeAvahiEntry represents the service of the services file
+type fakeAvahiEntry struct {
+	service *FakeAvahiService
+	remove  time.Duration
+}
+
+// fakeAvahiLoad loads the services file
+func fakeAvahiLoad(file string) ([]*fakeAvahiEntry, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	ini, err := IniRead(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*fakeAvahiEntry
+	var entry *fakeAvahiEntry
+
+	for _, line := range ini.Lines {
+		switch line.Kind {
+		case IniSection:
+			entry = &fakeAvahiEntry{
+				service: &FakeAvahiService{
+					Name: line.Section,
+					Type: "_uscan._tcp",
+				},
+			}
+			entries = append(entries, entry)
+
+		case IniVariable:
+			if entry == nil {
+				err = fmt.Errorf("%s: parameter outside of section",
+					line.Key)
+			} else {
+				err = entry.set(line.Key, line.Value)
+			}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", file, line.LineNo, err)
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.service.Address == "" {
+			return nil, fmt.Errorf("%s: [%s]: missed address",
+				file, entry.service.Name)
+		}
+	}
+
+	return entries, nil
+}
+
+// set sets the service parameter
+func (entry *fakeAvahiEntry) set(key, value string) error {
+	var err error
+	service := entry.service
+
+	switch key {
+	case "type":
+		service.Type = value
+	case "interface":
+		var n int
+		n, err = emuInt(value)
+		service.Interface = int32(n)
+	case "host":
+		service.Host = value
+	case "address":
+		if net.ParseIP(value) == nil {
+			err = fmt.Errorf("%q: invalid IP address", value)
+		}
+		service.Address = value
+	case "port":
+		var n uint64
+		n, err = strconv.ParseUint(value, 10, 16)
+		service.Port = uint16(n)
+	case "txt":
+		service.Txt = append(service.Txt, []byte(value))
+	case "resolve":
+		var ok bool
+		ok, err = emuBool(value)
+		service.Fail = !ok
+	case "remove":
+		entry.remove, err = time.ParseDuration(value)
+	default:
+		return fmt.Errorf("%s: unknown parameter", key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %s", key, err)
+	}
+
+	return nil
+}
+
+// cmdFakeAvahi implements the "fake-avahi" command
+func cmdFakeAvahi(args []string) {
+	// Parse options
+	opts := NewOptions(args, fakeAvahiUsage)
+	for opts.Next() {
+		opts.Common()
+	}
+
+	args = opts.Args()
+	if len(args) > 1 {
+		opts.Invalid(args[1])
+	}
+
+	var entries []*fakeAvahiEntry
+	var err error
+
+	if len(args) != 0 {
+		entries, err = fakeAvahiLoad(args[0])
+		LogCheck(err)
+	}
+
+	// Start the daemon
+	conn, err := dbus.SystemBus()
+	LogCheck(err)
+
+	fa, err := FakeAvahiStart(conn)
+	LogCheck(err)
+
+	for _, entry := range entries {
+		fa.Add(entry.service)
+		LogDebug("%q: added", entry.service.Name)
+
+		if entry.remove != 0 {
+			entry := entry
+			time.AfterFunc(entry.remove, func() {
+				fa.Remove(entry.service)
+				LogDebug("%q: removed", entry.service.Name)
+			})
+		}
+	}
+
+	select {}
+}
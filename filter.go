@@ -0,0 +1,187 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Endpoint filters
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// filterHelp describes the filter syntax, for usage pages
+const filterHelp = `Filter is a comma-separated list of conditions, all of them
+must be true for device to be selected:
+    proto=escl|wsd       protocol
+    name=pattern         device name, glob-style pattern
+    model=pattern        device model, glob-style pattern
+    platen, adf, duplex  device has the input source
+    res=N, res>=N        supports N dpi, max resolution is at least N dpi
+    color=mode           supports the color mode (substring, e.g. rgb)
+    format=type          supports the format (substring, e.g. pdf)
+    width>=N, height>=N  max scan area is at least N mm
+Conditions other than proto, name and model imply capabilities probing
+`
+
+// Filter selects endpoints. It is a list of conditions, all of them
+// must be true for endpoint to be selected
+type Filter []filterTerm
+
+// filterTerm is a single condition of the Filter
+type filterTerm struct {
+	key, op, value string
+	num            int
+}
+
+// ParseFilter parses the filter expression
+func ParseFilter(expr string) (Filter, error) {
+	var filter Filter
+
+	for _, s := range strings.Split(expr, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		var term filterTerm
+		for _, op := range []string{">=", "="} {
+			if i := strings.Index(s, op); i >= 0 {
+				term = filterTerm{
+					key:   strings.ToLower(strings.TrimSpace(s[:i])),
+					op:    op,
+					value: strings.TrimSpace(s[i+len(op):]),
+				}
+				break
+			}
+		}
+
+		switch {
+		case term.op == "":
+			term = filterTerm{key: "source", op: "=", value: s}
+			if s == "duplex" {
+				term.value = SourceADFDuplex
+			}
+			fallthrough
+
+		case term.key == "source":
+			switch term.value {
+			case SourcePlaten, SourceADF, SourceADFDuplex:
+			default:
+				return nil, fmt.Errorf("%q: unknown input source", s)
+			}
+
+		case term.op == "=" && (term.key == "proto" || term.key == "name" ||
+			term.key == "model" || term.key == "color" || term.key == "format"):
+
+		case term.key == "res" || term.key == "width" || term.key == "height":
+			n, err := strconv.Atoi(term.value)
+			if err != nil || n <= 0 ||
+				(term.key != "res" && term.op != ">=") {
+				return nil, fmt.Errorf("%q: invalid condition", s)
+			}
+			term.num = n
+
+		default:
+			return nil, fmt.Errorf("%q: invalid condition", s)
+		}
+
+		filter = append(filter, term)
+	}
+
+	return filter, nil
+}
+
+// NeedCaps reports whether filter needs scanner capabilities
+func (filter Filter) NeedCaps() bool {
+	for _, term := range filter {
+		switch term.key {
+		case "proto", "name", "model":
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// Match reports whether endpoint matches the filter
+func (filter Filter) Match(endpoint Endpoint) bool {
+	for _, term := range filter {
+		if !term.match(endpoint) {
+			return false
+		}
+	}
+	return true
+}
+
+// Apply returns endpoints that match the filter
+func (filter Filter) Apply(endpoints []Endpoint) []Endpoint {
+	if len(filter) == 0 {
+		return endpoints
+	}
+
+	var selected []Endpoint
+	for _, endpoint := range endpoints {
+		if filter.Match(endpoint) {
+			selected = append(selected, endpoint)
+		}
+	}
+
+	return selected
+}
+
+// match reports whether endpoint matches the condition
+func (term filterTerm) match(endpoint Endpoint) bool {
+	switch term.key {
+	case "proto":
+		return strings.EqualFold(term.value, endpoint.Proto)
+	case "name":
+		return globCompile(term.value).MatchString(endpoint.Name)
+	case "model":
+		model := endpoint.Model
+		if model == "" {
+			model = endpoint.Name
+		}
+		return globCompile(term.value).MatchString(model)
+	}
+
+	caps := endpoint.Caps
+	if caps == nil {
+		return false
+	}
+
+	switch term.key {
+	case "source":
+		return caps.HasSource(term.value)
+	case "res":
+		if term.op == ">=" {
+			return caps.MaxResolution() >= term.num
+		}
+		return caps.HasResolution(term.num)
+	case "color":
+		return filterSubstr(caps.ColorModes, term.value)
+	case "format":
+		return filterSubstr(caps.Formats, term.value)
+	case "width":
+		return caps.MaxWidth >= term.num
+	case "height":
+		return caps.MaxHeight >= term.num
+	}
+
+	return false
+}
+
+// filterSubstr reports whether any string of the list contains
+// the substring, ignoring case
+func filterSubstr(list []string, substr string) bool {
+	substr = strings.ToLower(substr)
+	for _, s := range list {
+		if strings.Contains(strings.ToLower(s), substr) {
+			return true
+		}
+	}
+	return false
+}
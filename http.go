@@ -0,0 +1,169 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// HTTP client
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"time"
+)
+
+// HTTPTimeout is the timeout of HTTP requests
+const HTTPTimeout = 5 * time.Second
+
+// httpClient is the HTTP client, used for all requests
+var httpClient HTTPClient = &traceHTTPClient{
+	&http.Client{Timeout: HTTPTimeout}}
+
+// HTTPScanTimeout is the timeout of HTTP requests that wait for
+// the scanned image, which may take a long time
+const HTTPScanTimeout = 2 * time.Minute
+
+// httpScanClient is the HTTP client, used for scan requests
+var httpScanClient HTTPClient = &traceHTTPClient{
+	&http.Client{Timeout: HTTPScanTimeout}}
+
+// traceHTTPClient wraps HTTPClient and writes requests and
+// responses into the protocol trace
+type traceHTTPClient struct {
+	HTTPClient
+}
+
+// Do performs HTTP request
+func (client *traceHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	if !Trace {
+		return client.HTTPClient.Do(req)
+	}
+
+	// Load request body, so it can be traced
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	// Perform request, tracking connection addresses
+	var local, remote net.Addr
+	ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			local = info.Conn.LocalAddr()
+			remote = info.Conn.RemoteAddr()
+		},
+	})
+
+	meta := TraceMeta{
+		Time:      time.Now(),
+		Direction: "out",
+		Method:    req.Method,
+		URL:       req.URL.String(),
+		Header:    req.Header,
+		ID:        traceNewID("http"),
+	}
+
+	resp, err := client.HTTPClient.Do(req.WithContext(ctx))
+
+	var data []byte
+	if err == nil {
+		data, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}
+
+	// Write the trace
+	if local != nil {
+		meta.Local = local.String()
+		meta.Remote = remote.String()
+	}
+
+	LogTraceMeta("http-request", body, meta)
+
+	meta.Time = time.Now()
+	meta.Direction = "in"
+	meta.Header = nil
+
+	if err != nil {
+		LogTraceMeta("http-error", []byte(err.Error()), meta)
+		return nil, err
+	}
+
+	meta.Status = resp.StatusCode
+	meta.Header = resp.Header
+	LogTraceMeta("http-response", data, meta)
+
+	return resp, nil
+}
+
+// TraceHandler wraps http.Handler and writes served requests and
+// responses into the protocol trace
+func TraceHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !Trace {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		meta := TraceMeta{
+			Direction: "in",
+			Remote:    r.RemoteAddr,
+			Method:    r.Method,
+			URL:       r.URL.String(),
+			Header:    r.Header,
+			ID:        traceNewID("http"),
+		}
+
+		if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			meta.Local = local.String()
+		}
+
+		LogTraceMeta("http-request", body, meta)
+
+		tw := &traceResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(tw, r)
+
+		meta.Time = time.Time{}
+		meta.Direction = "out"
+		meta.Status = tw.status
+		meta.Header = w.Header()
+		LogTraceMeta("http-response", tw.body.Bytes(), meta)
+	})
+}
+
+// traceResponseWriter is the http.ResponseWriter, that saves
+// response status and body for the trace
+type traceResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader sends HTTP response header
+func (tw *traceResponseWriter) WriteHeader(status int) {
+	tw.status = status
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes response body
+func (tw *traceResponseWriter) Write(data []byte) (int, error) {
+	tw.body.Write(data)
+	return tw.ResponseWriter.Write(data)
+}
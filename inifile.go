@@ -0,0 +1,338 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// airscan.conf (.INI-style) file parser and writer
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// IniLineKind is the kind of IniLine
+type IniLineKind int
+
+// IniLineKind values
+const (
+	IniOther    IniLineKind = iota // Blank line, comment or garbage
+	IniSection                     // [section]
+	IniVariable                    // key = value
+)
+
+// IniLine represents a single line of the .INI file
+type IniLine struct {
+	Kind    IniLineKind // Line kind
+	Text    string      // Line text, without trailing newline
+	Section string      // Section the line belongs to
+	Key     string      // Variable name, unquoted
+	Value   string      // Variable value, unquoted
+	LineNo  int         // Line number, 0 for added lines
+}
+
+// IniFile represents a parsed .INI file
+//
+// The file is kept line by line, so comments, ordering and
+// formatting of untouched lines are preserved when file
+// is written back
+type IniFile struct {
+	Lines []*IniLine
+}
+
+// IniRead parses the .INI file
+func IniRead(in io.Reader) (*IniFile, error) {
+	ini := &IniFile{}
+	section := ""
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := iniParseLine(scanner.Text())
+		if line.Kind == IniSection {
+			section = line.Section
+		} else {
+			line.Section = section
+		}
+
+		line.LineNo = len(ini.Lines) + 1
+		ini.Lines = append(ini.Lines, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ini, nil
+}
+
+// Bytes returns the .INI file content
+func (ini *IniFile) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, line := range ini.Lines {
+		buf.WriteString(line.Text)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// Text returns the .INI file content as slice of lines
+func (ini *IniFile) Text() []string {
+	lines := make([]string, len(ini.Lines))
+	for i, line := range ini.Lines {
+		lines[i] = line.Text
+	}
+	return lines
+}
+
+// Variables returns all variables of the section
+func (ini *IniFile) Variables(section string) []*IniLine {
+	var vars []*IniLine
+	for _, line := range ini.Lines {
+		if line.Kind == IniVariable && line.Section == section {
+			vars = append(vars, line)
+		}
+	}
+	return vars
+}
+
+// Set modifies value of the existing variable
+func (ini *IniFile) Set(line *IniLine, value string) {
+	indent := line.Text[:len(line.Text)-len(strings.TrimLeft(line.Text, " \t"))]
+	line.Value = value
+	line.Text = indent + IniFormat(line.Section, line.Key, value)
+}
+
+// Add adds a new variable to the section. The section is created,
+// if it doesn't exist yet
+//
+// The new variable is inserted after the last existing variable
+// with the same key, if any, or after the last variable of the
+// section, or right after the section header
+func (ini *IniFile) Add(section, key, value string) *IniLine {
+	line := &IniLine{
+		Kind:    IniVariable,
+		Text:    "  " + IniFormat(section, key, value),
+		Section: section,
+		Key:     key,
+		Value:   value,
+	}
+
+	// Find the insertion point
+	pos, lastKey := -1, -1
+	for i, l := range ini.Lines {
+		if l.Section != section {
+			continue
+		}
+
+		if l.Kind == IniVariable && l.Key == key {
+			lastKey = i
+		}
+
+		if l.Kind != IniOther {
+			pos = i
+		}
+	}
+
+	if lastKey >= 0 {
+		pos = lastKey
+	}
+
+	// Create section if missing
+	if pos < 0 {
+		if n := len(ini.Lines); n > 0 && strings.TrimSpace(ini.Lines[n-1].Text) != "" {
+			ini.Lines = append(ini.Lines, &IniLine{Kind: IniOther})
+		}
+
+		ini.Lines = append(ini.Lines, &IniLine{
+			Kind:    IniSection,
+			Text:    "[" + section + "]",
+			Section: section,
+		})
+
+		pos = len(ini.Lines) - 1
+	}
+
+	// Insert the line
+	ini.Lines = append(ini.Lines, nil)
+	copy(ini.Lines[pos+2:], ini.Lines[pos+1:])
+	ini.Lines[pos+1] = line
+
+	return line
+}
+
+// IniFormat formats the key = value line of the section
+//
+// Keys of the [devices] section are device names, and they are
+// always quoted, like in the discovery output. Other keys and
+// values are quoted only if needed
+func IniFormat(section, key, value string) string {
+	if section == "devices" || key == "" || strings.ContainsAny(key, "=[]") ||
+		iniNeedQuote(key) {
+		key = IniQuote(key)
+	}
+	if iniNeedQuote(value) {
+		value = IniQuote(value)
+	}
+	return key + " = " + value
+}
+
+// iniNeedQuote reports whether string contains characters
+// that need quoting
+func iniNeedQuote(s string) bool {
+	return strings.ContainsAny(s, "\"#;\\") || strings.TrimSpace(s) != s
+}
+
+// IniQuote quotes the string, as expected by the sane-airscan
+// configuration file parser
+func IniQuote(s string) string {
+	var buf strings.Builder
+
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c == '\n':
+			buf.WriteString(`\n`)
+		case c == '\t':
+			buf.WriteString(`\t`)
+		case c < ' ' || c == 0x7f:
+			fmt.Fprintf(&buf, "\\%.3o", c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+
+	return buf.String()
+}
+
+// iniParseLine parses a single line of the .INI file
+func iniParseLine(text string) *IniLine {
+	line := &IniLine{Kind: IniOther, Text: text}
+	s := strings.TrimSpace(text)
+
+	switch {
+	case s == "" || s[0] == '#' || s[0] == ';':
+		return line
+
+	case s[0] == '[':
+		end := strings.IndexByte(s, ']')
+		if end < 0 {
+			return line
+		}
+
+		line.Kind = IniSection
+		line.Section = strings.TrimSpace(s[1:end])
+		return line
+	}
+
+	// Parse the key
+	var key string
+	if s[0] == '"' {
+		var rest string
+		var ok bool
+		key, rest, ok = iniUnquote(s)
+		if !ok {
+			return line
+		}
+		s = strings.TrimLeft(rest, " \t")
+	} else {
+		end := strings.IndexAny(s, "=#;")
+		if end < 0 {
+			return line
+		}
+		key = strings.TrimSpace(s[:end])
+		s = s[end:]
+	}
+
+	if s == "" || s[0] != '=' {
+		return line
+	}
+
+	line.Kind = IniVariable
+	line.Key = key
+	line.Value = iniParseValue(s[1:])
+
+	return line
+}
+
+// iniParseValue parses the variable value: quoted parts are unquoted,
+// and comment, if any, is stripped
+func iniParseValue(s string) string {
+	var buf strings.Builder
+
+	s = strings.TrimSpace(s)
+	for s != "" {
+		c := s[0]
+		switch {
+		case c == '#' || c == ';':
+			s = ""
+		case c == '"':
+			part, rest, ok := iniUnquote(s)
+			if !ok {
+				// Unterminated quote - take the rest literally
+				buf.WriteString(s[1:])
+				s = ""
+			} else {
+				buf.WriteString(part)
+				s = rest
+			}
+		default:
+			buf.WriteByte(c)
+			s = s[1:]
+		}
+	}
+
+	return strings.TrimSpace(buf.String())
+}
+
+// iniUnquote parses the quoted string at the beginning of s
+//
+// It returns unquoted string, the rest of s after the closing
+// quote, and true on success
+func iniUnquote(s string) (string, string, bool) {
+	var buf strings.Builder
+
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			return buf.String(), s[i+1:], true
+
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", false
+			}
+
+			c = s[i]
+			switch {
+			case c == 'n':
+				c = '\n'
+			case c == 't':
+				c = '\t'
+			case c == 'r':
+				c = '\r'
+			case c >= '0' && c <= '7':
+				v := 0
+				for n := 0; n < 3 && i < len(s) && s[i] >= '0' && s[i] <= '7'; n++ {
+					v = v*8 + int(s[i]-'0')
+					i++
+				}
+				i--
+				c = byte(v)
+			}
+		}
+
+		buf.WriteByte(c)
+	}
+
+	return "", "", false
+}
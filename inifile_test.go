@@ -0,0 +1,195 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// airscan.conf (.INI-style) file parser and writer tests
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testIni parses the .INI file from the text
+func testIni(t *testing.T, text string) *IniFile {
+	ini, err := IniRead(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ini
+}
+
+// TestIniQuote checks that quoted strings are unquoted back
+func TestIniQuote(t *testing.T) {
+	tests := []struct {
+		in, quoted string
+	}{
+		{"Kyocera MFP", `"Kyocera MFP"`},
+		{`say "cheese"`, `"say \"cheese\""`},
+		{`C:\scan`, `"C:\\scan"`},
+		{"line\nbreak", `"line\nbreak"`},
+		{"tab\there", `"tab\there"`},
+		{"bell\a", `"bell\007"`},
+		{"del\x7f", `"del\177"`},
+		{"# not a comment ;", `"# not a comment ;"`},
+		{"  spaces  ", `"  spaces  "`},
+		{"", `""`},
+	}
+
+	for _, test := range tests {
+		quoted := IniQuote(test.in)
+		if quoted != test.quoted {
+			t.Errorf("IniQuote(%q): %s, expected %s", test.in, quoted,
+				test.quoted)
+		}
+
+		s, rest, ok := iniUnquote(quoted)
+		if !ok || s != test.in || rest != "" {
+			t.Errorf("iniUnquote(%s): %q %q %v", quoted, s, rest, ok)
+		}
+
+		line := iniParseLine(IniFormat("devices", test.in, test.in))
+		if line.Kind != IniVariable || line.Key != test.in ||
+			line.Value != strings.TrimSpace(test.in) {
+			t.Errorf("%q: parsed as %q = %q", test.in, line.Key,
+				line.Value)
+		}
+	}
+}
+
+// TestIniParseLine parses lines of different kinds
+func TestIniParseLine(t *testing.T) {
+	tests := []struct {
+		text       string
+		kind       IniLineKind
+		key, value string
+	}{
+		{"", IniOther, "", ""},
+		{"  # comment", IniOther, "", ""},
+		{"; comment", IniOther, "", ""},
+		{"[devices]", IniSection, "", ""},
+		{"[devices", IniOther, "", ""},
+		{"garbage", IniOther, "", ""},
+		{`"unterminated = x`, IniOther, "", ""},
+		{"key = value", IniVariable, "key", "value"},
+		{"key=value # comment", IniVariable, "key", "value"},
+		{`"Name" = http://10.0.0.1/eSCL, escl`, IniVariable, "Name",
+			"http://10.0.0.1/eSCL, escl"},
+		{`"a \"b\"" = "x;y" ; comment`, IniVariable, `a "b"`, "x;y"},
+		{`key = "unterminated`, IniVariable, "key", "unterminated"},
+	}
+
+	for _, test := range tests {
+		line := iniParseLine(test.text)
+		if line.Kind != test.kind || line.Key != test.key ||
+			line.Value != test.value {
+			t.Errorf("%q: got %d %q %q, expected %d %q %q", test.text,
+				line.Kind, line.Key, line.Value,
+				test.kind, test.key, test.value)
+		}
+		if line.Text != test.text {
+			t.Errorf("%q: text changed to %q", test.text, line.Text)
+		}
+	}
+}
+
+// TestIniAdd adds variables to the existing and missing sections
+func TestIniAdd(t *testing.T) {
+	tests := []struct {
+		name, in, out string
+	}{
+		{
+			name: "existing section",
+			in: "# airscan.conf\n" +
+				"[devices]\n" +
+				"  \"A\" = http://a/eSCL\n" +
+				"  # keep me\n" +
+				"\n" +
+				"[options]\n" +
+				"discovery = enable\n",
+			out: "# airscan.conf\n" +
+				"[devices]\n" +
+				"  \"A\" = http://a/eSCL\n" +
+				"  \"New\" = http://new/eSCL\n" +
+				"  # keep me\n" +
+				"\n" +
+				"[options]\n" +
+				"discovery = enable\n",
+		},
+		{
+			name: "empty section",
+			in: "[devices]\n" +
+				"; no devices yet\n",
+			out: "[devices]\n" +
+				"  \"New\" = http://new/eSCL\n" +
+				"; no devices yet\n",
+		},
+		{
+			name: "missing section",
+			in: "[options]\n" +
+				"discovery = enable\n",
+			out: "[options]\n" +
+				"discovery = enable\n" +
+				"\n" +
+				"[devices]\n" +
+				"  \"New\" = http://new/eSCL\n",
+		},
+		{
+			name: "empty file",
+			in:   "",
+			out: "[devices]\n" +
+				"  \"New\" = http://new/eSCL\n",
+		},
+		{
+			name: "same key",
+			in: "[devices]\n" +
+				"  \"New\" = http://old/eSCL\n" +
+				"  \"B\" = http://b/eSCL\n",
+			out: "[devices]\n" +
+				"  \"New\" = http://old/eSCL\n" +
+				"  \"New\" = http://new/eSCL\n" +
+				"  \"B\" = http://b/eSCL\n",
+		},
+	}
+
+	for _, test := range tests {
+		ini := testIni(t, test.in)
+		line := ini.Add("devices", "New", "http://new/eSCL")
+		if line.Section != "devices" || line.Key != "New" {
+			t.Errorf("%s: added %q to [%s]", test.name, line.Key,
+				line.Section)
+		}
+
+		out := string(ini.Bytes())
+		if out != test.out {
+			t.Errorf("%s:\n%s", test.name,
+				UnifiedDiff("expected", "got",
+					strings.Split(test.out, "\n"),
+					strings.Split(out, "\n")))
+		}
+
+		// Added variable is read back
+		vars := testIni(t, out).Variables("devices")
+		found := false
+		for _, v := range vars {
+			found = found || v.Value == "http://new/eSCL"
+		}
+		if !found {
+			t.Errorf("%s: added variable not read back", test.name)
+		}
+	}
+}
+
+// TestIniSet modifies the variable, keeping its indentation
+func TestIniSet(t *testing.T) {
+	ini := testIni(t, "[devices]\n\t\"A\" = http://a/eSCL # old\n")
+	ini.Set(ini.Variables("devices")[0], "http://b/eSCL, wsd")
+
+	out := string(ini.Bytes())
+	expected := "[devices]\n\t\"A\" = http://b/eSCL, wsd\n"
+	if out != expected {
+		t.Errorf("got %q, expected %q", out, expected)
+	}
+}
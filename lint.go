@@ -0,0 +1,320 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The "lint" command: airscan.conf validator
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// lintUsage is the usage template of the lint command
+const lintUsage = `Usage:
+    %s lint [options] [file]
+
+Validate [devices] and [blacklist] sections of the airscan.conf
+file (default: ` + ConfDefault + `) against the live network
+
+Each configured device is contacted and reported as reachable,
+unreachable, moved (found by discovery at a different URL) or
+duplicate. Fixes are suggested in the airscan.conf format.
+
+Exit status is 0 if no problems were found, 1 otherwise.
+
+Options are:
+` + usageCommonOptions
+
+// LintStatus is the status of the [devices] entry
+type LintStatus string
+
+// LintStatus values
+const (
+	LintReachable   LintStatus = "reachable"
+	LintUnreachable LintStatus = "unreachable"
+	LintMoved       LintStatus = "moved"
+	LintDuplicate   LintStatus = "duplicate"
+	LintDisabled    LintStatus = "disabled"
+	LintInvalid     LintStatus = "invalid"
+)
+
+// lintDevice contains the lint result of the [devices] entry
+type lintDevice struct {
+	ConfDevice
+	Status  LintStatus // Entry status
+	Err     error      // Error, if any
+	DupOf   *IniLine   // Duplicated line, for LintDuplicate
+	MovedTo []Endpoint // New endpoints, for LintMoved
+}
+
+// lintProbe contacts the device, using the same requests the
+// discovery would use. For WSD devices, the endpoint address is
+// obtained from the discovery, if known
+func lintProbe(dev ConfDevice, discovered func() []Endpoint) error {
+	switch dev.Proto {
+	case "escl":
+		elements, err := esclGet(dev.URL, "ScannerCapabilities")
+		if err != nil {
+			return err
+		}
+
+		if len(elements) == 0 ||
+			elements[0].Path != "/scan:ScannerCapabilities" {
+			return errors.New("not an eSCL ScannerCapabilities response")
+		}
+
+	case "wsd":
+		address := lintAddress(dev, discovered())
+		elements, err := wsddGetMetadata(address, dev.URL)
+		if err != nil {
+			return err
+		}
+
+		return wsdCheckResponse(elements, "Get")
+	}
+
+	return nil
+}
+
+// lintAddress returns WS-Addressing endpoint address of the WSD
+// device: the address of the discovered endpoint with the same URL,
+// "urn:uuid:" with UUID from the URL or, if unknown, the URL itself
+func lintAddress(dev ConfDevice, endpoints []Endpoint) string {
+	for _, endpoint := range endpoints {
+		if endpoint.Proto == dev.Proto && endpoint.UUID != "" &&
+			strings.TrimSuffix(endpoint.URL, "/") ==
+				strings.TrimSuffix(dev.URL, "/") {
+			return "urn:uuid:" + endpoint.UUID
+		}
+	}
+
+	if uuid := confUUIDRe.FindString(dev.URL); uuid != "" {
+		return "urn:uuid:" + uuid
+	}
+
+	return dev.URL
+}
+
+// lintCheck validates the entry syntax
+func lintCheck(dev ConfDevice) error {
+	switch dev.Proto {
+	case "escl", "wsd":
+	default:
+		return fmt.Errorf("unknown protocol %q", dev.Proto)
+	}
+
+	u, err := url.Parse(dev.URL)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q: not a HTTP URL", dev.URL)
+	}
+
+	return nil
+}
+
+// lintDevices validates and probes [devices] entries. WSD probes
+// wait for the discovered endpoints
+func lintDevices(ini *IniFile, discovered func() []Endpoint) []*lintDevice {
+	var results []*lintDevice
+	var wait sync.WaitGroup
+
+	seen := make(map[string]*IniLine)
+	for _, dev := range ConfDevices(ini) {
+		res := &lintDevice{ConfDevice: dev}
+		results = append(results, res)
+
+		if dev.Disabled {
+			res.Status = LintDisabled
+			continue
+		}
+
+		if err := lintCheck(dev); err != nil {
+			res.Status, res.Err = LintInvalid, err
+			continue
+		}
+
+		key := dev.Proto + " " + strings.TrimSuffix(dev.URL, "/")
+		if line := seen[key]; line != nil {
+			res.Status, res.DupOf = LintDuplicate, line
+			continue
+		}
+		seen[key] = dev.Line
+
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			res.Err = lintProbe(res.ConfDevice, discovered)
+		}()
+	}
+
+	wait.Wait()
+
+	return results
+}
+
+// lintClassify classifies results of probing, using results
+// of discovery to find moved devices
+func lintClassify(results []*lintDevice, endpoints []Endpoint) {
+	var devices []ConfDevice
+	for _, res := range results {
+		devices = append(devices, res.ConfDevice)
+	}
+
+	for _, res := range results {
+		if res.Status != "" {
+			continue
+		}
+
+		if res.Err == nil {
+			res.Status = LintReachable
+			continue
+		}
+
+		res.Status = LintUnreachable
+		for _, endpoint := range endpoints {
+			if same, _ := ConfSameDevice(res.ConfDevice, endpoint); same &&
+				endpoint.URL != res.URL {
+				res.MovedTo = append(res.MovedTo, endpoint)
+			}
+		}
+
+		// Recognize device by name, if it is unambiguous
+		if len(res.MovedTo) == 0 {
+			for _, endpoint := range endpoints {
+				if confSameName(res.ConfDevice, devices,
+					endpoint, endpoints) {
+					res.MovedTo = append(res.MovedTo, endpoint)
+				}
+			}
+		}
+
+		if len(res.MovedTo) != 0 {
+			res.Status = LintMoved
+		}
+	}
+}
+
+// cmdLint implements the "lint" command
+func cmdLint(args []string) {
+	// Parse options
+	opts := NewOptions(args, lintUsage)
+	for opts.Next() {
+		opts.Common()
+	}
+
+	file := ConfDefault
+	switch args := opts.Args(); len(args) {
+	case 0:
+	case 1:
+		file = args[0]
+	default:
+		opts.Invalid(args[1])
+	}
+
+	ini, err := confLoad(file)
+	LogCheck(err)
+
+	// Discover devices; probes run in parallel with discovery
+	var endpoints []Endpoint
+	done := make(chan struct{})
+	go func() {
+		endpoints = Discover(DiscoveryTime, nil)
+		close(done)
+	}()
+
+	devices := lintDevices(ini, func() []Endpoint {
+		<-done
+		return endpoints
+	})
+	<-done
+
+	lintClassify(devices, endpoints)
+	problems := 0
+
+	var fixes []string
+
+	// Report [devices] section
+	for _, res := range devices {
+		where := fmt.Sprintf("%s:%d: %s", file, res.Line.LineNo,
+			strings.TrimSpace(res.Line.Text))
+
+		switch res.Status {
+		case LintReachable, LintDisabled:
+			fmt.Printf("%s: %s\n", where, res.Status)
+
+		case LintDuplicate:
+			problems++
+			fmt.Printf("%s: %s of line %d\n", where, res.Status,
+				res.DupOf.LineNo)
+			fixes = append(fixes,
+				fmt.Sprintf("  ; line %d: remove duplicate", res.Line.LineNo))
+
+		case LintMoved:
+			problems++
+			fmt.Printf("%s: %s (%s)\n", where, res.Status, res.Err)
+			fixes = append(fixes,
+				fmt.Sprintf("  ; line %d: replace with", res.Line.LineNo))
+			for _, endpoint := range res.MovedTo {
+				fmt.Printf("%s:%d:   found at %s\n", file,
+					res.Line.LineNo, endpoint.URL)
+				fixes = append(fixes, "  "+IniFormat("devices",
+					endpoint.Name, ConfDeviceValue(endpoint)))
+			}
+
+		case LintUnreachable, LintInvalid:
+			problems++
+			fmt.Printf("%s: %s (%s)\n", where, res.Status, res.Err)
+			fixes = append(fixes,
+				fmt.Sprintf("  ; line %d: remove or disable", res.Line.LineNo),
+				"  "+IniFormat("devices", res.Name, "disable"))
+		}
+	}
+
+	// Report [blacklist] section
+	for _, line := range ini.Variables("blacklist") {
+		where := fmt.Sprintf("%s:%d: %s", file, line.LineNo,
+			strings.TrimSpace(line.Text))
+
+		rule, err := BlacklistParse(line.Key, line.Value)
+		if err != nil {
+			problems++
+			fmt.Printf("%s: %s (%s)\n", where, LintInvalid, err)
+			continue
+		}
+
+		var matched []string
+		for _, endpoint := range endpoints {
+			if rule.Match(endpoint) {
+				matched = append(matched,
+					fmt.Sprintf("%q (%s)", endpoint.Name, endpoint.Proto))
+			}
+		}
+
+		if len(matched) == 0 {
+			fmt.Printf("%s: matches no discovered device\n", where)
+		} else {
+			fmt.Printf("%s: matches %s\n", where, strings.Join(matched, ", "))
+		}
+	}
+
+	// Suggest fixes
+	if len(fixes) != 0 {
+		fmt.Printf("\nSuggested fixes:\n[devices]\n")
+		for _, fix := range fixes {
+			fmt.Printf("%s\n", fix)
+		}
+	}
+
+	if problems != 0 {
+		Exit(1)
+	}
+}
@@ -9,32 +9,46 @@ package main
 
 import (
 	"archive/tar"
-	"bytes"
 	"fmt"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 )
 
-// Debug enables or disables debugging
-var Debug = false
+// Log levels
+const (
+	LogLevelError = iota // Errors only
+	LogLevelInfo         // Errors and informational messages
+	LogLevelDebug        // All messages
+)
+
+// LogLevel is the log level. The -d option sets it to LogLevelDebug
+var LogLevel = LogLevelInfo
 
 // Trace enables or disables protocol trace
-var Trace = true
+var Trace = false
+
+// TraceFormat is the protocol trace format
+var TraceFormat = TraceFormatTar
 
-// Trace file name
-const traceName = "trace.tar"
+// Trace file name, without extension
+const traceName = "trace"
 
-// Trace file handle, opened on demand
+// Trace file writer, opened on demand
 var (
-	traceFile  *tar.Writer
-	traceLock  sync.Mutex
-	traceIndex int
+	traceWriter TraceWriter
+	traceLock   sync.Mutex
+	traceIndex  int
 )
 
 // LogMessage represents a multiline log message
 type LogMessage struct {
-	prefix string   // Per-line prefix
-	lines  []string // LogMessage lines
+	prefix  string   // Per-line prefix
+	lines   []string // LogMessage lines
+	outcome string   // Outcome of the last Ignore
+	reason  string   // Reason of the last Ignore
 }
 
 // LogCheck terminates a program, if err != nil
@@ -47,19 +61,67 @@ func LogCheck(err error) {
 // LogFatal writes an error message and terminates a program
 func LogFatal(format string, args ...interface{}) {
 	LogError(format, args...)
-	os.Exit(1)
+	Exit(1)
+}
+
+// Exit finalizes the protocol trace and terminates a program
+func Exit(code int) {
+	TraceClose()
+	os.Exit(code)
+}
+
+// Interrupt handling
+var (
+	interruptHooks []func()
+	interruptLock  sync.Mutex
+	interruptOnce  sync.Once
+)
+
+// OnInterrupt adds function, called when program is interrupted
+// by SIGINT or SIGTERM, before it terminates. The hook may be nil,
+// then only the protocol trace is finalized on interrupt
+func OnInterrupt(hook func()) {
+	interruptOnce.Do(func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+
+		go func() {
+			<-c
+			LogError("Interrupted")
+
+			interruptLock.Lock()
+			for _, hook := range interruptHooks {
+				hook()
+			}
+			Exit(1)
+		}()
+	})
+
+	if hook != nil {
+		interruptLock.Lock()
+		interruptHooks = append(interruptHooks, hook)
+		interruptLock.Unlock()
+	}
 }
 
 // LogError writes an error message
 func LogError(format string, args ...interface{}) {
-	os.Stdout.Write([]byte(fmt.Sprintf(format, args...) + "\n"))
+	logWrite(LogLevelError, "", fmt.Sprintf(format, args...))
+}
+
+// LogInfo writes an informational message
+func LogInfo(format string, args ...interface{}) {
+	logWrite(LogLevelInfo, "", fmt.Sprintf(format, args...))
 }
 
-// LogDebug writes a message
+// LogDebug writes a debug message
 func LogDebug(format string, args ...interface{}) {
-	if Debug {
-		os.Stdout.Write([]byte(fmt.Sprintf(format, args...) + "\n"))
-	}
+	logWrite(LogLevelDebug, "", fmt.Sprintf(format, args...))
+}
+
+// logEnabled tells if messages of the level are written
+func logEnabled(level int) bool {
+	return level <= LogLevel
 }
 
 // LogBegin starts a new multiline debug message
@@ -69,62 +131,106 @@ func LogBegin(prefix string) *LogMessage {
 	}
 }
 
-// Add record to the protocol trace
+// LogTrace adds record to the protocol trace
 func LogTrace(name string, data []byte) {
+	LogTraceMeta(name, data, TraceMeta{})
+}
+
+// LogTraceMeta adds record with metadata to the protocol trace.
+// If meta.Time is zero, the current time is used
+func LogTraceMeta(name string, data []byte, meta TraceMeta) {
 	// Trace enabled?
 	if !Trace {
 		return
 	}
 
+	if meta.Time.IsZero() {
+		meta.Time = time.Now()
+	}
+
 	// Acquire trace lock
 	traceLock.Lock()
 	defer traceLock.Unlock()
 
 	// Open trace file on demand
-	if traceFile == nil {
-		file, err := os.OpenFile(traceName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if traceWriter == nil {
+		err := traceStart()
 		if err != nil {
-			LogError("%s: %s", traceName, err)
+			LogError("Trace: %s", err)
+			Trace = false
 			return
 		}
+	}
 
-		traceFile = tar.NewWriter(file)
+	// Redact sensitive data
+	if TraceRedact {
+		name = traceRedactor.Text(name)
+		data = traceRedactor.Bytes(data)
+		meta = traceRedactor.Meta(meta)
 	}
 
-	// Build full name
-	name = fmt.Sprintf("%.3d-%s.xml", traceIndex, name)
+	traceWriter.WriteEntry(&TraceEntry{
+		TraceMeta: meta,
+		Index:     traceIndex,
+		Name:      name,
+		Data:      data,
+	})
+
 	traceIndex++
+	traceRecords++
+	traceRotate()
+}
+
+// traceWrite writes record to the trace file
+func traceWrite(tw *tar.Writer, name string, data []byte, t time.Time,
+	pax map[string]string) error {
 
-	// Write file header and data
 	hdr := &tar.Header{
-		Name: name,
-		Mode: 0644,
-		Size: int64(len(data)),
+		Name:       name,
+		Mode:       0644,
+		Size:       int64(len(data)),
+		ModTime:    t,
+		PAXRecords: pax,
+		Format:     tar.FormatPAX,
 	}
 
-	traceFile.WriteHeader(hdr)
-	traceFile.Write(data)
-	traceFile.Flush()
+	err := tw.WriteHeader(hdr)
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err == nil {
+		err = tw.Flush()
+	}
+
+	return err
 }
 
 // Debug appends line to the LogMessage
 func (m *LogMessage) Debug(format string, args ...interface{}) *LogMessage {
-	if Debug {
+	if logEnabled(LogLevelDebug) {
 		m.lines = append(m.lines, fmt.Sprintf(format, args...))
 	}
 	return m
 }
 
-// Commit the message to the log
+// Ignore appends line to the LogMessage, that explains why something
+// was ignored. Unlike debug lines, the discovery outcome and reason
+// are recorded even if debugging is disabled, see Outcome
+func (m *LogMessage) Ignore(outcome, format string,
+	args ...interface{}) *LogMessage {
+
+	m.outcome = outcome
+	m.reason = fmt.Sprintf(format, args...)
+	return m.Debug("%s", m.reason)
+}
+
+// Outcome returns the outcome and reason, recorded by the last Ignore
+func (m *LogMessage) Outcome() (outcome, reason string) {
+	return m.outcome, m.reason
+}
+
+// Commit the message to the log. Lines of the message are written
+// together, and the prefix is used as their group
 func (m *LogMessage) Commit() {
-	var buf bytes.Buffer
-	for _, l := range m.lines {
-		if m.prefix != "" {
-			buf.Write([]byte(m.prefix))
-			buf.Write([]byte(": "))
-		}
-		buf.Write([]byte(l))
-		buf.WriteByte('\n')
-	}
-	os.Stdout.Write(buf.Bytes())
+	logWrite(LogLevelDebug, m.prefix, m.lines...)
 }
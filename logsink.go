@@ -0,0 +1,259 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Log destinations and formats
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log formats
+const (
+	LogFormatText = "text" // Plain text lines
+	LogFormatJSON = "json" // JSON object per line
+)
+
+// Log sinks
+const (
+	LogSinkStderr   = "stderr"   // Standard error
+	LogSinkSyslog   = "syslog"   // Local syslog daemon
+	LogSinkJournald = "journald" // systemd journal
+)
+
+// Log destination. Standard output is reserved for results
+var (
+	LogFormat = LogFormatText // Log format
+	LogSink   = LogSinkStderr // Log sink
+)
+
+// logIdent identifies the program in syslog and journal
+const logIdent = "airscan-discover"
+
+// logJournalSocket is the native protocol socket of systemd journal
+const logJournalSocket = "/run/systemd/journal/socket"
+
+// logLevelNames contains names of log levels
+var logLevelNames = []string{
+	LogLevelError: "error",
+	LogLevelInfo:  "info",
+	LogLevelDebug: "debug",
+}
+
+// logRecord is the log record: one or more lines, written together
+type logRecord struct {
+	time  time.Time // Record time
+	level int       // Log level
+	group string    // Device or exchange, the lines relate to
+	lines []string  // Message lines
+}
+
+// logOutput writes log records to the sink
+type logOutput interface {
+	write(rec *logRecord) error
+}
+
+// Log output, opened on demand
+var (
+	logOut  logOutput
+	logLock sync.Mutex
+)
+
+// LogParseLevel returns log level by name
+func LogParseLevel(name string) (int, error) {
+	for level, n := range logLevelNames {
+		if n == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q", name)
+}
+
+// logWrite writes lines of the log level. Writes are serialized,
+// so lines of concurrent goroutines don't interleave
+func logWrite(level int, group string, lines ...string) {
+	if !logEnabled(level) || len(lines) == 0 {
+		return
+	}
+
+	rec := &logRecord{
+		time:  time.Now(),
+		level: level,
+		group: group,
+		lines: lines,
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	if logOut == nil {
+		var err error
+		logOut, err = logOpen()
+		if err != nil {
+			logOut = &logStderr{}
+			logOut.write(&logRecord{
+				time:  rec.time,
+				level: LogLevelError,
+				lines: []string{fmt.Sprintf("Log: %s: %s, using stderr",
+					LogSink, err)},
+			})
+		}
+	}
+
+	if logOut.write(rec) != nil {
+		// The sink is gone; don't lose messages
+		(&logStderr{}).write(rec)
+	}
+}
+
+// logOpen opens the log sink
+func logOpen() (logOutput, error) {
+	switch LogSink {
+	case LogSinkSyslog:
+		w, err := syslog.New(syslog.LOG_USER|syslog.LOG_INFO, logIdent)
+		if err != nil {
+			return nil, err
+		}
+		return &logSyslog{w}, nil
+
+	case LogSinkJournald:
+		conn, err := net.DialUnix("unixgram", nil,
+			&net.UnixAddr{Name: logJournalSocket, Net: "unixgram"})
+		if err != nil {
+			return nil, err
+		}
+		return &logJournald{conn}, nil
+	}
+
+	return &logStderr{}, nil
+}
+
+// format formats the log line in the LogFormat
+func (rec *logRecord) format(line string) string {
+	if LogFormat == LogFormatJSON {
+		data, _ := json.Marshal(struct {
+			Time  string `json:"time"`
+			Level string `json:"level"`
+			Group string `json:"group,omitempty"`
+			Msg   string `json:"msg"`
+		}{
+			rec.time.Format(time.RFC3339Nano),
+			logLevelNames[rec.level],
+			rec.group,
+			line,
+		})
+		return string(data)
+	}
+
+	if rec.group != "" {
+		return rec.group + ": " + line
+	}
+
+	return line
+}
+
+// logStderr writes log to the standard error
+type logStderr struct{}
+
+// write writes the log record
+func (logStderr) write(rec *logRecord) error {
+	var buf bytes.Buffer
+	for _, line := range rec.lines {
+		buf.WriteString(rec.format(line))
+		buf.WriteByte('\n')
+	}
+
+	_, err := os.Stderr.Write(buf.Bytes())
+	return err
+}
+
+// logSyslog writes log to the syslog
+type logSyslog struct {
+	w *syslog.Writer
+}
+
+// write writes the log record
+func (out *logSyslog) write(rec *logRecord) error {
+	for _, line := range rec.lines {
+		var err error
+		line = rec.format(line)
+
+		switch rec.level {
+		case LogLevelError:
+			err = out.w.Err(line)
+		case LogLevelInfo:
+			err = out.w.Info(line)
+		default:
+			err = out.w.Debug(line)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// logJournald writes log to the systemd journal, using its native
+// protocol. The group is stored in the AIRSCAN_GROUP field
+type logJournald struct {
+	conn *net.UnixConn
+}
+
+// logPriorities contains syslog priorities of log levels
+var logPriorities = []int{
+	LogLevelError: 3,
+	LogLevelInfo:  6,
+	LogLevelDebug: 7,
+}
+
+// write writes the log record
+func (out *logJournald) write(rec *logRecord) error {
+	for _, line := range rec.lines {
+		var buf bytes.Buffer
+
+		logJournalField(&buf, "MESSAGE", line)
+		logJournalField(&buf, "PRIORITY", strconv.Itoa(logPriorities[rec.level]))
+		logJournalField(&buf, "SYSLOG_IDENTIFIER", logIdent)
+		if rec.group != "" {
+			logJournalField(&buf, "AIRSCAN_GROUP", rec.group)
+		}
+
+		_, err := out.conn.Write(buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// logJournalField encodes field of the journal entry. Values with
+// newlines use the binary encoding
+func logJournalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+
+	buf.WriteString(name + "\n")
+	buf.Write(size[:])
+	buf.WriteString(value + "\n")
+}
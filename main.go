@@ -8,73 +8,172 @@
 package main
 
 import (
-	"fmt"
 	"os"
-	"time"
+	"strings"
+	"text/template"
 )
 
-// Usage/usage error templates
+// Usage template
 const usage = `Usage:
     %s [options]
+    %s command [options] [args]
 
 Options are:
-    -d   enable debug mode
-    -t   enable protocol trace
-    -h   print help page
-`
+    -o format      output format: conf (default), json or ndjson
+    -f file        format output using the template file
+    -c             probe scanner capabilities
+    -w filter      output only devices that match the filter
+    -r trace       replay the protocol trace or pcap/pcapng capture
+                   instead of network discovery
+` + usageCommonOptions + `
+Commands are:
+    conf        merge discovered devices into airscan.conf
+    lint        validate airscan.conf against the live network
+    blacklist   generate blacklist rules for unwanted devices
+    status      query or watch scanner status
+    scan        scan a test page
+    events      wait for scan-button events of WSD scanners
+    emulate     run a virtual device for testing
+    fake-avahi  run the fake Avahi daemon for testing
+    trace       inspect the protocol trace
+    pcap        discover devices from the packet capture
+    explain     explain why devices were or weren't discovered
 
-const usageError = `Invalid argument -%s
-Try %s -h for more information
-`
+Use %s command -h for the command help
+
+` + filterHelp
+
+// Version is the program version. It may be set at build time:
+//
+//	go build -ldflags "-X main.Version=1.0"
+var Version = "devel"
+
+// commands contains all known commands
+var commands = map[string]func(args []string){
+	"conf":       cmdConf,
+	"lint":       cmdLint,
+	"blacklist":  cmdBlacklist,
+	"status":     cmdStatus,
+	"scan":       cmdScan,
+	"events":     cmdEvents,
+	"emulate":    cmdEmulate,
+	"fake-avahi": cmdFakeAvahi,
+	"trace":      cmdTrace,
+	"pcap":       cmdPcap,
+	"explain":    cmdExplain,
+}
 
 // The main function
 func main() {
+	format := FormatConf
+	tmplFile := ""
+	probe := false
+	replay := ""
+	var filter Filter
+
+	// The trace is finalized when command returns, and by Exit
+	defer TraceClose()
+
+	// Dispatch commands
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		cmd := commands[os.Args[1]]
+		if cmd == nil {
+			NewOptions(nil, usage).Invalid(os.Args[1])
+		}
+		cmd(os.Args[2:])
+		return
+	}
+
 	// Parse options
-	for _, arg := range os.Args[1:] {
-		switch arg {
-		case "-d":
-			Debug = true
-		case "-t":
-			Debug = true
-			Trace = true
-		case "-h":
-			fmt.Printf(usage, os.Args[0])
-			os.Exit(0)
+	opts := NewOptions(os.Args[1:], usage)
+	for opts.Next() {
+		switch opts.Opt {
+		case "-o":
+			format = opts.Value()
+		case "-f":
+			format = FormatTmpl
+			tmplFile = opts.Value()
+		case "-c":
+			probe = true
+		case "-r":
+			replay = opts.Value()
+		case "-w":
+			var err error
+			filter, err = ParseFilter(opts.Value())
+			if err != nil {
+				opts.Fail("Option %s: %s", opts.Opt, err)
+			}
 		default:
-			fmt.Printf(usageError, arg, os.Args[0])
-			os.Exit(1)
+			opts.Common()
+		}
+	}
+
+	if len(opts.Args()) != 0 {
+		opts.Invalid(opts.Args()[0])
+	}
+
+	switch format {
+	case FormatConf, FormatJSON, FormatNDJSON:
+	case FormatTmpl:
+		if tmplFile == "" {
+			opts.Fail("Output format %q requires -f option", format)
 		}
+	default:
+		opts.Fail("Invalid output format %q", format)
 	}
 
-	// Perform a discovery
-	c := make(chan Endpoint)
-	t := time.NewTimer(2500 * time.Millisecond)
+	var tmpl *template.Template
+	if format == FormatTmpl {
+		var err error
+		tmpl, err = OutputTemplateLoad(tmplFile)
+		LogCheck(err)
+	}
 
-	endpoints := make(map[Endpoint]struct{})
+	if replay != "" {
+		replayStart(replay)
+	}
 
-	go DNSSdDiscover(c)
-	go WSSDDiscover(c)
+	if filter.NeedCaps() {
+		probe = true
+	}
 
-loop:
-	for {
-		select {
-		case endpoint := <-c:
-			endpoints[endpoint] = struct{}{}
-		case <-t.C:
-			break loop
+	// Perform a discovery. NDJSON events are streamed as devices
+	// are discovered, unless we need to wait for capabilities
+	var found func(Endpoint)
+	if format == FormatNDJSON && !probe {
+		found = func(endpoint Endpoint) {
+			if filter.Match(endpoint) {
+				OutputNDJSONFound(os.Stdout, endpoint)
+			}
 		}
 	}
 
-	// Output results
-	if Debug {
-		fmt.Printf("\n")
+	endpoints := Discover(DiscoveryTime, found)
+
+	if probe {
+		ProbeCapabilities(endpoints)
 	}
-	fmt.Printf("[devices]\n")
-	for endpoint := range endpoints {
-		line := fmt.Sprintf("%q = %s", endpoint.Name, endpoint.URL)
-		if endpoint.Proto != "" {
-			line += ", " + endpoint.Proto
+
+	endpoints = filter.Apply(endpoints)
+
+	if format == FormatNDJSON && found == nil {
+		for _, endpoint := range endpoints {
+			OutputNDJSONFound(os.Stdout, endpoint)
 		}
-		fmt.Printf("  %s\n", line)
 	}
+
+	// Output results
+	var err error
+	switch format {
+	case FormatConf:
+		err = OutputConf(os.Stdout, endpoints)
+	case FormatJSON:
+		err = OutputJSON(os.Stdout, endpoints)
+	case FormatNDJSON:
+		err = OutputNDJSONDone(os.Stdout, len(endpoints))
+	case FormatTmpl:
+		err = OutputTemplate(os.Stdout, tmpl, endpoints)
+	}
+
+	LogCheck(err)
 }
@@ -0,0 +1,253 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// In-memory network transports, for hermetic tests
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// MemNetwork is the in-memory Network. UDP packets are delivered
+// between sockets, created by ListenUDP, without real network.
+// Multicast packets are delivered to all sockets, bound to the
+// multicast address and port
+//
+// Loss and Delay, if not nil, are called for each packet
+// and allow to simulate packet loss and delayed replies
+type MemNetwork struct {
+	Ifaces []NetInterface                                        // Interfaces
+	Loss   func(from, to *net.UDPAddr, msg []byte) bool          // Drop packet?
+	Delay  func(from, to *net.UDPAddr, msg []byte) time.Duration // Delivery delay
+
+	lock     sync.Mutex
+	conns    []*memPacketConn
+	nextPort int
+}
+
+// memPacketConn is the PacketConn of MemNetwork
+type memPacketConn struct {
+	net    *MemNetwork
+	laddr  *net.UDPAddr
+	queue  chan memPacket
+	closed chan struct{}
+	once   sync.Once
+}
+
+// memPacket is the UDP packet, queued for delivery
+type memPacket struct {
+	from *net.UDPAddr
+	msg  []byte
+}
+
+// errMemClosed is returned by operations on closed memPacketConn
+var errMemClosed = errors.New("use of closed connection")
+
+// Interfaces returns network interfaces
+func (mn *MemNetwork) Interfaces() ([]NetInterface, error) {
+	return mn.Ifaces, nil
+}
+
+// ListenUDP creates UDP socket, bound to the local address.
+// If port is 0, the ephemeral port is assigned
+func (mn *MemNetwork) ListenUDP(network string, laddr *net.UDPAddr) (
+	PacketConn, error) {
+
+	mn.lock.Lock()
+	defer mn.lock.Unlock()
+
+	addr := *laddr
+	if addr.Port == 0 {
+		if mn.nextPort == 0 {
+			mn.nextPort = 49152
+		}
+		addr.Port = mn.nextPort
+		mn.nextPort++
+	}
+
+	conn := &memPacketConn{
+		net:    mn,
+		laddr:  &addr,
+		queue:  make(chan memPacket, 256),
+		closed: make(chan struct{}),
+	}
+
+	mn.conns = append(mn.conns, conn)
+
+	return conn, nil
+}
+
+// Close closes all sockets of the network
+func (mn *MemNetwork) Close() {
+	mn.lock.Lock()
+	conns := append([]*memPacketConn(nil), mn.conns...)
+	mn.lock.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// deliver delivers packet to all matching sockets
+func (mn *MemNetwork) deliver(from, to *net.UDPAddr, msg []byte) {
+	if mn.Loss != nil && mn.Loss(from, to, msg) {
+		return
+	}
+
+	var delay time.Duration
+	if mn.Delay != nil {
+		delay = mn.Delay(from, to, msg)
+	}
+
+	mn.lock.Lock()
+	var dest []*memPacketConn
+	for _, conn := range mn.conns {
+		if conn.accepts(from, to) {
+			dest = append(dest, conn)
+		}
+	}
+	mn.lock.Unlock()
+
+	data := make([]byte, len(msg))
+	copy(data, msg)
+	pkt := memPacket{from: from, msg: data}
+
+	for _, conn := range dest {
+		if delay > 0 {
+			conn := conn
+			time.AfterFunc(delay, func() { conn.enqueue(pkt) })
+		} else {
+			conn.enqueue(pkt)
+		}
+	}
+}
+
+// accepts reports whether socket accepts packet, sent to address.
+// Zone of socket address is the interface it is bound to; multicast
+// packets are sent via interface of the sender
+func (conn *memPacketConn) accepts(from, to *net.UDPAddr) bool {
+	if conn.laddr.Port != to.Port {
+		return false
+	}
+
+	if !conn.laddr.IP.Equal(to.IP) && !conn.laddr.IP.IsUnspecified() {
+		return false
+	}
+
+	zone := to.Zone
+	if to.IP.IsMulticast() {
+		zone = from.Zone
+	}
+
+	return conn.laddr.Zone == "" || zone == "" || conn.laddr.Zone == zone
+}
+
+// enqueue adds packet to the socket receive queue. If queue
+// is full, packet is dropped, like the real socket does
+func (conn *memPacketConn) enqueue(pkt memPacket) {
+	select {
+	case <-conn.closed:
+	case conn.queue <- pkt:
+	default:
+	}
+}
+
+// ReadFromUDP receives the next packet
+func (conn *memPacketConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case <-conn.closed:
+		return 0, nil, errMemClosed
+	case pkt := <-conn.queue:
+		return copy(b, pkt.msg), pkt.from, nil
+	}
+}
+
+// WriteTo sends packet to the address
+func (conn *memPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, errMemClosed
+	default:
+	}
+
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("not an UDP address")
+	}
+
+	conn.net.deliver(conn.laddr, to, b)
+	return len(b), nil
+}
+
+// LocalAddr returns the local address of the socket
+func (conn *memPacketConn) LocalAddr() net.Addr {
+	return conn.laddr
+}
+
+// Close closes the socket
+func (conn *memPacketConn) Close() error {
+	conn.once.Do(func() {
+		close(conn.closed)
+
+		mn := conn.net
+		mn.lock.Lock()
+		for i, c := range mn.conns {
+			if c == conn {
+				mn.conns = append(mn.conns[:i], mn.conns[i+1:]...)
+				break
+			}
+		}
+		mn.lock.Unlock()
+	})
+
+	return nil
+}
+
+// MemHTTPClient is the in-memory HTTPClient. Requests are served
+// by the Handler directly, without real network. The handler
+// may use Request.Host to emulate multiple devices
+type MemHTTPClient struct {
+	Handler http.Handler
+}
+
+// Do performs HTTP request
+func (client *MemHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	rec := httptest.NewRecorder()
+	if req.Host == "" {
+		req.Host = req.URL.Host
+	}
+
+	client.Handler.ServeHTTP(rec, req)
+
+	resp := rec.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+// MemDNSSdBrowser is the in-memory DNSSdBrowser. It reports
+// Services of the requested type, then nothing, like DNS-SD
+// browser after all services are found
+type MemDNSSdBrowser struct {
+	Services map[string][]DNSSdService // Services by type
+}
+
+// Browse starts browsing of services of the specified type
+func (browser *MemDNSSdBrowser) Browse(svcType string) (
+	<-chan DNSSdService, error) {
+
+	services := browser.Services[svcType]
+	out := make(chan DNSSdService, len(services))
+	for _, service := range services {
+		out <- service
+	}
+
+	return out, nil
+}
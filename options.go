@@ -0,0 +1,232 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Command-line options
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// usageError is the usage error template
+const usageError = `Invalid argument %s
+Try %s -h for more information
+`
+
+// usageCommonOptions is the help on options, common for all
+// commands (see Options.Common)
+const usageCommonOptions = usageLogOptions + usageTraceOptions +
+	usageHelpOption
+
+// usageLogOptions is the help on logging options
+const usageLogOptions = `    -d             enable debug mode
+    --log-level level
+                   log level: error, info (default) or debug
+    --log-format format
+                   log format: text (default) or json
+    --log-sink sink
+                   log to stderr (default), syslog or journald
+`
+
+// usageTraceOptions is the help on protocol trace options
+const usageTraceOptions = `    -t             enable protocol trace
+    -R             enable protocol trace with sensitive data redacted
+    --trace-format format
+                   protocol trace format: tar (default) or pcapng
+    -T path        write protocol trace to file or directory
+    -z             compress protocol trace with gzip
+    --trace-size n start the next trace file after n bytes (i.e., 10M)
+    --trace-keep n keep only n last trace files
+`
+
+// usageHelpOption is the help on the -h option
+const usageHelpOption = `    -h             print help page
+`
+
+// Options is the simple iterator over command-line options
+//
+// Usage:
+//
+//	opts := NewOptions(os.Args[1:], usage)
+//	for opts.Next() {
+//	        switch opts.Opt {
+//	        case "-x":
+//	                ...
+//	        default:
+//	                opts.Common()
+//	        }
+//	}
+//	args := opts.Args()
+type Options struct {
+	Opt   string   // Current option
+	args  []string // Remaining arguments
+	usage string   // Usage template
+}
+
+// NewOptions creates a new options iterator. The usage is the
+// help page template, where each %s is replaced with program name
+func NewOptions(args []string, usage string) *Options {
+	return &Options{
+		args:  args,
+		usage: usage,
+	}
+}
+
+// Next advances to the next option. It returns false when options
+// are exhausted: the next argument doesn't start with '-', or
+// the "--" argument is reached
+func (opts *Options) Next() bool {
+	if len(opts.args) == 0 {
+		return false
+	}
+
+	arg := opts.args[0]
+	switch {
+	case arg == "--":
+		opts.args = opts.args[1:]
+		return false
+	case len(arg) < 2 || arg[0] != '-':
+		return false
+	}
+
+	opts.Opt = arg
+	opts.args = opts.args[1:]
+	return true
+}
+
+// Value consumes and returns the value of the current option
+func (opts *Options) Value() string {
+	if len(opts.args) == 0 {
+		opts.Fail("Option %s requires an argument", opts.Opt)
+	}
+
+	v := opts.args[0]
+	opts.args = opts.args[1:]
+	return v
+}
+
+// IntValue consumes the value of the current option and
+// parses it as a non-negative integer
+func (opts *Options) IntValue() int {
+	s := opts.Value()
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		opts.Fail("Option %s: invalid number %q", opts.Opt, s)
+	}
+	return v
+}
+
+// SizeValue consumes the value of the current option and parses
+// it as a size in bytes, with optional K, M or G suffix
+func (opts *Options) SizeValue() int64 {
+	s := opts.Value()
+	num, mul := s, int64(1)
+
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K', 'k':
+			mul = 1 << 10
+		case 'M', 'm':
+			mul = 1 << 20
+		case 'G', 'g':
+			mul = 1 << 30
+		}
+	}
+
+	if mul != 1 {
+		num = s[:len(s)-1]
+	}
+
+	v, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || v < 0 {
+		opts.Fail("Option %s: invalid size %q", opts.Opt, s)
+	}
+
+	return v * mul
+}
+
+// Args returns remaining non-option arguments
+func (opts *Options) Args() []string {
+	return opts.args
+}
+
+// Common handles options, common for all commands. Unknown
+// option causes usage error
+func (opts *Options) Common() {
+	switch opts.Opt {
+	case "-d":
+		LogLevel = LogLevelDebug
+	case "-t":
+		Trace = true
+	case "-R":
+		Trace = true
+		TraceRedact = true
+	case "--trace-format":
+		Trace = true
+		TraceFormat = opts.Value()
+		switch TraceFormat {
+		case TraceFormatTar, TraceFormatPcapng:
+		default:
+			opts.Fail("Option %s: invalid trace format %q", opts.Opt,
+				TraceFormat)
+		}
+	case "-T":
+		Trace = true
+		TracePath = opts.Value()
+	case "-z":
+		Trace = true
+		TraceGzip = true
+	case "--trace-size":
+		Trace = true
+		TraceMaxSize = opts.SizeValue()
+	case "--trace-keep":
+		Trace = true
+		TraceMaxFiles = opts.IntValue()
+	case "--log-level":
+		level, err := LogParseLevel(opts.Value())
+		if err != nil {
+			opts.Fail("Option %s: %s", opts.Opt, err)
+		}
+		LogLevel = level
+	case "--log-format":
+		LogFormat = opts.Value()
+		switch LogFormat {
+		case LogFormatText, LogFormatJSON:
+		default:
+			opts.Fail("Option %s: invalid log format %q", opts.Opt, LogFormat)
+		}
+	case "--log-sink":
+		LogSink = opts.Value()
+		switch LogSink {
+		case LogSinkStderr, LogSinkSyslog, LogSinkJournald:
+		default:
+			opts.Fail("Option %s: invalid log sink %q", opts.Opt, LogSink)
+		}
+	case "-h":
+		fmt.Print(strings.ReplaceAll(opts.usage, "%s", os.Args[0]))
+		os.Exit(0)
+	default:
+		opts.Invalid(opts.Opt)
+	}
+}
+
+// Invalid reports invalid argument and terminates a program
+func (opts *Options) Invalid(arg string) {
+	fmt.Fprintf(os.Stderr, usageError, arg, os.Args[0])
+	os.Exit(1)
+}
+
+// Fail reports usage error and terminates a program
+func (opts *Options) Fail(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	msg = strings.TrimSuffix(msg, "\n")
+	fmt.Fprintf(os.Stderr, "%s\nTry %s -h for more information\n",
+		msg, os.Args[0])
+	os.Exit(1)
+}
@@ -0,0 +1,72 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Output formatting
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"text/template"
+)
+
+// Output formats
+const (
+	FormatConf   = "conf"   // airscan.conf [devices] section
+	FormatJSON   = "json"   // JSON document
+	FormatNDJSON = "ndjson" // Newline-delimited JSON events
+	FormatTmpl   = "tmpl"   // User-defined template
+)
+
+// outputEvent represents a single NDJSON event
+type outputEvent struct {
+	Event string `json:"event"`
+	*Endpoint
+	Count *int `json:"count,omitempty"`
+}
+
+// outputDocument represents the JSON output document
+type outputDocument struct {
+	Devices []Endpoint `json:"devices"`
+}
+
+// outputConfTemplate is the parsed built-in airscan.conf template
+var outputConfTemplate = template.Must(OutputTemplateParse("conf", confTemplate))
+
+// OutputConf writes endpoints as airscan.conf [devices] section
+func OutputConf(w io.Writer, endpoints []Endpoint) error {
+	return OutputTemplate(w, outputConfTemplate, endpoints)
+}
+
+// OutputJSON writes endpoints as JSON document
+func OutputJSON(w io.Writer, endpoints []Endpoint) error {
+	if endpoints == nil {
+		endpoints = []Endpoint{}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	return enc.Encode(outputDocument{endpoints})
+}
+
+// OutputNDJSONFound writes the "found" NDJSON event
+func OutputNDJSONFound(w io.Writer, endpoint Endpoint) error {
+	return outputNDJSON(w, outputEvent{Event: "found", Endpoint: &endpoint})
+}
+
+// OutputNDJSONDone writes the "done" NDJSON event, which terminates
+// the stream of events
+func OutputNDJSONDone(w io.Writer, count int) error {
+	return outputNDJSON(w, outputEvent{Event: "done", Count: &count})
+}
+
+// outputNDJSON writes a single NDJSON event
+func outputNDJSON(w io.Writer, event outputEvent) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(event)
+}
@@ -0,0 +1,596 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// pcap and pcapng capture files reader
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"time"
+)
+
+// pcap file magic numbers
+const (
+	pcapMagicMicro = 0xa1b2c3d4 // Microsecond timestamps
+	pcapMagicNano  = 0xa1b23c4d // Nanosecond timestamps
+)
+
+// pcapng blocks, not written by PcapngWriter
+const (
+	pcapngPB          = 0x00000002 // Packet Block (obsolete)
+	pcapngSPB         = 0x00000003 // Simple Packet Block
+	pcapngByteOrder   = 0x1A2B3C4D // SHB byte-order magic
+	pcapngOptIfTsoffs = 14         // IDB: timestamp offset, seconds
+)
+
+// Link types
+const (
+	pcapLinkNull     = 0   // BSD loopback
+	pcapLinkEthernet = 1   // Ethernet
+	pcapLinkRawAlt   = 12  // Raw IP on some systems
+	pcapLinkLoop     = 108 // OpenBSD loopback
+	pcapLinkSLL      = 113 // Linux "cooked" capture
+	pcapLinkIPv4     = 228 // Raw IPv4
+	pcapLinkIPv6     = 229 // Raw IPv6
+	pcapLinkSLL2     = 276 // Linux "cooked" capture v2
+)
+
+// PcapCapture is the packet capture, loaded from file
+type PcapCapture struct {
+	Interfaces []PcapInterface // Capture interfaces
+	Packets    []*PcapPacket   // Captured packets
+}
+
+// PcapInterface describes the capture interface
+type PcapInterface struct {
+	Index    int    // Interface index, starting from 1
+	Name     string // Interface name, may be empty
+	LinkType int    // Link type
+}
+
+// PcapPacket is the captured packet
+type PcapPacket struct {
+	Time  time.Time // Capture time
+	Iface int       // Interface index
+	Data  []byte    // Link-layer packet
+}
+
+// PcapIPPacket is the decoded (and reassembled, if fragmented)
+// IP packet
+type PcapIPPacket struct {
+	*PcapPacket
+	Src, Dst net.IP // IP addresses
+	Proto    byte   // IP protocol
+	Payload  []byte // IP payload
+
+	frag     bool   // It is a fragment
+	fragID   uint32 // Fragment identification
+	fragOff  int    // Fragment offset, bytes
+	fragMore bool   // More fragments follow
+}
+
+// PcapIsCapture tells if file is the pcap or pcapng capture file
+func PcapIsCapture(file string) bool {
+	f, err := traceOpen(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	var magic [4]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		return false
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian,
+		binary.BigEndian} {
+		switch order.Uint32(magic[:]) {
+		case pcapMagicMicro, pcapMagicNano, pcapngSHB:
+			return true
+		}
+	}
+
+	return false
+}
+
+// PcapRead reads the pcap or pcapng capture file, possibly
+// compressed with gzip
+func PcapRead(file string) (*PcapCapture, error) {
+	f, err := traceOpen(file)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	var capture *PcapCapture
+	if len(data) >= 4 && binary.LittleEndian.Uint32(data) == pcapngSHB {
+		capture, err = pcapngRead(data)
+	} else {
+		capture, err = pcapRead(data)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	return capture, nil
+}
+
+// pcapRead decodes the pcap file
+func pcapRead(data []byte) (*PcapCapture, error) {
+	if len(data) < 24 {
+		return nil, errors.New("not a pcap file")
+	}
+
+	var order binary.ByteOrder
+	var scale time.Duration
+
+	for _, order = range []binary.ByteOrder{binary.LittleEndian,
+		binary.BigEndian} {
+		switch order.Uint32(data) {
+		case pcapMagicMicro:
+			scale = time.Microsecond
+		case pcapMagicNano:
+			scale = time.Nanosecond
+		}
+		if scale != 0 {
+			break
+		}
+	}
+
+	if scale == 0 {
+		return nil, errors.New("not a pcap file")
+	}
+
+	capture := &PcapCapture{
+		Interfaces: []PcapInterface{{
+			Index:    1,
+			LinkType: int(order.Uint32(data[20:]) & 0xffff),
+		}},
+	}
+
+	for data = data[24:]; len(data) >= 16; {
+		sec := order.Uint32(data)
+		frac := order.Uint32(data[4:])
+		caplen := int(order.Uint32(data[8:]))
+		if caplen > len(data)-16 {
+			return capture, errors.New("truncated packet")
+		}
+
+		capture.Packets = append(capture.Packets, &PcapPacket{
+			Time:  time.Unix(int64(sec), int64(frac)*int64(scale)),
+			Iface: 1,
+			Data:  data[16 : 16+caplen],
+		})
+
+		data = data[16+caplen:]
+	}
+
+	return capture, nil
+}
+
+// pcapngInterface is the pcapng interface, as seen from its section
+type pcapngInterface struct {
+	index  int    // Global interface index
+	tsunit uint64 // Timestamp units per second
+	tsoffs int64  // Timestamp offset, seconds
+}
+
+// pcapngRead decodes the pcapng file
+func pcapngRead(data []byte) (*PcapCapture, error) {
+	capture := &PcapCapture{}
+	var order binary.ByteOrder = binary.LittleEndian
+	var ifaces []pcapngInterface
+
+	for len(data) >= 12 {
+		btype := order.Uint32(data)
+
+		// Section header defines byte order of the section
+		// (its block type is the same in both byte orders)
+		if btype == pcapngSHB {
+			if binary.LittleEndian.Uint32(data[8:]) == pcapngByteOrder {
+				order = binary.LittleEndian
+			} else {
+				order = binary.BigEndian
+			}
+			ifaces = nil
+		}
+
+		length := int(order.Uint32(data[4:]))
+		if length < 12 || length%4 != 0 || length > len(data) {
+			return capture, errors.New("invalid block length")
+		}
+
+		body := data[8 : length-4]
+		data = data[length:]
+
+		switch btype {
+		case pcapngIDB:
+			if len(body) < 8 {
+				return capture, errors.New("invalid interface block")
+			}
+
+			iface := PcapInterface{
+				Index:    len(capture.Interfaces) + 1,
+				LinkType: int(order.Uint16(body)),
+			}
+			ngiface := pcapngInterface{index: iface.Index, tsunit: 1000000}
+
+			pcapngOptions(order, body[8:], func(code uint16, value []byte) {
+				switch {
+				case code == pcapngOptIfName:
+					iface.Name = string(bytes.TrimRight(value, "\x00"))
+				case code == pcapngOptIfTsresol && len(value) >= 1:
+					if value[0]&0x80 != 0 {
+						ngiface.tsunit = 1 << (value[0] & 0x3f)
+					} else {
+						ngiface.tsunit = 1
+						for i := byte(0); i < value[0] && i < 19; i++ {
+							ngiface.tsunit *= 10
+						}
+					}
+				case code == pcapngOptIfTsoffs && len(value) >= 8:
+					ngiface.tsoffs = int64(order.Uint64(value))
+				}
+			})
+
+			capture.Interfaces = append(capture.Interfaces, iface)
+			ifaces = append(ifaces, ngiface)
+
+		case pcapngEPB, pcapngPB:
+			if len(body) < 20 {
+				return capture, errors.New("invalid packet block")
+			}
+
+			id := int(order.Uint32(body))
+			if btype == pcapngPB {
+				id = int(order.Uint16(body))
+			}
+
+			if id >= len(ifaces) {
+				return capture, fmt.Errorf("invalid interface ID %d", id)
+			}
+
+			ts := uint64(order.Uint32(body[4:]))<<32 |
+				uint64(order.Uint32(body[8:]))
+			caplen := int(order.Uint32(body[12:]))
+			if caplen > len(body)-20 {
+				return capture, errors.New("truncated packet")
+			}
+
+			ngiface := ifaces[id]
+			sec := int64(ts/ngiface.tsunit) + ngiface.tsoffs
+			nsec := float64(ts%ngiface.tsunit) * 1e9 /
+				float64(ngiface.tsunit)
+
+			capture.Packets = append(capture.Packets, &PcapPacket{
+				Time:  time.Unix(sec, int64(nsec)),
+				Iface: ngiface.index,
+				Data:  body[20 : 20+caplen],
+			})
+
+		case pcapngSPB:
+			// Simple packets have neither interface nor time
+			if len(ifaces) == 0 || len(body) < 4 {
+				continue
+			}
+
+			capture.Packets = append(capture.Packets, &PcapPacket{
+				Iface: ifaces[0].index,
+				Data:  body[4:],
+			})
+		}
+	}
+
+	return capture, nil
+}
+
+// pcapngOptions decodes pcapng options and calls callback for each
+func pcapngOptions(order binary.ByteOrder, opts []byte,
+	callback func(code uint16, value []byte)) {
+
+	for len(opts) >= 4 {
+		code := order.Uint16(opts)
+		length := int(order.Uint16(opts[2:]))
+		if code == pcapngOptEnd || length > len(opts)-4 {
+			return
+		}
+
+		callback(code, opts[4:4+length])
+
+		length = (length + 3) &^ 3
+		if length > len(opts)-4 {
+			return
+		}
+		opts = opts[4+length:]
+	}
+}
+
+// Interface returns the capture interface by index
+func (capture *PcapCapture) Interface(index int) PcapInterface {
+	if index >= 1 && index <= len(capture.Interfaces) {
+		return capture.Interfaces[index-1]
+	}
+	return PcapInterface{Index: index}
+}
+
+// IPPackets decodes IP packets of the capture, reassembling
+// fragmented ones. Non-IP packets are skipped
+func (capture *PcapCapture) IPPackets() []*PcapIPPacket {
+	var packets []*PcapIPPacket
+	fragments := make(map[string][]*PcapIPPacket)
+
+	for _, pkt := range capture.Packets {
+		linkType := capture.Interface(pkt.Iface).LinkType
+		ip := pcapDecodeIP(pkt, pcapDecodeLink(linkType, pkt.Data))
+		if ip == nil {
+			continue
+		}
+
+		if ip.frag {
+			key := fmt.Sprintf("%s %s %d %d", ip.Src, ip.Dst, ip.Proto,
+				ip.fragID)
+			fragments[key] = append(fragments[key], ip)
+			ip = pcapReassemble(fragments[key])
+			if ip == nil {
+				continue
+			}
+			delete(fragments, key)
+		}
+
+		packets = append(packets, ip)
+	}
+
+	return packets
+}
+
+// pcapDecodeLink returns IP packet of the link-layer packet,
+// or nil, if packet is not IP
+func pcapDecodeLink(linkType int, data []byte) []byte {
+	var ethertype uint16
+
+	switch linkType {
+	case pcapngLinkRaw, pcapLinkRawAlt, pcapLinkIPv4, pcapLinkIPv6:
+		return data
+
+	case pcapLinkNull, pcapLinkLoop:
+		// 4-byte address family, in the capturing host byte order.
+		// Any non-zero value is fine, IP version is checked later
+		if len(data) < 4 {
+			return nil
+		}
+		return data[4:]
+
+	case pcapLinkEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		ethertype = binary.BigEndian.Uint16(data[12:])
+		data = data[14:]
+
+		// Skip VLAN tags
+		for (ethertype == 0x8100 || ethertype == 0x88a8) && len(data) >= 4 {
+			ethertype = binary.BigEndian.Uint16(data[2:])
+			data = data[4:]
+		}
+
+	case pcapLinkSLL:
+		if len(data) < 16 {
+			return nil
+		}
+		ethertype = binary.BigEndian.Uint16(data[14:])
+		data = data[16:]
+
+	case pcapLinkSLL2:
+		if len(data) < 20 {
+			return nil
+		}
+		ethertype = binary.BigEndian.Uint16(data)
+		data = data[20:]
+
+	default:
+		return nil
+	}
+
+	if ethertype != 0x0800 && ethertype != 0x86dd {
+		return nil
+	}
+
+	return data
+}
+
+// pcapDecodeIP decodes IPv4 or IPv6 packet. It returns nil,
+// if packet is malformed
+func pcapDecodeIP(pkt *PcapPacket, data []byte) *PcapIPPacket {
+	if len(data) < 1 {
+		return nil
+	}
+
+	ip := &PcapIPPacket{PcapPacket: pkt}
+
+	switch data[0] >> 4 {
+	case 4:
+		if len(data) < 20 {
+			return nil
+		}
+
+		hlen := int(data[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(data[2:]))
+		if hlen < 20 || total < hlen || total > len(data) {
+			return nil
+		}
+
+		ip.Src = net.IP(data[12:16])
+		ip.Dst = net.IP(data[16:20])
+		ip.Proto = data[9]
+		ip.Payload = data[hlen:total]
+
+		flags := binary.BigEndian.Uint16(data[6:])
+		ip.fragMore = flags&0x2000 != 0
+		ip.fragOff = int(flags&0x1fff) * 8
+		ip.fragID = uint32(binary.BigEndian.Uint16(data[4:]))
+		ip.frag = ip.fragMore || ip.fragOff != 0
+
+	case 6:
+		if len(data) < 40 {
+			return nil
+		}
+
+		plen := int(binary.BigEndian.Uint16(data[4:]))
+		if 40+plen > len(data) {
+			return nil
+		}
+
+		ip.Src = net.IP(data[8:24])
+		ip.Dst = net.IP(data[24:40])
+		ip.Proto = data[6]
+		ip.Payload = data[40 : 40+plen]
+
+		// Skip extension headers
+	loop:
+		for len(ip.Payload) >= 8 {
+			switch ip.Proto {
+			case 0, 43, 60: // Hop-by-hop, routing, destination
+				hlen := (int(ip.Payload[1]) + 1) * 8
+				if hlen > len(ip.Payload) {
+					return nil
+				}
+				ip.Proto = ip.Payload[0]
+				ip.Payload = ip.Payload[hlen:]
+
+			case 44: // Fragment
+				off := binary.BigEndian.Uint16(ip.Payload[2:])
+				ip.frag = true
+				ip.fragOff = int(off &^ 7)
+				ip.fragMore = off&1 != 0
+				ip.fragID = binary.BigEndian.Uint32(ip.Payload[4:])
+				ip.Proto = ip.Payload[0]
+				ip.Payload = ip.Payload[8:]
+
+			default:
+				break loop
+			}
+		}
+
+	default:
+		return nil
+	}
+
+	return ip
+}
+
+// pcapReassemble reassembles fragmented IP packet. It returns nil,
+// if some fragments are still missing
+func pcapReassemble(fragments []*PcapIPPacket) *PcapIPPacket {
+	sorted := make([]*PcapIPPacket, len(fragments))
+	copy(sorted, fragments)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].fragOff < sorted[j].fragOff
+	})
+
+	var payload []byte
+	for _, frag := range sorted {
+		if frag.fragOff > len(payload) {
+			return nil
+		}
+
+		if end := frag.fragOff + len(frag.Payload); end > len(payload) {
+			payload = append(payload[:frag.fragOff], frag.Payload...)
+		}
+
+		if !frag.fragMore {
+			last := fragments[len(fragments)-1]
+			return &PcapIPPacket{
+				PcapPacket: last.PcapPacket,
+				Src:        frag.Src,
+				Dst:        frag.Dst,
+				Proto:      frag.Proto,
+				Payload:    payload,
+			}
+		}
+	}
+
+	return nil
+}
+
+// PcapUDP represents the decoded UDP datagram
+type PcapUDP struct {
+	*PcapIPPacket
+	SrcPort, DstPort int    // UDP ports
+	Data             []byte // UDP payload
+}
+
+// UDP decodes UDP datagram of the IP packet. It returns nil,
+// if packet is not UDP
+func (ip *PcapIPPacket) UDP() *PcapUDP {
+	if ip.Proto != 17 || len(ip.Payload) < 8 {
+		return nil
+	}
+
+	length := int(binary.BigEndian.Uint16(ip.Payload[4:]))
+	if length < 8 || length > len(ip.Payload) {
+		// Length is zero for IPv6 jumbograms; just trust IP
+		length = len(ip.Payload)
+	}
+
+	return &PcapUDP{
+		PcapIPPacket: ip,
+		SrcPort:      int(binary.BigEndian.Uint16(ip.Payload)),
+		DstPort:      int(binary.BigEndian.Uint16(ip.Payload[2:])),
+		Data:         ip.Payload[8:length],
+	}
+}
+
+// PcapTCP represents the decoded TCP segment
+type PcapTCP struct {
+	*PcapIPPacket
+	SrcPort, DstPort int    // TCP ports
+	Seq              uint32 // Sequence number
+	Flags            byte   // TCP flags
+	Data             []byte // Segment payload
+}
+
+// TCP flags
+const (
+	pcapTCPFin = 0x01
+	pcapTCPSyn = 0x02
+	pcapTCPRst = 0x04
+	pcapTCPAck = 0x10
+)
+
+// TCP decodes TCP segment of the IP packet. It returns nil,
+// if packet is not TCP
+func (ip *PcapIPPacket) TCP() *PcapTCP {
+	if ip.Proto != 6 || len(ip.Payload) < 20 {
+		return nil
+	}
+
+	hlen := int(ip.Payload[12]>>4) * 4
+	if hlen < 20 || hlen > len(ip.Payload) {
+		return nil
+	}
+
+	return &PcapTCP{
+		PcapIPPacket: ip,
+		SrcPort:      int(binary.BigEndian.Uint16(ip.Payload)),
+		DstPort:      int(binary.BigEndian.Uint16(ip.Payload[2:])),
+		Seq:          binary.BigEndian.Uint32(ip.Payload[4:]),
+		Flags:        ip.Payload[13],
+		Data:         ip.Payload[hlen:],
+	}
+}
@@ -0,0 +1,400 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// pcap and pcapng capture files reader tests
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCaptureFile writes data into the temporary file
+// and loads it as capture
+func testCaptureFile(t *testing.T, data []byte) (*Capture, error) {
+	dir, err := ioutil.TempDir("", "airscan-discover-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "test.pcap")
+	err = ioutil.WriteFile(file, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return CaptureLoad(file)
+}
+
+// testPcapPacket is the packet of the synthesized classic pcap file
+type testPcapPacket struct {
+	time time.Time
+	data []byte // IP packet
+}
+
+// testPcap returns the classic pcap file with Ethernet link type
+func testPcap(order binary.ByteOrder, nano bool,
+	packets []testPcapPacket) []byte {
+
+	var buf bytes.Buffer
+
+	hdr := make([]byte, 24)
+	if nano {
+		order.PutUint32(hdr, pcapMagicNano)
+	} else {
+		order.PutUint32(hdr, pcapMagicMicro)
+	}
+	order.PutUint16(hdr[4:], 2)
+	order.PutUint16(hdr[6:], 4)
+	order.PutUint32(hdr[16:], 65535)
+	order.PutUint32(hdr[20:], pcapLinkEthernet)
+	buf.Write(hdr)
+
+	for _, pkt := range packets {
+		frame := make([]byte, 14, 14+len(pkt.data))
+		frame[12] = 0x08
+		if pkt.data[0]>>4 == 6 {
+			frame[12], frame[13] = 0x86, 0xdd
+		}
+		frame = append(frame, pkt.data...)
+
+		rec := make([]byte, 16)
+		order.PutUint32(rec, uint32(pkt.time.Unix()))
+		if nano {
+			order.PutUint32(rec[4:], uint32(pkt.time.Nanosecond()))
+		} else {
+			order.PutUint32(rec[4:], uint32(pkt.time.Nanosecond()/1000))
+		}
+		order.PutUint32(rec[8:], uint32(len(frame)))
+		order.PutUint32(rec[12:], uint32(len(frame)))
+		buf.Write(rec)
+		buf.Write(frame)
+	}
+
+	return buf.Bytes()
+}
+
+// testFragments splits IPv4 packet into fragments of the given
+// payload size (multiple of 8)
+func testFragments(packet []byte, size int) [][]byte {
+	hdr, payload := packet[:20], packet[20:]
+
+	var frags [][]byte
+	for off := 0; off < len(payload); off += size {
+		end := off + size
+		more := uint16(0x2000)
+		if end >= len(payload) {
+			end = len(payload)
+			more = 0
+		}
+
+		frag := append([]byte(nil), hdr...)
+		binary.BigEndian.PutUint16(frag[2:], uint16(20+end-off))
+		binary.BigEndian.PutUint16(frag[4:], 0x1234)
+		binary.BigEndian.PutUint16(frag[6:], more|uint16(off/8))
+		frags = append(frags, append(frag, payload[off:end]...))
+	}
+
+	return frags
+}
+
+// testProbeMatch is the WS-Discovery message of tests
+var testProbeMatch = testSOAP(
+	"<a:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/ProbeMatches</a:Action>"+
+		"<a:MessageID>urn:uuid:0c0ffee0-0000-4000-8000-000000000001</a:MessageID>",
+	strings.Repeat("<!-- padding -->", 200))
+
+// TestPcapngRoundTrip writes the trace with PcapngWriter and
+// loads it back
+func TestPcapngRoundTrip(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)
+	body := bytes.Repeat([]byte("0123456789abcdef"), 400)
+
+	manifest := &TraceManifest{
+		Format:      traceFormat,
+		Version:     Version,
+		CommandLine: []string{"airscan-discover", "-t"},
+		StartTime:   now,
+		Interfaces: []TraceInterface{
+			{Index: 2, Name: "eth0", Addrs: []string{"10.0.0.1/24"}},
+		},
+	}
+
+	entries := []*TraceEntry{
+		{
+			TraceMeta: TraceMeta{Time: now, Direction: "in",
+				Local: "10.0.0.1:3702", Remote: "10.0.0.2:3702",
+				Zone: "eth0"},
+			Name: "udp-from-10.0.0.2:3702",
+			Data: testProbeMatch,
+		},
+		{
+			TraceMeta: TraceMeta{Time: now.Add(time.Second),
+				Direction: "out", Local: "10.0.0.1:50000",
+				Remote: "10.0.0.2:80", Zone: "eth0", Method: "GET",
+				URL: "http://10.0.0.2:80/eSCL/ScannerCapabilities",
+				ID:  "http-1"},
+			Name: "http-request",
+		},
+		{
+			TraceMeta: TraceMeta{Time: now.Add(2 * time.Second),
+				Direction: "in", Local: "10.0.0.1:50000",
+				Remote: "10.0.0.2:80", Zone: "eth0", Status: 200,
+				Header: http.Header{"Content-Type": {"text/xml"}},
+				ID:     "http-1"},
+			Name: "http-response",
+			Data: body,
+		},
+	}
+
+	var buf bytes.Buffer
+	pw := NewPcapngWriter(&buf)
+	err := pw.WriteManifest(manifest)
+	for _, entry := range entries {
+		if err == nil {
+			err = pw.WriteEntry(entry)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	capture, err := testCaptureFile(t, buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(capture.Interfaces) != 1 || capture.Interfaces[0].Name != "eth0" {
+		t.Errorf("interfaces: %+v", capture.Interfaces)
+	}
+
+	got := capture.Trace.Entries
+	if len(got) != 3 {
+		t.Fatalf("%d records, expected 3", len(got))
+	}
+
+	if got[0].Name != "udp-from-10.0.0.2:3702" ||
+		!bytes.Equal(got[0].Data, testProbeMatch) ||
+		!got[0].Time.Equal(now) || got[0].Zone != "eth0" {
+		t.Errorf("udp: %s %s %s", got[0].Name, got[0].Time, got[0].Zone)
+	}
+
+	if got[1].Name != "http-request" || got[1].Method != "GET" ||
+		got[1].URL != entries[1].URL {
+		t.Errorf("request: %s %s %s", got[1].Name, got[1].Method,
+			got[1].URL)
+	}
+
+	if got[2].Name != "http-response" || got[2].Status != 200 ||
+		!bytes.Equal(got[2].Data, body) ||
+		got[2].Header.Get("Content-Type") != "text/xml" ||
+		!got[2].Time.Equal(entries[2].Time) {
+		t.Errorf("response: %s %d, %d bytes", got[2].Name,
+			got[2].Status, len(got[2].Data))
+	}
+}
+
+// TestPcapClassic loads the classic pcap files of both byte
+// orders and timestamp resolutions
+func TestPcapClassic(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.1.20"), Port: 3702}
+	dst := &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 3702}
+	packet := pcapngIP(src.IP, dst.IP, 17,
+		pcapngUDP(src, dst, testProbeMatch))
+
+	src6 := &net.TCPAddr{IP: net.ParseIP("fe80::1"), Port: 3702}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("fe80::2"), Port: 3702}
+	packet6 := pcapngIP(src6.IP, dst6.IP, 17,
+		pcapngUDP(src6, dst6, testProbeMatch))
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian,
+		binary.BigEndian} {
+		for _, nano := range []bool{false, true} {
+			data := testPcap(order, nano, []testPcapPacket{
+				{now, packet},
+				{now.Add(time.Millisecond), packet6},
+			})
+
+			capture, err := testCaptureFile(t, data)
+			if err != nil {
+				t.Errorf("%s nano=%v: %s", order, nano, err)
+				continue
+			}
+
+			entries := capture.Trace.Entries
+			if len(entries) != 2 {
+				t.Errorf("%s nano=%v: %d records", order, nano,
+					len(entries))
+				continue
+			}
+
+			if entries[0].Name != "udp-from-192.168.1.20:3702" ||
+				!bytes.Equal(entries[0].Data, testProbeMatch) ||
+				!entries[0].Time.Equal(now) {
+				t.Errorf("%s nano=%v: %s %s", order, nano,
+					entries[0].Name, entries[0].Time)
+			}
+
+			if entries[1].Name != "udp-from-[fe80::1%if1]:3702" {
+				t.Errorf("%s nano=%v: %s", order, nano,
+					entries[1].Name)
+			}
+		}
+	}
+}
+
+// TestPcapFragments loads the capture with fragmented UDP datagram
+// and TCP segments, that come out of order and retransmitted
+func TestPcapFragments(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Fragmented UDP, fragments are reordered
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 3702}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 3702}
+	frags := testFragments(pcapngIP(src.IP, dst.IP, 17,
+		pcapngUDP(src, dst, testProbeMatch)), 1480)
+	if len(frags) < 3 {
+		t.Fatalf("%d fragments", len(frags))
+	}
+
+	var packets []testPcapPacket
+	for _, i := range []int{1, 2, 0} {
+		packets = append(packets, testPcapPacket{now, frags[i]})
+	}
+
+	// TCP, segments are reordered and retransmitted
+	client := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000}
+	server := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80}
+	request := []byte("GET /eSCL/ScannerStatus HTTP/1.1\r\n" +
+		"Host: 10.0.0.2\r\n\r\n")
+	response := []byte("HTTP/1.1 200 OK\r\nContent-Length: 6\r\n\r\n" +
+		"status")
+
+	tcp := func(at int, fromClient bool, seq uint32, flags byte,
+		data []byte) testPcapPacket {
+		s, d := client, server
+		if !fromClient {
+			s, d = server, client
+		}
+		return testPcapPacket{
+			now.Add(time.Duration(at) * time.Millisecond),
+			pcapngIP(s.IP, d.IP, 6, pcapngTCP(s, d, seq, 0, flags, data)),
+		}
+	}
+
+	packets = append(packets,
+		tcp(1, true, 999, pcapngSYN, nil),
+		tcp(2, false, 1999, pcapngSYN|pcapngACK, nil),
+		tcp(3, true, 1010, pcapngACK, request[10:]),
+		tcp(4, true, 1000, pcapngACK, request[:10]),
+		tcp(5, true, 1000, pcapngACK, request[:10]),
+		tcp(6, false, 2000, pcapngACK, response[:20]),
+		tcp(7, false, 2000, pcapngACK, response),
+	)
+
+	capture, err := testCaptureFile(t, testPcap(binary.LittleEndian,
+		false, packets))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := capture.Trace.Entries
+	if len(entries) != 3 {
+		t.Fatalf("%d records, expected 3", len(entries))
+	}
+
+	if entries[0].Name != "udp-from-10.0.0.2:3702" ||
+		!bytes.Equal(entries[0].Data, testProbeMatch) {
+		t.Errorf("udp: %s, %d bytes", entries[0].Name,
+			len(entries[0].Data))
+	}
+
+	if entries[1].Name != "http-request" ||
+		entries[1].URL != "http://10.0.0.2:80/eSCL/ScannerStatus" {
+		t.Errorf("request: %s %s", entries[1].Name, entries[1].URL)
+	}
+
+	if entries[2].Name != "http-response" ||
+		string(entries[2].Data) != "status" {
+		t.Errorf("response: %s %q", entries[2].Name, entries[2].Data)
+	}
+}
+
+// TestPcapMalformed loads truncated and malformed captures
+func TestPcapMalformed(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	src := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 3702}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 3702}
+	packet := pcapngIP(src.IP, dst.IP, 17,
+		pcapngUDP(src, dst, testProbeMatch))
+
+	pcap := testPcap(binary.LittleEndian, false, []testPcapPacket{
+		{now, packet},
+		{now, packet[:10]},                     // Truncated IP header
+		{now, append([]byte{0x75}, packet...)}, // Wrong IP version
+		{now, packet},
+	})
+
+	// Malformed packets are skipped
+	capture, err := testCaptureFile(t, pcap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(capture.Trace.Entries); n != 2 {
+		t.Errorf("malformed packets: %d records, expected 2", n)
+	}
+
+	// pcapng with the single UDP record
+	var buf bytes.Buffer
+	pw := NewPcapngWriter(&buf)
+	err = pw.WriteEntry(&TraceEntry{
+		TraceMeta: TraceMeta{Time: now, Direction: "in",
+			Local: "10.0.0.1:3702", Zone: "eth0"},
+		Name: "udp-from-10.0.0.2:3702",
+		Data: testProbeMatch,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcapng := buf.Bytes()
+
+	// Length of the section header is not a multiple of 4
+	invalid := append([]byte(nil), pcapng...)
+	binary.LittleEndian.PutUint32(invalid[4:],
+		binary.LittleEndian.Uint32(invalid[4:])+1)
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"empty", nil, "not a pcap file"},
+		{"garbage", []byte(strings.Repeat("garbage ", 4)),
+			"not a pcap file"},
+		{"pcap truncated", pcap[:len(pcap)-10], "truncated packet"},
+		{"pcapng truncated", pcapng[:len(pcapng)-10],
+			"invalid block length"},
+		{"pcapng invalid length", invalid, "invalid block length"},
+	}
+
+	for _, test := range tests {
+		_, err := testCaptureFile(t, test.data)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, expected %q", test.name, err,
+				test.err)
+		}
+	}
+}
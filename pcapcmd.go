@@ -0,0 +1,107 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The "pcap" command: discovery from the packet capture
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// pcapUsage is the usage template of the pcap command
+const pcapUsage = `Usage:
+    %s pcap [options] capture.pcap
+
+Discover devices from the existing pcap or pcapng packet capture
+(i.e., made with tcpdump or Wireshark), instead of the network.
+
+WS-Discovery messages (UDP port 3702), HTTP exchanges with devices
+and mDNS responses (UDP port 5353) are extracted from the capture
+and handled the same way, as during the network discovery. Devices,
+that would be discovered, are printed as airscan.conf [devices]
+section, followed by responders, that were ignored, and the reasons.
+
+The capture should include the discovery from its very beginning;
+the probes and metadata requests, that were not captured, can't
+be replayed.
+
+Options are:
+` + usageLogOptions + usageHelpOption
+
+// cmdPcap handles the pcap command
+func cmdPcap(args []string) {
+	// Parse options
+	opts := NewOptions(args, pcapUsage)
+	for opts.Next() {
+		opts.Common()
+	}
+
+	if len(opts.Args()) != 1 {
+		opts.Fail("Capture file must be specified")
+	}
+
+	file := opts.Args()[0]
+	if !PcapIsCapture(file) {
+		LogFatal("%s: not a pcap or pcapng file", file)
+	}
+
+	replayStart(file)
+
+	endpoints := Discover(DiscoveryTime, nil)
+	LogCheck(OutputConf(os.Stdout, endpoints))
+	pcapOutputIgnored(os.Stdout, endpoints, discoveryReport.Entries())
+}
+
+// pcapOutputIgnored writes reasons, why responders were ignored,
+// as airscan.conf comments. Responders, that yielded some device,
+// are not reported
+func pcapOutputIgnored(w io.Writer, endpoints []Endpoint,
+	entries []ReportEntry) {
+
+	found := make(map[string]bool)
+	for _, endpoint := range endpoints {
+		found[endpoint.Source] = true
+	}
+
+	var ignored []ReportEntry
+	for _, entry := range entries {
+		if entry.Outcome != OutcomeAccepted && !found[entry.Source] {
+			ignored = append(ignored, entry)
+		}
+	}
+
+	if len(ignored) == 0 {
+		return
+	}
+
+	sort.SliceStable(ignored, func(i, j int) bool {
+		return reportAddrLess(ignored[i].Source, ignored[j].Source)
+	})
+
+	fmt.Fprintf(w, "\n; Ignored responders:\n")
+	source := ""
+	for i, entry := range ignored {
+		if i == 0 || entry.Source != source {
+			source = entry.Source
+			fmt.Fprintf(w, ";   %s:\n", source)
+		}
+
+		reason := entry.Outcome
+		if entry.Detail != "" {
+			reason += ": " + entry.Detail
+		}
+
+		if entry.Name != "" {
+			fmt.Fprintf(w, ";     %s: %s: %s\n", entry.Backend,
+				reportName(entry), reason)
+		} else {
+			fmt.Fprintf(w, ";     %s: %s\n", entry.Backend, reason)
+		}
+	}
+}
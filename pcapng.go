@@ -0,0 +1,715 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Protocol trace in the pcapng format
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pcapng block types
+const (
+	pcapngSHB = 0x0A0D0D0A // Section Header Block
+	pcapngIDB = 0x00000001 // Interface Description Block
+	pcapngEPB = 0x00000006 // Enhanced Packet Block
+)
+
+// pcapng options
+const (
+	pcapngOptEnd         = 0 // End of options
+	pcapngOptComment     = 1 // Comment, all blocks
+	pcapngOptShbUserAppl = 4 // SHB: application
+	pcapngOptIfName      = 2 // IDB: interface name
+	pcapngOptIfIPv4Addr  = 4 // IDB: IPv4 address and mask
+	pcapngOptIfIPv6Addr  = 5 // IDB: IPv6 address and prefix
+	pcapngOptIfTsresol   = 9 // IDB: timestamp resolution
+	pcapngOptEpbFlags    = 2 // EPB: flags (direction)
+)
+
+// pcapngLinkRaw is the link type of raw IPv4/IPv6 packets
+const pcapngLinkRaw = 101
+
+// pcapngMSS is the maximum size of synthesized TCP segments
+const pcapngMSS = 1460
+
+// PcapngWriter writes the protocol trace in the pcapng format,
+// so it can be loaded into Wireshark. UDP messages are written as
+// synthesized IP/UDP packets, and HTTP exchanges are written as
+// synthesized TCP streams. Each packet is attributed to its network
+// interface and carries the trace record name as a comment
+type PcapngWriter struct {
+	w         io.Writer              // Underlying writer
+	started   bool                   // Section header written
+	ifaces    map[string]uint32      // Interface IDs by name
+	addrs     map[string][]net.IP    // Interface addresses by name
+	conns     map[string]*pcapngConn // TCP connections by addresses
+	exchanges map[string]*pcapngConn // TCP connections by exchange ID
+	last      *pcapngConn            // Connection of the last request
+	nextPort  int                    // Next synthesized port
+}
+
+// pcapngConn represents the synthesized TCP connection
+type pcapngConn struct {
+	iface          uint32       // Interface ID
+	client, server *net.TCPAddr // Connection addresses
+	clientSeq      uint32       // Next sequence number of client
+	serverSeq      uint32       // Next sequence number of server
+}
+
+// NewPcapngWriter creates a new PcapngWriter
+func NewPcapngWriter(w io.Writer) *PcapngWriter {
+	return &PcapngWriter{
+		w:         w,
+		ifaces:    make(map[string]uint32),
+		addrs:     make(map[string][]net.IP),
+		conns:     make(map[string]*pcapngConn),
+		exchanges: make(map[string]*pcapngConn),
+		nextPort:  49152,
+	}
+}
+
+// WriteManifest writes the section header, that describes the
+// traced session, and its network interfaces. It must be called
+// before any record is written
+func (pw *PcapngWriter) WriteManifest(manifest *TraceManifest) error {
+	var opts bytes.Buffer
+
+	pcapngOption(&opts, pcapngOptShbUserAppl,
+		[]byte("airscan-discover "+manifest.Version))
+	pcapngOption(&opts, pcapngOptComment,
+		[]byte(fmt.Sprintf("%s, started at %s",
+			strings.Join(manifest.CommandLine, " "),
+			manifest.StartTime.Format(time.RFC3339Nano))))
+
+	err := pw.section(opts.Bytes())
+
+	for _, iface := range manifest.Interfaces {
+		if err != nil {
+			break
+		}
+
+		var nets []*net.IPNet
+		for _, addr := range iface.Addrs {
+			ip, ipnet, err := net.ParseCIDR(addr)
+			if err == nil {
+				ipnet.IP = ip
+				nets = append(nets, ipnet)
+				pw.addrs[iface.Name] = append(pw.addrs[iface.Name], ip)
+			}
+		}
+
+		_, err = pw.iface(iface.Name, nets)
+	}
+
+	return err
+}
+
+// WriteEntry writes the trace record
+func (pw *PcapngWriter) WriteEntry(entry *TraceEntry) error {
+	if !pw.started {
+		err := pw.section(nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case entry.UDPTo() != nil || entry.UDPFrom() != nil:
+		return pw.writeUDP(entry)
+	case entry.Name == "http-request":
+		return pw.writeHTTPRequest(entry)
+	case entry.Name == "http-response":
+		return pw.writeHTTPResponse(entry)
+	}
+
+	// Other records (i.e., http-error) have no packets
+	return nil
+}
+
+// Close closes the underlying writer, if it is io.Closer
+func (pw *PcapngWriter) Close() error {
+	if closer, ok := pw.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// writeUDP writes the UDP message record
+func (pw *PcapngWriter) writeUDP(entry *TraceEntry) error {
+	out := entry.UDPTo() != nil
+	remote := entry.UDPTo()
+	if !out {
+		remote = entry.UDPFrom()
+	}
+
+	zone := entry.Zone
+	if zone == "" {
+		zone = remote.Zone
+	}
+
+	local := pcapngParseAddr(entry.Local)
+	if local == nil {
+		local = &net.TCPAddr{}
+	}
+	if local.IP == nil || local.IP.IsUnspecified() {
+		local.IP = pw.ifaceAddr(zone, remote.IP)
+	}
+	if zone == "" {
+		zone = pw.ifaceByAddr(local.IP)
+	}
+
+	iface, err := pw.iface(zone, nil)
+	if err != nil {
+		return err
+	}
+
+	src, dst := local, &net.TCPAddr{IP: remote.IP, Port: remote.Port}
+	if !out {
+		src, dst = dst, src
+	}
+
+	packet := pcapngIP(src.IP, dst.IP, 17,
+		pcapngUDP(src, dst, entry.Data))
+
+	return pw.packet(iface, entry, out, packet, pcapngComment(entry))
+}
+
+// writeHTTPRequest writes the HTTP request record
+func (pw *PcapngWriter) writeHTTPRequest(entry *TraceEntry) error {
+	// Requests, served by this program, come from the remote side
+	out := entry.Direction != "in"
+	client, server := entry.Local, entry.Remote
+	if !out {
+		client, server = server, client
+	}
+
+	conn, err := pw.conn(pcapngParseAddr(client), pcapngParseAddr(server),
+		entry)
+	if err != nil {
+		return err
+	}
+
+	if entry.ID != "" {
+		pw.exchanges[entry.ID] = conn
+	}
+	pw.last = conn
+
+	return pw.stream(conn, entry, true, out, pcapngHTTPRequest(entry))
+}
+
+// writeHTTPResponse writes the HTTP response record
+func (pw *PcapngWriter) writeHTTPResponse(entry *TraceEntry) error {
+	conn := pw.exchanges[entry.ID]
+	if conn == nil && entry.ID == "" {
+		conn = pw.last
+	}
+
+	if conn == nil {
+		// Request is not in the trace
+		return nil
+	}
+
+	delete(pw.exchanges, entry.ID)
+	out := entry.Direction == "out"
+
+	return pw.stream(conn, entry, false, out, pcapngHTTPResponse(entry))
+}
+
+// conn returns the TCP connection between client and server. The
+// new connection starts with the synthesized handshake. Old traces
+// have no addresses; they are taken from the URL or synthesized
+func (pw *PcapngWriter) conn(client, server *net.TCPAddr,
+	entry *TraceEntry) (*pcapngConn, error) {
+
+	if server == nil {
+		server = &net.TCPAddr{IP: net.IPv4zero, Port: 80}
+		if u, err := url.Parse(entry.URL); err == nil {
+			if ip := net.ParseIP(u.Hostname()); ip != nil {
+				server.IP = ip
+			}
+			if port, err := strconv.Atoi(u.Port()); err == nil {
+				server.Port = port
+			}
+		}
+	}
+
+	if client == nil {
+		client = &net.TCPAddr{IP: net.IPv4zero, Port: pw.nextPort}
+		if server.IP.To4() == nil {
+			client.IP = net.IPv6unspecified
+		}
+		pw.nextPort++
+	}
+
+	key := client.String() + " " + server.String()
+	if conn := pw.conns[key]; conn != nil {
+		return conn, nil
+	}
+
+	zone := entry.Zone
+	if zone == "" {
+		zone = client.Zone
+	}
+	if zone == "" {
+		zone = pw.ifaceByAddr(client.IP)
+	}
+	if zone == "" {
+		zone = pw.ifaceByAddr(server.IP)
+	}
+
+	iface, err := pw.iface(zone, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &pcapngConn{
+		iface:     iface,
+		client:    client,
+		server:    server,
+		clientSeq: 1000,
+		serverSeq: 2000,
+	}
+	pw.conns[key] = conn
+
+	// Handshake: SYN, SYN-ACK, ACK
+	out := entry.Direction != "in"
+	err = pw.segment(conn, entry, true, out, pcapngSYN, nil, "")
+	if err == nil {
+		err = pw.segment(conn, entry, false, !out,
+			pcapngSYN|pcapngACK, nil, "")
+	}
+	if err == nil {
+		err = pw.segment(conn, entry, true, out, pcapngACK, nil, "")
+	}
+
+	return conn, err
+}
+
+// stream writes data into the TCP connection, split into segments
+func (pw *PcapngWriter) stream(conn *pcapngConn, entry *TraceEntry,
+	fromClient, out bool, data []byte) error {
+
+	comment := pcapngComment(entry)
+	for len(data) > 0 {
+		n := len(data)
+		if n > pcapngMSS {
+			n = pcapngMSS
+		}
+
+		err := pw.segment(conn, entry, fromClient, out,
+			pcapngACK|pcapngPSH, data[:n], comment)
+		if err != nil {
+			return err
+		}
+
+		data = data[n:]
+	}
+
+	return nil
+}
+
+// TCP flags
+const (
+	pcapngSYN = 0x02
+	pcapngPSH = 0x08
+	pcapngACK = 0x10
+)
+
+// segment writes the TCP segment
+func (pw *PcapngWriter) segment(conn *pcapngConn, entry *TraceEntry,
+	fromClient, out bool, flags byte, data []byte, comment string) error {
+
+	src, dst := conn.client, conn.server
+	seq, ack := &conn.clientSeq, &conn.serverSeq
+	if !fromClient {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+
+	ackNum := *ack
+	if flags&pcapngACK == 0 {
+		ackNum = 0
+	}
+
+	packet := pcapngIP(src.IP, dst.IP, 6,
+		pcapngTCP(src, dst, *seq, ackNum, flags, data))
+
+	*seq += uint32(len(data))
+	if flags&pcapngSYN != 0 {
+		*seq++
+	}
+
+	return pw.packet(conn.iface, entry, out, packet, comment)
+}
+
+// section writes the section header block
+func (pw *PcapngWriter) section(opts []byte) error {
+	var body bytes.Buffer
+
+	binary.Write(&body, binary.LittleEndian, uint32(0x1A2B3C4D))
+	binary.Write(&body, binary.LittleEndian, uint16(1))
+	binary.Write(&body, binary.LittleEndian, uint16(0))
+	binary.Write(&body, binary.LittleEndian, int64(-1))
+	body.Write(opts)
+	if len(opts) != 0 {
+		binary.Write(&body, binary.LittleEndian, uint32(pcapngOptEnd))
+	}
+
+	pw.started = true
+	return pw.block(pcapngSHB, body.Bytes())
+}
+
+// iface returns ID of the interface, writing its description
+// block on demand
+func (pw *PcapngWriter) iface(name string, nets []*net.IPNet) (uint32, error) {
+	if name == "" {
+		name = "unknown"
+	}
+
+	if id, ok := pw.ifaces[name]; ok {
+		return id, nil
+	}
+
+	var body, opts bytes.Buffer
+
+	pcapngOption(&opts, pcapngOptIfName, []byte(name))
+	pcapngOption(&opts, pcapngOptIfTsresol, []byte{9})
+
+	for _, ipnet := range nets {
+		ones, _ := ipnet.Mask.Size()
+		if ip := ipnet.IP.To4(); ip != nil {
+			value := append(append([]byte{}, ip...),
+				net.CIDRMask(ones, 32)...)
+			pcapngOption(&opts, pcapngOptIfIPv4Addr, value)
+		} else {
+			value := append(append([]byte{}, ipnet.IP.To16()...),
+				byte(ones))
+			pcapngOption(&opts, pcapngOptIfIPv6Addr, value)
+		}
+	}
+
+	binary.Write(&body, binary.LittleEndian, uint16(pcapngLinkRaw))
+	binary.Write(&body, binary.LittleEndian, uint16(0))
+	binary.Write(&body, binary.LittleEndian, uint32(0))
+	pcapngOptionsEnd(&opts)
+	body.Write(opts.Bytes())
+
+	id := uint32(len(pw.ifaces))
+	pw.ifaces[name] = id
+
+	return id, pw.block(pcapngIDB, body.Bytes())
+}
+
+// ifaceAddr returns address of the interface of the same family,
+// as the peer address. Link-local peers prefer link-local address
+func (pw *PcapngWriter) ifaceAddr(name string, peer net.IP) net.IP {
+	ipv4 := peer.To4() != nil
+	linkLocal := peer.IsLinkLocalUnicast() || peer.IsLinkLocalMulticast()
+
+	var found net.IP
+	for _, ip := range pw.addrs[name] {
+		switch {
+		case (ip.To4() != nil) != ipv4:
+		case found == nil:
+			found = ip
+		case ip.IsLinkLocalUnicast() == linkLocal:
+			return ip
+		}
+	}
+
+	switch {
+	case found != nil:
+		return found
+	case ipv4:
+		return net.IPv4zero
+	}
+
+	return net.IPv6unspecified
+}
+
+// ifaceByAddr returns name of the interface with the address
+func (pw *PcapngWriter) ifaceByAddr(addr net.IP) string {
+	for name, addrs := range pw.addrs {
+		for _, ip := range addrs {
+			if ip.Equal(addr) {
+				return name
+			}
+		}
+	}
+
+	return ""
+}
+
+// packet writes the enhanced packet block
+func (pw *PcapngWriter) packet(iface uint32, entry *TraceEntry, out bool,
+	packet []byte, comment string) error {
+
+	var body, opts bytes.Buffer
+
+	ts := uint64(0)
+	if !entry.Time.IsZero() {
+		ts = uint64(entry.Time.UnixNano())
+	}
+
+	binary.Write(&body, binary.LittleEndian, iface)
+	binary.Write(&body, binary.LittleEndian, uint32(ts>>32))
+	binary.Write(&body, binary.LittleEndian, uint32(ts))
+	binary.Write(&body, binary.LittleEndian, uint32(len(packet)))
+	binary.Write(&body, binary.LittleEndian, uint32(len(packet)))
+	body.Write(packet)
+	pcapngPad(&body)
+
+	if comment != "" {
+		pcapngOption(&opts, pcapngOptComment, []byte(comment))
+	}
+
+	flags := uint32(1) // Inbound
+	if out {
+		flags = 2 // Outbound
+	}
+
+	var value [4]byte
+	binary.LittleEndian.PutUint32(value[:], flags)
+	pcapngOption(&opts, pcapngOptEpbFlags, value[:])
+	pcapngOptionsEnd(&opts)
+	body.Write(opts.Bytes())
+
+	return pw.block(pcapngEPB, body.Bytes())
+}
+
+// block writes the pcapng block
+func (pw *PcapngWriter) block(btype uint32, body []byte) error {
+	var buf bytes.Buffer
+
+	length := uint32(12 + len(body))
+	binary.Write(&buf, binary.LittleEndian, btype)
+	binary.Write(&buf, binary.LittleEndian, length)
+	buf.Write(body)
+	binary.Write(&buf, binary.LittleEndian, length)
+
+	_, err := pw.w.Write(buf.Bytes())
+	return err
+}
+
+// pcapngOption appends option to the options list
+func pcapngOption(opts *bytes.Buffer, code uint16, value []byte) {
+	binary.Write(opts, binary.LittleEndian, code)
+	binary.Write(opts, binary.LittleEndian, uint16(len(value)))
+	opts.Write(value)
+	pcapngPad(opts)
+}
+
+// pcapngOptionsEnd terminates the options list
+func pcapngOptionsEnd(opts *bytes.Buffer) {
+	if opts.Len() != 0 {
+		binary.Write(opts, binary.LittleEndian, uint32(pcapngOptEnd))
+	}
+}
+
+// pcapngPad pads buffer to the 32-bit boundary
+func pcapngPad(buf *bytes.Buffer) {
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+// pcapngComment returns the packet comment for the trace record
+func pcapngComment(entry *TraceEntry) string {
+	comment := fmt.Sprintf("%.3d-%s", entry.Index, entry.Name)
+	if entry.ID != "" {
+		comment += " " + entry.ID
+	}
+	return comment
+}
+
+// pcapngParseAddr parses the "host:port" address. It returns nil,
+// if address is missed or invalid
+func pcapngParseAddr(addr string) *net.TCPAddr {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil
+	}
+
+	var zone string
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+
+	ip := net.ParseIP(host)
+	n, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil
+	}
+
+	return &net.TCPAddr{IP: ip, Port: n, Zone: zone}
+}
+
+// pcapngIP returns the synthesized IPv4 or IPv6 packet
+func pcapngIP(src, dst net.IP, proto byte, payload []byte) []byte {
+	var hdr []byte
+
+	if src.To4() != nil && dst.To4() != nil {
+		hdr = make([]byte, 20)
+		hdr[0] = 0x45
+		binary.BigEndian.PutUint16(hdr[2:], uint16(20+len(payload)))
+		binary.BigEndian.PutUint16(hdr[6:], 0x4000) // Don't fragment
+		hdr[8] = 64
+		hdr[9] = proto
+		copy(hdr[12:], src.To4())
+		copy(hdr[16:], dst.To4())
+		binary.BigEndian.PutUint16(hdr[10:], pcapngChecksum(hdr))
+	} else {
+		hdr = make([]byte, 40)
+		hdr[0] = 0x60
+		binary.BigEndian.PutUint16(hdr[4:], uint16(len(payload)))
+		hdr[6] = proto
+		hdr[7] = 64
+		copy(hdr[8:], src.To16())
+		copy(hdr[24:], dst.To16())
+	}
+
+	// Transport checksum
+	var pseudo []byte
+	if len(hdr) == 20 {
+		pseudo = append(pseudo, hdr[12:20]...)
+		pseudo = append(pseudo, 0, proto)
+		pseudo = append(pseudo, byte(len(payload)>>8), byte(len(payload)))
+	} else {
+		pseudo = append(pseudo, hdr[8:40]...)
+		pseudo = append(pseudo, byte(len(payload)>>24),
+			byte(len(payload)>>16), byte(len(payload)>>8),
+			byte(len(payload)), 0, 0, 0, proto)
+	}
+
+	off := 16 // TCP
+	if proto == 17 {
+		off = 6 // UDP
+	}
+
+	sum := pcapngChecksum(append(pseudo, payload...))
+	if sum == 0 && proto == 17 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(payload[off:], sum)
+
+	return append(hdr, payload...)
+}
+
+// pcapngUDP returns the synthesized UDP datagram, without checksum
+func pcapngUDP(src, dst *net.TCPAddr, data []byte) []byte {
+	udp := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(data)))
+	return append(udp, data...)
+}
+
+// pcapngTCP returns the synthesized TCP segment, without checksum
+func pcapngTCP(src, dst *net.TCPAddr, seq, ack uint32, flags byte,
+	data []byte) []byte {
+
+	tcp := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint16(tcp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	return append(tcp, data...)
+}
+
+// pcapngChecksum computes the Internet checksum
+func pcapngChecksum(data []byte) uint16 {
+	var sum uint32
+
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 != 0 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+
+	return ^uint16(sum)
+}
+
+// pcapngHTTPRequest reconstructs HTTP request from the trace record
+func pcapngHTTPRequest(entry *TraceEntry) []byte {
+	var buf bytes.Buffer
+
+	method, uri, host := entry.Method, "/", ""
+	if method == "" {
+		method = "POST"
+	}
+
+	if u, err := url.Parse(entry.URL); err == nil && entry.URL != "" {
+		uri = u.RequestURI()
+		host = u.Host
+
+		// Zone is not sent in the Host header
+		if i := strings.IndexByte(host, '%'); i >= 0 {
+			if j := strings.IndexByte(host, ']'); j > i {
+				host = host[:i] + host[j:]
+			}
+		}
+	}
+
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\n", method, uri)
+	if host != "" {
+		fmt.Fprintf(&buf, "Host: %s\r\n", host)
+	}
+
+	pcapngHTTPHeader(&buf, entry)
+	return buf.Bytes()
+}
+
+// pcapngHTTPResponse reconstructs HTTP response from the trace record
+func pcapngHTTPResponse(entry *TraceEntry) []byte {
+	var buf bytes.Buffer
+
+	status := entry.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	fmt.Fprintf(&buf, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	pcapngHTTPHeader(&buf, entry)
+	return buf.Bytes()
+}
+
+// pcapngHTTPHeader writes HTTP headers and body. Old traces have
+// no headers; their messages are SOAP
+func pcapngHTTPHeader(buf *bytes.Buffer, entry *TraceEntry) {
+	header := entry.Header
+	if header == nil {
+		header = http.Header{
+			"Content-Type": {"application/soap+xml; charset=utf-8"},
+		}
+	}
+
+	header.WriteSubset(buf, map[string]bool{
+		"Host":              true,
+		"Content-Length":    true,
+		"Transfer-Encoding": true,
+	})
+
+	fmt.Fprintf(buf, "Content-Length: %d\r\n\r\n", len(entry.Data))
+	buf.Write(entry.Data)
+}
@@ -0,0 +1,393 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Protocol trace redaction
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// TraceRedact enables redaction of the protocol trace
+var TraceRedact = false
+
+// traceRedactor is used for redaction of the protocol trace
+// at capture time
+var traceRedactor = NewRedactor()
+
+// Redactor consistently replaces sensitive data (IP and MAC addresses,
+// UUIDs, serial numbers, host and client names) with pseudonyms.
+// The same value is always replaced with the same pseudonym, so
+// redacted messages still relate to each other, and the redacted
+// trace can be replayed
+type Redactor struct {
+	pseudonyms map[string]string // Pseudonyms by original value
+	counters   map[string]int    // Pseudonym counters by kind
+	serials    []string          // Known serial numbers
+	hosts      []string          // Known host names
+	clients    []string          // Known client names
+	public     map[string]bool   // Hosts of namespaces, not redacted
+	lock       sync.Mutex
+}
+
+// redactRegexp matches UUIDs, MAC addresses, IPv4 and IPv6 addresses.
+// IPv6 candidates are verified by parsing
+var redactRegexp = regexp.MustCompile(
+	`[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}|` +
+		`\b[0-9A-Fa-f]{2}(?:-[0-9A-Fa-f]{2}){5}\b|` +
+		`\b[0-9]{1,3}(?:\.[0-9]{1,3}){3}\b|` +
+		`[0-9A-Fa-f]*:[0-9A-Fa-f:]*:[0-9A-Fa-f.]*`)
+
+// redactMACRegexp matches MAC address, colon or dash separated
+var redactMACRegexp = regexp.MustCompile(
+	`^[0-9A-Fa-f]{2}(?::[0-9A-Fa-f]{2}){5}$|^[0-9A-Fa-f]{2}(?:-[0-9A-Fa-f]{2}){5}$`)
+
+// redactURLRegexp matches URLs in the text
+var redactURLRegexp = regexp.MustCompile(`[A-Za-z][A-Za-z0-9+.-]*://[^\s"'<>]+`)
+
+// redactSerialRegexp matches serial numbers, labeled in the text,
+// i.e., "Serial: 1234567890". Serial numbers contain digits
+var redactSerialRegexp = regexp.MustCompile(
+	`(?i)\bserial(?:[ _]?number|[ _]?no)?(?:[ \t]*[:=#][ \t]*|[ \t]+)` +
+		`([A-Za-z0-9-]*[0-9][A-Za-z0-9-]*)`)
+
+// redactNsRegexp matches XML namespace declarations
+var redactNsRegexp = regexp.MustCompile(`xmlns(?::\w+)?="([^"]*)"`)
+
+// NewRedactor creates a new Redactor. The local host name is
+// learned in advance, as it is sent by this program, i.e., as
+// the ClientDisplayName of the events command
+func NewRedactor() *Redactor {
+	r := &Redactor{
+		pseudonyms: make(map[string]string),
+		counters:   make(map[string]int),
+		public:     make(map[string]bool),
+	}
+
+	// Hosts of protocol namespaces and actions must be kept,
+	// otherwise redacted messages can't be decoded
+	for _, nsmap := range []map[string]string{wsddNsMap, esclNsMap} {
+		for ns := range nsmap {
+			r.learnNamespace(ns)
+		}
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		r.learnValue(&r.hosts, "host", hostname)
+	}
+
+	return r
+}
+
+// learnNamespace collects host of the namespace. Must be called
+// under the lock or before the Redactor is used
+func (r *Redactor) learnNamespace(ns string) {
+	if u, err := url.Parse(ns); err == nil && u.Hostname() != "" {
+		r.public[strings.ToLower(u.Hostname())] = true
+	}
+}
+
+// learn collects serial numbers, host and client names. Host names
+// are learned from all URLs, but namespaces. Must be called under
+// the lock
+func (r *Redactor) learn(data []byte) {
+	text := string(data)
+
+	for _, m := range redactNsRegexp.FindAllStringSubmatch(text, -1) {
+		r.learnNamespace(m[1])
+	}
+
+	for _, u := range redactURLRegexp.FindAllString(text, -1) {
+		r.learnURL(u)
+	}
+
+	for _, m := range redactSerialRegexp.FindAllStringSubmatch(text, -1) {
+		r.learnValue(&r.serials, "serial", m[1])
+	}
+
+	elements, err := XMLDecode(wsddNsMap, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+
+	for _, elem := range elements {
+		switch {
+		case strings.HasSuffix(elem.Path, ":SerialNumber"):
+			r.learnValue(&r.serials, "serial", elem.Text)
+		case strings.HasSuffix(elem.Path, ":ClientDisplayName"),
+			strings.HasSuffix(elem.Path, ":ClientContext"):
+			r.learnValue(&r.clients, "client", elem.Text)
+		}
+	}
+}
+
+// learnURL collects host name of the URL. Must be called under
+// the lock
+func (r *Redactor) learnURL(rawurl string) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return
+	}
+
+	host := u.Hostname()
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+
+	if host != "" && net.ParseIP(host) == nil && !r.public[strings.ToLower(host)] {
+		r.learnValue(&r.hosts, "host", host)
+	}
+}
+
+// learnValue adds value to the list of known values of the kind.
+// Too short values are ignored: they can't be safely replaced
+func (r *Redactor) learnValue(list *[]string, kind, value string) {
+	if len(value) < 4 || r.pseudonyms[value] != "" {
+		return
+	}
+
+	r.counters[kind]++
+	n := r.counters[kind]
+
+	switch kind {
+	case "serial":
+		r.pseudonyms[value] = fmt.Sprintf("SERIAL%.4d", n)
+	case "host":
+		r.pseudonyms[value] = fmt.Sprintf("host%d.invalid", n)
+		if strings.HasSuffix(strings.ToLower(value), ".local") {
+			r.pseudonyms[value] = fmt.Sprintf("host%d.local", n)
+		}
+	case "client":
+		r.pseudonyms[value] = fmt.Sprintf("client%d", n)
+	}
+
+	*list = append(*list, value)
+
+	// Replace longer values first
+	sort.SliceStable(*list, func(i, j int) bool {
+		return len((*list)[i]) > len((*list)[j])
+	})
+}
+
+// Bytes redacts the message
+func (r *Redactor) Bytes(data []byte) []byte {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.learn(data)
+	return []byte(r.text(string(data)))
+}
+
+// Text redacts the text string
+func (r *Redactor) Text(s string) string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.learn([]byte(s))
+	return r.text(s)
+}
+
+// text redacts the text string. Must be called under the lock
+func (r *Redactor) text(s string) string {
+	for _, serial := range r.serials {
+		s = strings.ReplaceAll(s, serial, r.pseudonyms[serial])
+	}
+
+	// Single-label host names and client names are replaced only
+	// within URLs and as the whole element text, they are too likely
+	// to match something else
+	for _, host := range r.hosts {
+		pseudonym := r.pseudonyms[host]
+		if strings.Contains(host, ".") {
+			s = strings.ReplaceAll(s, host, pseudonym)
+		} else {
+			s = strings.ReplaceAll(s, "//"+host, "//"+pseudonym)
+			s = strings.ReplaceAll(s, ">"+host+"<", ">"+pseudonym+"<")
+		}
+	}
+
+	for _, client := range r.clients {
+		s = strings.ReplaceAll(s, ">"+client+"<",
+			">"+r.pseudonyms[client]+"<")
+	}
+
+	return redactRegexp.ReplaceAllStringFunc(s, r.pseudonym)
+}
+
+// pseudonym returns pseudonym for UUID, MAC or IP address. Values,
+// that don't need to be redacted, are returned as is. Must be
+// called under the lock
+func (r *Redactor) pseudonym(value string) string {
+	var kind, key string
+
+	switch {
+	case strings.Count(value, "-") == 4:
+		kind, key = "uuid", strings.ToLower(value)
+	case redactMACRegexp.MatchString(value) && strings.Contains(value, "-"):
+		// Dash-separated MAC gets the same pseudonym, as colon-separated
+		mac := r.pseudonym(strings.ReplaceAll(value, "-", ":"))
+		return strings.ReplaceAll(mac, ":", "-")
+	case redactMACRegexp.MatchString(value):
+		kind, key = "mac", strings.ToLower(value)
+	default:
+		ip := net.ParseIP(value)
+		if ip == nil || ip.IsLoopback() || ip.IsMulticast() ||
+			ip.IsUnspecified() {
+			return value
+		}
+
+		switch {
+		case ip.To4() != nil && ip.IsLinkLocalUnicast():
+			kind = "ip4ll"
+		case ip.To4() != nil:
+			kind = "ip4"
+		case ip.IsLinkLocalUnicast():
+			kind = "ip6ll"
+		default:
+			kind = "ip6"
+		}
+
+		key = ip.String()
+	}
+
+	if pseudonym := r.pseudonyms[key]; pseudonym != "" {
+		return pseudonym
+	}
+
+	r.counters[kind]++
+	n := r.counters[kind]
+
+	var pseudonym string
+	switch kind {
+	case "uuid":
+		pseudonym = fmt.Sprintf("00000000-0000-4000-8000-%.12x", n)
+	case "mac":
+		pseudonym = fmt.Sprintf("02:00:00:00:%.2x:%.2x", n>>8&0xff, n&0xff)
+	case "ip4ll":
+		pseudonym = fmt.Sprintf("169.254.%d.%d", n>>8&0xff, n&0xff)
+	case "ip4":
+		pseudonym = fmt.Sprintf("10.0.%d.%d", n>>8&0xff, n&0xff)
+	case "ip6ll":
+		pseudonym = fmt.Sprintf("fe80::%x", n)
+	case "ip6":
+		pseudonym = fmt.Sprintf("fd00::%x", n)
+	}
+
+	r.pseudonyms[key] = pseudonym
+	return pseudonym
+}
+
+// Meta redacts the trace record metadata
+func (r *Redactor) Meta(meta TraceMeta) TraceMeta {
+	r.lock.Lock()
+	r.learnURL(meta.URL)
+	r.lock.Unlock()
+
+	meta.Local = r.Text(meta.Local)
+	meta.Remote = r.Text(meta.Remote)
+	meta.URL = r.Text(meta.URL)
+	meta.ID = r.Text(meta.ID)
+
+	if meta.Header != nil {
+		header := make(http.Header)
+		for name, values := range meta.Header {
+			for _, value := range values {
+				if name == "Host" {
+					value = r.host(value)
+				}
+				header.Add(name, r.Text(value))
+			}
+		}
+		meta.Header = header
+	}
+
+	return meta
+}
+
+// host redacts host name of the "host:port" string
+func (r *Redactor) host(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, ""
+	}
+
+	if net.ParseIP(host) != nil {
+		return hostport
+	}
+
+	r.lock.Lock()
+	r.learnValue(&r.hosts, "host", host)
+	pseudonym := r.pseudonyms[host]
+	r.lock.Unlock()
+
+	if pseudonym == "" {
+		return hostport
+	}
+
+	if port != "" {
+		return net.JoinHostPort(pseudonym, port)
+	}
+
+	return pseudonym
+}
+
+// Manifest redacts the trace manifest
+func (r *Redactor) Manifest(manifest *TraceManifest) *TraceManifest {
+	redacted := *manifest
+
+	redacted.CommandLine = nil
+	for _, arg := range manifest.CommandLine {
+		redacted.CommandLine = append(redacted.CommandLine, r.Text(arg))
+	}
+
+	redacted.Interfaces = nil
+	for _, iface := range manifest.Interfaces {
+		ti := TraceInterface{Index: iface.Index, Name: iface.Name}
+		for _, addr := range iface.Addrs {
+			ti.Addrs = append(ti.Addrs, r.Text(addr))
+		}
+		redacted.Interfaces = append(redacted.Interfaces, ti)
+	}
+
+	return &redacted
+}
+
+// Trace redacts the whole trace. All messages are learned first,
+// so serial numbers and host names are replaced even in messages,
+// that come before ones they were learned from
+func (r *Redactor) Trace(trace *TraceArchive) *TraceArchive {
+	r.lock.Lock()
+	for _, entry := range trace.Entries {
+		r.learn(entry.Data)
+		r.learnURL(entry.URL)
+	}
+	r.lock.Unlock()
+
+	redacted := &TraceArchive{}
+	if trace.Manifest != nil {
+		redacted.Manifest = r.Manifest(trace.Manifest)
+	}
+
+	for _, entry := range trace.Entries {
+		redacted.Entries = append(redacted.Entries, &TraceEntry{
+			TraceMeta: r.Meta(entry.TraceMeta),
+			Index:     entry.Index,
+			Name:      r.Text(entry.Name),
+			Data:      r.Bytes(entry.Data),
+		})
+	}
+
+	return redacted
+}
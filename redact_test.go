@@ -0,0 +1,247 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Protocol trace redaction tests
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sensitive values of the redacted trace
+const (
+	testRedactIP      = "192.168.1.20"
+	testRedactIP6     = "fe80::217:c8ff:fe7b:6a91"
+	testRedactUUID    = "4509a320-00a0-008f-00b6-00a0f1e0c0de"
+	testRedactHost    = "printer.example.com"
+	testRedactSerial  = "CNB8K3J1QZ"
+	testRedactMAC     = "00:1B:A9:12:34:56"
+	testRedactMACDash = "00-1B-A9-12-34-57"
+	testRedactClient  = "alice-laptop"
+)
+
+// testRedactTrace returns the trace of the WSD device discovery
+// and events subscription, made by the emulator
+func testRedactTrace() *TraceArchive {
+	emu := &wsdEmulator{
+		device: &EmuDevice{
+			Name:         "ACME Scanner " + testRedactMACDash,
+			Manufacturer: "ACME",
+			Model:        "ACME MFP 100",
+			Serial:       testRedactSerial,
+			Firmware:     "1.0 (MAC " + testRedactMAC + ")",
+			UUID:         testRedactUUID,
+		},
+		profile: &WsdEmuProfile{
+			XAddrs: fmt.Sprintf("http://%s:5357/%s http://[%s%%25eth0]:5357/%s",
+				testRedactIP, testRedactUUID, testRedactIP6, testRedactUUID),
+		},
+		address:  "urn:uuid:" + testRedactUUID,
+		instance: 1,
+	}
+
+	now := time.Now()
+	meta := TraceMeta{Time: now, Direction: "in", Zone: "eth0",
+		Local: "10.0.0.1:3702", Remote: testRedactIP + ":3702"}
+
+	probeMatches := emu.discoveryMessage("ProbeMatches",
+		"http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous",
+		"\t\t<a:RelatesTo>urn:uuid:0c0ffee0-0000-4000-8000-000000000001</a:RelatesTo>\n",
+		"\t\t<d:ProbeMatches>\n"+
+			emu.discoveryBody("ProbeMatch", nil)+
+			"\t\t</d:ProbeMatches>\n")
+
+	// Metadata is requested by the host name, so it is mentioned
+	// in the PresentationUrl and service addresses
+	url := fmt.Sprintf("http://%s:5357/%s", testRedactHost, testRedactUUID)
+	get := testSOAP(fmt.Sprintf(
+		"<a:To>urn:uuid:%s</a:To>"+
+			"<a:Action>http://schemas.xmlsoap.org/ws/2004/09/transfer/Get</a:Action>"+
+			"<a:MessageID>urn:uuid:0c0ffee0-0000-4000-8000-000000000002</a:MessageID>",
+		testRedactUUID), "")
+
+	req := httptest.NewRequest("POST", url, strings.NewReader(string(get)))
+	rec := httptest.NewRecorder()
+	emu.ServeHTTP(rec, req)
+
+	subscribe := fmt.Sprintf(eventsSubscribeTemplate,
+		"0c0ffee0-0000-4000-8000-000000000003",
+		"http://"+testRedactIP+":5357/WSDScanner",
+		"http://10.0.0.1:8080/events",
+		"0c0ffee0-0000-4000-8000-000000000004",
+		"PT1H", testRedactClient)
+
+	hostname, _ := os.Hostname()
+	text := fmt.Sprintf("Serial %s http://%s:80/ws host %s",
+		testRedactSerial, testRedactHost, hostname)
+
+	return &TraceArchive{
+		Manifest: &TraceManifest{
+			Format:      traceFormat,
+			CommandLine: []string{"airscan-discover", "-t", "-w", testRedactIP},
+			StartTime:   now,
+		},
+		Entries: []*TraceEntry{
+			{TraceMeta: meta, Index: 0,
+				Name: "udp-from-" + testRedactIP + ":3702",
+				Data: probeMatches},
+			{TraceMeta: TraceMeta{Time: now, Direction: "out",
+				Method: "POST", URL: url, ID: "1",
+				Header: http.Header{"Host": {testRedactHost + ":5357"}}},
+				Index: 1, Name: "http-request", Data: get},
+			{TraceMeta: TraceMeta{Time: now, Direction: "in",
+				Status: rec.Code, Header: rec.Header(), ID: "1"},
+				Index: 2, Name: "http-response", Data: rec.Body.Bytes()},
+			{TraceMeta: TraceMeta{Time: now, Direction: "out",
+				Method: "POST", URL: "http://" + testRedactIP + ":5357/WSDScanner",
+				ID: "2"},
+				Index: 3, Name: "http-request", Data: []byte(subscribe)},
+			{TraceMeta: TraceMeta{Time: now},
+				Index: 4, Name: "note", Data: []byte(text)},
+		},
+	}
+}
+
+// testTraceText returns all text of the trace
+func testTraceText(trace *TraceArchive) string {
+	var buf strings.Builder
+
+	buf.WriteString(strings.Join(trace.Manifest.CommandLine, " "))
+	for _, entry := range trace.Entries {
+		fmt.Fprintf(&buf, "\n%s %s %s %s %s %s %v\n%s", entry.Name,
+			entry.Local, entry.Remote, entry.URL, entry.ID, entry.Zone,
+			entry.Header, entry.Data)
+	}
+
+	return buf.String()
+}
+
+// TestRedactTrace redacts the realistic trace and checks, that
+// sensitive data is gone, and the redacted trace still replays
+func TestRedactTrace(t *testing.T) {
+	trace := testRedactTrace()
+	original := testTraceText(trace)
+
+	secrets := []string{
+		testRedactIP, testRedactIP6, testRedactUUID, testRedactHost,
+		testRedactSerial, testRedactMAC, testRedactMACDash,
+		testRedactClient,
+	}
+
+	if hostname, _ := os.Hostname(); len(hostname) >= 4 {
+		secrets = append(secrets, hostname)
+	}
+
+	for _, secret := range secrets {
+		if !strings.Contains(strings.ToLower(original),
+			strings.ToLower(secret)) {
+			t.Fatalf("%q: not in the original trace", secret)
+		}
+	}
+
+	redacted := NewRedactor().Trace(trace)
+	text := strings.ToLower(testTraceText(redacted))
+
+	for _, secret := range secrets {
+		if strings.Contains(text, strings.ToLower(secret)) {
+			t.Errorf("%q: not redacted", secret)
+		}
+	}
+
+	// Namespaces and actions are kept
+	for _, keep := range []string{
+		"http://schemas.xmlsoap.org/ws/2005/04/discovery/ProbeMatches",
+		"http://www.w3.org/2003/05/soap-envelope",
+	} {
+		if !strings.Contains(text, strings.ToLower(keep)) {
+			t.Errorf("%q: redacted", keep)
+		}
+	}
+
+	// Replay the redacted trace
+	replay := newTraceReplay(redacted.Entries)
+
+	testInstall()
+	testTransports.set(&MemNetwork{Ifaces: testInterfaces}, replay, replay)
+
+	wsddFoundMutex.Lock()
+	wsddFound = map[string]struct{}{}
+	wsddFoundMutex.Unlock()
+
+	out := make(chan Endpoint, 16)
+	replay.Discover(out)
+
+	select {
+	case endpoint := <-out:
+		if endpoint.Proto != "wsd" || endpoint.Model != "ACME MFP 100" {
+			t.Errorf("replayed: %s %q", endpoint.Proto, endpoint.Model)
+		}
+		if strings.Contains(endpoint.URL, testRedactIP) {
+			t.Errorf("replayed: %s: not redacted", endpoint.URL)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("redacted trace: device not discovered")
+	}
+}
+
+// TestRedactText redacts the text strings
+func TestRedactText(t *testing.T) {
+	tests := []struct {
+		in     string
+		secret []string
+		keep   []string
+	}{
+		{
+			in:     "MAC 00-1B-A9-12-34-56 and 00:1b:a9:12:34:56",
+			secret: []string{"1b-a9", "1b:a9"},
+		},
+		{
+			in:     "<wscn:ClientDisplayName>alice-laptop</wscn:ClientDisplayName>",
+			secret: []string{"alice-laptop"},
+			keep:   []string{"<wscn:ClientDisplayName>"},
+		},
+		{
+			in:     "Serial 1234567890 http://printer.example.com:80/ws",
+			secret: []string{"1234567890", "printer.example.com"},
+			keep:   []string{"Serial ", ":80/ws"},
+		},
+		{
+			in:   "<wsdp:SerialNumber>X1</wsdp:SerialNumber>",
+			keep: []string{"<wsdp:SerialNumber>", "</wsdp:SerialNumber>"},
+		},
+	}
+
+	for _, test := range tests {
+		r := NewRedactor()
+		out := r.Text(test.in)
+
+		for _, secret := range test.secret {
+			if strings.Contains(strings.ToLower(out), secret) {
+				t.Errorf("%q: %q not redacted: %q", test.in, secret, out)
+			}
+		}
+
+		for _, keep := range test.keep {
+			if !strings.Contains(out, keep) {
+				t.Errorf("%q: %q not kept: %q", test.in, keep, out)
+			}
+		}
+	}
+
+	// The same MAC gets the same pseudonym in both forms
+	r := NewRedactor()
+	colon := r.Text("00:1B:A9:12:34:56")
+	dash := r.Text("00-1b-a9-12-34-56")
+	if strings.ReplaceAll(dash, "-", ":") != colon {
+		t.Errorf("MAC pseudonyms differ: %q %q", colon, dash)
+	}
+}
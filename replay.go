@@ -0,0 +1,405 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Offline replay of protocol traces
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// TraceReplay replays the protocol trace or packet capture. Received
+// UDP messages are fed into the WS-Discovery message handler, HTTP
+// requests are answered with recorded responses, and DNS-SD services,
+// recorded in the trace or resolved from the capture, are reported
+// by the DNS-SD browser
+type TraceReplay struct {
+	entries   []*TraceEntry
+	zone      string                       // Zone for IPv4 messages
+	exchanges map[string][]*replayExchange // Exchanges by request key
+	services  []DNSSdService               // DNS-SD services
+	ifaces    []NetInterface               // Capture interfaces
+	lock      sync.Mutex
+}
+
+// replayExchange is the recorded HTTP exchange
+type replayExchange struct {
+	request  *TraceEntry // The http-request record
+	response *TraceEntry // The http-response or http-error record
+}
+
+// traceReplay is the active TraceReplay, if not nil
+var traceReplay *TraceReplay
+
+// TraceReplayLoad loads the protocol trace or pcap/pcapng packet
+// capture for replay
+func TraceReplayLoad(file string) (*TraceReplay, error) {
+	if PcapIsCapture(file) {
+		capture, err := CaptureLoad(file)
+		if err != nil {
+			return nil, err
+		}
+
+		replay := newTraceReplay(capture.Trace.Entries)
+		replay.services = capture.Services
+		replay.ifaces = capture.Interfaces
+
+		return replay, nil
+	}
+
+	trace, err := TraceRead(file)
+	if err != nil {
+		return nil, err
+	}
+
+	replay := newTraceReplay(trace.Entries)
+
+	// Interfaces of the manifest give names to interface
+	// indices of DNS-SD services. Old traces have no manifest
+	if trace.Manifest != nil {
+		replay.ifaces = replayInterfaces(trace.Manifest.Interfaces)
+	}
+
+	return replay, nil
+}
+
+// replayInterfaces returns network interfaces, recorded in the
+// trace manifest, or nil, if there are none
+func replayInterfaces(interfaces []TraceInterface) []NetInterface {
+	var ifaces []NetInterface
+
+	for _, iface := range interfaces {
+		ni := NetInterface{
+			Index: iface.Index,
+			Name:  iface.Name,
+			Flags: net.FlagUp | net.FlagMulticast,
+		}
+
+		for _, addr := range iface.Addrs {
+			ip, ipnet, err := net.ParseCIDR(addr)
+			if err == nil {
+				ipnet.IP = ip
+				ni.Addrs = append(ni.Addrs, ipnet)
+			}
+		}
+
+		ifaces = append(ifaces, ni)
+	}
+
+	return ifaces
+}
+
+// newTraceReplay creates a new TraceReplay for trace records
+func newTraceReplay(entries []*TraceEntry) *TraceReplay {
+	replay := &TraceReplay{
+		entries:   entries,
+		exchanges: make(map[string][]*replayExchange),
+	}
+
+	// Old traces don't record interface of IPv4 messages, but
+	// if all IPv6 messages came via the same interface, it is
+	// the only one used for discovery
+	zones := make(map[string]struct{})
+	for _, entry := range entries {
+		addr := entry.UDPFrom()
+		if addr == nil {
+			addr = entry.UDPTo()
+		}
+		if entry.Zone != "" {
+			zones[entry.Zone] = struct{}{}
+		} else if addr != nil && addr.Zone != "" {
+			zones[addr.Zone] = struct{}{}
+		}
+	}
+
+	if len(zones) == 1 {
+		for zone := range zones {
+			replay.zone = zone
+		}
+	}
+
+	// Collect DNS-SD services
+	for _, entry := range entries {
+		if service, ok := entry.DNSSdService(); ok {
+			replay.services = append(replay.services, service)
+		}
+	}
+
+	// Pair HTTP requests with responses. Requests, served by this
+	// program, are skipped
+	paired := make(map[*TraceEntry]struct{})
+	for i, entry := range entries {
+		if entry.Name != "http-request" || entry.Direction == "in" {
+			continue
+		}
+
+		response := replayFindResponse(entry, entries[i+1:], paired)
+		if response != nil {
+			paired[response] = struct{}{}
+			key := replayRequestKey(entry.Method, entry.URL, entry.Data)
+			replay.exchanges[key] = append(replay.exchanges[key],
+				&replayExchange{entry, response})
+		}
+	}
+
+	return replay
+}
+
+// replayFindResponse finds the response record for the request
+// record among the following records, not paired yet. Records of
+// the same exchange have the same correlation ID. Old traces don't
+// have IDs and concurrent exchanges interleave, so the SOAP response
+// is the one, that relates to the request's message ID. Responses
+// without RelatesTo (i.e., errors) are paired in order
+func replayFindResponse(request *TraceEntry, next []*TraceEntry,
+	paired map[*TraceEntry]struct{}) *TraceEntry {
+
+	msgID := ""
+	if request.ID == "" {
+		msgID = replayHeader(request.Data, "MessageID")
+	}
+
+	var unrelated *TraceEntry
+	for _, entry := range next {
+		if _, found := paired[entry]; found {
+			continue
+		}
+
+		switch {
+		case request.ID != "":
+			if entry.ID == request.ID && entry.Name != "http-request" {
+				return entry
+			}
+
+		case entry.Name != "http-response" && entry.Name != "http-error":
+
+		default:
+			relatesTo := replayHeader(entry.Data, "RelatesTo")
+			switch {
+			case msgID != "" && relatesTo == msgID:
+				return entry
+			case relatesTo == "" && unrelated == nil:
+				unrelated = entry
+			}
+		}
+	}
+
+	return unrelated
+}
+
+// replayHeader returns the WS-Addressing header of the SOAP message,
+// i.e., MessageID or RelatesTo, or "" if message doesn't have it
+func replayHeader(data []byte, name string) string {
+	elements, _ := XMLDecode(wsddNsMap, bytes.NewBuffer(data))
+	for _, elem := range elements {
+		if elem.Path == "/s:Envelope/s:Header/a:"+name {
+			return strings.TrimSpace(elem.Text)
+		}
+	}
+
+	return ""
+}
+
+// replayRequestKey returns the key, the request is matched by.
+// Message IDs are random, so SOAP requests are matched by destination
+// endpoint and action, and other requests by method and URL
+func replayRequestKey(method, url string, data []byte) string {
+	var to, action string
+
+	elements, _ := XMLDecode(wsddNsMap, bytes.NewBuffer(data))
+	for _, elem := range elements {
+		switch elem.Path {
+		case "/s:Envelope/s:Header/a:To":
+			to = elem.Text
+		case "/s:Envelope/s:Header/a:Action":
+			action = elem.Text
+		}
+	}
+
+	if to == "" && action == "" {
+		return method + " " + url
+	}
+
+	return to + " " + action
+}
+
+// Discover reports DNS-SD services of the trace and feeds received
+// UDP messages of the trace into the WS-Discovery message handler.
+// It returns, when all messages are handled
+func (replay *TraceReplay) Discover(outchan chan Endpoint) {
+	DNSSdDiscover(outchan)
+
+	for _, entry := range replay.entries {
+		from := entry.UDPFrom()
+		if from == nil {
+			continue
+		}
+
+		LogDebug("%s: UDP message replayed", from)
+
+		log := LogBegin(fmt.Sprintf("%s", from))
+		zone := entry.Zone
+		if zone == "" {
+			zone = from.Zone
+		}
+		if zone == "" {
+			zone = replay.zone
+		}
+
+		handleUDPMessage(log, entry.Data, from, zone, outchan)
+		log.Commit()
+	}
+}
+
+// Browse reports DNS-SD services of the trace. The channel is
+// closed after all services are reported
+func (replay *TraceReplay) Browse(svcType string) (<-chan DNSSdService, error) {
+	out := make(chan DNSSdService, len(replay.services))
+	if svcType == "_uscan._tcp" {
+		for _, service := range replay.services {
+			out <- service
+		}
+	}
+	close(out)
+
+	return out, nil
+}
+
+// Interfaces returns interfaces of the packet capture or
+// of the trace manifest
+func (replay *TraceReplay) Interfaces() ([]NetInterface, error) {
+	return replay.ifaces, nil
+}
+
+// ListenUDP fails, as UDP messages are fed from the trace
+func (replay *TraceReplay) ListenUDP(network string, laddr *net.UDPAddr) (
+	PacketConn, error) {
+	return nil, errors.New("replay: UDP sockets are not available")
+}
+
+// Do answers HTTP request with the recorded response
+func (replay *TraceReplay) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	url := req.URL.String()
+	key := replayRequestKey(req.Method, url, body)
+	host := req.URL.Hostname()
+	if i := strings.IndexByte(host, '%'); i >= 0 {
+		host = host[:i]
+	}
+
+	replay.lock.Lock()
+	response := replay.response(key, url, host)
+	replay.lock.Unlock()
+
+	if response == nil {
+		return nil, fmt.Errorf("%s %s: not in trace", req.Method, req.URL)
+	}
+
+	LogDebug("%s %s: replayed from record %d", req.Method, req.URL,
+		response.Index)
+
+	if response.Name == "http-error" {
+		return nil, fmt.Errorf("%s", response.Data)
+	}
+
+	// Old traces have neither status nor headers
+	status := response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	header := response.Header
+	if header == nil {
+		header = http.Header{
+			"Content-Type": {"application/soap+xml; charset=utf-8"},
+		}
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(response.Data)),
+		ContentLength: int64(len(response.Data)),
+		Request:       req,
+	}, nil
+}
+
+// response returns the recorded response for the request. Requests
+// to the same endpoint may come concurrently, in any order, so the
+// exchange with the same URL is preferred, and then the response,
+// that mentions the requested host. Repeated requests consume
+// responses; the last one is reused, when they are exhausted.
+// Must be called under the lock
+func (replay *TraceReplay) response(key, url, host string) *TraceEntry {
+	exchanges := replay.exchanges[key]
+	if len(exchanges) == 0 {
+		return nil
+	}
+
+	i := -1
+	for j, exchange := range exchanges {
+		if exchange.request.URL == url {
+			i = j
+			break
+		}
+	}
+
+	if i < 0 {
+		i = 0
+		for j, exchange := range exchanges {
+			if bytes.Contains(exchange.response.Data, []byte(host)) {
+				i = j
+				break
+			}
+		}
+	}
+
+	response := exchanges[i].response
+	if len(exchanges) > 1 {
+		exchanges = append(exchanges[:i:i], exchanges[i+1:]...)
+		replay.exchanges[key] = exchanges
+	}
+
+	return response
+}
+
+// replayStart makes the trace replay active: discovery uses the
+// trace instead of network, and trace writing is disabled
+func replayStart(file string) {
+	replay, err := TraceReplayLoad(file)
+	LogCheck(err)
+
+	LogDebug("%s: replaying", file)
+
+	Trace = false
+	traceReplay = replay
+	httpClient = replay
+	dnssdBrowser = replay
+
+	if replay.ifaces != nil {
+		network = replay
+	}
+}
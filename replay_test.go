@@ -0,0 +1,172 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Trace replay tests
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSOAP returns the SOAP message with WS-Addressing headers
+func testSOAP(header, body string) []byte {
+	return []byte(`<s:Envelope` +
+		` xmlns:s="http://www.w3.org/2003/05/soap-envelope"` +
+		` xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing">` +
+		`<s:Header>` + header + `</s:Header>` +
+		`<s:Body>` + body + `</s:Body></s:Envelope>`)
+}
+
+// testGet returns the old trace records of the Get exchange
+func testGet(to, msgID string) (request, response *TraceEntry) {
+	action := "http://schemas.xmlsoap.org/ws/2004/09/transfer/Get"
+	request = &TraceEntry{
+		TraceMeta: TraceMeta{Method: "POST",
+			URL: "http://10.0.0.1:5357/" + strings.TrimPrefix(to, "urn:")},
+		Name: "http-request",
+		Data: testSOAP(fmt.Sprintf(
+			"<a:To>%s</a:To><a:Action>%s</a:Action>"+
+				"<a:MessageID>%s</a:MessageID>", to, action, msgID), ""),
+	}
+	response = &TraceEntry{
+		Name: "http-response",
+		Data: testSOAP(fmt.Sprintf("<a:RelatesTo>%s</a:RelatesTo>",
+			msgID), "metadata of "+to),
+	}
+	return
+}
+
+// TestReplayOldTrace replays interleaved exchanges of the old trace
+func TestReplayOldTrace(t *testing.T) {
+	reqA, respA := testGet("urn:uuid:a", "urn:uuid:1")
+	reqB, respB := testGet("urn:uuid:b", "urn:uuid:2")
+
+	tests := []struct {
+		name    string
+		entries []*TraceEntry
+	}{
+		{"sequential", []*TraceEntry{reqA, respA, reqB, respB}},
+		{"interleaved", []*TraceEntry{reqA, reqB, respA, respB}},
+		{"reordered", []*TraceEntry{reqA, reqB, respB, respA}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			replay := newTraceReplay(test.entries)
+
+			for _, to := range []string{"urn:uuid:b", "urn:uuid:a"} {
+				request, _ := testGet(to, "urn:uuid:new")
+				req, err := http.NewRequest("POST", request.URL,
+					strings.NewReader(string(request.Data)))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				resp, err := replay.Do(req)
+				if err != nil {
+					t.Errorf("%s: %s", to, err)
+					continue
+				}
+
+				data, _ := ioutil.ReadAll(resp.Body)
+				if !strings.Contains(string(data), "metadata of "+to) {
+					t.Errorf("%s: wrong response %s", to, data)
+				}
+			}
+		})
+	}
+}
+
+// TestReplayDNSSd replays DNS-SD services of the trace, with
+// interfaces of the manifest
+func TestReplayDNSSd(t *testing.T) {
+	manifest := &TraceManifest{
+		Interfaces: []TraceInterface{
+			{Index: 1, Name: "lo", Addrs: []string{"127.0.0.1/8"}},
+			{Index: 7, Name: "wlan0", Addrs: []string{"10.7.0.1/24"}},
+		},
+	}
+
+	entries := []*TraceEntry{
+		{
+			Name: traceDNSSdName,
+			Data: []byte(`{"interface": 7, "name": "Replayed Scanner",` +
+				` "address": "10.7.0.20", "port": 8080,` +
+				` "txt": ["rs=/eSCL", "ty=Replayed", "UUID=1234"]}`),
+		},
+		{
+			Name: traceDNSSdName,
+			Data: []byte(`{"interface": 7, "name": "Broken Scanner",` +
+				` "error": "Timeout reached"}`),
+		},
+		{Name: traceDNSSdName, Data: []byte("not a service")},
+	}
+
+	replay := newTraceReplay(entries)
+	replay.ifaces = replayInterfaces(manifest.Interfaces)
+
+	ifaces, _ := replay.Interfaces()
+	if len(ifaces) != 2 || ifaces[1].Name != "wlan0" ||
+		len(ifaces[1].Addrs) != 1 ||
+		ifaces[1].Addrs[0].String() != "10.7.0.1/24" {
+		t.Fatalf("interfaces: %+v", ifaces)
+	}
+
+	testInstall()
+	testTransports.set(&MemNetwork{Ifaces: ifaces}, replay, replay)
+
+	discoveryReport.Reset()
+
+	out := make(chan Endpoint, 16)
+	DNSSdDiscover(out)
+	close(out)
+
+	var endpoints []Endpoint
+	for endpoint := range out {
+		endpoints = append(endpoints, endpoint)
+	}
+
+	if len(endpoints) != 1 {
+		t.Fatalf("%d endpoints, expected 1", len(endpoints))
+	}
+
+	endpoint := endpoints[0]
+	if endpoint.Name != "Replayed Scanner" ||
+		endpoint.URL != "http://10.7.0.20:8080/eSCL" ||
+		endpoint.Interface != "wlan0" || endpoint.Model != "Replayed" ||
+		endpoint.UUID != "1234" {
+		t.Errorf("got %+v", endpoint)
+	}
+
+	// Resolve errors are reported
+	failed := false
+	for _, entry := range discoveryReport.Entries() {
+		if entry.Name == "Broken Scanner" {
+			failed = entry.Outcome == OutcomeResolveFailed &&
+				entry.Interface == "wlan0" &&
+				entry.Detail == "Timeout reached"
+		}
+	}
+	if !failed {
+		t.Errorf("Broken Scanner: resolve failure not reported")
+	}
+
+	// Services are not browsed for other types
+	services, _ := replay.Browse("_ipp._tcp")
+	select {
+	case service, ok := <-services:
+		if ok {
+			t.Errorf("_ipp._tcp: %q reported", service.Name)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("_ipp._tcp: channel not closed")
+	}
+}
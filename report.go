@@ -0,0 +1,277 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Discovery report: outcomes of all seen responders
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Discovery backends
+const (
+	ReportWSD   = "wsd"    // WS-Discovery
+	ReportDNSSd = "dns-sd" // DNS-SD
+)
+
+// Discovery outcomes
+const (
+	OutcomeAccepted       = "accepted"
+	OutcomeNotScanner     = "not a scanner"
+	OutcomeNoXAddrs       = "no XAddrs"
+	OutcomeMetadataFailed = "metadata fetch failed"
+	OutcomeNoModel        = "no model"
+	OutcomeDuplicate      = "duplicate"
+	OutcomeResolveFailed  = "resolve failed"
+	OutcomeIgnored        = "ignored"
+)
+
+// ReportEntry is the discovery outcome of the responder. Multiple
+// messages of the same responder are merged into the single entry
+type ReportEntry struct {
+	Backend   string // ReportWSD or ReportDNSSd
+	Interface string // Interface name
+	Source    string // Responder address, may be empty
+	Name      string // Endpoint address or service instance name
+	Outcome   string // Outcome, i.e., OutcomeAccepted
+	Detail    string // Device name, or why it was not accepted
+	Messages  int    // Number of merged messages
+}
+
+// Report collects discovery outcomes
+type Report struct {
+	entries map[string]*ReportEntry // Entries by responder
+	lock    sync.Mutex
+}
+
+// discoveryReport collects outcomes of the discovery
+var discoveryReport = NewReport()
+
+// NewReport creates a new Report
+func NewReport() *Report {
+	return &Report{entries: make(map[string]*ReportEntry)}
+}
+
+// Reset removes all entries of the report
+func (r *Report) Reset() {
+	r.lock.Lock()
+	r.entries = make(map[string]*ReportEntry)
+	r.lock.Unlock()
+}
+
+// Add adds the outcome of the responder. Outcomes are ranked (see
+// reportRank): the accepted outcome of any message wins, specific
+// failures are not hidden by generic "ignored", and duplicates
+// don't hide other outcomes. The source may be unknown, i.e., if
+// DNS-SD service can't be resolved, so such outcomes are merged with
+// the outcomes of the same name, with the known source
+func (r *Report) Add(backend, iface, source, name, outcome, detail string) {
+	key := strings.Join([]string{backend, iface, source, name}, " ")
+	unknown := strings.Join([]string{backend, iface, "", name}, " ")
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	entry := r.entries[key]
+	switch {
+	case entry != nil:
+	case source == "":
+		entry = r.named(backend, iface, name)
+	case r.entries[unknown] != nil:
+		entry = r.entries[unknown]
+		entry.Source = source
+		delete(r.entries, unknown)
+		r.entries[key] = entry
+	}
+
+	if entry == nil {
+		entry = &ReportEntry{
+			Backend:   backend,
+			Interface: iface,
+			Source:    source,
+			Name:      name,
+		}
+		r.entries[key] = entry
+	}
+
+	entry.Messages++
+
+	// Failures of the same rank are replaced, so the failure
+	// of the latest message is reported
+	rank, old := reportRank(outcome), reportRank(entry.Outcome)
+	if rank > old || (rank == old && rank == reportRankFailure) {
+		entry.Outcome = outcome
+		entry.Detail = detail
+	}
+}
+
+// Outcome ranks
+const (
+	reportRankNone      = iota // No outcome yet
+	reportRankDuplicate        // OutcomeDuplicate
+	reportRankIgnored          // OutcomeIgnored
+	reportRankFailure          // Specific failure, i.e., OutcomeNoModel
+	reportRankAccepted         // OutcomeAccepted
+)
+
+// reportRank returns rank of the outcome. Outcome of the higher
+// rank replaces outcome of the lower rank
+func reportRank(outcome string) int {
+	switch outcome {
+	case "":
+		return reportRankNone
+	case OutcomeDuplicate:
+		return reportRankDuplicate
+	case OutcomeIgnored:
+		return reportRankIgnored
+	case OutcomeAccepted:
+		return reportRankAccepted
+	}
+	return reportRankFailure
+}
+
+// named returns the entry of the name with the known source, or nil.
+// The accepted entry is preferred. Must be called under the lock
+func (r *Report) named(backend, iface, name string) *ReportEntry {
+	var found *ReportEntry
+	for _, entry := range r.entries {
+		switch {
+		case entry.Backend != backend || entry.Interface != iface:
+		case entry.Name != name || entry.Source == "":
+		case found == nil || entry.Outcome == OutcomeAccepted:
+			found = entry
+		}
+	}
+
+	return found
+}
+
+// Entries returns report entries, sorted by interface, backend
+// and source address
+func (r *Report) Entries() []ReportEntry {
+	r.lock.Lock()
+	entries := make([]ReportEntry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		entries = append(entries, *entry)
+	}
+	r.lock.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		e1, e2 := &entries[i], &entries[j]
+		switch {
+		case e1.Interface != e2.Interface:
+			return e1.Interface < e2.Interface
+		case e1.Backend != e2.Backend:
+			return e1.Backend > e2.Backend // wsd first
+		case e1.Source != e2.Source:
+			return reportAddrLess(e1.Source, e2.Source)
+		}
+		return e1.Name < e2.Name
+	})
+
+	return entries
+}
+
+// reportAddrLess compares IP addresses: IPv4 addresses go first
+func reportAddrLess(a1, a2 string) bool {
+	ip1, ip2 := net.ParseIP(a1), net.ParseIP(a2)
+	if ip1 == nil || ip2 == nil {
+		return a1 < a2
+	}
+	if (ip1.To4() == nil) != (ip2.To4() == nil) {
+		return ip1.To4() != nil
+	}
+	return string(ip1.To16()) < string(ip2.To16())
+}
+
+// Write writes the report: all responders per interface, with
+// their outcomes, followed by per-backend counters
+func (r *Report) Write(w io.Writer) {
+	entries := r.Entries()
+
+	if len(entries) == 0 {
+		fmt.Fprintf(w, "No responders seen\n")
+	}
+
+	iface := ""
+	for i, entry := range entries {
+		if i == 0 || entry.Interface != iface {
+			iface = entry.Interface
+			name := iface
+			if name == "" {
+				name = "(unknown)"
+			}
+			fmt.Fprintf(w, "Interface %s:\n", name)
+		}
+
+		source := entry.Source
+		if source == "" {
+			source = "-"
+		}
+
+		outcome := entry.Outcome
+		if entry.Detail != "" {
+			outcome += ": " + entry.Detail
+		}
+
+		fmt.Fprintf(w, "  %-6s  %-25s  %s\n", entry.Backend, source,
+			reportName(entry))
+		fmt.Fprintf(w, "          %s\n", outcome)
+	}
+
+	fmt.Fprintf(w, "\nCounters:\n")
+	for _, backend := range []string{ReportWSD, ReportDNSSd} {
+		total := 0
+		counters := make(map[string]int)
+		var outcomes []string
+
+		for _, entry := range entries {
+			if entry.Backend == backend {
+				total++
+				if counters[entry.Outcome] == 0 {
+					outcomes = append(outcomes, entry.Outcome)
+				}
+				counters[entry.Outcome]++
+			}
+		}
+
+		sort.Slice(outcomes, func(i, j int) bool {
+			o1, o2 := outcomes[i], outcomes[j]
+			if c1, c2 := counters[o1], counters[o2]; c1 != c2 {
+				return c1 > c2
+			}
+			return o1 < o2
+		})
+
+		line := fmt.Sprintf("  %-6s  %d responder(s)", backend, total)
+		for _, outcome := range outcomes {
+			line += fmt.Sprintf(", %d %s", counters[outcome], outcome)
+		}
+		fmt.Fprintf(w, "%s\n", line)
+	}
+}
+
+// reportName returns the responder name for the report
+func reportName(entry ReportEntry) string {
+	name := entry.Name
+	switch {
+	case name == "" && entry.Backend == ReportDNSSd:
+		name = "(no service)"
+	case name == "":
+		name = "(no endpoint address)"
+	case entry.Backend == ReportDNSSd:
+		name = IniQuote(name)
+	}
+	if entry.Messages > 1 {
+		name += fmt.Sprintf(" (%d messages)", entry.Messages)
+	}
+	return name
+}
@@ -0,0 +1,107 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Discovery report tests
+
+package main
+
+import (
+	"testing"
+)
+
+// TestReportOutcomes adds sequences of outcomes of the same
+// responder and checks the reported one
+func TestReportOutcomes(t *testing.T) {
+	tests := []struct {
+		name     string
+		outcomes []string
+		expected string
+	}{
+		{
+			name: "ignored after metadata failure",
+			outcomes: []string{OutcomeMetadataFailed,
+				OutcomeIgnored},
+			expected: OutcomeMetadataFailed,
+		},
+		{
+			name:     "ignored after no model",
+			outcomes: []string{OutcomeNoModel, OutcomeIgnored},
+			expected: OutcomeNoModel,
+		},
+		{
+			name:     "failure after ignored",
+			outcomes: []string{OutcomeIgnored, OutcomeNoModel},
+			expected: OutcomeNoModel,
+		},
+		{
+			name: "latest failure",
+			outcomes: []string{OutcomeMetadataFailed,
+				OutcomeNoModel},
+			expected: OutcomeNoModel,
+		},
+		{
+			name: "accepted wins",
+			outcomes: []string{OutcomeIgnored, OutcomeAccepted,
+				OutcomeMetadataFailed, OutcomeIgnored},
+			expected: OutcomeAccepted,
+		},
+		{
+			name:     "duplicate after ignored",
+			outcomes: []string{OutcomeIgnored, OutcomeDuplicate},
+			expected: OutcomeIgnored,
+		},
+		{
+			name:     "ignored after duplicate",
+			outcomes: []string{OutcomeDuplicate, OutcomeIgnored},
+			expected: OutcomeIgnored,
+		},
+		{
+			name:     "duplicate only",
+			outcomes: []string{OutcomeDuplicate, OutcomeDuplicate},
+			expected: OutcomeDuplicate,
+		},
+	}
+
+	r := NewReport()
+	for _, test := range tests {
+		r.Reset()
+		for _, outcome := range test.outcomes {
+			r.Add(ReportWSD, "eth0", "10.0.0.1", "urn:uuid:1",
+				outcome, outcome+" detail")
+		}
+
+		entries := r.Entries()
+		switch {
+		case len(entries) != 1:
+			t.Errorf("%s: %d entries", test.name, len(entries))
+		case entries[0].Outcome != test.expected ||
+			entries[0].Detail != test.expected+" detail":
+			t.Errorf("%s: %q (%s), expected %q", test.name,
+				entries[0].Outcome, entries[0].Detail, test.expected)
+		case entries[0].Messages != len(test.outcomes):
+			t.Errorf("%s: %d messages", test.name,
+				entries[0].Messages)
+		}
+	}
+}
+
+// TestReportUnknownSource merges outcomes of the unknown source
+// with the outcomes of the same name
+func TestReportUnknownSource(t *testing.T) {
+	r := NewReport()
+	r.Add(ReportDNSSd, "eth0", "", "Scanner", OutcomeResolveFailed, "")
+	r.Add(ReportDNSSd, "eth0", "10.0.0.1", "Scanner", OutcomeIgnored, "")
+
+	entries := r.Entries()
+	if len(entries) != 1 || entries[0].Source != "10.0.0.1" ||
+		entries[0].Outcome != OutcomeResolveFailed {
+		t.Errorf("got %+v", entries)
+	}
+
+	r.Reset()
+	if n := len(r.Entries()); n != 0 {
+		t.Errorf("%d entries after Reset", n)
+	}
+}
@@ -0,0 +1,123 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// SANE device names
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SaneAssignNames computes SANE device names, that sane-airscan
+// would assign to the endpoints, and stores them into the endpoints
+//
+// sane-airscan names devices as "airscan:<p><id>:<name>", where <p>
+// is the protocol ('e' for eSCL, 'w' for WSD) and <id> is the hex
+// device ID, allocated by backend sequentially, in order devices
+// appear. Endpoints are expected to be sorted; IDs are allocated
+// in that order, so they match the backend as long as it sees the
+// same set of devices.
+//
+// Two forms are computed:
+//   - SaneName is the name of auto-discovered device. sane-airscan
+//     merges eSCL and WSD endpoints of the same device (with the
+//     same UUID or address) and prefers eSCL, so the WSD endpoint
+//     of such a device doesn't have its own auto-discovered name
+//   - SaneConfName is the name of the device, manually configured
+//     in airscan.conf, exactly as our output suggests. Here each
+//     name and protocol pair becomes a separate device
+func SaneAssignNames(endpoints []Endpoint) {
+	// Manually configured devices
+	confIDs := make(map[string]int)
+	for i := range endpoints {
+		endpoint := &endpoints[i]
+		key := endpoint.Proto + "\x00" + endpoint.Name
+
+		id, found := confIDs[key]
+		if !found {
+			id = len(confIDs)
+			confIDs[key] = id
+		}
+
+		endpoint.SaneConfName = saneName(endpoint.Proto, id, endpoint.Name)
+	}
+
+	// Auto-discovered devices. First pass finds the endpoint,
+	// that represents each device, second pass allocates IDs
+	devices := make(map[string]*Endpoint)
+	var keys []string
+
+	for i := range endpoints {
+		endpoint := &endpoints[i]
+		key := saneDeviceKey(endpoint)
+		dev := devices[key]
+
+		switch {
+		case dev == nil:
+			keys = append(keys, key)
+			devices[key] = endpoint
+		case dev.Proto != "escl" && endpoint.Proto == "escl":
+			devices[key] = endpoint
+		}
+	}
+
+	for id, key := range keys {
+		dev := devices[key]
+		name := saneName(dev.Proto, id, dev.Name)
+
+		for i := range endpoints {
+			endpoint := &endpoints[i]
+			if saneDeviceKey(endpoint) != key {
+				continue
+			}
+
+			if endpoint.Proto == dev.Proto && endpoint.Name == dev.Name {
+				endpoint.SaneName = name
+			}
+		}
+	}
+
+	// scanimage command lines
+	for i := range endpoints {
+		endpoint := &endpoints[i]
+		name := endpoint.SaneName
+		if name == "" {
+			name = endpoint.SaneConfName
+		}
+
+		endpoint.Scanimage = fmt.Sprintf(
+			"scanimage -d %s --format=png > scan.png", shellQuote(name))
+	}
+}
+
+// saneName formats SANE device name
+func saneName(proto string, id int, name string) string {
+	p := 'e'
+	if proto == "wsd" {
+		p = 'w'
+	}
+	return fmt.Sprintf("airscan:%c%x:%s", p, id, name)
+}
+
+// saneDeviceKey returns key, that identifies physical device,
+// the endpoint belongs to
+func saneDeviceKey(endpoint *Endpoint) string {
+	if endpoint.UUID != "" {
+		return "uuid:" + strings.ToLower(endpoint.UUID)
+	}
+
+	if ip := EndpointIP(*endpoint); ip != nil {
+		return "ip:" + ip.String()
+	}
+
+	return "name:" + endpoint.Name
+}
+
+// shellQuote quotes string for POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
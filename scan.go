@@ -0,0 +1,282 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The "scan" command: a minimal scan client
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// scanUsage is the usage template of the scan command
+const scanUsage = `Usage:
+    %s scan [options] [device]
+
+Scan a test page from the eSCL or WSD device. The device is either
+the device URL, or device name pattern (glob-style), matched against
+discovered devices. If omitted, the only discovered device is used.
+
+Options are:
+    -p proto       protocol: escl or wsd (default: escl for URL,
+                   eSCL preferred for discovered devices)
+    -r dpi         resolution (default: 300)
+    -m mode        color mode: color (default), gray or bw
+    -s source      input source: platen (default), feeder or duplex
+    -a x,y,w,h     scan region, in mm (default: maximal)
+    -f format      document format: jpeg (default), png or pdf
+    -o name        output file name prefix (default: scan)
+` + usageCommonOptions + `
+Pages are saved as name-1.jpg, name-2.jpg and so on.
+`
+
+// Color modes
+const (
+	ScanColor = "color"
+	ScanGray  = "gray"
+	ScanBW    = "bw"
+)
+
+// scanFormats maps document format names into MIME types
+var scanFormats = map[string]string{
+	"jpeg": "image/jpeg",
+	"png":  "image/png",
+	"pdf":  "application/pdf",
+}
+
+// scanExtensions maps MIME types into file name extensions
+var scanExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"application/pdf": ".pdf",
+}
+
+// ScanParams represents scan parameters, normalized
+// across protocols
+type ScanParams struct {
+	Resolution int    // Resolution, DPI
+	ColorMode  string // ScanColor, ScanGray or ScanBW
+	Source     string // SourcePlaten, SourceADF or SourceADFDuplex
+	Format     string // MIME type
+	X, Y       int    // Region offset, mm
+	Width      int    // Region width, mm, 0 if maximal
+	Height     int    // Region height, mm, 0 if maximal
+}
+
+// SetDefaults fills missed parameters from capabilities of the
+// selected input source. If caps is nil, hardcoded defaults
+// (300 DPI, A4) are used
+func (params *ScanParams) SetDefaults(caps *Capabilities) {
+	maxWidth, maxHeight := 210, 297
+	if caps != nil {
+		maxWidth, maxHeight = caps.MaxSize(params.Source)
+	}
+
+	if params.Width == 0 && maxWidth > params.X {
+		params.Width = maxWidth - params.X
+	}
+	if params.Height == 0 && maxHeight > params.Y {
+		params.Height = maxHeight - params.Y
+	}
+
+	if params.Resolution == 0 {
+		switch {
+		case caps == nil:
+			params.Resolution = 300
+		case caps.HasResolution(300):
+			params.Resolution = 300
+		case len(caps.Resolutions) != 0:
+			params.Resolution = caps.Resolutions[0]
+		}
+	}
+}
+
+// Interrupt handling
+var (
+	scanCancel     func()
+	scanCancelLock sync.Mutex
+	scanSignals    sync.Once
+)
+
+// ScanOnInterrupt sets the function that cancels the scan job,
+// when program is interrupted. Use nil to reset it
+func ScanOnInterrupt(cancel func()) {
+	scanSignals.Do(func() {
+		OnInterrupt(func() {
+			scanCancelLock.Lock()
+			if scanCancel != nil {
+				scanCancel()
+			}
+		})
+	})
+
+	scanCancelLock.Lock()
+	scanCancel = cancel
+	scanCancelLock.Unlock()
+}
+
+// scanSelect returns the endpoint to scan from. The device is
+// either URL or name pattern, "" matches any device
+//
+// If proto is "", eSCL is assumed for URL. For discovered devices,
+// only one endpoint per device is considered, eSCL preferred
+func scanSelect(device, proto string) Endpoint {
+	if strings.HasPrefix(device, "http://") ||
+		strings.HasPrefix(device, "https://") {
+		if proto == "" {
+			proto = "escl"
+		}
+		return Endpoint{Proto: proto, Name: device, URL: device}
+	}
+
+	pattern := globCompile("*")
+	if device != "" {
+		pattern = globCompile(device)
+	}
+
+	var selected []Endpoint
+	for _, endpoint := range Discover(DiscoveryTime, nil) {
+		switch {
+		case !pattern.MatchString(endpoint.Name):
+		case proto == "" && endpoint.SaneName != "",
+			proto == endpoint.Proto:
+			selected = append(selected, endpoint)
+		}
+	}
+
+	switch len(selected) {
+	case 0:
+		LogFatal("No matching devices found")
+	case 1:
+		return selected[0]
+	}
+
+	LogError("Several devices match, please choose one:")
+	for _, endpoint := range selected {
+		LogError("    %s (%s)  %s", IniQuote(endpoint.Name),
+			endpoint.Proto, endpoint.URL)
+	}
+	Exit(1)
+
+	return Endpoint{}
+}
+
+// scanRegion parses the scan region option value
+func scanRegion(opts *Options, params *ScanParams) {
+	s := opts.Value()
+	fields := strings.Split(s, ",")
+	if len(fields) != 4 {
+		opts.Fail("Option %s: invalid region %q", opts.Opt, s)
+	}
+
+	var v [4]int
+	for i, f := range fields {
+		n, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || n < 0 || (i >= 2 && n == 0) {
+			opts.Fail("Option %s: invalid region %q", opts.Opt, s)
+		}
+		v[i] = n
+	}
+
+	params.X, params.Y, params.Width, params.Height = v[0], v[1], v[2], v[3]
+}
+
+// cmdScan implements the "scan" command
+func cmdScan(args []string) {
+	params := ScanParams{
+		ColorMode: ScanColor,
+		Source:    SourcePlaten,
+		Format:    "image/jpeg",
+	}
+	output := "scan"
+	proto := ""
+
+	// Parse options
+	opts := NewOptions(args, scanUsage)
+	for opts.Next() {
+		switch opts.Opt {
+		case "-p":
+			proto = strings.ToLower(opts.Value())
+			if proto != "escl" && proto != "wsd" {
+				opts.Fail("Invalid protocol %q", proto)
+			}
+		case "-r":
+			params.Resolution = opts.IntValue()
+		case "-m":
+			params.ColorMode = strings.ToLower(opts.Value())
+			switch params.ColorMode {
+			case ScanColor, ScanGray, ScanBW:
+			default:
+				opts.Fail("Invalid color mode %q", params.ColorMode)
+			}
+		case "-s":
+			switch s := strings.ToLower(opts.Value()); s {
+			case "platen":
+				params.Source = SourcePlaten
+			case "feeder", "adf":
+				params.Source = SourceADF
+			case "duplex", SourceADFDuplex:
+				params.Source = SourceADFDuplex
+			default:
+				opts.Fail("Invalid input source %q", s)
+			}
+		case "-a":
+			scanRegion(opts, &params)
+		case "-f":
+			s := strings.ToLower(opts.Value())
+			params.Format = scanFormats[s]
+			if params.Format == "" {
+				opts.Fail("Invalid document format %q", s)
+			}
+		case "-o":
+			output = opts.Value()
+		default:
+			opts.Common()
+		}
+	}
+
+	args = opts.Args()
+	if len(args) > 1 {
+		opts.Invalid(args[1])
+	}
+
+	device := ""
+	if len(args) != 0 {
+		device = args[0]
+	}
+
+	endpoint := scanSelect(device, proto)
+	LogDebug("Scanning from %s (%s) %s", IniQuote(endpoint.Name),
+		endpoint.Proto, endpoint.URL)
+
+	// Scan and save pages
+	pages := 0
+	save := func(data []byte) error {
+		pages++
+		file := fmt.Sprintf("%s-%d%s", output, pages,
+			scanExtensions[params.Format])
+
+		err := ioutil.WriteFile(file, data, 0644)
+		if err == nil {
+			fmt.Printf("%s: %d bytes\n", file, len(data))
+		}
+		return err
+	}
+
+	var err error
+	if endpoint.Proto == "wsd" {
+		err = WsdScan(endpoint.URL, params, save)
+	} else {
+		err = EsclScan(endpoint.URL, params, save)
+	}
+
+	if err != nil {
+		LogFatal("%s: %s", endpoint.URL, err)
+	}
+}
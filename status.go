@@ -0,0 +1,377 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The "status" command: scanner status monitoring
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusUsage is the usage template of the status command
+const statusUsage = `Usage:
+    %s status [options]
+
+Discover devices and query their status: state (idle, processing,
+stopped, ...), ADF state (loaded, empty, jam, ...) and active jobs.
+
+In the watch mode, devices are polled periodically, and state
+transitions are reported as events. Unreachable devices are polled
+with exponential backoff.
+
+Options are:
+    -w             watch mode
+    -i interval    poll interval (default: 5s)
+    -m interval    max poll interval for unreachable devices (default: 5m)
+    -o format      output format: text (default) or ndjson
+` + usageCommonOptions
+
+// Scanner states
+const (
+	StateIdle        = "idle"
+	StateProcessing  = "processing"
+	StateTesting     = "testing"
+	StateStopped     = "stopped"
+	StateDown        = "down"
+	StateUnreachable = "unreachable"
+)
+
+// Status represents scanner status, normalized across protocols
+type Status struct {
+	State    string   `json:"state"`             // Scanner state
+	AdfState string   `json:"adf_state"`         // ADF state, if any
+	Jobs     int      `json:"jobs"`              // Active jobs
+	Reasons  []string `json:"reasons,omitempty"` // State reasons
+	Error    string   `json:"error,omitempty"`   // Error, if unreachable
+}
+
+// statusEvent is the status change event
+type statusEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	Name     string    `json:"name"`
+	Proto    string    `json:"proto"`
+	URL      string    `json:"url"`
+	Previous *Status   `json:"previous,omitempty"`
+	Status
+}
+
+// Equal reports whether two statuses are the same. Error texts
+// are not compared, so retries of unreachable device don't produce
+// events
+func (status *Status) Equal(other *Status) bool {
+	return status.State == other.State &&
+		status.AdfState == other.AdfState &&
+		status.Jobs == other.Jobs &&
+		strings.Join(status.Reasons, ",") == strings.Join(other.Reasons, ",")
+}
+
+// String returns status as a human-readable string
+func (status *Status) String() string {
+	s := status.State
+	if status.AdfState != "" {
+		s += ", adf " + status.AdfState
+	}
+	if status.Jobs != 0 {
+		s += fmt.Sprintf(", %d job(s)", status.Jobs)
+	}
+	if len(status.Reasons) != 0 {
+		s += " (" + strings.Join(status.Reasons, ", ") + ")"
+	}
+	if status.Error != "" {
+		s += " (" + status.Error + ")"
+	}
+	return s
+}
+
+// QueryStatus queries the endpoint status. Query errors are
+// reported as the StateUnreachable status
+func QueryStatus(endpoint Endpoint) *Status {
+	var status *Status
+	var err error
+
+	switch endpoint.Proto {
+	case "escl":
+		status, err = EsclStatus(endpoint.URL)
+	case "wsd":
+		status, err = WsdStatus(endpoint.URL)
+	default:
+		err = fmt.Errorf("protocol %q not supported", endpoint.Proto)
+	}
+
+	if err != nil {
+		status = &Status{State: StateUnreachable, Error: err.Error()}
+	}
+
+	return status
+}
+
+// EsclStatus queries and parses eSCL ScannerStatus:
+//
+//	<scan:ScannerStatus>
+//	  <pwg:Version>2.0</pwg:Version>
+//	  <pwg:State>Idle</pwg:State>
+//	  <scan:AdfState>ScannerAdfLoaded</scan:AdfState>
+//	  <scan:Jobs>
+//	    <scan:JobInfo>
+//	      <pwg:JobUri>/eSCL/ScanJobs/1</pwg:JobUri>
+//	      <pwg:JobState>Processing</pwg:JobState>
+//	    </scan:JobInfo>
+//	  </scan:Jobs>
+//	</scan:ScannerStatus>
+func EsclStatus(base string) (*Status, error) {
+	elements, err := esclGet(base, "ScannerStatus")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(elements) == 0 || elements[0].Path != "/scan:ScannerStatus" {
+		return nil, fmt.Errorf("not an eSCL ScannerStatus response")
+	}
+
+	status := &Status{}
+	for _, elem := range elements {
+		switch elem.Path {
+		case "/scan:ScannerStatus/pwg:State":
+			status.State = strings.ToLower(elem.Text)
+		case "/scan:ScannerStatus/scan:AdfState":
+			status.AdfState = esclAdfState(elem.Text)
+		case "/scan:ScannerStatus/scan:Jobs/scan:JobInfo/pwg:JobState":
+			switch elem.Text {
+			case "Pending", "Processing":
+				status.Jobs++
+			}
+		}
+	}
+
+	return status, nil
+}
+
+// esclAdfState normalizes eSCL ADF state: "ScannerAdfLoaded"
+// becomes "loaded" and so on
+func esclAdfState(state string) string {
+	return strings.ToLower(strings.TrimPrefix(state, "ScannerAdf"))
+}
+
+// wsdAdfReasons maps WS-Scan state reasons and conditions into
+// the ADF states, compatible with eSCL
+var wsdAdfReasons = map[string]string{
+	"InputTrayEmpty":    "empty",
+	"MediaJam":          "jam",
+	"MultipleFeedError": "multipickdetected",
+	"InterlockOpen":     "hatchopen",
+	"CoverOpen":         "hatchopen",
+}
+
+// WsdStatus queries and parses WS-Scan ScannerStatus:
+//
+//	<wscn:ScannerStatus>
+//	  <wscn:ScannerState>Idle</wscn:ScannerState>
+//	  <wscn:ScannerStateReasons>
+//	    <wscn:ScannerStateReason>None</wscn:ScannerStateReason>
+//	  </wscn:ScannerStateReasons>
+//	  <wscn:ActiveConditions>
+//	    <wscn:DeviceCondition>
+//	      <wscn:Name>InputTrayEmpty</wscn:Name>
+//	      <wscn:Component>ADF</wscn:Component>
+//	    </wscn:DeviceCondition>
+//	  </wscn:ActiveConditions>
+//	  <wscn:ActiveJobs>
+//	    <wscn:JobSummary>...</wscn:JobSummary>
+//	  </wscn:ActiveJobs>
+//	</wscn:ScannerStatus>
+func WsdStatus(url string) (*Status, error) {
+	elements, err := wsdGetScannerElements(url, "ScannerStatus")
+	if err != nil {
+		return nil, err
+	}
+
+	status := &Status{}
+	for _, elem := range elements {
+		path := elem.Path
+		switch {
+		case strings.HasSuffix(path, "/wscn:ScannerStatus/wscn:ScannerState"):
+			status.State = strings.ToLower(elem.Text)
+
+		case strings.HasSuffix(path, "/wscn:ScannerStateReasons/wscn:ScannerStateReason"),
+			strings.HasSuffix(path, "/wscn:ActiveConditions/wscn:DeviceCondition/wscn:Name"):
+			if elem.Text == "None" || capsContains(status.Reasons, elem.Text) {
+				break
+			}
+
+			status.Reasons = append(status.Reasons, elem.Text)
+			if adf, found := wsdAdfReasons[elem.Text]; found {
+				status.AdfState = adf
+			}
+
+		case strings.HasSuffix(path, "/wscn:ActiveJobs/wscn:JobSummary"),
+			strings.HasSuffix(path, "/wscn:ActiveJobs/wscn:Job"):
+			status.Jobs++
+		}
+	}
+
+	if status.State == "" {
+		return nil, fmt.Errorf("GetScannerElements: no ScannerStatus")
+	}
+
+	return status, nil
+}
+
+// statusWatch polls the endpoint periodically and sends status
+// change events into the channel. It never returns
+func statusWatch(endpoint Endpoint, interval, maxInterval time.Duration,
+	events chan<- statusEvent) {
+
+	var prev *Status
+	delay := interval
+
+	for {
+		status := QueryStatus(endpoint)
+
+		if prev == nil || !status.Equal(prev) {
+			events <- statusEvent{
+				Event:    "status",
+				Time:     time.Now(),
+				Name:     endpoint.Name,
+				Proto:    endpoint.Proto,
+				URL:      endpoint.URL,
+				Previous: prev,
+				Status:   *status,
+			}
+		}
+
+		// Back off, if device is unreachable
+		if status.State == StateUnreachable {
+			delay *= 2
+			if delay > maxInterval {
+				delay = maxInterval
+			}
+		} else {
+			delay = interval
+		}
+
+		prev = status
+		time.Sleep(delay)
+	}
+}
+
+// statusPrint prints the status event
+func statusPrint(event statusEvent, format string, watch bool) {
+	if format == FormatNDJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.Encode(event)
+		return
+	}
+
+	line := fmt.Sprintf("%s (%s) %s: ", IniQuote(event.Name),
+		event.Proto, event.URL)
+
+	if watch {
+		line = event.Time.Format("15:04:05 ") + line
+		if event.Previous != nil {
+			line += event.Previous.State + " -> "
+		}
+	}
+
+	fmt.Printf("%s%s\n", line, event.Status.String())
+}
+
+// statusDuration parses the interval option value. Plain numbers
+// are seconds
+func statusDuration(opts *Options) time.Duration {
+	value := opts.Value()
+	s := value
+	if _, err := strconv.Atoi(s); err == nil {
+		s += "s"
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		opts.Fail("Option %s: invalid interval %q", opts.Opt, value)
+	}
+
+	return d
+}
+
+// cmdStatus implements the "status" command
+func cmdStatus(args []string) {
+	watch := false
+	interval := 5 * time.Second
+	maxInterval := 5 * time.Minute
+	format := "text"
+
+	// Parse options
+	opts := NewOptions(args, statusUsage)
+	for opts.Next() {
+		switch opts.Opt {
+		case "-w":
+			watch = true
+		case "-i":
+			interval = statusDuration(opts)
+		case "-m":
+			maxInterval = statusDuration(opts)
+		case "-o":
+			format = opts.Value()
+			if format != "text" && format != FormatNDJSON {
+				opts.Fail("Invalid output format %q", format)
+			}
+		default:
+			opts.Common()
+		}
+	}
+
+	if len(opts.Args()) != 0 {
+		opts.Invalid(opts.Args()[0])
+	}
+
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+
+	endpoints := Discover(DiscoveryTime, nil)
+	events := make(chan statusEvent)
+
+	for _, endpoint := range endpoints {
+		if watch {
+			go statusWatch(endpoint, interval, maxInterval, events)
+		} else {
+			go func(endpoint Endpoint) {
+				events <- statusEvent{
+					Event:  "status",
+					Time:   time.Now(),
+					Name:   endpoint.Name,
+					Proto:  endpoint.Proto,
+					URL:    endpoint.URL,
+					Status: *QueryStatus(endpoint),
+				}
+			}(endpoint)
+		}
+	}
+
+	// Print events. In the one-shot mode, results are printed
+	// in order of endpoints
+	if watch {
+		for event := range events {
+			statusPrint(event, format, true)
+		}
+	}
+
+	results := make(map[string]statusEvent)
+	for range endpoints {
+		event := <-events
+		results[event.Proto+" "+event.URL] = event
+	}
+
+	for _, endpoint := range endpoints {
+		statusPrint(results[endpoint.Proto+" "+endpoint.URL], format, false)
+	}
+}
@@ -0,0 +1,164 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Template-driven output
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// confTemplate is the built-in template for the airscan.conf output
+const confTemplate = `[devices]
+{{- range .}}
+  {{quote .Name}} = {{.URL}}{{if ne .Proto "escl"}}, {{.Proto}}{{end}}
+{{- end}}
+{{- if .}}
+
+; SANE device names, if auto-discovered / if configured as above:
+{{- range .}}
+;   {{if .SaneName}}{{.SaneName}}{{else}}(merged with eSCL){{end}} / {{.SaneConfName}}
+{{- end}}
+;
+; To scan:
+{{- range .}}{{if .SaneName}}
+;   {{.Scanimage}}
+{{- end}}{{end}}
+{{- end}}
+{{- range .}}{{if .Caps}}
+;
+; {{quote .Name}} ({{.Proto}}) capabilities:
+;   {{.Caps}}
+{{- else if .CapsError}}
+;
+; {{quote .Name}} ({{.Proto}}) capabilities:
+;   {{.CapsError}}
+{{- end}}{{end}}
+`
+
+// templateFuncs contains helper functions, available to templates
+var templateFuncs = template.FuncMap{
+	"quote": templateQuote,
+	"csv":   templateCSV,
+	"json":  templateJSON,
+	"host":  templateHost,
+	"port":  templatePort,
+	"proto": templateProto,
+	"join":  strings.Join,
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// OutputTemplateLoad loads output template from file
+func OutputTemplateLoad(file string) (*template.Template, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return OutputTemplateParse(file, string(data))
+}
+
+// OutputTemplateParse parses output template
+func OutputTemplateParse(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+// OutputTemplate writes endpoints, using the template
+func OutputTemplate(w io.Writer, tmpl *template.Template,
+	endpoints []Endpoint) error {
+	if endpoints == nil {
+		endpoints = []Endpoint{}
+	}
+	return tmpl.Execute(w, endpoints)
+}
+
+// templateQuote returns a double-quoted string, with special
+// characters escaped, as used in airscan.conf
+func templateQuote(s string) string {
+	return IniQuote(s)
+}
+
+// templateCSV joins fields into a single CSV record, without
+// the trailing newline
+func templateCSV(fields ...string) (string, error) {
+	var buf strings.Builder
+	w := csv.NewWriter(&buf)
+	w.Write(fields)
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n"), w.Error()
+}
+
+// templateJSON returns value, encoded as JSON. It can also be used
+// to quote strings for YAML, as JSON strings are valid YAML
+func templateJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+// templateHost extracts host part of the URL, without port and,
+// for IPv6 literals, without square brackets and zone
+func templateHost(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	host := u.Hostname()
+	if i := strings.IndexByte(host, '%'); i >= 0 && net.ParseIP(host[:i]) != nil {
+		host = host[:i]
+	}
+
+	return host, nil
+}
+
+// templatePort extracts port part of the URL. If port is not
+// specified explicitly, the default port for URL scheme is returned
+func templatePort(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	port := u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+
+	return port, nil
+}
+
+// templateProto filters endpoints by protocol. Usage:
+//
+//	{{range proto "wsd" .}}...{{end}}
+//
+// Multiple protocols may be specified, separated by comma
+func templateProto(protos string, endpoints []Endpoint) []Endpoint {
+	var filtered []Endpoint
+
+	for _, endpoint := range endpoints {
+		for _, proto := range strings.Split(protos, ",") {
+			if strings.EqualFold(strings.TrimSpace(proto), endpoint.Proto) {
+				filtered = append(filtered, endpoint)
+				break
+			}
+		}
+	}
+
+	return filtered
+}
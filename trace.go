@@ -0,0 +1,542 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Protocol trace format
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The trace is the tar archive. Each record is stored as a separate
+// file, named "NNN-name.xml", where NNN is the record index and name
+// is the record kind:
+//
+//	udp-from-ADDR    received UDP message
+//	udp-to-ADDR      sent UDP message
+//	http-request     HTTP request body
+//	http-response    HTTP response body
+//	http-error       HTTP request failure (error text)
+//
+// Record time is stored as the file modification time. Other record
+// metadata is stored in PAX extended header records with the AIRSCAN.
+// prefix, and the trace starts with the manifest.json file, that
+// describes the traced session. Traces, written by older versions,
+// have neither; they are still readable, without metadata
+const traceManifestName = "manifest.json"
+
+// traceFormat is the current trace format version
+const traceFormat = 2
+
+// TraceManifest describes the traced session
+type TraceManifest struct {
+	Format      int              `json:"format"`       // Trace format
+	Version     string           `json:"version"`      // Program version
+	CommandLine []string         `json:"command_line"` // Command line
+	StartTime   time.Time        `json:"start_time"`   // Start time
+	Interfaces  []TraceInterface `json:"interfaces"`   // Interfaces
+}
+
+// TraceInterface describes the network interface in the manifest
+type TraceInterface struct {
+	Index int      `json:"index"` // Interface index
+	Name  string   `json:"name"`  // Interface name
+	Addrs []string `json:"addrs"` // Interface addresses
+}
+
+// TraceMeta represents the trace record metadata
+type TraceMeta struct {
+	Time      time.Time   // Record time
+	Direction string      // "in" or "out"
+	Local     string      // Local address
+	Remote    string      // Remote address
+	Zone      string      // Interface name
+	Method    string      // HTTP method
+	URL       string      // HTTP URL
+	Status    int         // HTTP status
+	Header    http.Header // HTTP headers
+	ID        string      // Correlation ID
+}
+
+// TraceEntry represents a single record of the protocol trace
+type TraceEntry struct {
+	TraceMeta
+	Index int    // Record index
+	Name  string // Record name, i.e., "udp-from-192.168.1.10:3702"
+	Data  []byte // Record data
+}
+
+// TraceArchive represents the protocol trace, loaded from file
+type TraceArchive struct {
+	Manifest *TraceManifest // Nil for old traces
+	Entries  []*TraceEntry  // Trace records
+}
+
+// traceNextID is used to generate correlation IDs
+var traceNextID uint32
+
+// TraceNewManifest returns the manifest of the current session
+func TraceNewManifest() *TraceManifest {
+	manifest := &TraceManifest{
+		Format:      traceFormat,
+		Version:     Version,
+		CommandLine: os.Args,
+		StartTime:   time.Now(),
+	}
+
+	interfaces, _ := network.Interfaces()
+	for _, iface := range interfaces {
+		ti := TraceInterface{Index: iface.Index, Name: iface.Name}
+		for _, addr := range iface.Addrs {
+			ti.Addrs = append(ti.Addrs, addr.String())
+		}
+		manifest.Interfaces = append(manifest.Interfaces, ti)
+	}
+
+	return manifest
+}
+
+// Bytes returns the manifest, encoded as JSON
+func (manifest *TraceManifest) Bytes() []byte {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	LogCheck(err)
+	return append(data, '\n')
+}
+
+// traceNewID returns the new correlation ID with the prefix
+func traceNewID(prefix string) string {
+	return fmt.Sprintf("%s-%d", prefix, atomic.AddUint32(&traceNextID, 1))
+}
+
+// traceSOAPID returns correlation ID of the SOAP message: its
+// RelatesTo, if any, or MessageID, so the request and response
+// have the same ID
+func traceSOAPID(msg []byte) string {
+	var msgID, relatesTo string
+
+	elements, _ := XMLDecode(wsddNsMap, bytes.NewBuffer(msg))
+	for _, elem := range elements {
+		switch elem.Path {
+		case "/s:Envelope/s:Header/a:MessageID":
+			msgID = elem.Text
+		case "/s:Envelope/s:Header/a:RelatesTo":
+			relatesTo = elem.Text
+		}
+	}
+
+	if relatesTo != "" {
+		return relatesTo
+	}
+
+	return msgID
+}
+
+// paxRecords encodes metadata into PAX records. Time is not
+// included, it is stored as file modification time
+func (meta TraceMeta) paxRecords() map[string]string {
+	pax := make(map[string]string)
+
+	add := func(key, value string) {
+		if value != "" {
+			pax["AIRSCAN."+key] = value
+		}
+	}
+
+	add("direction", meta.Direction)
+	add("local", meta.Local)
+	add("remote", meta.Remote)
+	add("zone", meta.Zone)
+	add("method", meta.Method)
+	add("url", meta.URL)
+	add("id", meta.ID)
+
+	if meta.Status != 0 {
+		add("status", strconv.Itoa(meta.Status))
+	}
+
+	if len(meta.Header) != 0 {
+		var buf bytes.Buffer
+		meta.Header.Write(&buf)
+		add("header", buf.String())
+	}
+
+	return pax
+}
+
+// traceParseMeta decodes metadata from the tar header
+func traceParseMeta(hdr *tar.Header) TraceMeta {
+	pax := hdr.PAXRecords
+	meta := TraceMeta{
+		Direction: pax["AIRSCAN.direction"],
+		Local:     pax["AIRSCAN.local"],
+		Remote:    pax["AIRSCAN.remote"],
+		Zone:      pax["AIRSCAN.zone"],
+		Method:    pax["AIRSCAN.method"],
+		URL:       pax["AIRSCAN.url"],
+		ID:        pax["AIRSCAN.id"],
+	}
+
+	// Old traces have zero modification time
+	if hdr.ModTime.Unix() > 0 {
+		meta.Time = hdr.ModTime
+	}
+
+	meta.Status, _ = strconv.Atoi(pax["AIRSCAN.status"])
+
+	if header := pax["AIRSCAN.header"]; header != "" {
+		r := textproto.NewReader(bufio.NewReader(
+			strings.NewReader(header + "\r\n")))
+		mime, err := r.ReadMIMEHeader()
+		if err == nil {
+			meta.Header = http.Header(mime)
+		}
+	}
+
+	return meta
+}
+
+// TraceRead reads the protocol trace file
+func TraceRead(file string) (*TraceArchive, error) {
+	f, err := traceOpen(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	trace := &TraceArchive{}
+	tr := tar.NewReader(f)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+
+		if hdr.Name == traceManifestName {
+			trace.Manifest = &TraceManifest{}
+			err = json.Unmarshal(data, trace.Manifest)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %s", file, hdr.Name, err)
+			}
+			continue
+		}
+
+		entry, err := traceParseName(hdr.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+
+		entry.TraceMeta = traceParseMeta(hdr)
+		entry.Data = data
+		trace.Entries = append(trace.Entries, entry)
+	}
+
+	return trace, nil
+}
+
+// TraceWriter writes the protocol trace
+type TraceWriter interface {
+	// WriteManifest writes the manifest. It must be called
+	// before any record is written
+	WriteManifest(manifest *TraceManifest) error
+
+	// WriteEntry writes the trace record
+	WriteEntry(entry *TraceEntry) error
+
+	// Close closes the trace file
+	Close() error
+}
+
+// Trace file formats
+const (
+	TraceFormatTar    = "tar"
+	TraceFormatPcapng = "pcapng"
+)
+
+// TraceCreate creates the protocol trace file of the format.
+// If file name ends with .gz, the file is compressed with gzip
+func TraceCreate(file, format string) (TraceWriter, error) {
+	f, err := traceOpenFile(file, os.O_TRUNC)
+	if err != nil {
+		return nil, err
+	}
+
+	return traceNewWriter(f, format), nil
+}
+
+// traceOpenFile creates the trace file for writing. Flags are added
+// to os.O_WRONLY|os.O_CREATE. If file name ends with .gz, the file
+// is compressed with gzip
+func traceOpenFile(file string, flags int) (io.WriteCloser, error) {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(file, ".gz") {
+		return &traceGzipFile{gzip.NewWriter(f), f}, nil
+	}
+
+	return f, nil
+}
+
+// traceNewWriter creates the TraceWriter of the format on top
+// of the opened file
+func traceNewWriter(f io.WriteCloser, format string) TraceWriter {
+	if format == TraceFormatPcapng {
+		return NewPcapngWriter(f)
+	}
+
+	return &tarTraceWriter{f, tar.NewWriter(f)}
+}
+
+// TraceWrite writes the protocol trace file of the format
+func TraceWrite(file, format string, trace *TraceArchive) error {
+	tw, err := TraceCreate(file, format)
+	if err != nil {
+		return err
+	}
+
+	if trace.Manifest != nil {
+		err = tw.WriteManifest(trace.Manifest)
+	}
+
+	for _, entry := range trace.Entries {
+		if err != nil {
+			break
+		}
+		err = tw.WriteEntry(entry)
+	}
+
+	err2 := tw.Close()
+	if err == nil {
+		err = err2
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+
+	return nil
+}
+
+// traceOpen opens the trace or capture file for reading.
+// Files, compressed with gzip, are decompressed transparently
+func traceOpen(file string) (io.ReadCloser, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	magic, _ := r.Peek(2)
+	if !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, f}, nil
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %s", file, err)
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, f}, nil
+}
+
+// traceGzipFile is the trace file, compressed with gzip
+type traceGzipFile struct {
+	*gzip.Writer
+	file io.Closer
+}
+
+// Close flushes compressed data and closes the file
+func (gf *traceGzipFile) Close() error {
+	err := gf.Writer.Close()
+	err2 := gf.file.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
+
+// tarTraceWriter writes the protocol trace in the tar format
+type tarTraceWriter struct {
+	file io.WriteCloser
+	tw   *tar.Writer
+}
+
+// WriteManifest writes the manifest
+func (tw *tarTraceWriter) WriteManifest(manifest *TraceManifest) error {
+	return traceWrite(tw.tw, traceManifestName, manifest.Bytes(),
+		manifest.StartTime, nil)
+}
+
+// WriteEntry writes the trace record
+func (tw *tarTraceWriter) WriteEntry(entry *TraceEntry) error {
+	name := fmt.Sprintf("%.3d-%s.xml", entry.Index, entry.Name)
+	return traceWrite(tw.tw, name, entry.Data, entry.Time,
+		entry.paxRecords())
+}
+
+// Close closes the trace file
+func (tw *tarTraceWriter) Close() error {
+	err := tw.tw.Close()
+	err2 := tw.file.Close()
+	if err == nil {
+		err = err2
+	}
+	return err
+}
+
+// traceParseName parses the trace record name, "NNN-name.xml"
+func traceParseName(name string) (*TraceEntry, error) {
+	s := strings.TrimSuffix(name, ".xml")
+
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		return nil, fmt.Errorf("%q: invalid record name", name)
+	}
+
+	index, err := strconv.Atoi(s[:i])
+	if err != nil {
+		return nil, fmt.Errorf("%q: invalid record name", name)
+	}
+
+	return &TraceEntry{Index: index, Name: s[i+1:]}, nil
+}
+
+// UDPFrom returns the source address of received UDP message,
+// or nil, if entry is not the received UDP message
+func (entry *TraceEntry) UDPFrom() *net.UDPAddr {
+	return entry.udpAddr("udp-from-")
+}
+
+// UDPTo returns the destination address of sent UDP message,
+// or nil, if entry is not the sent UDP message
+func (entry *TraceEntry) UDPTo() *net.UDPAddr {
+	return entry.udpAddr("udp-to-")
+}
+
+// udpAddr parses UDP address, that follows the prefix in the name
+func (entry *TraceEntry) udpAddr(prefix string) *net.UDPAddr {
+	if !strings.HasPrefix(entry.Name, prefix) {
+		return nil
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", entry.Name[len(prefix):])
+	if err != nil {
+		return nil
+	}
+
+	return addr
+}
+
+// traceDNSSdName is the name of the DNS-SD service record
+const traceDNSSdName = "dnssd-service"
+
+// traceDNSSdRecord is the DNS-SD service, as recorded in the trace.
+// TXT records are kept as strings, so they can be redacted. Services,
+// that failed to resolve, are recorded with the error
+type traceDNSSdRecord struct {
+	Interface int      `json:"interface"`       // Interface index
+	Name      string   `json:"name"`            // Service instance name
+	Address   string   `json:"address"`         // IP address
+	Port      uint16   `json:"port"`            // IP port
+	Txt       []string `json:"txt"`             // TXT records
+	Error     string   `json:"error,omitempty"` // Resolve error
+}
+
+// LogTraceDNSSd adds the DNS-SD service to the protocol trace
+func LogTraceDNSSd(service DNSSdService) {
+	if !Trace {
+		return
+	}
+
+	record := traceDNSSdRecord{
+		Interface: service.Interface,
+		Name:      service.Name,
+		Address:   service.Address,
+		Port:      service.Port,
+	}
+
+	for _, txt := range service.Txt {
+		record.Txt = append(record.Txt, string(txt))
+	}
+
+	meta := TraceMeta{
+		Direction: "in",
+		Zone:      netInterfaceName(service.Interface),
+	}
+
+	if service.Err != nil {
+		record.Error = service.Err.Error()
+	} else {
+		meta.Remote = net.JoinHostPort(service.Address,
+			strconv.Itoa(int(service.Port)))
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	LogCheck(err)
+
+	LogTraceMeta(traceDNSSdName, data, meta)
+}
+
+// DNSSdService returns the DNS-SD service of the record, or false,
+// if entry is not the DNS-SD service record
+func (entry *TraceEntry) DNSSdService() (DNSSdService, bool) {
+	var record traceDNSSdRecord
+	if entry.Name != traceDNSSdName ||
+		json.Unmarshal(entry.Data, &record) != nil {
+		return DNSSdService{}, false
+	}
+
+	service := DNSSdService{
+		Interface: record.Interface,
+		Name:      record.Name,
+		Address:   record.Address,
+		Port:      record.Port,
+	}
+
+	for _, txt := range record.Txt {
+		service.Txt = append(service.Txt, []byte(txt))
+	}
+
+	if record.Error != "" {
+		service.Err = errors.New(record.Error)
+	}
+
+	return service, true
+}
@@ -0,0 +1,604 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// The "trace" command: protocol trace inspection
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// traceUsage is the usage template of the trace command
+const traceUsage = `Usage:
+    %s trace show [options] trace.tar
+    %s trace redact [options] trace.tar redacted.tar
+    %s trace pcapng [options] trace.tar trace.pcapng
+
+The show action prints the protocol trace as a chronological timeline
+of probes, matches, metadata requests and responses. Each message is
+printed with its key fields (action, endpoint address, types, XAddrs,
+model) and the pretty-printed XML body.
+
+The redact action writes copy of the trace with IP and MAC addresses,
+UUIDs, serial numbers and host names consistently replaced with
+pseudonyms, so the trace can be shared. The redacted trace can
+still be replayed. The same redaction is applied at capture time,
+if trace is enabled with the -R option. If the output file name
+ends with .pcapng, the redacted trace is written in pcapng format.
+
+The pcapng action converts the trace into pcapng format, so it can
+be loaded into Wireshark. UDP messages become synthesized IP/UDP
+packets and HTTP exchanges become synthesized TCP streams, with the
+real addresses and ports, timestamps and network interfaces. Each
+packet carries the trace record name in its comment. The trace
+is written in pcapng format at capture time, if enabled with
+the --trace-format pcapng option.
+
+Options are:
+    -D device      show only messages of the device (show)
+    -m types       show only messages of these types (show)
+    -s             summary only, don't print message bodies (show)
+` + usageLogOptions + usageHelpOption + `
+The device is matched by its endpoint address (with or without
+the urn:uuid: prefix), IP address or model name. Probes and requests,
+answered by the device, are shown too.
+
+Message types are comma-separated list of:
+    probe          WS-Discovery Probe
+    match          ProbeMatches and ResolveMatches
+    hello, bye     WS-Discovery announcements
+    metadata       metadata Get and GetResponse
+    error          HTTP errors, SOAP faults and DNS-SD resolve errors
+    udp, http      all messages of the transport
+    dnssd          DNS-SD services
+
+Other names are compared with the SOAP action name (i.e., Resolve)
+or the last element of the HTTP request path (i.e., ScannerStatus).
+`
+
+// traceActions contains actions of the trace command
+var traceActions = map[string]func(args []string){
+	"show":   cmdTraceShow,
+	"redact": cmdTraceRedact,
+	"pcapng": cmdTracePcapng,
+}
+
+// traceView is the trace record, decoded for viewing
+type traceView struct {
+	*TraceEntry
+	group   string   // Correlation group
+	kind    string   // Message kind, i.e., "Probe"
+	proto   string   // "udp", "http" or "dnssd"
+	out     bool     // Outgoing message
+	peer    string   // Remote address or URL
+	action  string   // SOAP action
+	address string   // Endpoint address
+	types   string   // Device types
+	xaddrs  []string // Transport addresses
+	model   string   // Manufacturer and model
+	fault   string   // SOAP fault reason or DNS-SD resolve error
+}
+
+// traceViewLoad decodes trace records for viewing
+func traceViewLoad(entries []*TraceEntry) []*traceView {
+	var views []*traceView
+	var request *traceView
+
+	for _, entry := range entries {
+		view := &traceView{TraceEntry: entry, group: entry.ID}
+		views = append(views, view)
+
+		switch {
+		case entry.UDPFrom() != nil:
+			view.proto = "udp"
+			view.peer = entry.UDPFrom().String()
+		case entry.UDPTo() != nil:
+			view.proto = "udp"
+			view.out = true
+			view.peer = entry.UDPTo().String()
+		case strings.HasPrefix(entry.Name, "http-"):
+			view.proto = "http"
+			view.out = entry.Name == "http-request"
+			view.peer = entry.URL
+		case entry.Name == traceDNSSdName:
+			view.proto = "dnssd"
+			view.peer = entry.Remote
+		}
+
+		// Old traces have no direction; all their
+		// HTTP requests are outgoing
+		switch entry.Direction {
+		case "in":
+			view.out = false
+		case "out":
+			view.out = true
+		}
+
+		if view.proto != "http" && entry.Zone != "" &&
+			!strings.Contains(view.peer, "%") {
+			view.peer += " via " + entry.Zone
+		}
+
+		view.decode()
+
+		// Old traces have no IDs, and HTTP request is followed
+		// by its response
+		if view.group == "" {
+			view.group = traceSOAPID(entry.Data)
+		}
+
+		switch entry.Name {
+		case "http-request":
+			request = view
+		case "http-response", "http-error":
+			if request != nil && view.group == "" {
+				view.group = request.group
+			}
+			request = nil
+		}
+
+		if view.group == "" {
+			view.group = fmt.Sprintf("#%d", entry.Index)
+		}
+	}
+
+	// Responses inherit kind and peer of their requests
+	requests := make(map[string]*traceView)
+	for _, view := range views {
+		switch view.Name {
+		case "http-request":
+			requests[view.group] = view
+		case "http-response", "http-error":
+			if request := requests[view.group]; request != nil {
+				if view.kind == "" {
+					view.kind = request.kind
+				}
+				if view.peer == "" {
+					view.peer = request.peer
+				}
+			}
+		}
+	}
+
+	// Sort by time. Old traces have no time, and records are
+	// written in order anyway
+	sort.SliceStable(views, func(i, j int) bool {
+		return views[i].Time.Before(views[j].Time)
+	})
+
+	return views
+}
+
+// decode decodes key fields of the message
+func (view *traceView) decode() {
+	var manufacturer, model string
+
+	// DNS-SD service is named by the instance name, and
+	// its TXT record tells the model. Resolve errors are
+	// shown as faults
+	if service, ok := view.DNSSdService(); ok {
+		view.kind = service.Name
+		if service.Err != nil {
+			view.fault = service.Err.Error()
+		}
+		for _, txt := range service.Txt {
+			if bytes.HasPrefix(bytes.ToLower(txt), []byte("ty=")) {
+				view.model = string(txt[3:])
+			}
+		}
+		return
+	}
+
+	elements, err := XMLDecode(wsddNsMap, bytes.NewReader(view.Data))
+	if err == nil {
+		for _, elem := range elements {
+			switch {
+			case elem.Path == "/s:Envelope/s:Header/a:Action":
+				view.action = elem.Text
+			case elem.Path == "/s:Envelope/s:Header/a:To" &&
+				strings.HasPrefix(elem.Text, "urn:") &&
+				elem.Text != "urn:schemas-xmlsoap-org:ws:2005:04:discovery":
+				// Requests to device are addressed by its endpoint
+				view.address = elem.Text
+			case strings.HasSuffix(elem.Path, "/a:EndpointReference/a:Address") &&
+				!strings.Contains(elem.Path, "/devprof:Hosted/"):
+				view.address = elem.Text
+			case strings.HasSuffix(elem.Path, "/d:Types"):
+				view.types = elem.Text
+			case strings.HasSuffix(elem.Path, "/d:XAddrs"):
+				view.xaddrs = strings.Fields(elem.Text)
+			case strings.HasSuffix(elem.Path, "/devprof:ThisModel/devprof:Manufacturer"):
+				manufacturer = elem.Text
+			case strings.HasSuffix(elem.Path, "/devprof:ThisModel/devprof:ModelName"):
+				model = elem.Text
+			case elem.Path == "/s:Envelope/s:Body/s:Fault/s:Reason/s:Text":
+				view.fault = elem.Text
+			}
+		}
+	}
+
+	view.model = strings.TrimSpace(manufacturer + " " + model)
+
+	switch {
+	case view.action != "":
+		view.kind = path.Base(view.action)
+	case view.Name == "http-request" && view.URL != "":
+		if u, err := url.Parse(view.URL); err == nil {
+			view.kind = path.Base(u.Path)
+		}
+	}
+}
+
+// hosts returns IP addresses of the message peer and XAddrs
+func (view *traceView) hosts() []string {
+	var hosts []string
+
+	addrs := append([]string{view.peer}, view.xaddrs...)
+	if !view.out {
+		addrs = append(addrs, view.Remote)
+	}
+
+	for _, addr := range addrs {
+		addr = strings.Fields(addr + " ")[0]
+		if u, err := url.Parse(addr); err == nil && u.Host != "" {
+			addr = u.Host
+		}
+
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+
+		if i := strings.IndexByte(host, '%'); i >= 0 {
+			host = host[:i]
+		}
+
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts
+}
+
+// matchDevice reports whether message belongs to the device
+func (view *traceView) matchDevice(device string) bool {
+	device = strings.ToLower(device)
+	address := strings.ToLower(view.address)
+
+	switch {
+	case address != "" &&
+		(address == device || address == "urn:uuid:"+device):
+		return true
+	case view.model != "" &&
+		strings.Contains(strings.ToLower(view.model), device):
+		return true
+	}
+
+	// Outgoing multicast probes are sent to everybody
+	if view.out && view.proto == "udp" {
+		return false
+	}
+
+	for _, host := range view.hosts() {
+		if host == device {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchKinds reports whether message is one of the kinds
+func (view *traceView) matchKinds(kinds []string) bool {
+	for _, kind := range kinds {
+		var match bool
+
+		switch kind {
+		case "probe":
+			match = view.kind == "Probe"
+		case "match":
+			match = view.kind == "ProbeMatches" ||
+				view.kind == "ResolveMatches"
+		case "metadata":
+			match = view.kind == "Get" || view.kind == "GetResponse"
+		case "error":
+			match = view.Name == "http-error" || view.fault != "" ||
+				view.Status >= 400
+		case "udp", "http", "dnssd":
+			match = view.proto == kind
+		default:
+			match = strings.EqualFold(view.kind, kind)
+		}
+
+		if match {
+			return true
+		}
+	}
+
+	return false
+}
+
+// traceFilterDevice returns messages of the device. Messages are
+// grouped by correlation ID, so probes and requests are shown with
+// their responses, and the device, once found, is followed by its
+// endpoint address
+func traceFilterDevice(views []*traceView, device string) []*traceView {
+	groups := make(map[string]bool)
+	addresses := make(map[string]bool)
+
+	for _, view := range views {
+		if view.matchDevice(device) {
+			groups[view.group] = true
+		}
+	}
+
+	for _, view := range views {
+		if groups[view.group] && view.address != "" {
+			addresses[view.address] = true
+		}
+	}
+
+	for _, view := range views {
+		if addresses[view.address] {
+			groups[view.group] = true
+		}
+	}
+
+	var filtered []*traceView
+	for _, view := range views {
+		if groups[view.group] {
+			filtered = append(filtered, view)
+		}
+	}
+
+	return filtered
+}
+
+// traceShowManifest prints the trace manifest
+func traceShowManifest(w io.Writer, file string, manifest *TraceManifest) {
+	if manifest == nil {
+		fmt.Fprintf(w, "%s: old format trace, no session information\n",
+			file)
+		return
+	}
+
+	fmt.Fprintf(w, "%s: format %d, written by version %s\n",
+		file, manifest.Format, manifest.Version)
+	fmt.Fprintf(w, "  started:  %s\n",
+		manifest.StartTime.Format("2006-01-02 15:04:05.000 -0700"))
+	fmt.Fprintf(w, "  command:  %s\n", strings.Join(manifest.CommandLine, " "))
+
+	for _, iface := range manifest.Interfaces {
+		fmt.Fprintf(w, "  iface %d:  %s\n", iface.Index,
+			strings.Join(append([]string{iface.Name}, iface.Addrs...), " "))
+	}
+}
+
+// traceShowView prints the trace message
+func traceShowView(w io.Writer, view *traceView, summary bool) {
+	// Summary line
+	tm := "            "
+	if !view.Time.IsZero() {
+		tm = view.Time.Format("15:04:05.000")
+	}
+
+	dir := "<-"
+	if view.out {
+		dir = "->"
+	}
+
+	var what string
+	switch view.Name {
+	case "http-request":
+		what = strings.TrimSpace(view.Method + " " + view.peer)
+		if what == "" {
+			what = "request"
+		}
+	case "http-response":
+		what = "response"
+		if view.Status != 0 {
+			what = fmt.Sprintf("%d %s", view.Status,
+				http.StatusText(view.Status))
+		}
+	case "http-error":
+		what = "error"
+	default:
+		what = view.peer
+	}
+
+	fmt.Fprintf(w, "%s  #%.3d  %s %-4s %s", tm, view.Index, dir,
+		view.proto, what)
+	if view.kind != "" {
+		fmt.Fprintf(w, "  [%s]", view.kind)
+	}
+	fmt.Fprintf(w, "\n")
+
+	// Key fields
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(w, "    %-9s %s\n", name+":", value)
+		}
+	}
+
+	field("action", view.action)
+	field("address", view.address)
+	field("types", view.types)
+	for _, xaddr := range view.xaddrs {
+		field("xaddr", xaddr)
+	}
+	field("model", view.model)
+	field("fault", view.fault)
+	field("id", view.ID)
+
+	// Message body
+	data := view.Data
+	if !summary && len(data) != 0 {
+		if view.proto == "dnssd" {
+			// JSON is already indented
+		} else if pretty, err := XMLIndent(data, "  "); err == nil {
+			data = pretty
+		}
+
+		fmt.Fprintf(w, "\n")
+		if utf8.Valid(data) {
+			text := strings.TrimRight(string(data), "\n")
+			for _, line := range strings.Split(text, "\n") {
+				fmt.Fprintf(w, "    %s\n", line)
+			}
+		} else {
+			fmt.Fprintf(w, "    (%d bytes of binary data)\n", len(data))
+		}
+	}
+
+	fmt.Fprintf(w, "\n")
+}
+
+// cmdTrace implements the "trace" command
+func cmdTrace(args []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		opts := NewOptions(args, traceUsage)
+		for opts.Next() {
+			opts.Common()
+		}
+		opts.Fail("Missed trace action")
+	}
+
+	action := traceActions[args[0]]
+	if action == nil {
+		NewOptions(nil, traceUsage).Invalid(args[0])
+	}
+
+	action(args[1:])
+}
+
+// cmdTraceShow implements the "trace show" command
+func cmdTraceShow(args []string) {
+	device := ""
+	summary := false
+	var kinds []string
+
+	// Parse options
+	opts := NewOptions(args, traceUsage)
+	for opts.Next() {
+		switch opts.Opt {
+		case "-D":
+			device = opts.Value()
+		case "-m":
+			for _, kind := range strings.Split(opts.Value(), ",") {
+				kind = strings.ToLower(strings.TrimSpace(kind))
+				if kind != "" {
+					kinds = append(kinds, kind)
+				}
+			}
+		case "-s":
+			summary = true
+		default:
+			opts.Common()
+		}
+	}
+
+	args = opts.Args()
+	switch len(args) {
+	case 0:
+		opts.Fail("Missed trace file")
+	case 1:
+	default:
+		opts.Invalid(args[1])
+	}
+
+	// Load the trace
+	trace, err := TraceRead(args[0])
+	LogCheck(err)
+
+	views := traceViewLoad(trace.Entries)
+	if device != "" {
+		views = traceFilterDevice(views, device)
+	}
+
+	// Print the timeline
+	traceShowManifest(os.Stdout, args[0], trace.Manifest)
+	fmt.Printf("\n")
+
+	for _, view := range views {
+		if kinds == nil || view.matchKinds(kinds) {
+			traceShowView(os.Stdout, view, summary)
+		}
+	}
+}
+
+// cmdTraceRedact implements the "trace redact" command
+func cmdTraceRedact(args []string) {
+	// Parse options
+	opts := NewOptions(args, traceUsage)
+	for opts.Next() {
+		opts.Common()
+	}
+
+	args = opts.Args()
+	switch len(args) {
+	case 0:
+		opts.Fail("Missed trace file")
+	case 1:
+		opts.Fail("Missed output file")
+	case 2:
+	default:
+		opts.Invalid(args[2])
+	}
+
+	// Redact the trace
+	trace, err := TraceRead(args[0])
+	LogCheck(err)
+
+	trace = NewRedactor().Trace(trace)
+
+	format := TraceFormatTar
+	if strings.HasSuffix(args[1], ".pcapng") {
+		format = TraceFormatPcapng
+	}
+
+	err = TraceWrite(args[1], format, trace)
+	LogCheck(err)
+
+	LogDebug("%s: %d records redacted", args[1], len(trace.Entries))
+}
+
+// cmdTracePcapng implements the "trace pcapng" command
+func cmdTracePcapng(args []string) {
+	// Parse options
+	opts := NewOptions(args, traceUsage)
+	for opts.Next() {
+		opts.Common()
+	}
+
+	args = opts.Args()
+	switch len(args) {
+	case 0:
+		opts.Fail("Missed trace file")
+	case 1:
+		opts.Fail("Missed output file")
+	case 2:
+	default:
+		opts.Invalid(args[2])
+	}
+
+	// Convert the trace
+	trace, err := TraceRead(args[0])
+	LogCheck(err)
+
+	err = TraceWrite(args[1], TraceFormatPcapng, trace)
+	LogCheck(err)
+}
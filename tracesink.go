@@ -0,0 +1,246 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Protocol trace destination and rotation
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Protocol trace destination
+var (
+	// TracePath is the trace file or directory. If it is a
+	// directory, each run writes a new file, named by its start
+	// time. If empty, trace is written to the current directory.
+	// Existing files are never overwritten
+	TracePath = ""
+
+	// TraceGzip enables gzip compression of the trace
+	TraceGzip = false
+
+	// TraceMaxSize, if not 0, is the size of trace data, written
+	// before compression, when the trace continues in the next file
+	TraceMaxSize int64
+
+	// TraceMaxFiles, if not 0, is the maximum number of trace files,
+	// kept on rotation. The oldest files are removed, including
+	// files of previous runs, if trace is written to directory
+	TraceMaxFiles = 0
+)
+
+// Current trace file. Must be accessed under the traceLock
+var (
+	traceFile    string   // Current file name
+	traceRecords int      // Records in the current file
+	traceSize    int64    // Bytes in the current file, before compression
+	traceBase    string   // Base name of the run, without extension
+	traceExt     string   // File name extension
+	traceDir     string   // Trace directory, "" if TracePath is file
+	tracePart    int      // Current file number
+	traceFiles   []string // Files, written by the run
+)
+
+// traceCountFile counts bytes, written to the current trace file
+type traceCountFile struct {
+	io.WriteCloser
+}
+
+// traceStart opens the next trace file and writes the manifest.
+// Must be called under the traceLock
+func traceStart() error {
+	if traceBase == "" {
+		err := traceNameRun()
+		if err != nil {
+			return err
+		}
+	} else {
+		tracePart++
+	}
+
+	file := traceBase + traceExt
+	if tracePart > 0 {
+		file = fmt.Sprintf("%s.%d%s", traceBase, tracePart, traceExt)
+	}
+
+	f, err := traceOpenFile(file, os.O_EXCL)
+	if err != nil {
+		return err
+	}
+
+	manifest := TraceNewManifest()
+	if TraceRedact {
+		manifest = traceRedactor.Manifest(manifest)
+	}
+
+	traceWriter = traceNewWriter(&traceCountFile{f}, TraceFormat)
+	traceFile = file
+	traceRecords = 0
+	traceSize = 0
+	traceWriter.WriteManifest(manifest)
+
+	LogInfo("Trace: writing %s", file)
+	OnInterrupt(nil)
+
+	traceFiles = append(traceFiles, file)
+	tracePrune()
+
+	return nil
+}
+
+// tracePrune removes the oldest trace files, if there are more,
+// than TraceMaxFiles. In the trace directory, files of previous runs
+// are counted too. Must be called under the traceLock
+func tracePrune() {
+	if TraceMaxFiles <= 0 {
+		return
+	}
+
+	files := traceFiles
+	if traceDir != "" {
+		files, _ = filepath.Glob(filepath.Join(traceDir,
+			traceName+"-[0-9]*"+traceExt))
+
+		// Sort by modification time, the current file is the last
+		mtime := make(map[string]time.Time)
+		for _, file := range files {
+			if fi, err := os.Stat(file); err == nil {
+				mtime[file] = fi.ModTime()
+			}
+		}
+
+		sort.SliceStable(files, func(i, j int) bool {
+			switch {
+			case files[i] == traceFile:
+				return false
+			case files[j] == traceFile:
+				return true
+			}
+			return mtime[files[i]].Before(mtime[files[j]])
+		})
+	}
+
+	for len(files) > TraceMaxFiles {
+		os.Remove(files[0])
+		LogInfo("Trace: %s removed", files[0])
+		files = files[1:]
+	}
+
+	if traceDir == "" {
+		traceFiles = files
+	}
+}
+
+// traceNameRun chooses base name and extension of the trace
+// files of this run. Must be called under the traceLock
+func traceNameRun() error {
+	traceBase = traceName
+	traceExt = "." + TraceFormat
+	if TraceGzip {
+		traceExt += ".gz"
+	}
+
+	dir := TracePath
+	if dir != "" && !strings.HasSuffix(dir, string(os.PathSeparator)) {
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			// TracePath is the file
+			traceBase = strings.TrimSuffix(dir, ".gz")
+			traceBase = strings.TrimSuffix(traceBase, "."+TraceFormat)
+			if TraceGzip || strings.HasSuffix(dir, ".gz") {
+				traceExt = "." + TraceFormat + ".gz"
+			}
+			traceBase = traceFreeBase(traceBase)
+			return nil
+		}
+	}
+
+	// TracePath is the directory, the current one by default:
+	// name the file by start time
+	if dir == "" {
+		dir = "."
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	traceDir = dir
+
+	stamp := time.Now().Format("20060102-150405")
+	traceBase = traceFreeBase(filepath.Join(dir, traceName+"-"+stamp))
+
+	return nil
+}
+
+// traceFreeBase returns the base name, which is not used by existing
+// files: if base+traceExt exists, -2, -3 and so on is appended.
+// Must be called under the traceLock
+func traceFreeBase(base string) string {
+	name := base
+	for i := 2; ; i++ {
+		if _, err := os.Stat(name + traceExt); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+// traceRotate finishes the current trace file, if it exceeds
+// TraceMaxSize. The next record will start the new file. Written
+// bytes are counted, as the compressor buffers its output, so the
+// file size lags behind. Must be called under the traceLock
+func traceRotate() {
+	if TraceMaxSize != 0 && traceSize >= TraceMaxSize {
+		traceFinish()
+	}
+}
+
+// Write writes data to the file and counts written bytes
+func (cf *traceCountFile) Write(data []byte) (int, error) {
+	n, err := cf.WriteCloser.Write(data)
+	traceSize += int64(n)
+	return n, err
+}
+
+// traceFinish finalizes the current trace file. Must be called
+// under the traceLock
+func traceFinish() {
+	if traceWriter == nil {
+		return
+	}
+
+	err := traceWriter.Close()
+	traceWriter = nil
+
+	if err != nil {
+		LogError("Trace: %s: %s", traceFile, err)
+		return
+	}
+
+	var size int64
+	if fi, err := os.Stat(traceFile); err == nil {
+		size = fi.Size()
+	}
+
+	LogInfo("Trace: %s finalized, %d records, %d bytes",
+		traceFile, traceRecords, size)
+}
+
+// TraceClose finalizes the protocol trace. It is safe to call
+// TraceClose many times, and records, added after, start the
+// new trace file
+func TraceClose() {
+	traceLock.Lock()
+	traceFinish()
+	traceLock.Unlock()
+}
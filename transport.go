@@ -0,0 +1,191 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Network transports, used by discovery
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/holoplot/go-avahi"
+)
+
+// Network provides access to network interfaces and packet sockets
+type Network interface {
+	// Interfaces returns network interfaces
+	Interfaces() ([]NetInterface, error)
+
+	// ListenUDP creates UDP socket, bound to the local address
+	ListenUDP(network string, laddr *net.UDPAddr) (PacketConn, error)
+}
+
+// NetInterface represents network interface
+type NetInterface struct {
+	Index int       // Interface index
+	Name  string    // Interface name
+	Flags net.Flags // Interface flags
+	Addrs []net.Addr
+}
+
+// PacketConn is the UDP socket
+type PacketConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// HTTPClient performs HTTP requests
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// DNSSdBrowser browses and resolves DNS-SD services
+type DNSSdBrowser interface {
+	// Browse starts browsing of services of the specified type.
+	// Resolved services are sent to the returned channel
+	Browse(svcType string) (<-chan DNSSdService, error)
+}
+
+// DNSSdService represents resolved DNS-SD service
+type DNSSdService struct {
+	Interface int      // Interface index
+	Name      string   // Service instance name
+	Address   string   // IP address
+	Port      uint16   // IP port
+	Txt       [][]byte // TXT records
+	Err       error    // Resolve error, if any
+}
+
+var (
+	// network is the Network, used for discovery
+	network Network = sysNetwork{}
+
+	// dnssdBrowser is the DNSSdBrowser, used for discovery
+	dnssdBrowser DNSSdBrowser = avahiBrowser{}
+)
+
+// sysNetwork is the Network, implemented by the operating system
+type sysNetwork struct{}
+
+// Interfaces returns network interfaces
+func (sysNetwork) Interfaces() ([]NetInterface, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]NetInterface, 0, len(interfaces))
+	for _, iface := range interfaces {
+		addrs, _ := iface.Addrs()
+		list = append(list, NetInterface{
+			Index: iface.Index,
+			Name:  iface.Name,
+			Flags: iface.Flags,
+			Addrs: addrs,
+		})
+	}
+
+	return list, nil
+}
+
+// ListenUDP creates UDP socket, bound to the local address
+func (sysNetwork) ListenUDP(network string, laddr *net.UDPAddr) (
+	PacketConn, error) {
+	return net.ListenUDP(network, laddr)
+}
+
+// netInterfaceName returns name of the network interface by index
+func netInterfaceName(index int) string {
+	interfaces, _ := network.Interfaces()
+	for _, iface := range interfaces {
+		if iface.Index == index {
+			return iface.Name
+		}
+	}
+	return ""
+}
+
+// avahiBrowser is the DNSSdBrowser, implemented by Avahi
+type avahiBrowser struct{}
+
+// Browse starts browsing of services of the specified type
+func (avahiBrowser) Browse(svcType string) (<-chan DNSSdService, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, errors.New("Cannot get system bus")
+	}
+
+	server, err := avahi.ServerNew(conn)
+	if err != nil {
+		return nil, errors.New("Avahi new failed")
+	}
+
+	sb, err := server.ServiceBrowserNew(avahi.InterfaceUnspec,
+		avahi.ProtoUnspec, svcType, "local", 0)
+	if err != nil {
+		return nil, fmt.Errorf("ServiceBrowserNew() failed: %s", err)
+	}
+
+	go func() {
+		for service := range sb.RemoveChannel {
+			LogDebug("DNS-SD: %q: removed", service.Name)
+		}
+	}()
+
+	out := make(chan DNSSdService)
+	go func() {
+		for found := range sb.AddChannel {
+			service, err := server.ResolveService(found.Interface,
+				found.Protocol, found.Name, found.Type,
+				found.Domain, avahi.ProtoUnspec, 0)
+			if err != nil {
+				out <- DNSSdService{
+					Interface: int(found.Interface),
+					Name:      found.Name,
+					Err:       err,
+				}
+				continue
+			}
+
+			out <- DNSSdService{
+				Interface: int(service.Interface),
+				Name:      service.Name,
+				Address:   service.Address,
+				Port:      service.Port,
+				Txt:       service.Txt,
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// httpGet performs HTTP GET request
+func httpGet(client HTTPClient, url string) (*http.Response, error) {
+	rq, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(rq)
+}
+
+// httpPost performs HTTP POST request
+func httpPost(client HTTPClient, url, contentType string,
+	body io.Reader) (*http.Response, error) {
+
+	rq, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	rq.Header.Set("Content-Type", contentType)
+	return client.Do(rq)
+}
@@ -13,8 +13,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
-	"net/http"
 	"net/url"
+	"path"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -33,18 +34,22 @@ var (
 // wsddNsMap maps WS-Discovery XML namespaces into short prefixes,
 // convenient to compare
 var wsddNsMap = map[string]string{
-	"http://www.w3.org/2003/05/soap-envelope":            "s",
-	"https://www.w3.org/2003/05/soap-envelope":           "s",
-	"http://schemas.xmlsoap.org/ws/2005/04/discovery":    "d",
-	"https://schemas.xmlsoap.org/ws/2005/04/discovery":   "d",
-	"http://schemas.xmlsoap.org/ws/2004/08/addressing":   "a",
-	"https://schemas.xmlsoap.org/ws/2004/08/addressing":  "a",
-	"http://schemas.xmlsoap.org/ws/2006/02/devprof":      "devprof",
-	"https://schemas.xmlsoap.org/ws/2006/02/devprof":     "devprof",
-	"http://schemas.xmlsoap.org/ws/2004/09/mex":          "mex",
-	"https://schemas.xmlsoap.org/ws/2004/09/mex":         "mex",
-	"http://schemas.microsoft.com/windows/pnpx/2005/10":  "pnpx",
-	"https://schemas.microsoft.com/windows/pnpx/2005/10": "pnpx",
+	"http://www.w3.org/2003/05/soap-envelope":                "s",
+	"https://www.w3.org/2003/05/soap-envelope":               "s",
+	"http://schemas.xmlsoap.org/ws/2005/04/discovery":        "d",
+	"https://schemas.xmlsoap.org/ws/2005/04/discovery":       "d",
+	"http://schemas.xmlsoap.org/ws/2004/08/addressing":       "a",
+	"https://schemas.xmlsoap.org/ws/2004/08/addressing":      "a",
+	"http://schemas.xmlsoap.org/ws/2006/02/devprof":          "devprof",
+	"https://schemas.xmlsoap.org/ws/2006/02/devprof":         "devprof",
+	"http://schemas.xmlsoap.org/ws/2004/09/mex":              "mex",
+	"https://schemas.xmlsoap.org/ws/2004/09/mex":             "mex",
+	"http://schemas.microsoft.com/windows/pnpx/2005/10":      "pnpx",
+	"https://schemas.microsoft.com/windows/pnpx/2005/10":     "pnpx",
+	"http://schemas.microsoft.com/windows/2006/08/wdp/scan":  "wscn",
+	"https://schemas.microsoft.com/windows/2006/08/wdp/scan": "wscn",
+	"http://schemas.xmlsoap.org/ws/2004/08/eventing":         "wse",
+	"https://schemas.xmlsoap.org/ws/2004/08/eventing":        "wse",
 }
 
 // wsddFound contains a set of already discovered devices
@@ -102,14 +107,13 @@ func alreadyKnown(address string, save bool) bool {
 func ifAddrs() []*net.UDPAddr {
 	var addrs []*net.UDPAddr
 
-	interfaces, _ := net.Interfaces()
+	interfaces, _ := network.Interfaces()
 	for _, iface := range interfaces {
 		if iface.Flags&net.FlagLoopback != 0 {
 			continue
 		}
 
-		ifaddrs, _ := iface.Addrs()
-		for _, ifaddr := range ifaddrs {
+		for _, ifaddr := range iface.Addrs {
 			addr := &net.UDPAddr{
 				IP:   ifaddr.(*net.IPNet).IP,
 				Zone: iface.Name,
@@ -194,49 +198,73 @@ func parseHosted(elements []*XMLElement) []string {
 	return urls
 }
 
-// getMetadata requests a device metadata, usung WD-Discovery
-// Get/GetResponse messages
-//
-// On success, it builds and returns a device endpoint
-func getMetadata(log *LogMessage, address, xaddr string) []Endpoint {
-	u, err := uuid.NewRandom()
-	LogCheck(err)
-
-	msg := fmt.Sprintf(getMetadataTemplate, u, address)
-
-	// Send Get request
-	log.Debug("requesting a metadata")
-
-	resp, err := http.Post(xaddr, "application/soap+xml; charset=utf-8",
-		bytes.NewBuffer(([]byte)(msg)))
-
-	LogTrace("http-request", []byte(msg))
-
+// wsddRequest sends SOAP request to the device and returns
+// parsed response
+func wsddRequest(xaddr string, msg []byte) ([]*XMLElement, error) {
+	resp, err := httpPost(httpClient, xaddr,
+		"application/soap+xml; charset=utf-8", bytes.NewBuffer(msg))
 	if err != nil {
-		log.Debug("HTTP: %s", err)
-		return nil
+		return nil, fmt.Errorf("HTTP: %s", err)
 	}
 
 	// Load response body
 	response, err := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
 	if err != nil {
-		log.Debug("HTTP: %s", err)
-		return nil
+		return nil, fmt.Errorf("HTTP: %s", err)
 	}
 
-	LogTrace("http-response", response)
-
-	// Parse response XML
+	// Parse response XML. Errors, other than SOAP faults, are
+	// reported by HTTP status
 	elements, err := XMLDecode(wsddNsMap, bytes.NewBuffer(response))
+	switch {
+	case resp.StatusCode/100 != 2 && (err != nil || !wsddIsFault(elements)):
+		return nil, fmt.Errorf("HTTP: %s", resp.Status)
+	case err != nil:
+		return nil, fmt.Errorf("XML: %s", err)
+	}
+
+	return elements, nil
+}
+
+// wsddIsFault reports whether SOAP response is the SOAP fault
+func wsddIsFault(elements []*XMLElement) bool {
+	for _, elem := range elements {
+		if elem.Path == "/s:Envelope/s:Body/s:Fault" {
+			return true
+		}
+	}
+	return false
+}
+
+// wsddGetMetadata sends WS-Transfer Get request to the device
+// and returns parsed response
+func wsddGetMetadata(address, xaddr string) ([]*XMLElement, error) {
+	u, err := uuid.NewRandom()
+	LogCheck(err)
+
+	msg := fmt.Sprintf(getMetadataTemplate, u, address)
+	return wsddRequest(xaddr, []byte(msg))
+}
+
+// getMetadata requests a device metadata, usung WD-Discovery
+// Get/GetResponse messages
+//
+// On success, it builds and returns a device endpoint
+func getMetadata(log *LogMessage, address, xaddr string) []Endpoint {
+	// Send Get request
+	log.Debug("requesting a metadata")
+
+	elements, err := wsddGetMetadata(address, xaddr)
 	if err != nil {
-		log.Debug("XML: %s", err)
+		log.Ignore(OutcomeMetadataFailed, "metadata request failed: %s", err)
 		return nil
 	}
 
 	// Decode response
 	var action, manufacturer, model string
 	var urls []string
+	meta := make(map[string]string)
 
 	for _, elem := range elements {
 		switch elem.Path {
@@ -246,6 +274,16 @@ func getMetadata(log *LogMessage, address, xaddr string) []Endpoint {
 			manufacturer = elem.Text
 		case "/s:Envelope/s:Body/mex:Metadata/mex:MetadataSection/devprof:ThisModel/devprof:ModelName":
 			model = elem.Text
+		case "/s:Envelope/s:Body/mex:Metadata/mex:MetadataSection/devprof:ThisModel/devprof:ModelNumber":
+			meta["ModelNumber"] = elem.Text
+		case "/s:Envelope/s:Body/mex:Metadata/mex:MetadataSection/devprof:ThisModel/devprof:PresentationUrl":
+			meta["PresentationUrl"] = elem.Text
+		case "/s:Envelope/s:Body/mex:Metadata/mex:MetadataSection/devprof:ThisDevice/devprof:FriendlyName":
+			meta["FriendlyName"] = elem.Text
+		case "/s:Envelope/s:Body/mex:Metadata/mex:MetadataSection/devprof:ThisDevice/devprof:FirmwareVersion":
+			meta["FirmwareVersion"] = elem.Text
+		case "/s:Envelope/s:Body/mex:Metadata/mex:MetadataSection/devprof:ThisDevice/devprof:SerialNumber":
+			meta["SerialNumber"] = elem.Text
 		case "/s:Envelope/s:Body/mex:Metadata/mex:MetadataSection/devprof:Relationship/devprof:Hosted":
 			urls = append(urls, parseHosted(elem.Children)...)
 		}
@@ -263,45 +301,69 @@ func getMetadata(log *LogMessage, address, xaddr string) []Endpoint {
 	case "http://schemas.xmlsoap.org/ws/2004/09/transfer/GetResponse",
 		"https://schemas.xmlsoap.org/ws/2004/09/transfer/GetResponse":
 	default:
-		log.Debug("metadata ignored: unknown action")
+		err := wsdCheckResponse(elements, "Get")
+		if fault, ok := err.(*wsdFault); ok {
+			log.Ignore(OutcomeMetadataFailed,
+				"metadata request failed: %s", fault)
+		} else {
+			log.Ignore(OutcomeMetadataFailed,
+				"metadata ignored: unknown action")
+		}
 		return nil
 	}
 
 	if model == "" && manufacturer == "" {
-		log.Debug("metadata ignored: no model or manufacturer")
+		log.Ignore(OutcomeNoModel, "metadata ignored: no model or manufacturer")
 		return nil
 	}
 
 	if len(urls) == 0 {
-		log.Debug("metadata ignored: no scanner URLs")
+		log.Ignore(OutcomeNotScanner, "metadata ignored: no scanner URLs")
 		return nil
 	}
 
 	// Return discovered endpoints
 	var endpoints []Endpoint
 
+	name := model
 	if manufacturer != "" {
-		model = manufacturer + " " + model
+		name = manufacturer + " " + model
 	}
 
 	for _, url := range urls {
-		endpoint := Endpoint{Proto: "wsd", Name: model, URL: url}
+		endpoint := Endpoint{
+			Proto:        "wsd",
+			Name:         name,
+			URL:          url,
+			UUID:         strings.TrimPrefix(address, "urn:uuid:"),
+			Manufacturer: manufacturer,
+			Model:        model,
+			Meta:         meta,
+		}
 		endpoints = append(endpoints, endpoint)
 	}
 
 	return endpoints
 }
 
-// handleUDPMessage handles received UDP message
-func handleUDPMessage(log *LogMessage, msg []byte, zone string, outchan chan Endpoint) {
+// handleUDPMessage handles received UDP message. It returns number
+// of endpoints, sent to outchan. The outcome is added to the
+// discovery report
+func handleUDPMessage(log *LogMessage, msg []byte, from *net.UDPAddr,
+	zone string, outchan chan Endpoint) (sent int) {
 	var action, address, types string
 	var xaddrs []string
+	var names []string
+
+	defer func() {
+		reportUDPMessage(log, from, zone, action, address, names, sent)
+	}()
 
 	// Parse XML
 	elements, err := XMLDecode(wsddNsMap, bytes.NewBuffer(msg))
 	if err != nil {
-		log.Debug("XML: %s", err)
-		return
+		log.Ignore(OutcomeIgnored, "message ignored: XML: %s", err)
+		return 0
 	}
 
 	// Decode the message
@@ -327,8 +389,8 @@ func handleUDPMessage(log *LogMessage, msg []byte, zone string, outchan chan End
 
 	// Check for duplicates
 	if alreadyKnown(address, false) {
-		log.Debug("message ignored: %s already known", address)
-		return
+		log.Ignore(OutcomeDuplicate, "message ignored: %s already known", address)
+		return 0
 	}
 
 	// Write debug messages
@@ -343,61 +405,115 @@ func handleUDPMessage(log *LogMessage, msg []byte, zone string, outchan chan End
 	case "http://schemas.xmlsoap.org/ws/2005/04/discovery/ProbeMatches",
 		"https://schemas.xmlsoap.org/ws/2005/04/discovery/ProbeMatches":
 	default:
-		log.Debug("message ignored: unknown action")
-		return
+		log.Ignore(OutcomeIgnored, "message ignored: unknown action")
+		return 0
 	}
 
 	if len(xaddrs) == 0 {
-		log.Debug("message ignored: no xaddrs")
-		return
+		log.Ignore(OutcomeNoXAddrs, "message ignored: no xaddrs")
+		return 0
 	}
 
 	if strings.Index(types, "ScanDeviceType") < 0 {
-		log.Debug("message ignored: not a scanner")
-		return
+		log.Ignore(OutcomeNotScanner, "message ignored: not a scanner")
+		return 0
 	}
 
 	if address == "" {
-		log.Debug("message ignored: no endpoint address")
-		return
+		log.Ignore(OutcomeIgnored, "message ignored: no endpoint address")
+		return 0
 	}
 
-	endpoints := make(map[Endpoint]struct{})
+	endpoints := make(map[string]Endpoint)
 	for _, xaddr := range xaddrs {
 		epp := getMetadata(log, address, xaddr)
 		for _, endpoint := range epp {
-			endpoints[endpoint] = struct{}{}
+			endpoints[endpoint.Key()] = endpoint
 		}
 	}
 
 	// Update table of already known addresses
 	alreadyKnown(address, true)
 
-	for endpoint := range endpoints {
+	for _, endpoint := range endpoints {
 		url, err := fixIpv6URLZone(endpoint.URL, zone)
 		if err != nil {
 			log.Debug("%s: %s", endpoint.URL, err)
 		} else {
 			endpoint.URL = url
+			endpoint.Interface = zone
+			endpoint.Source = from.IP.String()
 			outchan <- endpoint
+			names = append(names, endpoint.Name)
+			sent++
+		}
+	}
+
+	return sent
+}
+
+// reportUDPMessage adds outcome of the received UDP message to the
+// discovery report. Probes from other hosts are not reported: they
+// are not responders
+func reportUDPMessage(log *LogMessage, from *net.UDPAddr, zone,
+	action, address string, names []string, sent int) {
+
+	switch path.Base(action) {
+	case "Probe", "Resolve":
+		return
+	}
+
+	outcome, reason := log.Outcome()
+	if sent != 0 {
+		sort.Strings(names)
+		unique := names[:1]
+		for _, name := range names[1:] {
+			if name != unique[len(unique)-1] {
+				unique = append(unique, name)
+			}
 		}
+		outcome, reason = OutcomeAccepted, strings.Join(unique, ", ")
 	}
+
+	if outcome == "" {
+		outcome, reason = OutcomeIgnored, "no endpoints"
+	}
+
+	reason = strings.TrimPrefix(reason, "message ignored: ")
+	reason = strings.TrimPrefix(reason, "metadata ignored: ")
+	reason = strings.TrimPrefix(reason, "metadata request failed: ")
+	if outcome == OutcomeIgnored && action != "" {
+		reason = path.Base(action) + ": " + reason
+	}
+
+	discoveryReport.Add(ReportWSD, zone, from.IP.String(), address,
+		outcome, reason)
 }
 
 // recvUDPMessages receives and handles UDP messages
-func recvUDPMessages(conn *net.UDPConn, zone string, outchan chan Endpoint) {
+func recvUDPMessages(conn PacketConn, zone string, outchan chan Endpoint) {
 	buf := make([]byte, 32768)
 
 	for {
-		n, from, _ := conn.ReadFromUDP(buf)
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
 		if n > 0 {
 			msg := buf[:n]
 
 			LogDebug("%s: UDP message received", from)
-			LogTrace(fmt.Sprintf("udp-from-%s", from), msg)
+			LogTraceMeta(fmt.Sprintf("udp-from-%s", from), msg, TraceMeta{
+				Direction: "in",
+				Local:     conn.LocalAddr().String(),
+				Remote:    from.String(),
+				Zone:      zone,
+				ID:        traceSOAPID(msg),
+			})
 
 			log := LogBegin(fmt.Sprintf("%s", from))
-			handleUDPMessage(log, msg, zone, outchan)
+			handleUDPMessage(log, msg, from, zone, outchan)
 			log.Commit()
 		}
 	}
@@ -405,7 +521,7 @@ func recvUDPMessages(conn *net.UDPConn, zone string, outchan chan Endpoint) {
 
 // WSSDDiscover performs WS-Discovery for scanner devices
 func WSSDDiscover(outchan chan Endpoint) {
-	var conns []*net.UDPConn
+	var conns []PacketConn
 	var zones []string
 
 	// Create sockets, one per interface
@@ -425,7 +541,7 @@ func WSSDDiscover(outchan chan Endpoint) {
 			if !ip4 {
 				proto = "udp6"
 			}
-			conn, err := net.ListenUDP(proto, addr)
+			conn, err := network.ListenUDP(proto, addr)
 			LogCheck(err)
 
 			if conn != nil {
@@ -459,7 +575,13 @@ func WSSDDiscover(outchan chan Endpoint) {
 			msg := fmt.Sprintf(probeTemplate, u)
 			conn.WriteTo([]byte(msg), dest)
 			LogDebug("%s: UDP message sent", dest)
-			LogTrace(fmt.Sprintf("udp-to-%s", dest), []byte(msg))
+			LogTraceMeta(fmt.Sprintf("udp-to-%s", dest), []byte(msg), TraceMeta{
+				Direction: "out",
+				Local:     laddr.String(),
+				Remote:    dest.String(),
+				Zone:      laddr.Zone,
+				ID:        fmt.Sprintf("urn:uuid:%s", u),
+			})
 		}
 
 		time.Sleep(250 * time.Millisecond)
@@ -0,0 +1,525 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// Virtual WSD device
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// wsdEmuDiscoveryTemplate represents the WS-Discovery message,
+// sent by the virtual device. Parameters are action, message ID,
+// destination, headers, instance ID, message number and body
+const wsdEmuDiscoveryTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<s:Envelope xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:wsdp="http://schemas.xmlsoap.org/ws/2006/02/devprof" xmlns:wscn="http://schemas.microsoft.com/windows/2006/08/wdp/scan">
+	<s:Header>
+		<a:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/%s</a:Action>
+		<a:MessageID>urn:uuid:%s</a:MessageID>
+		<a:To>%s</a:To>
+%s		<d:AppSequence InstanceId="%d" MessageNumber="%d"/>
+	</s:Header>
+	<s:Body>
+%s	</s:Body>
+</s:Envelope>
+`
+
+// wsdEmuMetadataTemplate represents the metadata GetResponse.
+// Parameters are message ID, request message ID, manufacturer,
+// model (twice), presentation URL, friendly name, firmware version,
+// serial number, device address (twice) and hosted services
+const wsdEmuMetadataTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<s:Envelope xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:mex="http://schemas.xmlsoap.org/ws/2004/09/mex" xmlns:wsdp="http://schemas.xmlsoap.org/ws/2006/02/devprof" xmlns:wscn="http://schemas.microsoft.com/windows/2006/08/wdp/scan">
+	<s:Header>
+		<a:Action>http://schemas.xmlsoap.org/ws/2004/09/transfer/GetResponse</a:Action>
+		<a:MessageID>urn:uuid:%s</a:MessageID>
+		<a:RelatesTo>%s</a:RelatesTo>
+		<a:To>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:To>
+	</s:Header>
+	<s:Body>
+		<mex:Metadata>
+			<mex:MetadataSection Dialect="http://schemas.xmlsoap.org/ws/2006/02/devprof/ThisModel">
+				<wsdp:ThisModel>
+					<wsdp:Manufacturer>%s</wsdp:Manufacturer>
+					<wsdp:ModelName>%s</wsdp:ModelName>
+					<wsdp:ModelNumber>%s</wsdp:ModelNumber>
+					<wsdp:PresentationUrl>%s</wsdp:PresentationUrl>
+				</wsdp:ThisModel>
+			</mex:MetadataSection>
+			<mex:MetadataSection Dialect="http://schemas.xmlsoap.org/ws/2006/02/devprof/ThisDevice">
+				<wsdp:ThisDevice>
+					<wsdp:FriendlyName>%s</wsdp:FriendlyName>
+					<wsdp:FirmwareVersion>%s</wsdp:FirmwareVersion>
+					<wsdp:SerialNumber>%s</wsdp:SerialNumber>
+				</wsdp:ThisDevice>
+			</mex:MetadataSection>
+			<mex:MetadataSection Dialect="http://schemas.xmlsoap.org/ws/2006/02/devprof/Relationship">
+				<wsdp:Relationship Type="http://schemas.xmlsoap.org/ws/2006/02/devprof/host">
+					<wsdp:Host>
+						<a:EndpointReference>
+							<a:Address>%s</a:Address>
+						</a:EndpointReference>
+						<wsdp:Types>wsdp:Device wscn:ScanDeviceType</wsdp:Types>
+						<wsdp:ServiceId>%s</wsdp:ServiceId>
+					</wsdp:Host>
+%s				</wsdp:Relationship>
+			</mex:MetadataSection>
+		</mex:Metadata>
+	</s:Body>
+</s:Envelope>
+`
+
+// wsdEmuHostedTemplate represents the hosted scanner service.
+// Parameters are service URL and service ID
+const wsdEmuHostedTemplate = `					<wsdp:Hosted>
+						<a:EndpointReference>
+							<a:Address>%s</a:Address>
+						</a:EndpointReference>
+						<wsdp:Types>wscn:ScannerServiceType</wsdp:Types>
+						<wsdp:ServiceId>%s</wsdp:ServiceId>
+					</wsdp:Hosted>
+`
+
+// wsdEmuFaultTemplate represents the SOAP fault. Parameters are
+// message ID, request message ID, code, subcode and reason
+const wsdEmuFaultTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<s:Envelope xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:s="http://www.w3.org/2003/05/soap-envelope">
+	<s:Header>
+		<a:Action>http://schemas.xmlsoap.org/ws/2004/08/addressing/fault</a:Action>
+		<a:MessageID>urn:uuid:%s</a:MessageID>
+		<a:RelatesTo>%s</a:RelatesTo>
+	</s:Header>
+	<s:Body>
+		<s:Fault>
+			<s:Code>
+				<s:Value>%s</s:Value>
+				<s:Subcode>
+					<s:Value>%s</s:Value>
+				</s:Subcode>
+			</s:Code>
+			<s:Reason>
+				<s:Text xml:lang="en">%s</s:Text>
+			</s:Reason>
+		</s:Fault>
+	</s:Body>
+</s:Envelope>
+`
+
+// wsdEmuServicePath is the path of the hosted scanner service
+const wsdEmuServicePath = "/WSDScanner"
+
+// wsdEmulator is the virtual WSD device
+type wsdEmulator struct {
+	device   *EmuDevice
+	profile  *WsdEmuProfile
+	address  string        // Endpoint address, urn:uuid:...
+	port     int           // HTTP port
+	conns    []*wsdEmuConn // Multicast sockets
+	instance int64         // AppSequence InstanceId
+	msgNum   int           // AppSequence MessageNumber
+	lock     sync.Mutex
+}
+
+// wsdEmuConn is the multicast socket, bound to the interface
+type wsdEmuConn struct {
+	conn  *net.UDPConn
+	iface *net.Interface
+	group *net.UDPAddr
+}
+
+// WsdEmulate starts the virtual WSD device. It returns after
+// the device is started; requests are served in background
+func WsdEmulate(device *EmuDevice, profile *WsdEmuProfile) error {
+	emu := &wsdEmulator{
+		device:   device,
+		profile:  profile,
+		address:  "urn:uuid:" + device.UUID,
+		instance: time.Now().Unix(),
+	}
+
+	// Start HTTP server
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", profile.Port))
+	if err != nil {
+		return err
+	}
+
+	emu.port = listener.Addr().(*net.TCPAddr).Port
+	LogInfo("WSD: %s, port %d", emu.address, emu.port)
+
+	go func() {
+		LogCheck(http.Serve(listener, TraceHandler(emu)))
+	}()
+
+	// Join WS-Discovery multicast groups
+	interfaces, _ := net.Interfaces()
+	for i := range interfaces {
+		iface := &interfaces[i]
+		if iface.Flags&net.FlagLoopback != 0 ||
+			iface.Flags&net.FlagUp == 0 ||
+			iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+
+		ip4, ll6 := emu.ifaceAddrs(iface)
+		groups := []struct {
+			network string
+			group   *net.UDPAddr
+			enable  bool
+		}{
+			{"udp4", &net.UDPAddr{IP: WSDiscoveryAddrIp4, Port: 3702}, ip4 != nil},
+			{"udp6", &net.UDPAddr{IP: WSDiscoveryAddrIp6, Port: 3702,
+				Zone: iface.Name}, ll6 != nil},
+		}
+
+		for _, g := range groups {
+			if !g.enable {
+				continue
+			}
+
+			conn, err := net.ListenMulticastUDP(g.network, iface, g.group)
+			if err != nil {
+				LogDebug("WSD: %s: %s", iface.Name, err)
+				continue
+			}
+
+			c := &wsdEmuConn{conn: conn, iface: iface, group: g.group}
+			emu.conns = append(emu.conns, c)
+			go emu.recv(c)
+		}
+	}
+
+	if len(emu.conns) == 0 {
+		return fmt.Errorf("WSD: no usable network interfaces")
+	}
+
+	// Announce the device
+	if profile.Hello {
+		emu.hello("Hello")
+		OnInterrupt(func() { emu.hello("Bye") })
+	}
+
+	return nil
+}
+
+// ifaceAddrs returns IPv4 and IPv6 link-local addresses of interface
+func (emu *wsdEmulator) ifaceAddrs(iface *net.Interface) (ip4, ll6 net.IP) {
+	addrs, _ := iface.Addrs()
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		switch {
+		case !ok:
+		case ipnet.IP.To4() != nil:
+			if ip4 == nil {
+				ip4 = ipnet.IP
+			}
+		case ipnet.IP.IsLinkLocalUnicast():
+			if ll6 == nil {
+				ll6 = ipnet.IP
+			}
+		}
+	}
+	return
+}
+
+// xaddrs returns XAddrs for the interface, according to profile
+func (emu *wsdEmulator) xaddrs(iface *net.Interface) string {
+	xaddrs := emu.profile.XAddrs
+	ip4, ll6 := emu.ifaceAddrs(iface)
+	path := "/" + emu.device.UUID
+
+	var urls []string
+	switch xaddrs {
+	case "none":
+	case "all", "ipv4", "ll6":
+		if ip4 != nil && xaddrs != "ll6" {
+			urls = append(urls, fmt.Sprintf("http://%s:%d%s",
+				ip4, emu.port, path))
+		}
+		if ll6 != nil && xaddrs != "ipv4" {
+			urls = append(urls, fmt.Sprintf("http://[%s]:%d%s",
+				ll6, emu.port, path))
+		}
+	default:
+		urls = strings.Fields(xaddrs)
+	}
+
+	return strings.Join(urls, " ")
+}
+
+// match reports whether UDP message from the address is received
+// via the interface of the connection. All multicast sockets get
+// all messages, so only one of them must respond
+func (c *wsdEmuConn) match(from *net.UDPAddr) bool {
+	if from.IP.To4() == nil {
+		return from.Zone == c.iface.Name
+	}
+
+	addrs, _ := c.iface.Addrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.Contains(from.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// recv receives and handles WS-Discovery messages
+func (emu *wsdEmulator) recv(c *wsdEmuConn) {
+	buf := make([]byte, 32768)
+
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if n == 0 || !c.match(from) {
+			continue
+		}
+
+		msg := buf[:n]
+		LogTraceMeta(fmt.Sprintf("udp-from-%s", from), msg, TraceMeta{
+			Direction: "in",
+			Local:     c.conn.LocalAddr().String(),
+			Remote:    from.String(),
+			Zone:      c.iface.Name,
+			ID:        traceSOAPID(msg),
+		})
+
+		elements, err := XMLDecode(wsddNsMap, bytes.NewBuffer(msg))
+		if err != nil {
+			LogDebug("WSD: %s: XML: %s", from, err)
+			continue
+		}
+
+		var action, msgID string
+		for _, elem := range elements {
+			switch elem.Path {
+			case "/s:Envelope/s:Header/a:Action":
+				action = elem.Text
+			case "/s:Envelope/s:Header/a:MessageID":
+				msgID = elem.Text
+			}
+		}
+
+		if strings.HasSuffix(action, "/discovery/Probe") {
+			LogDebug("WSD: %s: Probe", from)
+			go emu.probeMatches(c, from, msgID)
+		}
+	}
+}
+
+// probeMatches responds to Probe with ProbeMatches
+func (emu *wsdEmulator) probeMatches(c *wsdEmuConn, to *net.UDPAddr,
+	msgID string) {
+
+	if emu.profile.Probe == "ignore" {
+		return
+	}
+
+	time.Sleep(emu.profile.ProbeDelay)
+
+	headers := fmt.Sprintf("\t\t<a:RelatesTo>%s</a:RelatesTo>\n",
+		wsdEscape(msgID))
+	body := "\t\t<d:ProbeMatches>\n" +
+		emu.discoveryBody("ProbeMatch", c.iface) +
+		"\t\t</d:ProbeMatches>\n"
+
+	msg := emu.discoveryMessage("ProbeMatches",
+		"http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous",
+		headers, body)
+
+	emu.send(c, to, msg, emu.profile.Probe == "malformed")
+}
+
+// hello sends Hello or Bye to all interfaces
+func (emu *wsdEmulator) hello(action string) {
+	for _, c := range emu.conns {
+		body := emu.discoveryBody(action, c.iface)
+		if action == "Bye" {
+			body = fmt.Sprintf("\t\t<d:Bye>\n"+
+				"\t\t\t<a:EndpointReference>\n"+
+				"\t\t\t\t<a:Address>%s</a:Address>\n"+
+				"\t\t\t</a:EndpointReference>\n"+
+				"\t\t</d:Bye>\n", emu.address)
+		}
+
+		msg := emu.discoveryMessage(action,
+			"urn:schemas-xmlsoap-org:ws:2005:04:discovery", "", body)
+
+		emu.send(c, c.group, msg, false)
+	}
+}
+
+// discoveryBody returns body of Hello or ProbeMatch element
+func (emu *wsdEmulator) discoveryBody(elem string,
+	iface *net.Interface) string {
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "\t\t\t<d:%s>\n", elem)
+	fmt.Fprintf(&buf, "\t\t\t\t<a:EndpointReference>\n"+
+		"\t\t\t\t\t<a:Address>%s</a:Address>\n"+
+		"\t\t\t\t</a:EndpointReference>\n", emu.address)
+	buf.WriteString("\t\t\t\t<d:Types>wsdp:Device wscn:ScanDeviceType</d:Types>\n")
+	if xaddrs := emu.xaddrs(iface); xaddrs != "" {
+		fmt.Fprintf(&buf, "\t\t\t\t<d:XAddrs>%s</d:XAddrs>\n", xaddrs)
+	}
+	buf.WriteString("\t\t\t\t<d:MetadataVersion>1</d:MetadataVersion>\n")
+	fmt.Fprintf(&buf, "\t\t\t</d:%s>\n", elem)
+
+	return buf.String()
+}
+
+// discoveryMessage formats the WS-Discovery message
+func (emu *wsdEmulator) discoveryMessage(action, to, headers,
+	body string) []byte {
+
+	u, err := uuid.NewRandom()
+	LogCheck(err)
+
+	emu.lock.Lock()
+	emu.msgNum++
+	msgNum := emu.msgNum
+	emu.lock.Unlock()
+
+	return []byte(fmt.Sprintf(wsdEmuDiscoveryTemplate, action, u, to,
+		headers, emu.instance, msgNum, body))
+}
+
+// send sends UDP message. If malformed is true, the message is
+// truncated, so it becomes invalid XML
+func (emu *wsdEmulator) send(c *wsdEmuConn, to *net.UDPAddr,
+	msg []byte, malformed bool) {
+
+	if malformed {
+		msg = msg[:len(msg)/2]
+	}
+
+	_, err := c.conn.WriteToUDP(msg, to)
+	if err != nil {
+		LogDebug("WSD: %s: %s", to, err)
+		return
+	}
+
+	LogDebug("WSD: %s: message sent", to)
+	LogTraceMeta(fmt.Sprintf("udp-to-%s", to), msg, TraceMeta{
+		Direction: "out",
+		Local:     c.conn.LocalAddr().String(),
+		Remote:    to.String(),
+		Zone:      c.iface.Name,
+		ID:        traceSOAPID(msg),
+	})
+}
+
+// ServeHTTP serves metadata and scanner service requests
+func (emu *wsdEmulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(emu.profile.Delay)
+
+	if r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+
+	var action, msgID string
+	elements, err := XMLDecode(wsddNsMap, bytes.NewBuffer(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, elem := range elements {
+		switch elem.Path {
+		case "/s:Envelope/s:Header/a:Action":
+			action = elem.Text
+		case "/s:Envelope/s:Header/a:MessageID":
+			msgID = elem.Text
+		}
+	}
+
+	LogDebug("WSD: %s %s: %s", r.Method, r.URL.Path, action)
+
+	var response string
+	status := http.StatusOK
+	switch {
+	case r.URL.Path == wsdEmuServicePath,
+		!strings.HasSuffix(action, "/transfer/Get"):
+		response, status = emu.fault(msgID, wsdEmuSender,
+			"wsa:ActionNotSupported", "The action is not supported")
+
+	case emu.profile.Metadata == "fault":
+		response, status = emu.fault(msgID, wsdEmuReceiver,
+			"wsa:EndpointUnavailable", "Emulated fault")
+
+	default:
+		response = emu.metadata(msgID, r.Host)
+		if emu.profile.Metadata == "malformed" {
+			response = response[:len(response)/2]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(response))
+}
+
+// metadata returns the metadata GetResponse
+func (emu *wsdEmulator) metadata(msgID, host string) string {
+	u, err := uuid.NewRandom()
+	LogCheck(err)
+
+	device := emu.device
+	hosted := ""
+	if emu.profile.Metadata != "no-hosted" {
+		hosted = fmt.Sprintf(wsdEmuHostedTemplate,
+			"http://"+host+wsdEmuServicePath,
+			"uri:"+device.UUID+wsdEmuServicePath)
+	}
+
+	return fmt.Sprintf(wsdEmuMetadataTemplate, u, wsdEscape(msgID),
+		wsdEscape(device.Manufacturer), wsdEscape(device.Model),
+		wsdEscape(device.Model), "http://"+host+"/",
+		wsdEscape(device.Name), wsdEscape(device.Firmware),
+		wsdEscape(device.Serial), emu.address, emu.address, hosted)
+}
+
+// SOAP 1.2 fault codes
+const (
+	wsdEmuSender   = "s:Sender"   // Request is invalid
+	wsdEmuReceiver = "s:Receiver" // Device failed to process request
+)
+
+// fault returns the SOAP fault and HTTP status to send it with:
+// 400 for wsdEmuSender and 500 for wsdEmuReceiver faults
+func (emu *wsdEmulator) fault(msgID, code, subcode, reason string) (
+	string, int) {
+
+	u, err := uuid.NewRandom()
+	LogCheck(err)
+
+	status := http.StatusInternalServerError
+	if code == wsdEmuSender {
+		status = http.StatusBadRequest
+	}
+
+	return fmt.Sprintf(wsdEmuFaultTemplate, u, wsdEscape(msgID),
+		code, subcode, reason), status
+}
@@ -0,0 +1,340 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// WS-Scan protocol
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// wsdRequestTemplate represents a WS-Scan request message template.
+// Parameters are action, message ID, destination and body
+const wsdRequestTemplate = `<?xml version="1.0" ?>
+<s:Envelope xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:wscn="http://schemas.microsoft.com/windows/2006/08/wdp/scan">
+	<s:Header>
+		<a:Action>http://schemas.microsoft.com/windows/2006/08/wdp/scan/%s</a:Action>
+		<a:MessageID>urn:uuid:%s</a:MessageID>
+		<a:To>%s</a:To>
+		<a:ReplyTo>
+			<a:Address>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:Address>
+		</a:ReplyTo>
+	</s:Header>
+	<s:Body>
+%s	</s:Body>
+</s:Envelope>
+`
+
+// wsdFormats maps WS-Scan document formats into MIME types
+var wsdFormats = map[string]string{
+	"jfif":                     "image/jpeg",
+	"exif":                     "image/jpeg",
+	"png":                      "image/png",
+	"pdf-a":                    "application/pdf",
+	"tiff-single-uncompressed": "image/tiff",
+	"tiff-single-g4":           "image/tiff",
+	"tiff-single-g3mh":         "image/tiff",
+	"tiff-single-jpeg-tn2":     "image/tiff",
+	"tiff-multi-uncompressed":  "image/tiff",
+	"tiff-multi-g4":            "image/tiff",
+	"tiff-multi-g3mh":          "image/tiff",
+	"tiff-multi-jpeg-tn2":      "image/tiff",
+	"dib":                      "image/bmp",
+	"xps":                      "application/vnd.ms-xpsdocument",
+}
+
+// wsdFault represents SOAP fault, returned by WS-Scan request
+type wsdFault struct {
+	Subcode string // Fault subcode, i.e. wscn:ClientErrorNoImagesAvailable
+	Reason  string // Human-readable reason
+}
+
+// Error returns wsdFault as a string
+func (fault *wsdFault) Error() string {
+	if fault.Reason != "" {
+		return "SOAP fault: " + fault.Reason
+	}
+	return "SOAP fault: " + fault.Subcode
+}
+
+// HasSubcode reports whether fault has the specified subcode. Namespace
+// prefix of the subcode is ignored
+func (fault *wsdFault) HasSubcode(subcode string) bool {
+	return fault.Subcode == subcode ||
+		strings.HasSuffix(fault.Subcode, ":"+subcode)
+}
+
+// wsdRequest sends WS-Scan request and checks response action
+//
+// The body is the content of the s:Body element, action is the
+// request action name, relative to the WS-Scan namespace
+func wsdRequest(url, action, body string) ([]*XMLElement, error) {
+	elements, _, err := wsdCall(httpClient, url, action, body)
+	return elements, err
+}
+
+// wsdCall sends WS-Scan request, using the specified HTTP client,
+// and checks response action. SOAP faults are returned as *wsdFault
+//
+// If response is MTOM-encoded (multipart/related), the SOAP envelope
+// is parsed, and other parts are returned as attachments
+func wsdCall(client HTTPClient, url, action, body string) (
+	[]*XMLElement, [][]byte, error) {
+
+	u, err := uuid.NewRandom()
+	LogCheck(err)
+
+	msg := fmt.Sprintf(wsdRequestTemplate, action, u, url, body)
+
+	resp, err := httpPost(client, url, "application/soap+xml; charset=utf-8",
+		bytes.NewBufferString(msg))
+	if err != nil {
+		return nil, nil, fmt.Errorf("HTTP: %s", err)
+	}
+
+	response, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, nil, fmt.Errorf("HTTP: %s", err)
+	}
+
+	// Split MTOM response
+	envelope := response
+	var attachments [][]byte
+
+	mediatype, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediatype == "multipart/related" {
+		envelope, attachments, err = wsdSplitMTOM(response, params)
+		if err != nil {
+			return nil, nil, fmt.Errorf("MTOM: %s", err)
+		}
+	}
+
+	// Parse response XML
+	elements, err := XMLDecode(wsddNsMap, bytes.NewBuffer(envelope))
+	if err != nil {
+		return nil, nil, fmt.Errorf("XML: %s", err)
+	}
+
+	err = wsdCheckResponse(elements, action)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return elements, attachments, nil
+}
+
+// wsdCheckResponse checks that SOAP response action matches the
+// request action. SOAP faults are returned as *wsdFault
+func wsdCheckResponse(elements []*XMLElement, action string) error {
+	var respAction string
+	fault := &wsdFault{}
+	for _, elem := range elements {
+		switch elem.Path {
+		case "/s:Envelope/s:Header/a:Action":
+			respAction = elem.Text
+		case "/s:Envelope/s:Body/s:Fault/s:Reason/s:Text":
+			fault.Reason = elem.Text
+		case "/s:Envelope/s:Body/s:Fault/s:Code/s:Subcode/s:Value":
+			fault.Subcode = elem.Text
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(respAction, "/"+action+"Response"):
+		return nil
+	case fault.Reason != "" || fault.Subcode != "":
+		return fault
+	}
+
+	return fmt.Errorf("%s: unexpected response action %q",
+		action, respAction)
+}
+
+// wsdSplitMTOM splits MTOM multipart/related message into the
+// root part (SOAP envelope) and attachments. The root part is
+// the part, referred by the start parameter, or the first part
+func wsdSplitMTOM(data []byte, params map[string]string) (
+	[]byte, [][]byte, error) {
+
+	var root []byte
+	var attachments [][]byte
+
+	reader := multipart.NewReader(bytes.NewReader(data), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		id := part.Header.Get("Content-ID")
+		if root == nil && (params["start"] == "" || params["start"] == id) {
+			root = body
+		} else {
+			attachments = append(attachments, body)
+		}
+	}
+
+	if root == nil {
+		return nil, nil, errors.New("root part not found")
+	}
+
+	return root, attachments, nil
+}
+
+// wsdGetScannerElements queries the specified scanner elements
+func wsdGetScannerElements(url string, names ...string) ([]*XMLElement, error) {
+	var body strings.Builder
+
+	body.WriteString("\t\t<wscn:GetScannerElementsRequest>\n")
+	body.WriteString("\t\t\t<wscn:RequestedElements>\n")
+	for _, name := range names {
+		fmt.Fprintf(&body, "\t\t\t\t<wscn:Name>wscn:%s</wscn:Name>\n", name)
+	}
+	body.WriteString("\t\t\t</wscn:RequestedElements>\n")
+	body.WriteString("\t\t</wscn:GetScannerElementsRequest>\n")
+
+	return wsdRequest(url, "GetScannerElements", body.String())
+}
+
+// WsdCapabilities queries and parses WS-Scan scanner capabilities
+func WsdCapabilities(url string) (*Capabilities, error) {
+	elements, err := wsdGetScannerElements(url, "ScannerDescription",
+		"ScannerConfiguration", "DefaultScanTicket")
+	if err != nil {
+		return nil, err
+	}
+
+	caps := wsdParseCapabilities(elements)
+	if len(caps.Sources) == 0 {
+		return nil, errors.New("GetScannerElements: no ScannerConfiguration")
+	}
+
+	return caps, nil
+}
+
+// wsdParseCapabilities parses GetScannerElementsResponse:
+//
+//	<wscn:ScannerDescription>
+//	  <wscn:ScannerName>Kyocera ECOSYS M2040dn</wscn:ScannerName>
+//	</wscn:ScannerDescription>
+//	<wscn:ScannerConfiguration>
+//	  <wscn:DeviceSettings>
+//	    <wscn:FormatsSupported>
+//	      <wscn:FormatValue>jfif</wscn:FormatValue>
+//	    </wscn:FormatsSupported>
+//	  </wscn:DeviceSettings>
+//	  <wscn:Platen>
+//	    <wscn:PlatenColor>
+//	      <wscn:ColorEntry>RGB24</wscn:ColorEntry>
+//	    </wscn:PlatenColor>
+//	    <wscn:PlatenMaximumSize>
+//	      <wscn:Width>8500</wscn:Width>
+//	      <wscn:Height>11690</wscn:Height>
+//	    </wscn:PlatenMaximumSize>
+//	    <wscn:PlatenResolutions>
+//	      <wscn:Widths>
+//	        <wscn:Width>300</wscn:Width>
+//	      </wscn:Widths>
+//	    </wscn:PlatenResolutions>
+//	  </wscn:Platen>
+//	  <wscn:ADF>
+//	    <wscn:ADFSupportsDuplex>true</wscn:ADFSupportsDuplex>
+//	    <wscn:ADFFront>...</wscn:ADFFront>
+//	    <wscn:ADFBack>...</wscn:ADFBack>
+//	  </wscn:ADF>
+//	</wscn:ScannerConfiguration>
+//
+// Sizes are in 1/1000 of inch. The DefaultScanTicket is used
+// only as a fallback source of the document format
+func wsdParseCapabilities(elements []*XMLElement) *Capabilities {
+	caps := &Capabilities{}
+	defaultFormat := ""
+
+	for _, elem := range elements {
+		path := elem.Path
+
+		switch {
+		case strings.HasSuffix(path, "/wscn:ScannerDescription/wscn:ScannerName"):
+			if caps.MakeAndModel == "" {
+				caps.MakeAndModel = elem.Text
+			}
+
+		case strings.HasSuffix(path, "/wscn:ScannerConfiguration/wscn:Platen"):
+			caps.addSource(SourcePlaten)
+
+		case strings.HasSuffix(path, "/wscn:ScannerConfiguration/wscn:ADF/wscn:ADFFront"):
+			caps.addSource(SourceADF)
+
+		case strings.HasSuffix(path, "/wscn:ADF/wscn:ADFSupportsDuplex"):
+			if elem.Text == "true" || elem.Text == "1" {
+				caps.addSource(SourceADFDuplex)
+			}
+
+		case strings.HasSuffix(path, "/wscn:FormatsSupported/wscn:FormatValue"):
+			caps.addFormat(wsdFormatMIME(elem.Text))
+
+		case strings.HasSuffix(path, "Color/wscn:ColorEntry"):
+			caps.addColorMode(elem.Text)
+
+		case strings.HasSuffix(path, "Resolutions/wscn:Widths/wscn:Width"):
+			res, _ := strconv.Atoi(elem.Text)
+			caps.addResolution(res)
+
+		case strings.HasSuffix(path, "MaximumSize"):
+			var width, height int
+			for _, child := range elem.Children {
+				switch child.Path {
+				case path + "/wscn:Width":
+					width, _ = strconv.Atoi(child.Text)
+				case path + "/wscn:Height":
+					height, _ = strconv.Atoi(child.Text)
+				}
+			}
+			source := SourcePlaten
+			if strings.Contains(path, "/wscn:ADF/") {
+				source = SourceADF
+			}
+			caps.addMaxSize(source, width*254/10000, height*254/10000)
+
+		case strings.HasSuffix(path, "/wscn:DefaultScanTicket/wscn:DocumentParameters/wscn:Format"):
+			defaultFormat = elem.Text
+		}
+	}
+
+	if len(caps.Formats) == 0 && defaultFormat != "" {
+		caps.addFormat(wsdFormatMIME(defaultFormat))
+	}
+
+	caps.normalize()
+	return caps
+}
+
+// wsdFormatMIME converts WS-Scan document format into MIME type.
+// Unknown formats are returned as is
+func wsdFormatMIME(format string) string {
+	if mime, found := wsdFormats[format]; found {
+		return mime
+	}
+	return format
+}
@@ -0,0 +1,240 @@
+// Discovery tool for sane-airscan compatible devices
+//
+// Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+// See LICENSE for license terms and conditions
+//
+// WS-Scan scan client
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// wsdScanTicketTemplate represents the WS-Scan ScanTicket. Parameters
+// are user name, format, images to transfer, input source, input
+// size (width, height), and media sides
+const wsdScanTicketTemplate = `			<wscn:ScanTicket>
+				<wscn:JobDescription>
+					<wscn:JobName>airscan-discover</wscn:JobName>
+					<wscn:JobOriginatingUserName>%s</wscn:JobOriginatingUserName>
+				</wscn:JobDescription>
+				<wscn:DocumentParameters>
+					<wscn:Format>%s</wscn:Format>
+					<wscn:ImagesToTransfer>%d</wscn:ImagesToTransfer>
+					<wscn:InputSource>%s</wscn:InputSource>
+					<wscn:InputSize>
+						<wscn:InputMediaSize>
+							<wscn:Width>%d</wscn:Width>
+							<wscn:Height>%d</wscn:Height>
+						</wscn:InputMediaSize>
+					</wscn:InputSize>
+					<wscn:MediaSides>
+%s					</wscn:MediaSides>
+				</wscn:DocumentParameters>
+			</wscn:ScanTicket>
+`
+
+// wsdMediaSideTemplate represents the media side of the ScanTicket.
+// Parameters are side (MediaFront or MediaBack), region (x, y,
+// width, height, in 1/1000 of inch), color mode and resolution
+// (twice)
+const wsdMediaSideTemplate = `						<wscn:%[1]s>
+							<wscn:ScanRegion>
+								<wscn:ScanRegionXOffset>%[2]d</wscn:ScanRegionXOffset>
+								<wscn:ScanRegionYOffset>%[3]d</wscn:ScanRegionYOffset>
+								<wscn:ScanRegionWidth>%[4]d</wscn:ScanRegionWidth>
+								<wscn:ScanRegionHeight>%[5]d</wscn:ScanRegionHeight>
+							</wscn:ScanRegion>
+							<wscn:ColorProcessing>%[6]s</wscn:ColorProcessing>
+							<wscn:Resolution>
+								<wscn:Width>%[7]d</wscn:Width>
+								<wscn:Height>%[7]d</wscn:Height>
+							</wscn:Resolution>
+						</wscn:%[1]s>
+`
+
+// wsdColorModes maps color modes into WS-Scan ColorProcessing values
+var wsdColorModes = map[string]string{
+	ScanColor: "RGB24",
+	ScanGray:  "Grayscale8",
+	ScanBW:    "BlackAndWhite1",
+}
+
+// wsdSources maps input sources into WS-Scan InputSource values
+var wsdSources = map[string]string{
+	SourcePlaten:    "Platen",
+	SourceADF:       "ADF",
+	SourceADFDuplex: "ADFDuplex",
+}
+
+// wsdScanFormats maps MIME types into WS-Scan formats
+var wsdScanFormats = map[string]string{
+	"image/jpeg":      "jfif",
+	"image/png":       "png",
+	"application/pdf": "pdf-a",
+}
+
+// WsdScan performs a scan. Each received image (page)
+// is passed to the page callback
+func WsdScan(url string, params ScanParams,
+	page func(data []byte) error) error {
+
+	// Fill missed parameters from capabilities
+	caps, err := WsdCapabilities(url)
+	if err != nil {
+		LogDebug("%s: capabilities: %s", url, err)
+	} else {
+		params.SetDefaults(caps)
+	}
+	params.SetDefaults(nil)
+
+	ticket := wsdScanTicket(params)
+
+	// Validate scan ticket
+	elements, err := wsdRequest(url, "ValidateScanTicket",
+		"\t\t<wscn:ValidateScanTicketRequest>\n"+ticket+
+			"\t\t</wscn:ValidateScanTicketRequest>\n")
+	if err != nil {
+		return fmt.Errorf("ValidateScanTicket: %s", err)
+	}
+
+	for _, elem := range elements {
+		if strings.HasSuffix(elem.Path, "/wscn:ValidationInfo/wscn:ValidTicket") &&
+			elem.Text != "true" && elem.Text != "1" {
+			return errors.New("ValidateScanTicket: scan ticket rejected")
+		}
+	}
+
+	// Create scan job
+	elements, err = wsdRequest(url, "CreateScanJob",
+		"\t\t<wscn:CreateScanJobRequest>\n"+ticket+
+			"\t\t</wscn:CreateScanJobRequest>\n")
+	if err != nil {
+		return fmt.Errorf("CreateScanJob: %s", err)
+	}
+
+	var jobID, jobToken string
+	for _, elem := range elements {
+		switch {
+		case strings.HasSuffix(elem.Path, "/wscn:CreateScanJobResponse/wscn:JobId"):
+			jobID = elem.Text
+		case strings.HasSuffix(elem.Path, "/wscn:CreateScanJobResponse/wscn:JobToken"):
+			jobToken = elem.Text
+		}
+	}
+
+	if jobID == "" {
+		return errors.New("CreateScanJob: missed JobId")
+	}
+
+	LogDebug("%s: job %s created", url, jobID)
+
+	ScanOnInterrupt(func() { wsdCancelJob(url, jobID) })
+	defer ScanOnInterrupt(nil)
+
+	// Retrieve images
+	for pages := 0; ; {
+		body := fmt.Sprintf("\t\t<wscn:RetrieveImageRequest>\n"+
+			"\t\t\t<wscn:JobId>%s</wscn:JobId>\n"+
+			"\t\t\t<wscn:JobToken>%s</wscn:JobToken>\n"+
+			"\t\t\t<wscn:DocumentDescription>\n"+
+			"\t\t\t\t<wscn:DocumentName>IMAGE%06d</wscn:DocumentName>\n"+
+			"\t\t\t</wscn:DocumentDescription>\n"+
+			"\t\t</wscn:RetrieveImageRequest>\n",
+			wsdEscape(jobID), wsdEscape(jobToken), pages+1)
+
+		_, attachments, err := wsdCall(httpScanClient, url,
+			"RetrieveImage", body)
+
+		if fault, ok := err.(*wsdFault); ok &&
+			fault.HasSubcode("ClientErrorNoImagesAvailable") && pages != 0 {
+			return nil
+		}
+
+		if err != nil {
+			wsdCancelJob(url, jobID)
+			return fmt.Errorf("RetrieveImage: %s", err)
+		}
+
+		if len(attachments) == 0 {
+			wsdCancelJob(url, jobID)
+			return errors.New("RetrieveImage: no image in response")
+		}
+
+		LogDebug("%s: page %d: %d bytes", url, pages+1, len(attachments[0]))
+		err = page(attachments[0])
+		if err != nil {
+			wsdCancelJob(url, jobID)
+			return err
+		}
+		pages++
+
+		// Platen scans always produce a single image
+		if params.Source == SourcePlaten {
+			return nil
+		}
+	}
+}
+
+// wsdScanTicket formats the ScanTicket from scan parameters
+func wsdScanTicket(params ScanParams) string {
+	x, y := wsdUnits(params.X), wsdUnits(params.Y)
+	width, height := wsdUnits(params.Width), wsdUnits(params.Height)
+	color := wsdColorModes[params.ColorMode]
+
+	sides := fmt.Sprintf(wsdMediaSideTemplate, "MediaFront",
+		x, y, width, height, color, params.Resolution)
+	if params.Source == SourceADFDuplex {
+		sides += fmt.Sprintf(wsdMediaSideTemplate, "MediaBack",
+			x, y, width, height, color, params.Resolution)
+	}
+
+	images := 0
+	if params.Source == SourcePlaten {
+		images = 1
+	}
+
+	user := wsdEscape(os.Getenv("USER"))
+	if user == "" {
+		user = "nobody"
+	}
+
+	return fmt.Sprintf(wsdScanTicketTemplate, user,
+		wsdScanFormats[params.Format], images,
+		wsdSources[params.Source],
+		wsdUnits(params.X+params.Width), wsdUnits(params.Y+params.Height),
+		sides)
+}
+
+// wsdCancelJob cancels the scan job. Errors are only logged,
+// as there is nothing else to do with them
+func wsdCancelJob(url, jobID string) {
+	_, err := wsdRequest(url, "CancelJob", fmt.Sprintf(
+		"\t\t<wscn:CancelJobRequest>\n"+
+			"\t\t\t<wscn:JobId>%s</wscn:JobId>\n"+
+			"\t\t</wscn:CancelJobRequest>\n", wsdEscape(jobID)))
+
+	if err != nil {
+		LogDebug("%s: cancel job %s: %s", url, jobID, err)
+	} else {
+		LogDebug("%s: job %s cancelled", url, jobID)
+	}
+}
+
+// wsdEscape escapes string for use in XML text
+func wsdEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// wsdUnits converts millimeters into 1/1000 of inch
+func wsdUnits(mm int) int {
+	return mm * 10000 / 254
+}
@@ -84,3 +84,134 @@ func XMLDecode(ns map[string]string, in io.Reader) ([]*XMLElement, error) {
 
 	return elements, nil
 }
+
+// XMLIndent reformats XML document with indentation, one element
+// per line. Elements that contain only text are kept on a single
+// line. Namespace prefixes are preserved as is
+func XMLIndent(in []byte, indent string) ([]byte, error) {
+	var tokens []xml.Token
+
+	decoder := xml.NewDecoder(bytes.NewReader(in))
+	for {
+		token, err := decoder.RawToken()
+		if err != nil {
+			if err != io.EOF {
+				return nil, err
+			}
+			break
+		}
+
+		// Drop whitespace between elements
+		if t, ok := token.(xml.CharData); ok {
+			t = bytes.TrimSpace(t)
+			if len(t) == 0 {
+				continue
+			}
+			token = t
+		}
+
+		tokens = append(tokens, xml.CopyToken(token))
+	}
+
+	var out bytes.Buffer
+	depth := 0
+
+	line := func() {
+		if out.Len() != 0 {
+			out.WriteByte('\n')
+		}
+		for i := 0; i < depth; i++ {
+			out.WriteString(indent)
+		}
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		switch t := tokens[i].(type) {
+		case xml.StartElement:
+			line()
+			xmlWriteStart(&out, t)
+
+			// Collapse <a/> and <a>text</a>
+			next := tokens[i+1:]
+			if len(next) > 0 {
+				if _, ok := next[0].(xml.EndElement); ok {
+					out.Truncate(out.Len() - 1)
+					out.WriteString("/>")
+					i++
+					continue
+				}
+			}
+
+			if len(next) > 1 {
+				text, ok1 := next[0].(xml.CharData)
+				end, ok2 := next[1].(xml.EndElement)
+				if ok1 && ok2 {
+					xml.EscapeText(&out, text)
+					xmlWriteEnd(&out, end)
+					i += 2
+					continue
+				}
+			}
+
+			depth++
+
+		case xml.EndElement:
+			depth--
+			line()
+			xmlWriteEnd(&out, t)
+
+		case xml.CharData:
+			line()
+			xml.EscapeText(&out, t)
+
+		case xml.Comment:
+			line()
+			out.WriteString("<!--")
+			out.Write(t)
+			out.WriteString("-->")
+
+		case xml.ProcInst:
+			line()
+			out.WriteString("<?" + t.Target + " ")
+			out.Write(t.Inst)
+			out.WriteString("?>")
+
+		case xml.Directive:
+			line()
+			out.WriteString("<!")
+			out.Write(t)
+			out.WriteString(">")
+		}
+	}
+
+	if depth != 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	out.WriteByte('\n')
+	return out.Bytes(), nil
+}
+
+// xmlName formats the raw XML name with its prefix
+func xmlName(name xml.Name) string {
+	if name.Space != "" {
+		return name.Space + ":" + name.Local
+	}
+	return name.Local
+}
+
+// xmlWriteStart writes the raw XML start element
+func xmlWriteStart(out *bytes.Buffer, t xml.StartElement) {
+	out.WriteString("<" + xmlName(t.Name))
+	for _, attr := range t.Attr {
+		out.WriteString(" " + xmlName(attr.Name) + `="`)
+		xml.EscapeText(out, []byte(attr.Value))
+		out.WriteString(`"`)
+	}
+	out.WriteString(">")
+}
+
+// xmlWriteEnd writes the raw XML end element
+func xmlWriteEnd(out *bytes.Buffer, t xml.EndElement) {
+	out.WriteString("</" + xmlName(t.Name) + ">")
+}